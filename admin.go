@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+const maxBackupSize = 20 << 20
+
+const adminhelptext = `Admin commands:
+
+/admin feeds ... Lists all feeds with their number of subscribers and recent errors
+/admin feed <id> ... Lists the chats that subscribe to a feed (use the ID from /admin feeds)
+/admin backup ... Sends a backup of all feeds and subscriptions
+/admin restore ... Restores a backup into an empty database (reply to the backup file)
+/admin setquota <user id> <n>|default ... Sets how many feeds a user may add (0 for no limit, default for the limit of the config)
+/admin pause ... Stops fetching feeds and sending items to chats, e.g. during maintenance
+/admin resume ... Continues sending items, including those published during the pause
+`
+
+// admin handles the /admin commands. It returns nil if the user is not an
+// admin, so that the command is treated like an unknown one.
+func admin(ctx context.Context, cfg *Config, db *DB, bot *tgbotapi.BotAPI, msg *tgbotapi.Message, args string) tgbotapi.Chattable {
+	chatID := msg.Chat.ID
+	if !cfg.IsAdmin(int64(msg.From.ID)) {
+		return nil
+	}
+
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return tgbotapi.NewMessage(chatID, adminhelptext)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"User ID": msg.From.ID,
+		"Chat ID": chatID,
+		"Cmd":     fields[0],
+	}).Info("admin command")
+
+	switch fields[0] {
+	case "feeds":
+		return allFeeds(ctx, db, chatID)
+
+	case "feed":
+		if len(fields) != 2 {
+			return tgbotapi.NewMessage(chatID, "Usage: /admin feed <id>")
+		}
+
+		return feedSubscribers(ctx, db, chatID, fields[1])
+
+	case "setquota":
+		return setUserQuota(ctx, db, chatID, fields[1:])
+
+	case "pause", "resume":
+		paused := fields[0] == "pause"
+		if err := setDeliveryPaused(ctx, db, paused); err != nil {
+			logrus.WithError(err).Error("set delivery paused failed")
+			return tgbotapi.NewMessage(chatID, backendError(err))
+		}
+
+		if paused {
+			return tgbotapi.NewMessage(chatID, "Delivery is paused. No feeds are fetched until /admin resume.")
+		}
+
+		return tgbotapi.NewMessage(chatID, "Delivery is resumed.")
+
+	case "backup":
+		b, err := db.Backup(ctx)
+		if err != nil {
+			logrus.WithError(err).Error("backup failed")
+			return tgbotapi.NewMessage(chatID, backendError(err))
+		}
+
+		var buf bytes.Buffer
+		if err := encodeBackup(&buf, b); err != nil {
+			logrus.WithError(err).Error("encoding backup failed")
+			return tgbotapi.NewMessage(chatID, backendError(err))
+		}
+
+		return tgbotapi.NewDocumentUpload(chatID, tgbotapi.FileBytes{
+			Name:  fmt.Sprintf("telegram-rss-bot-backup-%s.json", b.Created.UTC().Format("2006-01-02")),
+			Bytes: buf.Bytes(),
+		})
+
+	case "restore":
+		reply := msg.ReplyToMessage
+		if reply == nil || reply.Document == nil {
+			return tgbotapi.NewMessage(chatID, "Reply to a backup file with this command.")
+		}
+
+		b, err := downloadBackup(bot, reply.Document)
+		if err != nil {
+			logrus.WithError(err).Warn("cannot load backup")
+			return tgbotapi.NewMessage(chatID, "I cannot read this backup: "+err.Error())
+		}
+
+		if len(fields) < 2 || fields[1] != "confirm" {
+			return tgbotapi.NewMessage(chatID, fmt.Sprintf("The backup contains %s. Reply to it with /admin restore confirm to restore it.", b.Summary()))
+		}
+
+		switch err := db.Restore(ctx, b); err {
+		case nil:
+			return tgbotapi.NewMessage(chatID, fmt.Sprintf("Restored %s.", b.Summary()))
+
+		case ErrNotEmpty:
+			return tgbotapi.NewMessage(chatID, "Backups can only be restored into an empty database.")
+
+		default:
+			logrus.WithError(err).Error("restore failed")
+			return tgbotapi.NewMessage(chatID, "Restoring the backup failed.")
+		}
+	}
+
+	return tgbotapi.NewMessage(chatID, adminhelptext)
+}
+
+// allFeeds lists every feed the bot serves.
+func allFeeds(ctx context.Context, db *DB, chatID int64) tgbotapi.Chattable {
+	list, err := db.AllFeedStats(ctx, time.Now().Add(-feedErrorWindow))
+	if err != nil {
+		logrus.WithError(err).Error("get feed stats failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if len(list) == 0 {
+		return tgbotapi.NewMessage(chatID, "There are no feeds.")
+	}
+
+	text := fmt.Sprintf("%d feeds (ID, title, subscribers, errors in the last %d hours):\n", len(list), feedErrorWindow/time.Hour)
+	for _, stats := range list {
+		text += fmt.Sprintf("%d. %s (url %s): %d subscribers, %d errors\n", stats.ID, stats.Title, stats.FullURL(), stats.Subscribers, stats.RecentErrors)
+	}
+
+	return tgbotapi.NewMessage(chatID, text)
+}
+
+// feedSubscribers lists the chats that subscribe to the feed with the given ID.
+func feedSubscribers(ctx context.Context, db *DB, chatID int64, arg string) tgbotapi.Chattable {
+	feedID, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Please provide the ID of the feed")
+	}
+
+	feed, err := db.FeedByID(ctx, feedID)
+	if err == sql.ErrNoRows {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("There is no feed with ID %d.", feedID))
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("Feed ID", feedID).Error("get feed failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	subscribers, err := db.SubscribersOfFeed(ctx, feedID)
+	if err != nil {
+		logrus.WithError(err).WithField("Feed ID", feedID).Error("get subscribers of feed failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	recentErrors, err := db.RecentFeedErrors(ctx, time.Now().Add(-feedErrorWindow), feedID)
+	if err != nil {
+		logrus.WithError(err).WithField("Feed ID", feedID).Error("get feed errors failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	text := fmt.Sprintf("%d. %s (url %s): %d errors in the last %d hours\n", feed.ID, feed.Title, feed.FullURL(), recentErrors, feedErrorWindow/time.Hour)
+	if len(subscribers) == 0 {
+		return tgbotapi.NewMessage(chatID, text+"No chat subscribes to this feed.")
+	}
+
+	text += fmt.Sprintf("%d subscribers (chat ID, items received up to):\n", len(subscribers))
+	for _, s := range subscribers {
+		received := "nothing yet"
+		if s.LastUpdate.Unix() > 0 {
+			received = chatTime(s.LastUpdate, time.UTC)
+		}
+		text += fmt.Sprintf("%d: %s\n", s.ChatID, received)
+	}
+
+	return tgbotapi.NewMessage(chatID, text)
+}
+
+// setUserQuota handles /admin setquota, which overrides the limit of feeds
+// that a user may add in total.
+func setUserQuota(ctx context.Context, db *DB, chatID int64, args []string) tgbotapi.Chattable {
+	const usage = "Usage: /admin setquota <user id> <n>|default"
+	if len(args) != 2 {
+		return tgbotapi.NewMessage(chatID, usage)
+	}
+
+	userID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, usage)
+	}
+
+	if args[1] == "default" {
+		if err := db.ResetUserQuota(ctx, userID); err != nil {
+			logrus.WithError(err).WithField("User ID", userID).Error("reset user quota failed")
+			return tgbotapi.NewMessage(chatID, backendError(err))
+		}
+
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("User %d may add as many feeds as the config allows.", userID))
+	}
+
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 {
+		return tgbotapi.NewMessage(chatID, usage)
+	}
+
+	if err := db.SetUserQuota(ctx, userID, n); err != nil {
+		logrus.WithError(err).WithField("User ID", userID).Error("set user quota failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if n == 0 {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("User %d may add any number of feeds.", userID))
+	}
+
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("User %d may add %d feeds.", userID, n))
+}
+
+func downloadBackup(bot *tgbotapi.BotAPI, doc *tgbotapi.Document) (*Backup, error) {
+	data, err := downloadDocument(bot, doc, maxBackupSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeBackup(bytes.NewReader(data))
+}
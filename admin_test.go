@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+func TestAdminFeeds(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{Admins: []int64{1}}}
+
+	command := func(userID int) tgbotapi.Chattable {
+		msg := &tgbotapi.Message{From: &tgbotapi.User{ID: userID}, Chat: &tgbotapi.Chat{ID: 10}}
+		return admin(ctx, cfg, db, nil, msg, "feeds")
+	}
+
+	if res := command(2); res != nil {
+		t.Fatalf("answered a user who is not an admin: %v", res)
+	}
+
+	if text := command(1).(tgbotapi.MessageConfig).Text; text != "There are no feeds." {
+		t.Fatalf("listing without feeds = %q", text)
+	}
+
+	for _, chatID := range []int64{10, 20, 30} {
+		if err := db.AddFeedToChat(ctx, 1, chatID, Feed{Title: "Popular", URL: "//example.com/popular", Scheme: "https"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: "Broken", URL: "//example.com/broken", Scheme: "http"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddFeedError(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	// Feeds without subscribers are listed as well.
+	if err := db.RemoveFeedFromChat(ctx, 20, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddFeedToChat(ctx, 1, 40, Feed{Title: "Orphan", URL: "//example.com/orphan", Scheme: "https"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RemoveFeedFromChat(ctx, 40, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := db.AllFeedStats(ctx, time.Now().Add(-feedErrorWindow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 3 {
+		t.Fatalf("got stats of %d feeds, want 3", len(stats))
+	}
+
+	want := "3 feeds (ID, title, subscribers, errors in the last 12 hours):\n" +
+		"1. Popular (url https://example.com/popular): 2 subscribers, 0 errors\n" +
+		"2. Broken (url http://example.com/broken): 1 subscribers, 1 errors\n" +
+		"3. Orphan (url https://example.com/orphan): 0 subscribers, 0 errors\n"
+	if text := command(1).(tgbotapi.MessageConfig).Text; text != want {
+		t.Fatalf("listing = %q, want %q", text, want)
+	}
+}
+
+func TestAdminFeed(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{Admins: []int64{1}}}
+
+	command := func(userID int, args string) tgbotapi.Chattable {
+		msg := &tgbotapi.Message{From: &tgbotapi.User{ID: userID}, Chat: &tgbotapi.Chat{ID: 10}}
+		return admin(ctx, cfg, db, nil, msg, args)
+	}
+
+	for _, chatID := range []int64{20, 10} {
+		if err := db.AddFeedToChat(ctx, 2, chatID, Feed{Title: "Blog", URL: "//example.com/blog", Scheme: "https"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.UpdateSub(ctx, 20, 1, time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateSub(ctx, 10, 1, firstSecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddFeedError(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	subscribers, err := db.SubscribersOfFeed(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscribers) != 2 || subscribers[0].ChatID != 20 || subscribers[1].ChatID != 10 {
+		t.Fatalf("subscribers = %+v, want chats 20 and 10", subscribers)
+	}
+
+	if res := command(2, "feed 1"); res != nil {
+		t.Fatalf("answered a user who is not an admin: %v", res)
+	}
+
+	want := "1. Blog (url https://example.com/blog): 1 errors in the last 12 hours\n" +
+		"2 subscribers (chat ID, items received up to):\n" +
+		"20: 2024-01-02 10:00 UTC\n" +
+		"10: nothing yet\n"
+	if text := command(1, "feed 1").(tgbotapi.MessageConfig).Text; text != want {
+		t.Fatalf("feed 1 = %q, want %q", text, want)
+	}
+
+	if text := command(1, "feed 2").(tgbotapi.MessageConfig).Text; text != "There is no feed with ID 2." {
+		t.Fatalf("unknown feed = %q", text)
+	}
+	if text := command(1, "feed x").(tgbotapi.MessageConfig).Text; text != "Please provide the ID of the feed" {
+		t.Fatalf("invalid ID = %q", text)
+	}
+}
+
+func TestAdminSetQuota(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	db.MaxTotalFeedsByUser = 1
+	db.Prepare()
+	cfg := &Config{Bot: BotConfig{Admins: []int64{1}}}
+
+	command := func(args string) string {
+		msg := &tgbotapi.Message{From: &tgbotapi.User{ID: 1}, Chat: &tgbotapi.Chat{ID: 10}}
+		return admin(ctx, cfg, db, nil, msg, args).(tgbotapi.MessageConfig).Text
+	}
+
+	for _, args := range []string{"setquota", "setquota 2", "setquota x 3", "setquota 2 -1", "setquota 2 many"} {
+		if text := command(args); text != "Usage: /admin setquota <user id> <n>|default" {
+			t.Errorf("/admin %s = %q", args, text)
+		}
+	}
+
+	if text := command("setquota 2 3"); text != "User 2 may add 3 feeds." {
+		t.Fatalf("reply = %q", text)
+	}
+	if limit, err := userFeedLimit(ctx, db.q, 2, db.MaxTotalFeedsByUser); err != nil || limit != 3 {
+		t.Fatalf("limit of user 2 = %d, %v, want 3", limit, err)
+	}
+
+	if text := command("setquota 2 default"); text != "User 2 may add as many feeds as the config allows." {
+		t.Fatalf("reply = %q", text)
+	}
+	if limit, err := userFeedLimit(ctx, db.q, 2, db.MaxTotalFeedsByUser); err != nil || limit != 1 {
+		t.Fatalf("limit of user 2 after reset = %d, %v, want 1", limit, err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEvent is a request of a user: a command, or the data of a button
+// that was pressed, in which case Command is empty. URLs in Args are
+// redacted as configured.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	UserID  int64     `json:"userID"`
+	Name    string    `json:"name"`
+	ChatID  int64     `json:"chatID"`
+	Command string    `json:"command,omitempty"`
+	Args    string    `json:"args"`
+}
+
+// text returns the request as the user sent it.
+func (e *AuditEvent) text() string {
+	if e.Command == "" {
+		return e.Args
+	}
+
+	if e.Args == "" {
+		return "/" + e.Command
+	}
+
+	return "/" + e.Command + " " + e.Args
+}
+
+// AuditSink records requests, see AuditConfig.
+type AuditSink interface {
+	Audit(ctx context.Context, e AuditEvent) error
+	Close() error
+}
+
+// dbAuditSink records requests in the requests table, which the request
+// limit counts.
+type dbAuditSink struct {
+	db *DB
+}
+
+func (s dbAuditSink) Audit(ctx context.Context, e AuditEvent) error {
+	return s.db.logRequest(ctx, e.Time, e.Name, e.text(), e.UserID)
+}
+
+func (s dbAuditSink) Close() error {
+	return nil
+}
+
+// fileAuditSink appends requests to a file, one JSON object per line.
+type fileAuditSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openFileAuditSink(path string) (*fileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileAuditSink{f: f}, nil
+}
+
+func (s *fileAuditSink) Audit(ctx context.Context, e AuditEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Each line is written at once, so that it is not interleaved with
+	// others even if another process appends to the file, too.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.f.Write(append(line, '\n'))
+	return err
+}
+
+func (s *fileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Close()
+}
+
+// newAuditSink returns the sink that cfg selects.
+func newAuditSink(cfg *AuditConfig, db *DB) (AuditSink, error) {
+	switch cfg.Sink {
+	case "", auditSinkDB:
+		return dbAuditSink{db}, nil
+
+	case auditSinkFile:
+		return openFileAuditSink(cfg.File)
+	}
+
+	return nil, fmt.Errorf("unknown audit sink %q", cfg.Sink)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+func readAuditFile(t *testing.T, path string) []AuditEvent {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return events
+}
+
+func TestFileAuditSink(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	cfg := &Config{Audit: AuditConfig{Sink: auditSinkFile, File: path, Always: true}}
+	user := &tgbotapi.User{ID: 1, FirstName: "Alice", LastName: "Smith"}
+
+	sink, err := newAuditSink(&cfg.Audit, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowRequest(ctx, cfg, db, sink, nil, user, 10, "addfeed", "https://example.com/private.xml") {
+		t.Fatal("audited request was not allowed")
+	}
+	if !allowRequest(ctx, cfg, db, sink, nil, user, 10, "", "feeds:2") {
+		t.Fatal("audited button was not allowed")
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is appended to when the bot starts again.
+	if sink, err = newAuditSink(&cfg.Audit, db); err != nil {
+		t.Fatal(err)
+	}
+	allowRequest(ctx, cfg, db, sink, nil, user, 20, "help", "")
+	sink.Close()
+
+	events := readAuditFile(t, path)
+	if len(events) != 3 {
+		t.Fatalf("%d events in the file, want 3", len(events))
+	}
+	for i := range events {
+		if events[i].Time.IsZero() {
+			t.Errorf("event %d has no time", i)
+		}
+		events[i].Time = events[0].Time
+	}
+	want := []AuditEvent{
+		{Time: events[0].Time, UserID: 1, Name: "Alice Smith", ChatID: 10, Command: "addfeed", Args: "[redacted]"},
+		{Time: events[0].Time, UserID: 1, Name: "Alice Smith", ChatID: 10, Args: "feeds:2"},
+		{Time: events[0].Time, UserID: 1, Name: "Alice Smith", ChatID: 20, Command: "help"},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events %+v, want %+v", events, want)
+	}
+
+	// The file sink leaves the requests table alone.
+	var n int
+	if err := db.q.QueryRowContext(ctx, "SELECT COUNT(*) FROM requests").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d requests were stored in the database", n)
+	}
+
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("audit file has permissions %v", perm)
+	}
+}
+
+func TestAuditOnlyWhenEnabled(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	cfg := &Config{Audit: AuditConfig{Sink: auditSinkFile, File: path}}
+
+	sink, err := newAuditSink(&cfg.Audit, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	allowRequest(ctx, cfg, db, sink, nil, &tgbotapi.User{ID: 1}, 10, "help", "")
+	if events := readAuditFile(t, path); len(events) != 0 {
+		t.Fatalf("request was audited although neither logging nor auditing is on: %+v", events)
+	}
+
+	cfg.Bot.LogRequests = true
+	allowRequest(ctx, cfg, db, sink, nil, &tgbotapi.User{ID: 1}, 10, "help", "")
+	if events := readAuditFile(t, path); len(events) != 1 {
+		t.Fatalf("%d events with logged requests, want 1", len(events))
+	}
+}
+
+func TestDBAuditSinkStoresText(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Audit: AuditConfig{Always: true}}
+	user := &tgbotapi.User{ID: 1}
+
+	sink, err := newAuditSink(&cfg.Audit, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowRequest(ctx, cfg, db, sink, nil, user, 10, "feeds", "")
+	allowRequest(ctx, cfg, db, sink, nil, user, 10, "", "feeds:2")
+
+	rows, err := db.q.QueryContext(ctx, "SELECT text FROM requests ORDER BY nr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var texts []string
+	for rows.Next() {
+		var text string
+		if err := rows.Scan(&text); err != nil {
+			t.Fatal(err)
+		}
+		texts = append(texts, text)
+	}
+	if !reflect.DeepEqual(texts, []string{"/feeds", "feeds:2"}) {
+		t.Errorf("stored requests %q", texts)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxBackfillItems limits how many old items are sent when a feed is added,
+// so that adding a feed cannot flood the chat.
+const maxBackfillItems = 10
+
+// parseAddFeedArgs splits the arguments of /addfeed into the URL and the
+// number of items to backfill, which is backfill unless given. It reports
+// whether the arguments have the right form.
+func parseAddFeedArgs(args string, backfill int) (feedURL string, n int, ok bool) {
+	fields := strings.Fields(args)
+	switch {
+	case len(fields) == 1:
+		return fields[0], backfill, true
+
+	case len(fields) == 3 && fields[1] == "--backfill":
+		n, err := strconv.Atoi(fields[2])
+		return fields[0], n, err == nil && n >= 0
+	}
+
+	return "", 0, false
+}
+
+// backfillSub arranges for the latest n items of the feed that the chat
+// just subscribed to to be sent with the next update, which applies the
+// settings of the chat and the limits of the sender to them as to any new
+// item. It returns the number of items that will be sent.
+func backfillSub(ctx context.Context, cfg *Config, db *DB, chatID int64, feed Feed, n int) int {
+	parsed, ok := parsedFeeds.Get(feed.URL, time.Now())
+	if !ok {
+		var err error
+		if parsed, _, err = fetchFeed(ctx, newFeedClient(cfg), feed.fetchURL(), HTTPCache{}); err != nil {
+			logrus.WithError(err).WithField("Feed", feed.FullURL()).Warn("backfill: cannot fetch feed")
+			return 0
+		}
+		parsedFeeds.Put(feed.URL, parsed, time.Now())
+	}
+
+	var published []time.Time
+	for _, item := range parsed.Items {
+		if item.PublishedParsed != nil {
+			published = append(published, *item.PublishedParsed)
+		}
+	}
+
+	if len(published) == 0 {
+		return 0
+	}
+
+	sort.Slice(published, func(i, j int) bool {
+		return published[i].After(published[j])
+	})
+	if len(published) > n {
+		published = published[:n]
+	}
+
+	info, err := db.FeedByURL(ctx, feed.URL)
+	if err != nil {
+		logrus.WithError(err).WithField("Feed", feed.FullURL()).Error("backfill: FeedByURL")
+		return 0
+	}
+
+	// Read positions are stored in seconds.
+	since := published[len(published)-1].Add(-time.Second)
+	if err := db.BackfillSub(ctx, chatID, info.ID, since); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"Feed":    feed.FullURL(),
+		}).Error("backfill: BackfillSub")
+
+		return 0
+	}
+
+	return len(published)
+}
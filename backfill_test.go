@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+func TestParseAddFeedArgs(t *testing.T) {
+	tests := []struct {
+		args string
+		url  string
+		n    int
+		ok   bool
+	}{
+		{"https://example.com/feed", "https://example.com/feed", 1, true},
+		{" https://example.com/feed --backfill 3 ", "https://example.com/feed", 3, true},
+		{"https://example.com/feed --backfill 0", "https://example.com/feed", 0, true},
+		{"https://example.com/feed --backfill -1", "", 0, false},
+		{"https://example.com/feed --backfill", "", 0, false},
+		{"https://example.com/feed 3", "", 0, false},
+		{"", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		url, n, ok := parseAddFeedArgs(tt.args, 1)
+		if ok != tt.ok || (ok && (url != tt.url || n != tt.n)) {
+			t.Errorf("parseAddFeedArgs(%q) = %q, %d, %v; want %q, %d, %v", tt.args, url, n, ok, tt.url, tt.n, tt.ok)
+		}
+	}
+}
+
+func TestAddFeedBackfill(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{MaxDescriptionLength: defaultMaxDescriptionLength}}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, simulateFeed)
+	}))
+	defer srv.Close()
+
+	sent := make(map[int64]int)
+	send := func(msg tgbotapi.Chattable) { sent[msg.(tgbotapi.MessageConfig).ChatID]++ }
+
+	// Chat 20 is up to date with the feed, whose validators are stored.
+	user := tgbotapi.User{ID: 1}
+	addFeed(ctx, cfg, db, user, 20, 0, srv.URL)
+	var count int64
+	if err := updateFeed(ctx, cfg, db, srv.Client(), send, dueFeed(t, db), &count); err != nil {
+		t.Fatal(err)
+	}
+	sent = make(map[int64]int)
+
+	if text := addFeed(ctx, cfg, db, user, 10, 0, srv.URL+" --backfill 11").(tgbotapi.MessageConfig).Text; text != "At most 10 items can be backfilled." {
+		t.Fatalf("too large backfill: %q", text)
+	}
+
+	text := addFeed(ctx, cfg, db, user, 10, 0, srv.URL+" --backfill 2").(tgbotapi.MessageConfig).Text
+	if !strings.HasSuffix(text, "Its latest 2 items will arrive shortly.") {
+		t.Fatalf("reply to backfill: %q", text)
+	}
+
+	feeds, err := db.ActiveFeeds(ctx)
+	if err != nil || len(feeds) != 1 {
+		t.Fatalf("feed is not due after backfill: %v, %v", feeds, err)
+	}
+	if err := updateFeed(ctx, cfg, db, srv.Client(), send, feeds[0], &count); err != nil {
+		t.Fatal(err)
+	}
+
+	if sent[10] != 2 || sent[20] != 0 {
+		t.Fatalf("sent %v after backfill, want 2 items to chat 10 only", sent)
+	}
+}
+
+func TestBackfillItemsConfig(t *testing.T) {
+	cfg := &Config{Bot: BotConfig{BackfillItems: maxBackfillItems + 1}}
+	if err := cfg.applyDefaults(); err != errBackfillItems {
+		t.Fatalf("applyDefaults with too many backfill items: %v", err)
+	}
+}
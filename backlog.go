@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// A backlogSelector picks at most n of the new items of a feed that are
+// delivered to a chat. The items are sorted by their publication date, oldest
+// first, and the selection must keep that order and include the newest item.
+type backlogSelector func(items []*gofeed.Item, n int) []*gofeed.Item
+
+var backlogSelectors = map[string]backlogSelector{
+	"newest": selectNewest,
+	"spread": selectSpread,
+}
+
+// selectNewest keeps the n most recent items.
+func selectNewest(items []*gofeed.Item, n int) []*gofeed.Item {
+	if len(items) <= n {
+		return items
+	}
+
+	return items[len(items)-n:]
+}
+
+// selectSpread keeps n items spread over the whole time range of the backlog.
+// Recent items are sampled more densely: the k-th kept item is the one closest
+// to an age that grows exponentially with k, up to the age of the oldest item.
+func selectSpread(items []*gofeed.Item, n int) []*gofeed.Item {
+	if len(items) <= n {
+		return items
+	}
+
+	if n <= 1 {
+		return selectNewest(items, n)
+	}
+
+	newest := *items[len(items)-1].PublishedParsed
+	span := newest.Sub(*items[0].PublishedParsed)
+
+	picked := make([]bool, len(items))
+	for k := 0; k < n; k++ {
+		frac := (math.Exp2(float64(k)) - 1) / (math.Exp2(float64(n-1)) - 1)
+		target := newest.Add(-time.Duration(frac * float64(span)))
+
+		picked[closestUnpicked(items, picked, target)] = true
+	}
+
+	selected := make([]*gofeed.Item, 0, n)
+	for i, item := range items {
+		if picked[i] {
+			selected = append(selected, item)
+		}
+	}
+
+	return selected
+}
+
+// closestUnpicked returns the index of the item published closest to target
+// that was not picked yet. There has to be at least one unpicked item.
+func closestUnpicked(items []*gofeed.Item, picked []bool, target time.Time) int {
+	i := sort.Search(len(items), func(i int) bool {
+		return !items[i].PublishedParsed.Before(target)
+	})
+
+	lo := i - 1
+	for lo >= 0 && picked[lo] {
+		lo--
+	}
+
+	hi := i
+	for hi < len(items) && picked[hi] {
+		hi++
+	}
+
+	if lo < 0 {
+		return hi
+	} else if hi >= len(items) {
+		return lo
+	}
+
+	if target.Sub(*items[lo].PublishedParsed) <= items[hi].PublishedParsed.Sub(target) {
+		return lo
+	}
+
+	return hi
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// hourlyItems returns n items published an hour apart, oldest first. Their
+// titles are their indexes.
+func hourlyItems(n int) []*gofeed.Item {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	items := make([]*gofeed.Item, n)
+	for i := range items {
+		published := start.Add(time.Duration(i) * time.Hour)
+		items[i] = &gofeed.Item{Title: string(rune('a' + i)), PublishedParsed: &published}
+	}
+
+	return items
+}
+
+func titles(items []*gofeed.Item) string {
+	s := ""
+	for _, item := range items {
+		s += item.Title
+	}
+
+	return s
+}
+
+func TestBacklogSelectors(t *testing.T) {
+	items := hourlyItems(16)
+
+	if got := titles(selectNewest(items, 4)); got != "mnop" {
+		t.Errorf("selectNewest kept %q, want the last four", got)
+	}
+
+	// The newest, the oldest and two in between, denser towards the newest.
+	if got := titles(selectSpread(items, 4)); got != "ajnp" {
+		t.Errorf("selectSpread kept %q, want %q", got, "ajnp")
+	}
+
+	for name, sel := range backlogSelectors {
+		for _, n := range []int{1, 2, 5, 15} {
+			kept := sel(items, n)
+			if len(kept) != n {
+				t.Errorf("%s kept %d of %d items", name, len(kept), n)
+				continue
+			}
+
+			if kept[len(kept)-1] != items[len(items)-1] {
+				t.Errorf("%s did not keep the newest item", name)
+			}
+
+			for i := 1; i < len(kept); i++ {
+				if !kept[i-1].PublishedParsed.Before(*kept[i].PublishedParsed) {
+					t.Errorf("%s changed the order of the items: %q", name, titles(kept))
+					break
+				}
+			}
+		}
+
+		if kept := sel(items[:3], 5); !reflect.DeepEqual(kept, items[:3]) {
+			t.Errorf("%s dropped items of a small backlog", name)
+		}
+	}
+}
+
+func TestNewItemsForSubUsesBacklogStrategy(t *testing.T) {
+	items := hourlyItems(16)
+	sub := Sub{LastUpdate: *items[0].PublishedParsed}
+
+	cfg := &Config{Bot: BotConfig{MaxBacklog: 4, BacklogStrategy: "spread"}}
+	if got := titles(newItemsForSub(cfg, items, sub)); len(got) != 4 || got[0] != 'b' {
+		t.Errorf("spread backlog of items after the first = %q", got)
+	}
+
+	cfg.Bot.BacklogStrategy = ""
+	if got := titles(newItemsForSub(cfg, items, sub)); got != "mnop" {
+		t.Errorf("default backlog = %q, want the newest", got)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const backupVersion = 1
+
+// backupTable is a table that is backed up together with the columns that are
+// exported from it.
+type backupTable struct {
+	name    string
+	columns []string
+}
+
+// backupTables are the tables that make up the state of the bot, in the order
+// in which they have to be restored. Logs like feedErrors are not included,
+// and neither are the credentials of feeds with HTTP Basic authentication, so
+// they do not end up in a file that is sent through Telegram. New columns have
+// to be added here to be backed up.
+var backupTables = []backupTable{
+	{"feeds", []string{"id", "url", "title", "userID", "scheme", "publishInterval", "nextFetch", "feedType", "hasDescriptions", "etag", "lastModified", "advertisedInterval"}},
+	{"updates", []string{"nr", "chatID", "feedID", "channel", "lastUpdate", "userID", "lastSent", "ignoreTitleChanges", "note", "format", "displayTitle", "digestAt", "digestSent", "snoozeUntil", "snoozeQueue", "threadID"}},
+	{"chats", []string{"chatID", "dedupLinks", "redirectChatID", "redirectUntil", "redirectOnly", "updateInterval", "digestDescriptionLength", "timezone", "skipRepublished"}},
+	{"filters", []string{"nr", "updateNr", "keyword"}},
+	{"mutes", []string{"nr", "updateNr", "keyword"}},
+	{"digestItems", []string{"nr", "updateNr", "title", "link", "description", "published"}},
+	{"userQuotas", []string{"userID", "maxTotalFeeds"}},
+}
+
+var ErrNotEmpty = errors.New("database is not empty")
+
+type backupRow map[string]interface{}
+
+type Backup struct {
+	Version int                    `json:"version"`
+	Created time.Time              `json:"created"`
+	Tables  map[string][]backupRow `json:"tables"`
+}
+
+func encodeBackup(w io.Writer, b *Backup) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(b)
+}
+
+func decodeBackup(r io.Reader) (*Backup, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	b := new(Backup)
+	if err := dec.Decode(b); err != nil {
+		return nil, err
+	}
+
+	if b.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", b.Version)
+	}
+
+	for table, rows := range b.Tables {
+		t, ok := findBackupTable(table)
+		if !ok {
+			return nil, fmt.Errorf("unexpected table %q in backup", table)
+		}
+
+		for _, row := range rows {
+			for col := range row {
+				if !t.hasColumn(col) {
+					return nil, fmt.Errorf("unexpected column %q in table %s", col, table)
+				}
+			}
+		}
+	}
+
+	return b, nil
+}
+
+func findBackupTable(name string) (backupTable, bool) {
+	for _, t := range backupTables {
+		if t.name == name {
+			return t, true
+		}
+	}
+
+	return backupTable{}, false
+}
+
+func (t backupTable) hasColumn(col string) bool {
+	for _, c := range t.columns {
+		if c == col {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Summary describes the contents of the backup in a few words.
+func (b *Backup) Summary() string {
+	return fmt.Sprintf("%d feeds, %d subscriptions and %d chat settings (created %s)",
+		len(b.Tables["feeds"]), len(b.Tables["updates"]), len(b.Tables["chats"]), b.Created.UTC().Format("2006-01-02 15:04 MST"))
+}
+
+// Backup exports the columns of all rows of the backupTables.
+func (db *DB) Backup(ctx context.Context) (*Backup, error) {
+	b := &Backup{
+		Version: backupVersion,
+		Created: time.Now(),
+		Tables:  make(map[string][]backupRow),
+	}
+
+	for _, table := range backupTables {
+		cols := table.columns
+		rows, err := db.q.QueryContext(ctx, "SELECT "+strings.Join(cols, ",")+" FROM "+table.name)
+		if err != nil {
+			return nil, err
+		}
+
+		b.Tables[table.name] = []backupRow{}
+		for rows.Next() {
+			values := make([]interface{}, len(cols))
+			ptrs := make([]interface{}, len(cols))
+			for i := range values {
+				ptrs[i] = &values[i]
+			}
+
+			if err := rows.Scan(ptrs...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			row := make(backupRow, len(cols))
+			for i, col := range cols {
+				if raw, ok := values[i].([]byte); ok {
+					row[col] = string(raw)
+				} else {
+					row[col] = values[i]
+				}
+			}
+
+			b.Tables[table.name] = append(b.Tables[table.name], row)
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// Restore imports a backup into an empty database. It returns ErrNotEmpty if
+// any of the backupTables has rows already.
+func (db *DB) Restore(ctx context.Context, b *Backup) error {
+	tx, err := db.q.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range backupTables {
+		var n int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table.name).Scan(&n); err != nil {
+			tx.Rollback()
+			return err
+		} else if n != 0 {
+			tx.Rollback()
+			return ErrNotEmpty
+		}
+	}
+
+	for _, table := range backupTables {
+		for _, row := range b.Tables[table.name] {
+			cols := make([]string, 0, len(row))
+			for _, col := range table.columns {
+				if _, ok := row[col]; ok {
+					cols = append(cols, col)
+				}
+			}
+
+			args := make([]interface{}, len(cols))
+			for i, col := range cols {
+				args[i] = row[col]
+				if num, ok := args[i].(json.Number); ok {
+					args[i] = num.String()
+				}
+			}
+
+			placeholders := strings.Repeat(",?", len(cols))[1:]
+			query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table.name, strings.Join(cols, ","), placeholders)
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
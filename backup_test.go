@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backupJSON returns the backup of db as it is written to a file, without the
+// time it was created.
+func backupJSON(t *testing.T, db *DB) string {
+	t.Helper()
+
+	b, err := db.Backup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Created = time.Time{}
+
+	var buf bytes.Buffer
+	if err := encodeBackup(&buf, b); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := openTestDB(t)
+
+	for _, name := range []string{"a", "b"} {
+		if err := src.AddFeedToChat(ctx, 1, 10, Feed{Title: name, URL: "//example.com/" + name, Scheme: "https"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.AddFeedToChat(ctx, 2, 20, Feed{URL: "//example.com/a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(src.UpdateSub(ctx, 10, 1, time.Unix(1600000000, 0)))
+	must(src.SetNote(ctx, 10, 2, "read later"))
+	must(src.SetFormat(ctx, 20, 1, formatPoll))
+	must(src.SetIgnoreTitleChanges(ctx, 10, 1, true))
+	must(src.SetDedupLinks(ctx, 10, true))
+	must(src.SetChatInterval(ctx, 20, 2*time.Hour))
+	must(src.SetRedirect(ctx, 10, Redirect{ChatID: 30, Until: time.Unix(1700000000, 0), Only: true}))
+	must(src.AddFilter(ctx, 10, 1, "golang"))
+	must(src.AddMute(ctx, 10, 2, "sponsored"))
+	must(src.SetDigest(ctx, 10, 1, 8*time.Hour, time.Unix(1600000000, 0)))
+	must(src.AddDigestItem(ctx, 10, 1, DigestItem{Title: "Go 2", Link: "https://example.com/go2", Published: time.Unix(1600000100, 0)}))
+	must(src.SetUserQuota(ctx, 2, 50))
+
+	want := backupJSON(t, src)
+
+	b, err := decodeBackup(bytes.NewBufferString(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := openTestDB(t)
+	if err := dst.Restore(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := backupJSON(t, dst); got != want {
+		t.Fatalf("restored database differs.\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The restored subscriptions work as before.
+	_, sub, err := dst.FeedOfChat(ctx, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sub.IgnoreTitleChanges || !sub.DedupLinks || sub.Redirect.ChatID != 30 || !sub.LastUpdate.Equal(time.Unix(1600000000, 0)) {
+		t.Fatalf("restored subscription %+v", sub)
+	}
+}
+
+func TestRestoreNeedsEmptyDatabase(t *testing.T) {
+	ctx := context.Background()
+
+	src := openTestDB(t)
+	if err := src.AddFeedToChat(ctx, 1, 10, Feed{Title: "a", URL: "//example.com/a", Scheme: "https"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := src.Backup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only chat settings, but no feeds.
+	dst := openTestDB(t)
+	if err := dst.SetDedupLinks(ctx, 10, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dst.Restore(ctx, b); err != ErrNotEmpty {
+		t.Fatalf("restore into database with chat settings: err = %v, want ErrNotEmpty", err)
+	}
+}
+
+func TestBackupWithoutCredentials(t *testing.T) {
+	ctx := context.Background()
+	src := openTestDB(t)
+
+	feed := Feed{URL: "//example.com/private", Scheme: "https", BasicAuth: url.UserPassword("alice", "s3cret")}
+	if err := src.AddFeedToChat(ctx, 1, 10, feed); err != nil {
+		t.Fatal(err)
+	}
+
+	data := backupJSON(t, src)
+	for _, secret := range []string{"authUser", "authPassword", "alice", "s3cret"} {
+		if strings.Contains(data, secret) {
+			t.Fatalf("backup contains %q:\n%s", secret, data)
+		}
+	}
+
+	b, err := decodeBackup(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := openTestDB(t)
+	if err := dst.Restore(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// The feed is restored, but has to be given its credentials again.
+	f, _, err := dst.FeedOfChat(ctx, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.URL != feed.URL || f.BasicAuth != nil {
+		t.Fatalf("restored feed %+v", f)
+	}
+}
+
+// notBackedUp are the tables and columns that are left out of backups on
+// purpose. A nil list stands for the whole table.
+var notBackedUp = map[string][]string{
+	"feeds":           {"authUser", "authPassword"}, // credentials
+	"feedErrors":      nil,                          // logs
+	"requests":        nil,
+	"requestCounts":   nil,
+	"deliveredItems":  nil,
+	"deliveryCounts":  nil,
+	"botState":        nil, // a pause is for the database it was set on
+	"schema_version":  nil,
+	"sqlite_sequence": nil,
+}
+
+// TestBackupCoversSchema fails when a table or column is added to the schema
+// without deciding whether it is part of backups.
+func TestBackupCoversSchema(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	tables, err := db.q.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type='table'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for tables.Next() {
+		var name string
+		if err := tables.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	tables.Close()
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		seen[name] = true
+		excluded, skip := notBackedUp[name]
+		table, ok := findBackupTable(name)
+		if skip && excluded == nil {
+			if ok {
+				t.Errorf("table %s is both backed up and left out", name)
+			}
+			continue
+		} else if !ok {
+			t.Errorf("table %s is not accounted for in backups", name)
+			continue
+		}
+
+		rows, err := db.q.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cols []string
+		for rows.Next() {
+			var col string
+			if err := rows.Scan(&col); err != nil {
+				t.Fatal(err)
+			}
+			cols = append(cols, col)
+		}
+		rows.Close()
+
+		for _, col := range cols {
+			if !table.hasColumn(col) && !containsString(excluded, col) {
+				t.Errorf("column %s.%s is not accounted for in backups", name, col)
+			}
+		}
+		for _, col := range table.columns {
+			if !containsString(cols, col) {
+				t.Errorf("backed up column %s.%s does not exist", name, col)
+			}
+		}
+	}
+
+	for _, table := range backupTables {
+		if !seen[table.name] {
+			t.Errorf("backed up table %s does not exist", table.name)
+		}
+	}
+}
+
+func TestDecodeBackupRejectsUnknownColumns(t *testing.T) {
+	data := `{"version":1,"tables":{"feeds":[{"id":1,"url":"//example.com/a","authPassword":"s3cret"}]}}`
+	if _, err := decodeBackup(strings.NewReader(data)); err == nil || !strings.Contains(err.Error(), "authPassword") {
+		t.Fatalf("decoding backup with credentials: err = %v", err)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+// commandContext is what a command gets to handle a message.
+type commandContext struct {
+	ctx      context.Context
+	cfg      *Config
+	db       *DB
+	bot      *tgbotapi.BotAPI
+	msg      *tgbotapi.Message
+	chatID   int64
+	threadID int // forum topic the command was sent in, zero if none
+	user     tgbotapi.User
+	args     string
+	imports  *importSessions
+}
+
+// commandHandler describes a command of the bot. The help text and the
+// commands registered with Telegram are generated from these descriptions.
+type commandHandler struct {
+	name        string
+	usage       string // arguments, as shown in the help text
+	description string
+
+	// hidden commands are neither listed in the help nor registered with
+	// Telegram.
+	hidden bool
+
+	// whitelisted commands may only be used by whitelisted users.
+	whitelisted bool
+
+	// ungated commands are answered to anyone, without logging the request
+	// or counting it against the request limit of the user. They must not
+	// touch the database or the feeds.
+	ungated bool
+
+	// If missingArgs is set, it is the reply when the command is used
+	// without arguments.
+	missingArgs string
+
+	// fetches is set for commands that load feeds. They count against the
+	// fetch limit of the chat and run in the background.
+	fetches bool
+
+	// run handles the command and returns the reply, if any.
+	run func(c *commandContext) tgbotapi.Chattable
+}
+
+// commandList holds the commands in the order in which they are listed.
+var commandList = []*commandHandler{
+	{
+		name:        "addfeed",
+		usage:       "<url> [--backfill <n>]",
+		description: "Adds an RSS/Atom feed to this chat (and sends its latest n items)",
+		whitelisted: true,
+		missingArgs: "copy the URL of the feed after the command",
+		fetches:     true,
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return addFeed(c.ctx, c.cfg, c.db, c.user, c.chatID, c.threadID, c.args)
+		},
+	},
+	{
+		name:        "search",
+		usage:       "<keyword>",
+		description: "Lists the recent items of the feeds in this chat that contain the keyword or, for a #keyword, have that category",
+		missingArgs: "Please tell me what to search for, like /search golang",
+		fetches:     true,
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return search(c.ctx, c.cfg, c.db, parsedFeeds, c.chatID, c.args, time.Now())
+		},
+	},
+	{
+		name:        "preview",
+		usage:       "<url>",
+		description: "Shows the latest items of a feed without adding it",
+		whitelisted: true,
+		missingArgs: "copy the URL of the feed after the command",
+		fetches:     true,
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return preview(c.ctx, c.cfg, c.chatID, strings.TrimSpace(c.args))
+		},
+	},
+	{
+		name:        "feeds",
+		description: "Lists the feeds that are assigned to this chat",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return listFeeds(c.ctx, c.db, c.chatID)
+		},
+	},
+	{
+		name:        "removefeed",
+		usage:       "<id>",
+		description: "Remove a particular feed from this chat (use the number from feeds command)",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return removeFeed(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "export",
+		description: "Sends the feeds of this chat as OPML file",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return exportFeeds(c.ctx, c.db, c.chatID, time.Now())
+		},
+	},
+	{
+		name:        "import",
+		description: "Lets you pick feeds of an OPML file to add to this chat (send it with /import as caption or reply to it)",
+		whitelisted: true,
+		fetches:     true,
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return previewImport(c.bot, c.imports, c.msg)
+		},
+	},
+	{
+		name:        "removematch",
+		usage:       "<text>",
+		description: "Remove all feeds whose title or URL contains the text (asks for confirmation)",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return removeMatch(c.ctx, c.db, c.chatID, strings.TrimSpace(c.args))
+		},
+	},
+	{
+		name:        "unsubscribeall",
+		description: "Remove all feeds from this chat (asks for confirmation)",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return unsubscribeAll(c.ctx, c.db, c.chatID)
+		},
+	},
+	{
+		name:        "ignoretitles",
+		usage:       "<id> on|off",
+		description: "Do not resend items of a feed when only their title changed",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return ignoreTitles(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "simulate",
+		usage:       "<id> <since>",
+		description: "Shows which items of a feed would have been sent since a time (like 48h or 2024-01-31)",
+		fetches:     true,
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return simulate(c.ctx, c.cfg, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "latency",
+		usage:       "<id>",
+		description: "Shows how long it takes on average until new items of a feed arrive here",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return deliveryLatency(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "filter",
+		usage:       "<id> <keyword>",
+		description: "Only sends items of a feed that contain one of the keywords or, for #keywords, have that category (/filter <id> clear removes them)",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return filter(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "mute",
+		usage:       "<id> <keyword>",
+		description: "Never sends items of a feed that contain the keyword or, for a #keyword, have that category",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return mute(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "unmute",
+		usage:       "<id> <keyword>",
+		description: "Removes a keyword that was muted",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return unmute(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "markread",
+		usage:       "<id>|all",
+		description: "Skips the items of a feed (or of all feeds) that were published until now",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return markRead(c.ctx, c.db, c.chatID, c.args, time.Now())
+		},
+	},
+	{
+		name:        "snooze",
+		usage:       "<id> <duration>|off [queue]",
+		description: "Skips new items of a feed for a while, like 3h (with queue, they are sent afterwards)",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return snooze(c.ctx, c.db, c.chatID, c.args, time.Now())
+		},
+	},
+	{
+		name:        "renamefeed",
+		usage:       "<id> <title>",
+		description: "Shows a feed under another title in this chat (leave out the title to use the feed's own)",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return renameFeed(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "digest",
+		usage:       "<id> <HH:MM>|off",
+		description: "Collects the new items of a feed and sends them once a day at the given time",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return setDigest(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "digestlength",
+		usage:       "<n>",
+		description: "Shows at most n characters of each description in the digests of this chat (0 for the default)",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return setDigestLength(c.ctx, c.cfg, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "timezone",
+		usage:       "<name>",
+		description: "Sets the time zone (like Europe/Vienna) in which times are shown and digests are sent in this chat",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return setTimezone(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "note",
+		usage:       "<id> <text>",
+		description: "Attaches a note to a feed in this chat (leave out the text to remove it)",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return setNote(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "feedinfo",
+		usage:       "<id>",
+		description: "Shows details about a feed in this chat",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return feedInfo(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "status",
+		description: "Shows when each feed of this chat last had new items and how often it failed to load recently",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return feedStatus(c.ctx, c.db, c.chatID)
+		},
+	},
+	{
+		name:        "mostactive",
+		description: "Shows which feeds sent the most items to this chat in the last week",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return mostActive(c.ctx, c.db, c.chatID, time.Now())
+		},
+	},
+	{
+		name:        "dedup",
+		usage:       "on|off",
+		description: "Skip items whose link was already sent to this chat by a feed listed before or removed since",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return setDedup(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "skiprepublished",
+		usage:       "on|off",
+		description: "Skip items that a feed publishes again with a newer date but unchanged",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return setSkipRepublished(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "setinterval",
+		usage:       "<minutes>",
+		description: "Sends new items to this chat at most this often (0 for as soon as possible)",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return setInterval(c.ctx, c.cfg, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "redirect",
+		usage:       "<chat id> <duration> [only]|off",
+		description: "Also (or only) send updates of this chat to another chat for a while (off stops redirecting)",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return redirect(c.ctx, c.db, c.bot, c.user, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "format",
+		usage:       "<id> " + strings.Join(itemFormats, "|"),
+		description: "Sends items of a feed as one line each (compact), or as polls or quizzes if they have the form of a question",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return setFormat(c.ctx, c.db, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "chown",
+		usage:       "<id> <user>",
+		description: "Transfers a feed of this chat to another user (reply to their message, mention them or give their user ID)",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return chown(c.ctx, c.db, c.bot, c.msg, c.args)
+		},
+	},
+	{
+		name:        "transfer",
+		usage:       "<chat id>",
+		description: "Moves all feeds of another chat to this one (e.g. after a group was upgraded)",
+		whitelisted: true,
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return transferChat(c.ctx, c.cfg, c.db, c.user, c.chatID, c.args)
+		},
+	},
+	{
+		name:        "commands",
+		description: "Lists the commands of this bot",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return tgbotapi.NewMessage(c.chatID, commandsText)
+		},
+	},
+	{
+		name:        "whoami",
+		description: "Shows your user ID, e.g. for the whitelist",
+		ungated:     true,
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return whoami(c.chatID, c.user)
+		},
+	},
+	{
+		name:        "chatinfo",
+		description: "Shows the ID and type of this chat, e.g. for /transfer",
+		ungated:     true,
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return chatInfo(c.msg, c.threadID)
+		},
+	},
+	{
+		name:        "help",
+		description: "Shows what each command does",
+		run: func(c *commandContext) tgbotapi.Chattable {
+			return tgbotapi.NewMessage(c.chatID, helptext)
+		},
+	},
+	{
+		// Admin commands are explained by /admin itself, and only to
+		// admins.
+		name:   "admin",
+		hidden: true,
+		run: func(c *commandContext) tgbotapi.Chattable {
+			if msg := admin(c.ctx, c.cfg, c.db, c.bot, c.msg, c.args); msg != nil {
+				return msg
+			}
+
+			return unknownCommand(c.chatID)
+		},
+	},
+}
+
+// commandRegistry maps the names of the commands to their handlers.
+var commandRegistry map[string]*commandHandler
+
+// helptext and commandsText are generated from commandList. They cannot be
+// initialized directly, as the commands that show them refer to them.
+var helptext, commandsText string
+
+func init() {
+	commandRegistry = make(map[string]*commandHandler, len(commandList))
+
+	help := "This bot can serve you in the following ways:\n\n"
+	var list string
+	for _, cmd := range commandList {
+		commandRegistry[cmd.name] = cmd
+		if cmd.hidden {
+			continue
+		}
+
+		line := "/" + cmd.name
+		if cmd.usage != "" {
+			line += " " + cmd.usage
+		}
+		help += line + " ... " + cmd.description + "\n"
+		list += "/" + cmd.name + " - " + cmd.description + "\n"
+	}
+
+	helptext = help
+	commandsText = list
+}
+
+// isUngated reports whether the command with the given name is ungated.
+func isUngated(name string) bool {
+	cmd, ok := commandRegistry[name]
+	return ok && cmd.ungated
+}
+
+func unknownCommand(chatID int64) tgbotapi.Chattable {
+	return tgbotapi.NewMessage(chatID, "I don't know that command")
+}
+
+// runCommand handles the command with the given name. Commands that fetch
+// feeds are passed to background, the replies are passed to reply.
+func runCommand(c *commandContext, name string, fetchLimiter *rateLimiter, background func(func()), reply func(tgbotapi.Chattable)) {
+	cmd, ok := commandRegistry[name]
+	if !ok {
+		reply(unknownCommand(c.chatID))
+		return
+	}
+
+	if cmd.whitelisted && !c.cfg.IsWhitelisted(c.user) {
+		reply(tgbotapi.NewMessage(c.chatID, "You may not do this."))
+		return
+	}
+
+	if cmd.missingArgs != "" && strings.TrimSpace(c.args) == "" {
+		reply(tgbotapi.NewMessage(c.chatID, cmd.missingArgs))
+		return
+	}
+
+	run := func() {
+		if msg := cmd.run(c); msg != nil {
+			reply(msg)
+		}
+	}
+
+	if !cmd.fetches {
+		run()
+		return
+	}
+
+	if !fetchLimiter.Allow(c.chatID) {
+		reply(tgbotapi.NewMessage(c.chatID, "Too many fetch requests in this chat. Please try again in a few minutes."))
+		return
+	}
+
+	background(run)
+}
+
+// botCommand is a command as registered with Telegram.
+type botCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+// registerCommands tells Telegram about the commands of the bot, so that
+// clients can suggest them.
+func registerCommands(bot *tgbotapi.BotAPI) error {
+	var list []botCommand
+	for _, cmd := range commandList {
+		if !cmd.hidden {
+			list = append(list, botCommand{Command: cmd.name, Description: cmd.description})
+		}
+	}
+
+	commands, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	_, err = bot.MakeRequest("setMyCommands", url.Values{"commands": {string(commands)}})
+	return err
+}
+
+// setupCommands registers the commands with Telegram unless this is left
+// to BotFather. The bot works without them, so failures are only logged.
+func setupCommands(cfg *Config, bot *tgbotapi.BotAPI) {
+	if cfg.Bot.SkipCommandRegistration {
+		logrus.Info("not registering commands with Telegram")
+		return
+	}
+
+	if err := registerCommands(bot); err != nil {
+		logrus.WithError(err).Warn("cannot register commands with Telegram")
+	}
+}
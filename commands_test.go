@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+func TestHelpTextListsCommands(t *testing.T) {
+	for _, cmd := range commandList {
+		listed := strings.Contains(helptext, "\n/"+cmd.name+" ")
+		if listed == cmd.hidden {
+			t.Errorf("/%s listed in help: %v, hidden: %v", cmd.name, listed, cmd.hidden)
+		}
+		if commandRegistry[cmd.name] != cmd {
+			t.Errorf("/%s is not in the registry", cmd.name)
+		}
+	}
+
+	for _, line := range []string{
+		"/help ... Shows what each command does\n",
+		"/commands ... Lists the commands of this bot\n",
+		"/addfeed <url> [--backfill <n>] ... Adds an RSS/Atom feed to this chat (and sends its latest n items)\n",
+	} {
+		if !strings.Contains(helptext, line) {
+			t.Errorf("help does not contain %q", line)
+		}
+	}
+
+	if !strings.HasPrefix(commandsText, "/addfeed - Adds an RSS/Atom feed to this chat (and sends its latest n items)\n") {
+		t.Errorf("commands text starts with %q", strings.SplitN(commandsText, "\n", 2)[0])
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	db := openTestDB(t)
+	cfg := &Config{}
+	cfg.Bot.UserIDWhitelist = []int64{1}
+
+	fetchLimiter := newRateLimiter(1, time.Minute)
+
+	run := func(userID int, cmd, args string) (replies []string, background int) {
+		user := tgbotapi.User{ID: userID}
+		c := &commandContext{
+			ctx:    context.Background(),
+			cfg:    cfg,
+			db:     db,
+			msg:    &tgbotapi.Message{From: &user, Chat: &tgbotapi.Chat{ID: 10}},
+			chatID: 10,
+			user:   user,
+			args:   args,
+		}
+
+		runCommand(c, cmd, fetchLimiter, func(func()) {
+			background++
+		}, func(msg tgbotapi.Chattable) {
+			replies = append(replies, msg.(tgbotapi.MessageConfig).Text)
+		})
+
+		return replies, background
+	}
+
+	tests := []struct {
+		user       int
+		cmd, args  string
+		reply      string
+		background int
+	}{
+		{1, "nosuchcommand", "", "I don't know that command", 0},
+		{1, "admin", "stats", "I don't know that command", 0},
+		{1, "help", "", helptext, 0},
+		{1, "dedup", "maybe", "Usage: /dedup on|off", 0},
+		{2, "addfeed", "https://example.com/feed", "You may not do this.", 0},
+		{1, "addfeed", " ", "copy the URL of the feed after the command", 0},
+		{1, "addfeed", "https://example.com/feed", "", 1},
+		{1, "preview", "https://example.com/feed", "Too many fetch requests in this chat. Please try again in a few minutes.", 0},
+	}
+
+	for _, tt := range tests {
+		replies, background := run(tt.user, tt.cmd, tt.args)
+
+		var want []string
+		if tt.reply != "" {
+			want = []string{tt.reply}
+		}
+		if !reflect.DeepEqual(replies, want) || background != tt.background {
+			t.Errorf("/%s %s by user %d: replies %q, %d in background; want %q, %d", tt.cmd, tt.args, tt.user, replies, background, want, tt.background)
+		}
+	}
+}
+
+func TestRegisterCommands(t *testing.T) {
+	var commands []botCommand
+	bot := newTestBot(t, func(method string, params url.Values) (interface{}, string) {
+		if method != "setMyCommands" {
+			t.Errorf("unexpected call of %s", method)
+			return nil, "unexpected"
+		}
+
+		if err := json.Unmarshal([]byte(params.Get("commands")), &commands); err != nil {
+			t.Error(err)
+		}
+		return true, ""
+	})
+
+	if err := registerCommands(bot); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.Command)
+		if cmd.Description == "" {
+			t.Errorf("/%s has no description", cmd.Command)
+		}
+	}
+
+	if len(names) != len(commandList)-1 || names[0] != "addfeed" || names[len(names)-1] != "help" {
+		t.Errorf("registered commands %v", names)
+	}
+	for _, name := range names {
+		if name == "admin" {
+			t.Error("hidden command /admin was registered")
+		}
+	}
+}
+
+func TestSetupCommands(t *testing.T) {
+	var calls int
+	bot := newTestBot(t, func(method string, params url.Values) (interface{}, string) {
+		calls++
+		return true, ""
+	})
+
+	cfg := &Config{}
+	cfg.Bot.SkipCommandRegistration = true
+	setupCommands(cfg, bot)
+	if calls != 0 {
+		t.Fatalf("commands were registered although skip-command-registration is set")
+	}
+
+	cfg.Bot.SkipCommandRegistration = false
+	setupCommands(cfg, bot)
+	if calls != 1 {
+		t.Fatalf("%d requests to register commands, want 1", calls)
+	}
+}
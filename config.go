@@ -1,16 +1,158 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
 	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
 )
 
+const defaultMaxDescriptionLength = 500
+const defaultBatchSize = 10
+const defaultFetchConcurrency = 8
+const defaultUpdateInterval = time.Hour
+const defaultUpdateTimeout = time.Minute * 20
+const defaultFeedFetchTimeout = time.Second * 30
+const defaultMinFetchInterval = time.Minute * 15
+const defaultMaxFetchInterval = time.Hour * 24
+const defaultDedupWindow = time.Hour * 24 * 3
+const defaultMaxRequests = 25
+const defaultRequestsWindow = time.Minute * 5
+const defaultUserAgent = "telegram-rss-bot/1.0 (+https://github.com/chtisgit/telegram-rss-bot)"
+
+// duration is a time.Duration that is given as a string like "1h30m".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
 type BotConfig struct {
 	APIKey string `toml:"api-key"`
 
-	UserWhitelist []string `toml:"user-whitelist"`
-	LogRequests   bool     `toml:"log-requests"`
+	// Users may add feeds if their username is in UserWhitelist or their
+	// ID is in UserIDWhitelist. If both are empty, everyone may.
+	UserWhitelist   []string `toml:"user-whitelist"`
+	UserIDWhitelist []int64  `toml:"user-id-whitelist"`
+	LogRequests     bool     `toml:"log-requests"`
+
+	// LogRedactURLs replaces URLs in commands before they are logged or
+	// stored with the requests. It is on unless disabled.
+	LogRedactURLs *bool `toml:"log-redact-urls"`
+
+	// Admins are the user IDs that may use the /admin commands.
+	Admins []int64 `toml:"admins"`
+
+	// AggregateRequests only counts requests per user instead of logging
+	// each request with its full text.
+	AggregateRequests bool `toml:"aggregate-requests"`
+
+	// MaxFetchRequests limits how many commands that fetch feeds (like
+	// /addfeed) can be issued in a chat within five minutes.
+	MaxFetchRequests int `toml:"max-fetch-requests"`
+
+	// Users who sent MaxRequests requests within RequestsWindow are
+	// ignored until the window has passed. A negative MaxRequests turns
+	// the limit off. RequestsWindow may be at most an hour.
+	MaxRequests    int      `toml:"max-requests"`
+	RequestsWindow duration `toml:"requests-window"`
+
+	// MaxBacklog limits how many new items of a feed are sent to a chat in
+	// one update. BacklogStrategy selects which of the items are kept.
+	MaxBacklog      int    `toml:"max-backlog"`
+	BacklogStrategy string `toml:"backlog-strategy"`
+
+	// MaxDescriptionLength is the number of characters of an item's
+	// description that are shown in a message.
+	MaxDescriptionLength int `toml:"max-description-length"`
+
+	// ShowPublished adds when an item was published to its message.
+	ShowPublished bool `toml:"show-published"`
+
+	// ShowCategories adds the categories of an item to its message as
+	// hashtags.
+	ShowCategories bool `toml:"show-categories"`
+
+	// SendImages sends items that have an image as photo.
+	SendImages bool `toml:"send-images"`
+
+	// MessageTemplate is a text/template that renders the message of an
+	// item in Telegram HTML, see itemTemplateData for its fields. It is
+	// parsed into messageTemplate when the config is loaded.
+	MessageTemplate string `toml:"message-template"`
+	messageTemplate *template.Template
+
+	// BackfillItems is how many of the latest items of a feed are sent when
+	// it is added, unless /addfeed asks for another number.
+	BackfillItems int `toml:"backfill-items"`
+
+	// BatchItems combines up to BatchSize new items of a feed into one
+	// message instead of sending a message for each item.
+	BatchItems bool `toml:"batch-items"`
+	BatchSize  int  `toml:"batch-size"`
+
+	// UpdateInterval is how often each feed is fetched. The fetches of all
+	// feeds are spread over the interval. An update of the feeds that are
+	// due is cancelled if it takes longer than UpdateTimeout.
+	UpdateInterval duration `toml:"update-interval"`
+	UpdateTimeout  duration `toml:"update-timeout"`
+
+	// FeedFetchTimeout limits how long fetching a single feed may take, so
+	// that a server that does not answer fails like any other feed instead
+	// of holding up the update.
+	FeedFetchTimeout duration `toml:"feed-fetch-timeout"`
+
+	// Feeds that advertise how often they change are fetched that often
+	// instead, but at most every MinFetchInterval and at least every
+	// MaxFetchInterval.
+	MinFetchInterval duration `toml:"min-fetch-interval"`
+	MaxFetchInterval duration `toml:"max-fetch-interval"`
+
+	// Chats that turned on /dedup do not get items whose link was
+	// delivered by another feed within DedupWindow, and chats that turned on
+	// /skiprepublished do not get items that the same feed delivered with
+	// the same content within DedupWindow.
+	DedupWindow duration `toml:"dedup-window"`
+
+	// DryRun makes updates only log the messages they would send. Nothing
+	// is recorded that would keep the items from being sent later.
+	DryRun bool `toml:"dry-run"`
+
+	// FetchConcurrency is the number of feeds that are fetched at the same time.
+	FetchConcurrency int `toml:"fetch-concurrency"`
+
+	// FetchAttempts is how often fetching a feed is tried during an update
+	// before it counts as an error of the feed.
+	FetchAttempts int `toml:"fetch-attempts"`
+
+	// UserAgent is sent with every request for a feed.
+	UserAgent string `toml:"user-agent"`
+
+	// SkipCommandRegistration keeps the bot from registering its commands
+	// with Telegram on startup, for those who set them up via BotFather.
+	SkipCommandRegistration bool `toml:"skip-command-registration"`
+
+	// HealthAddr enables serving a health check under /healthz.
+	HealthAddr string `toml:"health-addr"`
 
 	// Constraints
 	MaxFeedsPerChat      int `toml:"max-feeds-per-chat"`
@@ -19,32 +161,394 @@ type BotConfig struct {
 }
 
 type DBConfig struct {
+	// Driver is "mysql" (the default) or "sqlite3".
 	Driver string `toml:"driver"`
 	Source string `toml:"src"`
 }
 
+// WebhookConfig enables receiving updates via a webhook instead of polling
+// for them. Cert and Key may be left empty when a reverse proxy terminates TLS.
+type WebhookConfig struct {
+	ListenAddr string `toml:"listen-addr"`
+	PublicURL  string `toml:"public-url"`
+	Cert       string `toml:"cert"`
+	Key        string `toml:"key"`
+}
+
+// MetricsConfig enables serving Prometheus metrics on ListenAddr.
+type MetricsConfig struct {
+	ListenAddr string `toml:"listen-addr"`
+}
+
+// LogConfig selects what is logged and how. Level is one of trace, debug,
+// info, warn and error, Format is text or json.
+type LogConfig struct {
+	Level  string `toml:"level"`
+	Format string `toml:"format"`
+}
+
+// AuditConfig selects where requests are recorded: in the requests table
+// of the database (Sink "db", the default) or appended to File as JSON lines
+// (Sink "file"). Requests are recorded if bot.log-requests or Always is set.
+type AuditConfig struct {
+	Sink   string `toml:"sink"`
+	File   string `toml:"file"`
+	Always bool   `toml:"always"`
+}
+
+const (
+	auditSinkDB   = "db"
+	auditSinkFile = "file"
+)
+
 type Config struct {
-	Bot BotConfig `toml:"bot"`
-	DB  DBConfig  `toml:"db"`
+	Bot     BotConfig     `toml:"bot"`
+	DB      DBConfig      `toml:"db"`
+	Webhook WebhookConfig `toml:"webhook"`
+	Metrics MetricsConfig `toml:"metrics"`
+	Log     LogConfig     `toml:"log"`
+	Audit   AuditConfig   `toml:"audit"`
 }
 
+var errUpdateTimeout = errors.New("update-timeout must be shorter than update-interval")
+var errBackfillItems = fmt.Errorf("backfill-items must be at most %d", maxBackfillItems)
+var errFetchInterval = errors.New("min-fetch-interval must not be longer than max-fetch-interval")
+var errDedupWindow = errors.New("dedup-window must not be longer than delivered items are kept (30 days)")
+var errRequestsWindow = errors.New("requests-window must not be longer than request counts are kept (1 hour)")
+
 func loadConfigFile(path string) (*Config, error) {
 	cfg := new(Config)
 
-	if _, err := toml.DecodeFile(configfilePath, &cfg); err != nil {
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
 		return nil, err
 	}
 
-	sort.Strings(cfg.Bot.UserWhitelist)
+	if err := cfg.applyDefaults(); err != nil {
+		return nil, err
+	}
 
 	return cfg, nil
 }
 
-func (c *Config) IsWhitelisted(username string) bool {
-	if len(c.Bot.UserWhitelist) == 0 {
+// applyDefaults fills in the settings that were left out and checks that
+// the settings fit together.
+func (c *Config) applyDefaults() error {
+	sort.Strings(c.Bot.UserWhitelist)
+
+	if c.Bot.MaxDescriptionLength <= 0 {
+		c.Bot.MaxDescriptionLength = defaultMaxDescriptionLength
+	}
+
+	if c.Bot.BatchSize == 0 {
+		c.Bot.BatchSize = defaultBatchSize
+	}
+
+	if c.Bot.FetchConcurrency <= 0 {
+		c.Bot.FetchConcurrency = defaultFetchConcurrency
+	}
+
+	if c.Bot.FetchAttempts <= 0 {
+		c.Bot.FetchAttempts = defaultFetchAttempts
+	}
+
+	if c.Bot.UpdateInterval.Duration <= 0 {
+		c.Bot.UpdateInterval.Duration = defaultUpdateInterval
+	}
+
+	if c.Bot.UpdateTimeout.Duration <= 0 {
+		c.Bot.UpdateTimeout.Duration = defaultUpdateTimeout
+	}
+
+	if c.Bot.UpdateTimeout.Duration >= c.Bot.UpdateInterval.Duration {
+		return errUpdateTimeout
+	}
+
+	if c.Bot.BackfillItems > maxBackfillItems {
+		return errBackfillItems
+	}
+
+	if c.Bot.FeedFetchTimeout.Duration <= 0 {
+		c.Bot.FeedFetchTimeout.Duration = defaultFeedFetchTimeout
+	}
+
+	if c.Bot.MinFetchInterval.Duration <= 0 {
+		c.Bot.MinFetchInterval.Duration = defaultMinFetchInterval
+	}
+
+	if c.Bot.MaxFetchInterval.Duration <= 0 {
+		c.Bot.MaxFetchInterval.Duration = defaultMaxFetchInterval
+	}
+
+	if c.Bot.MinFetchInterval.Duration > c.Bot.MaxFetchInterval.Duration {
+		return errFetchInterval
+	}
+
+	if c.Bot.DedupWindow.Duration <= 0 {
+		c.Bot.DedupWindow.Duration = defaultDedupWindow
+	}
+
+	if c.Bot.DedupWindow.Duration > deliveredItemsRetention {
+		return errDedupWindow
+	}
+
+	if c.Bot.MaxRequests == 0 {
+		c.Bot.MaxRequests = defaultMaxRequests
+	}
+
+	if c.Bot.RequestsWindow.Duration <= 0 {
+		c.Bot.RequestsWindow.Duration = defaultRequestsWindow
+	}
+
+	if c.Bot.RequestsWindow.Duration > requestCountsRetention {
+		return errRequestsWindow
+	}
+
+	if c.Bot.UserAgent == "" {
+		c.Bot.UserAgent = defaultUserAgent
+	}
+
+	if c.Bot.MessageTemplate == "" {
+		c.Bot.MessageTemplate = defaultItemTemplate
+	}
+
+	t, err := parseItemTemplate(c.Bot.MessageTemplate)
+	if err != nil {
+		return fmt.Errorf("message-template: %w", err)
+	}
+	c.Bot.messageTemplate = t
+
+	return nil
+}
+
+// Validate checks the settings that the bot cannot run without or that
+// have no sensible meaning. The error lists every problem that was found.
+func (c *Config) Validate() error {
+	var problems []string
+
+	if c.Bot.APIKey == "" {
+		problems = append(problems, "bot.api-key is missing")
+	}
+
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"bot.max-feeds-per-chat", c.Bot.MaxFeedsPerChat},
+		{"bot.max-total-feeds-by-user", c.Bot.MaxTotalFeedsByUser},
+		{"bot.max-active-feeds-by-user", c.Bot.MaxActiveFeedsByUser},
+		{"bot.max-fetch-requests", c.Bot.MaxFetchRequests},
+		{"bot.max-backlog", c.Bot.MaxBacklog},
+		{"bot.batch-size", c.Bot.BatchSize},
+		{"bot.backfill-items", c.Bot.BackfillItems},
+	} {
+		if limit.value < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative (is %d)", limit.name, limit.value))
+		}
+	}
+
+	switch c.DB.Driver {
+	case "", "mysql":
+		if c.DB.Source == "" {
+			problems = append(problems, "db.src is missing")
+		} else if _, err := mysql.ParseDSN(c.DB.Source); err != nil {
+			problems = append(problems, fmt.Sprintf("db.src is not a valid MySQL DSN: %v", err))
+		}
+
+	case "sqlite", "sqlite3":
+		if c.DB.Source == "" {
+			problems = append(problems, "db.src is missing")
+		}
+
+	default:
+		problems = append(problems, fmt.Sprintf("db.driver %q is not supported, use mysql or sqlite3", c.DB.Driver))
+	}
+
+	switch c.Audit.Sink {
+	case "", auditSinkDB:
+
+	case auditSinkFile:
+		if c.Audit.File == "" {
+			problems = append(problems, "audit.file is missing")
+		}
+
+	default:
+		problems = append(problems, fmt.Sprintf("audit.sink %q is not supported, use db or file", c.Audit.Sink))
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// redactedSecret replaces the secrets in a config that is printed.
+const redactedSecret = "[redacted]"
+
+// printConfig writes cfg as TOML to w with its secrets replaced: the API
+// key, the password in the database source and the path of the webhook,
+// which only Telegram should know.
+func printConfig(w io.Writer, cfg *Config) error {
+	c := *cfg
+
+	if c.Bot.APIKey != "" {
+		c.Bot.APIKey = redactedSecret
+	}
+
+	c.DB.Source = redactDBSource(c.DB.Driver, c.DB.Source)
+
+	if u, err := url.Parse(c.Webhook.PublicURL); err != nil {
+		c.Webhook.PublicURL = redactedSecret
+	} else if u.User != nil || (u.Path != "" && u.Path != "/") {
+		u.User = nil
+		u.Path = "/" + redactedSecret
+		u.RawPath = ""
+		u.RawQuery = ""
+		c.Webhook.PublicURL = u.String()
+	}
+
+	return toml.NewEncoder(w).Encode(&c)
+}
+
+// redactDBSource replaces the password in the data source of the driver.
+func redactDBSource(driver, source string) string {
+	if source == "" {
+		return ""
+	}
+
+	switch driver {
+	case "", "mysql":
+		dsn, err := mysql.ParseDSN(source)
+		if err != nil {
+			return redactedSecret
+		}
+		if dsn.Passwd != "" {
+			dsn.Passwd = redactedSecret
+		}
+		return dsn.FormatDSN()
+
+	default:
+		// SQLite only has a password with its authentication extension,
+		// which takes it as a parameter.
+		path, query, found := strings.Cut(source, "?")
+		if !found {
+			return source
+		}
+
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			return path + "?" + redactedSecret
+		}
+		for key := range params {
+			if strings.Contains(strings.ToLower(key), "pass") {
+				params.Set(key, redactedSecret)
+			}
+		}
+		return path + "?" + params.Encode()
+	}
+}
+
+// requestsStored reports whether every request is stored in the requests
+// table, where the request limit can count them.
+func (c *Config) requestsStored() bool {
+	return (c.Bot.LogRequests || c.Audit.Always) && (c.Audit.Sink == "" || c.Audit.Sink == auditSinkDB)
+}
+
+// RedactURLs reports whether URLs are removed from logged commands.
+func (c *BotConfig) RedactURLs() bool {
+	return c.LogRedactURLs == nil || *c.LogRedactURLs
+}
+
+// HasWhitelist reports whether only whitelisted users may add feeds.
+func (c *Config) HasWhitelist() bool {
+	return len(c.Bot.UserWhitelist) != 0 || len(c.Bot.UserIDWhitelist) != 0
+}
+
+// sharedConfig holds the configuration, which is replaced when it is
+// reloaded. A Config that was taken from it must not be modified.
+type sharedConfig struct {
+	mu  sync.RWMutex
+	cfg *Config
+}
+
+func newSharedConfig(cfg *Config) *sharedConfig {
+	return &sharedConfig{cfg: cfg}
+}
+
+func (s *sharedConfig) Get() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.cfg
+}
+
+func (s *sharedConfig) Set(cfg *Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cfg = cfg
+}
+
+// reloadedConfig returns old with the settings that can be changed at runtime
+// taken from loaded: the whitelists, the feed limits, the description length
+// and whether publish times are shown. Other changes are ignored.
+func reloadedConfig(old, loaded *Config) *Config {
+	if loaded.Bot.APIKey != old.Bot.APIKey || loaded.DB != old.DB {
+		logrus.Warn("changes to the API key or the database require a restart")
+	}
+
+	cfg := *old
+	cfg.Bot.UserWhitelist = loaded.Bot.UserWhitelist
+	cfg.Bot.UserIDWhitelist = loaded.Bot.UserIDWhitelist
+	cfg.Bot.MaxFeedsPerChat = loaded.Bot.MaxFeedsPerChat
+	cfg.Bot.MaxTotalFeedsByUser = loaded.Bot.MaxTotalFeedsByUser
+	cfg.Bot.MaxActiveFeedsByUser = loaded.Bot.MaxActiveFeedsByUser
+	cfg.Bot.MaxDescriptionLength = loaded.Bot.MaxDescriptionLength
+	cfg.Bot.ShowPublished = loaded.Bot.ShowPublished
+	cfg.Bot.ShowCategories = loaded.Bot.ShowCategories
+
+	return &cfg
+}
+
+func (c *Config) IsWhitelisted(user tgbotapi.User) bool {
+	if !c.HasWhitelist() {
 		return true
 	}
 
-	i := sort.SearchStrings(c.Bot.UserWhitelist, username)
-	return i != len(c.Bot.UserWhitelist) && c.Bot.UserWhitelist[i] == username
+	for _, id := range c.Bot.UserIDWhitelist {
+		if id == int64(user.ID) {
+			return true
+		}
+	}
+
+	if user.UserName == "" {
+		return false
+	}
+
+	i := sort.SearchStrings(c.Bot.UserWhitelist, user.UserName)
+	return i != len(c.Bot.UserWhitelist) && c.Bot.UserWhitelist[i] == user.UserName
+}
+
+// BacklogSelector returns the configured backlog strategy, defaulting to "newest".
+func (c *BotConfig) BacklogSelector() backlogSelector {
+	if sel, ok := backlogSelectors[c.BacklogStrategy]; ok {
+		return sel
+	}
+
+	return selectNewest
+}
+
+func (c *Config) IsAdmin(userID int64) bool {
+	for _, id := range c.Bot.Admins {
+		if id == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Enabled reports whether updates are received via webhook.
+func (c *WebhookConfig) Enabled() bool {
+	return c.PublicURL != ""
 }
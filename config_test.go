@@ -0,0 +1,382 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+func TestIsWhitelisted(t *testing.T) {
+	alice := tgbotapi.User{ID: 1, UserName: "alice"}
+	bob := tgbotapi.User{ID: 2, UserName: "bob"}
+	anonymous := tgbotapi.User{ID: 3}
+
+	tests := []struct {
+		name      string
+		usernames []string
+		ids       []int64
+		allowed   []tgbotapi.User
+		denied    []tgbotapi.User
+	}{
+		{"empty", nil, nil, []tgbotapi.User{alice, bob, anonymous}, nil},
+		{"usernames", []string{"alice"}, nil, []tgbotapi.User{alice}, []tgbotapi.User{bob, anonymous}},
+		{"ids", nil, []int64{3}, []tgbotapi.User{anonymous}, []tgbotapi.User{alice, bob}},
+		{"mixed", []string{"bob"}, []int64{1}, []tgbotapi.User{alice, bob}, []tgbotapi.User{anonymous}},
+		// A user who changed their username keeps access by ID.
+		{"renamed", []string{"alice"}, []int64{2}, []tgbotapi.User{alice, {ID: 2, UserName: "robert"}}, []tgbotapi.User{{ID: 4, UserName: "bob"}}},
+	}
+
+	for _, tt := range tests {
+		cfg := &Config{Bot: BotConfig{UserWhitelist: tt.usernames, UserIDWhitelist: tt.ids}}
+		for _, user := range tt.allowed {
+			if !cfg.IsWhitelisted(user) {
+				t.Errorf("%s: user %d (%q) is not whitelisted", tt.name, user.ID, user.UserName)
+			}
+		}
+		for _, user := range tt.denied {
+			if cfg.IsWhitelisted(user) {
+				t.Errorf("%s: user %d (%q) is whitelisted", tt.name, user.ID, user.UserName)
+			}
+		}
+	}
+}
+
+func TestReloadedConfig(t *testing.T) {
+	old := &Config{
+		Bot: BotConfig{APIKey: "key", UserWhitelist: []string{"alice"}, MaxFeedsPerChat: 10, MaxDescriptionLength: 500, BatchSize: 5},
+		DB:  DBConfig{Driver: "sqlite3", Source: "bot.db"},
+	}
+	loaded := &Config{
+		Bot: BotConfig{APIKey: "other", UserIDWhitelist: []int64{2}, MaxFeedsPerChat: 20, MaxActiveFeedsByUser: 3, MaxDescriptionLength: 200, ShowCategories: true, BatchSize: 50},
+		DB:  DBConfig{Driver: "mysql", Source: "bot@/bot"},
+	}
+
+	cfg := reloadedConfig(old, loaded)
+
+	if cfg.IsWhitelisted(tgbotapi.User{ID: 1, UserName: "alice"}) || !cfg.IsWhitelisted(tgbotapi.User{ID: 2}) {
+		t.Errorf("whitelists were not reloaded: %q, %v", cfg.Bot.UserWhitelist, cfg.Bot.UserIDWhitelist)
+	}
+	if cfg.Bot.MaxFeedsPerChat != 20 || cfg.Bot.MaxActiveFeedsByUser != 3 || cfg.Bot.MaxDescriptionLength != 200 {
+		t.Errorf("limits were not reloaded: %+v", cfg.Bot)
+	}
+	if !cfg.Bot.ShowCategories {
+		t.Error("show-categories was not reloaded")
+	}
+	if cfg.Bot.APIKey != "key" || cfg.DB != old.DB || cfg.Bot.BatchSize != 5 {
+		t.Errorf("settings that need a restart were reloaded: %+v", cfg)
+	}
+	if old.Bot.MaxFeedsPerChat != 10 {
+		t.Error("the old configuration was modified")
+	}
+}
+
+func TestUpdateIntervalConfig(t *testing.T) {
+	tests := []struct {
+		file     string
+		interval time.Duration
+		timeout  time.Duration
+		err      bool
+	}{
+		{"", defaultUpdateInterval, defaultUpdateTimeout, false},
+		{"[bot]\nupdate-interval = \"2h\"\nupdate-timeout = \"30m\"", 2 * time.Hour, 30 * time.Minute, false},
+		{"[bot]\nupdate-interval = \"30m\"", 30 * time.Minute, defaultUpdateTimeout, false},
+		{"[bot]\nupdate-timeout = \"1h\"", 0, 0, true},
+		{"[bot]\nupdate-interval = \"10m\"\nupdate-timeout = \"10m\"", 0, 0, true},
+		{"[bot]\nupdate-interval = \"often\"", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		cfg := new(Config)
+		_, err := toml.Decode(tt.file, cfg)
+		if err == nil {
+			err = cfg.applyDefaults()
+		}
+
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: no error", tt.file)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", tt.file, err)
+		} else if cfg.Bot.UpdateInterval.Duration != tt.interval || cfg.Bot.UpdateTimeout.Duration != tt.timeout {
+			t.Errorf("%q: interval %s, timeout %s; want %s, %s", tt.file, cfg.Bot.UpdateInterval, cfg.Bot.UpdateTimeout, tt.interval, tt.timeout)
+		}
+	}
+}
+
+func TestFeedFetchTimeoutConfig(t *testing.T) {
+	tests := []struct {
+		file    string
+		timeout time.Duration
+	}{
+		{"", defaultFeedFetchTimeout},
+		{"[bot]\nfeed-fetch-timeout = \"10s\"", 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		cfg := new(Config)
+		if _, err := toml.Decode(tt.file, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.applyDefaults(); err != nil {
+			t.Fatalf("%q: %v", tt.file, err)
+		}
+
+		if cfg.Bot.FeedFetchTimeout.Duration != tt.timeout {
+			t.Errorf("%q: feed fetch timeout %s, want %s", tt.file, cfg.Bot.FeedFetchTimeout, tt.timeout)
+		}
+		if client := newFeedClient(cfg); client.Timeout != tt.timeout {
+			t.Errorf("%q: client timeout %s, want %s", tt.file, client.Timeout, tt.timeout)
+		}
+	}
+}
+
+func TestRequestLimitConfig(t *testing.T) {
+	tests := []struct {
+		file   string
+		max    int
+		window time.Duration
+	}{
+		{"", defaultMaxRequests, defaultRequestsWindow},
+		{"[bot]\nmax-requests = 10\nrequests-window = \"1m\"", 10, time.Minute},
+		{"[bot]\nmax-requests = -1", -1, defaultRequestsWindow},
+	}
+
+	for _, tt := range tests {
+		cfg := new(Config)
+		if _, err := toml.Decode(tt.file, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.applyDefaults(); err != nil {
+			t.Fatalf("%q: %v", tt.file, err)
+		}
+
+		if cfg.Bot.MaxRequests != tt.max || cfg.Bot.RequestsWindow.Duration != tt.window {
+			t.Errorf("%q: %d requests per %s, want %d per %s", tt.file, cfg.Bot.MaxRequests, cfg.Bot.RequestsWindow, tt.max, tt.window)
+		}
+	}
+
+	// Requests are counted only as long as requestCountsRetention.
+	cfg := new(Config)
+	if _, err := toml.Decode("[bot]\nrequests-window = \"2h\"", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.applyDefaults(); err != errRequestsWindow {
+		t.Fatalf("requests-window longer than the retention: err = %v", err)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.toml")
+	if err := os.WriteFile(path, []byte("[bot]\napi-key = \"123:abc\"\nbatch-size = 3\n[db]\ndriver = \"sqlite3\"\nsrc = \"bot.db\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Bot.APIKey != "123:abc" || cfg.Bot.BatchSize != 3 || cfg.DB.Source != "bot.db" {
+		t.Fatalf("loaded config %+v does not match the file", cfg)
+	}
+	if cfg.Bot.UpdateInterval.Duration != defaultUpdateInterval {
+		t.Errorf("update interval %s, want the default %s", cfg.Bot.UpdateInterval, defaultUpdateInterval)
+	}
+
+	if _, err := loadConfigFile(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Error("loading a missing config file did not fail")
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	tests := []struct {
+		file    string
+		secrets []string
+	}{
+		{
+			"[bot]\napi-key = \"123:tokensecret\"\n[db]\nsrc = \"bot:hunter2@tcp(db:3306)/bot\"\n[webhook]\npublic-url = \"https://bot.example.com/hook-pathsecret\"",
+			[]string{"tokensecret", "hunter2", "pathsecret"},
+		},
+		{
+			"[db]\ndriver = \"sqlite3\"\nsrc = \"bot.db?_auth&_auth_user=bot&_auth_pass=hunter2\"",
+			[]string{"hunter2"},
+		},
+		{"[db]\nsrc = \"not a dsn:hunter2\"", []string{"hunter2"}},
+	}
+
+	for _, tt := range tests {
+		cfg := new(Config)
+		if _, err := toml.Decode(tt.file, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.applyDefaults(); err != nil {
+			t.Fatal(err)
+		}
+
+		source := cfg.DB.Source
+		var b strings.Builder
+		if err := printConfig(&b, cfg); err != nil {
+			t.Fatal(err)
+		}
+		out := b.String()
+
+		if cfg.DB.Source != source {
+			t.Errorf("printing changed the config")
+		}
+
+		for _, secret := range tt.secrets {
+			if strings.Contains(out, secret) {
+				t.Errorf("printed config contains %q:\n%s", secret, out)
+			}
+		}
+
+		// The printed config is a config file with the same settings.
+		printed := new(Config)
+		if _, err := toml.Decode(out, printed); err != nil {
+			t.Fatalf("printed config cannot be read: %v\n%s", err, out)
+		}
+		if printed.Bot.UpdateInterval != cfg.Bot.UpdateInterval || printed.DB.Driver != cfg.DB.Driver || printed.Bot.MessageTemplate != cfg.Bot.MessageTemplate {
+			t.Errorf("printed config differs:\n%s", out)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	const valid = "[bot]\napi-key = \"123:abc\"\n[db]\n"
+
+	tests := []struct {
+		file     string
+		problems []string
+	}{
+		{valid + "driver = \"sqlite3\"\nsrc = \"bot.db\"", nil},
+		{valid + "src = \"bot:secret@tcp(localhost:3306)/bot\"", nil},
+		{"[db]\ndriver = \"sqlite3\"\nsrc = \"bot.db\"", []string{"bot.api-key is missing"}},
+		{valid + "driver = \"postgres\"\nsrc = \"bot\"", []string{`db.driver "postgres" is not supported`}},
+		{valid + "driver = \"sqlite3\"", []string{"db.src is missing"}},
+		{valid + "src = \"bot@localhost/bot\"", []string{"db.src is not a valid MySQL DSN"}},
+		{valid + "driver = \"sqlite3\"\nsrc = \"bot.db\"\n[audit]\nsink = \"file\"\nfile = \"audit.log\"", nil},
+		{valid + "driver = \"sqlite3\"\nsrc = \"bot.db\"\n[audit]\nsink = \"file\"", []string{"audit.file is missing"}},
+		{valid + "driver = \"sqlite3\"\nsrc = \"bot.db\"\n[audit]\nsink = \"syslog\"", []string{`audit.sink "syslog" is not supported`}},
+		{
+			"[bot]\nmax-feeds-per-chat = -1\nmax-backlog = -5\n[db]\ndriver = \"sqlite3\"",
+			[]string{"bot.api-key is missing", "bot.max-feeds-per-chat must not be negative (is -1)", "bot.max-backlog must not be negative (is -5)", "db.src is missing"},
+		},
+	}
+
+	for _, tt := range tests {
+		cfg := new(Config)
+		if _, err := toml.Decode(tt.file, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.applyDefaults(); err != nil {
+			t.Fatalf("%q: %v", tt.file, err)
+		}
+
+		err := cfg.Validate()
+		if len(tt.problems) == 0 {
+			if err != nil {
+				t.Errorf("%q: %v", tt.file, err)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Errorf("%q: no error", tt.file)
+			continue
+		}
+		for _, problem := range tt.problems {
+			if !strings.Contains(err.Error(), problem) {
+				t.Errorf("%q: error %q does not mention %q", tt.file, err, problem)
+			}
+		}
+	}
+}
+
+func TestFetchIntervalConfig(t *testing.T) {
+	tests := []struct {
+		file     string
+		min, max time.Duration
+		err      bool
+	}{
+		{"", defaultMinFetchInterval, defaultMaxFetchInterval, false},
+		{"[bot]\nmin-fetch-interval = \"5m\"\nmax-fetch-interval = \"6h\"", 5 * time.Minute, 6 * time.Hour, false},
+		{"[bot]\nmin-fetch-interval = \"2d\"", 0, 0, true},
+		{"[bot]\nmin-fetch-interval = \"48h\"", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		cfg := new(Config)
+		_, err := toml.Decode(tt.file, cfg)
+		if err == nil {
+			err = cfg.applyDefaults()
+		}
+
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: no error", tt.file)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", tt.file, err)
+		} else if cfg.Bot.MinFetchInterval.Duration != tt.min || cfg.Bot.MaxFetchInterval.Duration != tt.max {
+			t.Errorf("%q: min %s, max %s; want %s, %s", tt.file, cfg.Bot.MinFetchInterval, cfg.Bot.MaxFetchInterval, tt.min, tt.max)
+		}
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer logrus.SetFormatter(logrus.StandardLogger().Formatter)
+	defer logrus.SetLevel(logrus.GetLevel())
+
+	tests := []struct {
+		cfg   LogConfig
+		level logrus.Level
+		json  bool
+	}{
+		{LogConfig{}, logrus.InfoLevel, false},
+		{LogConfig{Level: "debug", Format: "text"}, logrus.DebugLevel, false},
+		{LogConfig{Level: "warn", Format: "json"}, logrus.WarnLevel, true},
+		{LogConfig{Level: "loud", Format: "xml"}, logrus.InfoLevel, false},
+	}
+
+	for _, tt := range tests {
+		setupLogging(&tt.cfg)
+
+		if level := logrus.GetLevel(); level != tt.level {
+			t.Errorf("%+v: level %s, want %s", tt.cfg, level, tt.level)
+		}
+		if _, json := logrus.StandardLogger().Formatter.(*logrus.JSONFormatter); json != tt.json {
+			t.Errorf("%+v: JSON format = %v, want %v", tt.cfg, json, tt.json)
+		}
+	}
+}
+
+func TestMessageTemplateConfig(t *testing.T) {
+	cfg := new(Config)
+	if err := cfg.applyDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Bot.messageTemplate == nil || cfg.Bot.MessageTemplate != defaultItemTemplate {
+		t.Fatalf("template without setting = %q", cfg.Bot.MessageTemplate)
+	}
+
+	cfg = new(Config)
+	if _, err := toml.Decode("[bot]\nmessage-template = \"{{.Link}\"", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.applyDefaults(); err == nil {
+		t.Fatal("broken template was accepted")
+	}
+}
@@ -5,9 +5,15 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 type queryRower interface {
@@ -18,50 +24,123 @@ type queryRower interface {
 type checkFunc func(ctx context.Context, q queryRower, userID, chatID int64) error
 
 type DB struct {
-	q *sql.DB
+	q      retryDB
+	driver string
 
-	checkAddConstraint checkFunc
+	// checkMu guards the check functions, which Prepare replaces.
+	checkMu              sync.RWMutex
+	checkAddConstraint   checkFunc
+	checkOwnerConstraint checkFunc
+	checkChatConstraint  checkFunc
 
 	MaxFeedsPerChat      int
 	MaxTotalFeedsByUser  int
 	MaxActiveFeedsByUser int
+
+	AggregateRequests bool
 }
 
+const requestBucketSeconds = 5 * 60
+const deliveryBucketSeconds = 60 * 60
+
 var ErrMaxFeedsInChat = errors.New("chat is already at maximum feeds")
 var ErrMaxTotalFeedsByUser = errors.New("user added too many feeds")
 var ErrMaxActiveFeedsByUser = errors.New("user has too many active feeds")
+var ErrAlreadySubscribed = errors.New("chat already has this feed")
+
+// OpenDB connects to the database. The driver is either "mysql" (the default)
+// or "sqlite3".
+func OpenDB(driver, url string) (*DB, error) {
+	switch driver {
+	case "", "mysql":
+		driver = "mysql"
+
+	case "sqlite", "sqlite3":
+		driver = "sqlite3"
 
-func OpenDB(url string) (*DB, error) {
-	q, err := sql.Open("mysql", url)
+		// Cascading deletes rely on foreign keys, which are off by default.
+		// Commands and updates query the database concurrently, which needs
+		// WAL mode and writers that wait for each other.
+		url = withSQLiteParam(url, "_foreign_keys", "1")
+		url = withSQLiteParam(url, "_journal_mode", "WAL")
+		url = withSQLiteParam(url, "_busy_timeout", "5000")
+
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", driver)
+	}
+
+	q, err := sql.Open(driver, url)
 	if err != nil {
 		return nil, err
 	}
 
 	q.SetConnMaxLifetime(time.Minute * 5)
 
-	if err := q.Ping(); err != nil {
+	if err := waitForDB(context.Background(), q); err != nil {
+		q.Close()
 		return nil, err
 	}
 
 	return &DB{
-		q: q,
+		q:      retryDB{q},
+		driver: driver,
 	}, nil
 }
 
+// withSQLiteParam adds a connection parameter to a SQLite data source unless it
+// is set already.
+func withSQLiteParam(src, key, value string) string {
+	if strings.Contains(src, key+"=") {
+		return src
+	}
+
+	if strings.Contains(src, "?") {
+		return src + "&" + key + "=" + value
+	}
+
+	return src + "?" + key + "=" + value
+}
+
+// onConflict starts the clause of an INSERT that updates the existing row if
+// one with the same key exists. The assignments have to follow.
+func (db *DB) onConflict(key string) string {
+	if db.driver == "sqlite3" {
+		return "ON CONFLICT(" + key + ") DO UPDATE SET"
+	}
+
+	return "ON DUPLICATE KEY UPDATE"
+}
+
+// inserted refers to the value that was to be inserted into column col in
+// the assignments following onConflict.
+func (db *DB) inserted(col string) string {
+	if db.driver == "sqlite3" {
+		return "excluded." + col
+	}
+
+	return "VALUES(" + col + ")"
+}
+
 func (db *DB) Close() error {
 	return db.q.Close()
 }
 
+// Ping checks that the database can still be reached.
+func (db *DB) Ping(ctx context.Context) error {
+	return db.q.PingContext(ctx)
+}
+
+// Prepare builds the checks of the feed limits. It has to be called again
+// after the limits were changed.
 func (db *DB) Prepare() {
 	q1 := fmt.Sprintf("SELECT COUNT(*) >= %d FROM updates WHERE chatID=?", db.MaxFeedsPerChat)
 	if db.MaxFeedsPerChat == 0 {
 		q1 = "0"
 	}
 
-	q2 := fmt.Sprintf("SELECT COUNT(*) >= %d FROM feeds WHERE userID=?", db.MaxTotalFeedsByUser)
-	if db.MaxTotalFeedsByUser == 0 {
-		q2 = "0"
-	}
+	// The limit of the user is a parameter, as admins may override it.
+	q2 := "SELECT ? > 0 AND COUNT(*) >= ? FROM feeds WHERE userID=?"
+	maxTotalFeeds := db.MaxTotalFeedsByUser
 
 	q3 := fmt.Sprintf("SELECT COUNT(*) >= %d FROM updates WHERE userID=?", db.MaxActiveFeedsByUser)
 	if db.MaxActiveFeedsByUser == 0 {
@@ -70,9 +149,27 @@ func (db *DB) Prepare() {
 
 	fullQuery := fmt.Sprintf("SELECT (%s) + 2*(%s) + 4*(%s)", q1, q2, q3)
 
+	db.checkMu.Lock()
+	defer db.checkMu.Unlock()
+
 	db.checkAddConstraint = func(ctx context.Context, q queryRower, userID, chatID int64) error {
+		limit, err := userFeedLimit(ctx, q, userID, maxTotalFeeds)
+		if err != nil {
+			return err
+		}
+
+		// Limits that are turned off have no parameters.
+		var args []interface{}
+		if q1 != "0" {
+			args = append(args, chatID)
+		}
+		args = append(args, limit, limit, userID)
+		if q3 != "0" {
+			args = append(args, userID)
+		}
+
 		var res uint
-		if err := q.QueryRowContext(ctx, fullQuery, chatID, userID, userID).Scan(&res); err != nil {
+		if err := q.QueryRowContext(ctx, fullQuery, args...).Scan(&res); err != nil {
 			return err
 		}
 
@@ -86,6 +183,44 @@ func (db *DB) Prepare() {
 
 		return nil
 	}
+
+	ownerQuery := fmt.Sprintf("SELECT (%s)", q3)
+
+	db.checkOwnerConstraint = func(ctx context.Context, q queryRower, userID, chatID int64) error {
+		if q3 == "0" {
+			return nil
+		}
+
+		var res uint
+		if err := q.QueryRowContext(ctx, ownerQuery, userID).Scan(&res); err != nil {
+			return err
+		}
+
+		if res != 0 {
+			return ErrMaxActiveFeedsByUser
+		}
+
+		return nil
+	}
+
+	chatQuery := fmt.Sprintf("SELECT (%s)", q1)
+
+	db.checkChatConstraint = func(ctx context.Context, q queryRower, userID, chatID int64) error {
+		if q1 == "0" {
+			return nil
+		}
+
+		var res uint
+		if err := q.QueryRowContext(ctx, chatQuery, chatID).Scan(&res); err != nil {
+			return err
+		}
+
+		if res != 0 {
+			return ErrMaxFeedsInChat
+		}
+
+		return nil
+	}
 }
 
 func (db *DB) AddFeedToChat(ctx context.Context, userID, chatID int64, feed Feed) error {
@@ -94,14 +229,32 @@ func (db *DB) AddFeedToChat(ctx context.Context, userID, chatID int64, feed Feed
 		return err
 	}
 
-	if err := db.checkAddConstraint(ctx, tx, userID, chatID); err != nil {
+	var feedID int64
+	known := tx.QueryRowContext(ctx, "SELECT id FROM feeds WHERE url=?", feed.URL).Scan(&feedID) == nil
+	if known {
+		var subscribed bool
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM updates WHERE chatID=? AND feedID=?", chatID, feedID).Scan(&subscribed); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if subscribed {
+			tx.Rollback()
+			return ErrAlreadySubscribed
+		}
+	}
+
+	db.checkMu.RLock()
+	check := db.checkAddConstraint
+	db.checkMu.RUnlock()
+
+	if err := check(ctx, tx, userID, chatID); err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	var feedID int64
-	if err := tx.QueryRowContext(ctx, "SELECT id FROM feeds WHERE url=?", feed.URL).Scan(&feedID); err != nil {
-		res, err := tx.ExecContext(ctx, "INSERT INTO feeds (url,title,userID) VALUES (?,?,?)", feed.URL, feed.Title, userID)
+	if !known {
+		authUser, authPassword := authColumns(feed.BasicAuth)
+		res, err := tx.ExecContext(ctx, "INSERT INTO feeds (url,scheme,title,userID,authUser,authPassword) VALUES (?,?,?,?,?,?)", feed.URL, feed.Scheme, feed.Title, userID, authUser, authPassword)
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -114,7 +267,7 @@ func (db *DB) AddFeedToChat(ctx context.Context, userID, chatID int64, feed Feed
 		}
 	}
 
-	_, err = tx.ExecContext(ctx, "INSERT INTO updates (chatID, feedID, userID, lastUpdate) VALUES (?, ?, ?, ?)", chatID, feedID, userID, time.Now().Unix())
+	_, err = tx.ExecContext(ctx, "INSERT INTO updates (chatID, feedID, userID, lastUpdate, threadID) VALUES (?, ?, ?, ?, ?)", chatID, feedID, userID, time.Now().Unix(), feed.ThreadID)
 
 	if err != nil {
 		tx.Rollback()
@@ -124,158 +277,1445 @@ func (db *DB) AddFeedToChat(ctx context.Context, userID, chatID int64, feed Feed
 	return tx.Commit()
 }
 
-func (db *DB) FeedsByChat(ctx context.Context, chatID int64) (<-chan Feed, error) {
-	rows, err := db.q.QueryContext(ctx, "SELECT ROW_NUMBER() OVER (),feeds.title,feeds.url FROM updates JOIN feeds on updates.feedID = feeds.id WHERE updates.chatID = ? ORDER BY nr", chatID)
+// FeedsByChat returns the feeds of the chat in the order of their numbers.
+func (db *DB) FeedsByChat(ctx context.Context, chatID int64) ([]Feed, error) {
+	rows, err := db.q.QueryContext(ctx, "SELECT ROW_NUMBER() OVER (ORDER BY nr),"+chatFeedTitle+",feeds.url,feeds.scheme,feeds.publishInterval,updates.note,updates.snoozeUntil,feeds.id FROM updates JOIN feeds on updates.feedID = feeds.id WHERE updates.chatID = ? ORDER BY nr", chatID)
 	if err != nil {
 		return nil, err
 	}
 
-	ch := make(chan Feed)
-	go func() {
-		defer close(ch)
+	defer rows.Close()
 
-		for rows.Next() {
-			var feed Feed
+	var feeds []Feed
+	for rows.Next() {
+		var feed Feed
+		var publishInterval, snoozeUntil int64
 
-			if err := rows.Scan(&feed.ID, &feed.Title, &feed.URL); err != nil {
-				rows.Close()
-				break
-			}
-
-			select {
-			case ch <- feed:
-				// data sent
-			case <-ctx.Done():
-				rows.Close()
-				return
-			}
+		if err := rows.Scan(&feed.ID, &feed.Title, &feed.URL, &feed.Scheme, &publishInterval, &feed.Note, &snoozeUntil, &feed.FeedID); err != nil {
+			return nil, err
 		}
-	}()
 
-	return ch, nil
+		feed.PublishInterval = time.Duration(publishInterval) * time.Second
+		feed.SnoozedUntil = time.Unix(snoozeUntil, 0)
+		feeds = append(feeds, feed)
+	}
+
+	return feeds, rows.Err()
 }
 
-func (db *DB) RemoveFeedFromChat(ctx context.Context, chatID, feedNum int64) error {
-	var feedID int64
+// feedIDByNum returns the ID of the feed with the given number in the chat,
+// counting from 1. It returns sql.ErrNoRows if there is no such feed.
+func (db *DB) feedIDByNum(ctx context.Context, chatID, feedNum int64) (feedID int64, err error) {
+	if feedNum < 1 {
+		return 0, sql.ErrNoRows
+	}
+
 	row := db.q.QueryRowContext(ctx, fmt.Sprintf("SELECT feeds.id FROM updates JOIN feeds on updates.feedID = feeds.id WHERE updates.chatID = ? ORDER BY nr LIMIT %d, 1", feedNum-1), chatID)
-	if err := row.Scan(&feedID); err != nil {
+	err = row.Scan(&feedID)
+	return
+}
+
+func (db *DB) RemoveFeedFromChat(ctx context.Context, chatID, feedNum int64) error {
+	feedID, err := db.feedIDByNum(ctx, chatID, feedNum)
+	if err != nil {
 		return err
 	}
 
-	_, err := db.q.ExecContext(ctx, "DELETE FROM updates WHERE chatID=? AND feedID=?", chatID, feedID)
+	_, err = db.q.ExecContext(ctx, "DELETE FROM updates WHERE chatID=? AND feedID=?", chatID, feedID)
 	return err
 }
 
-type Feed struct {
-	ID    int64
-	Title string
-	URL   string
+// RemoveSub removes the subscription of the chat to the feed with the given
+// ID and reports whether there was one.
+func (db *DB) RemoveSub(ctx context.Context, chatID, feedID int64) (bool, error) {
+	res, err := db.q.ExecContext(ctx, "DELETE FROM updates WHERE chatID=? AND feedID=?", chatID, feedID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
 }
 
-func (db *DB) FeedByURL(ctx context.Context, url string) (f Feed, err error) {
-	f.URL = url
-	err = db.q.QueryRowContext(ctx, "SELECT id,title WHERE url=?", url).Scan(&f.ID, &f.Title)
-	return
+// RemoveFeedsFromChat removes the subscriptions of the chat to all feeds with the given URLs
+// and returns the number of removed subscriptions.
+func (db *DB) RemoveFeedsFromChat(ctx context.Context, chatID int64, urls []string) (int64, error) {
+	if len(urls) == 0 {
+		return 0, nil
+	}
+
+	args := []interface{}{chatID}
+	for _, url := range urls {
+		args = append(args, url)
+	}
+
+	placeholders := strings.Repeat(",?", len(urls))[1:]
+	res, err := db.q.ExecContext(ctx, "DELETE FROM updates WHERE chatID=? AND feedID IN (SELECT id FROM feeds WHERE url IN ("+placeholders+"))", args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
 }
 
-func (db *DB) Feeds(ctx context.Context) (<-chan Feed, error) {
-	rows, err := db.q.QueryContext(ctx, "SELECT id,url FROM feeds")
+// RemoveAllFeedsFromChat removes all subscriptions of the chat and returns
+// their number. Unlike RemoveChat, the settings of the chat are kept.
+func (db *DB) RemoveAllFeedsFromChat(ctx context.Context, chatID int64) (int64, error) {
+	res, err := db.q.ExecContext(ctx, "DELETE FROM updates WHERE chatID=?", chatID)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	ch := make(chan Feed)
-	go func() {
-		defer close(ch)
+	return res.RowsAffected()
+}
 
-		for rows.Next() {
-			var id int64
-			var url string
-			if err := rows.Scan(&id, &url); err != nil {
-				rows.Close()
-				break
-			}
+// RemoveChat removes all subscriptions and settings of a chat, and stops other
+// chats from redirecting their updates to it.
+func (db *DB) RemoveChat(ctx context.Context, chatID int64) error {
+	tx, err := db.q.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
 
-			select {
-			case ch <- Feed{
-				ID:  id,
-				URL: url,
-			}:
-				// data sent
-			case <-ctx.Done():
-				rows.Close()
-				return
-			}
+	for _, query := range []string{
+		"DELETE FROM updates WHERE chatID=?",
+		"DELETE FROM deliveredItems WHERE chatID=?",
+		"DELETE FROM deliveryCounts WHERE chatID=?",
+		"DELETE FROM chats WHERE chatID=?",
+		"UPDATE chats SET redirectChatID=0, redirectUntil=0, redirectOnly=0 WHERE redirectChatID=?",
+	} {
+		if _, err := tx.ExecContext(ctx, query, chatID); err != nil {
+			tx.Rollback()
+			return err
 		}
-	}()
+	}
 
-	return ch, nil
+	return tx.Commit()
 }
 
-type Sub struct {
-	ChatID int64
+// SubOwners returns the users who own the subscriptions of the chat.
+func (db *DB) SubOwners(ctx context.Context, chatID int64) ([]int64, error) {
+	rows, err := db.q.QueryContext(ctx, "SELECT DISTINCT userID FROM updates WHERE chatID=? ORDER BY userID", chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	LastUpdate time.Time
+	var owners []int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		owners = append(owners, userID)
+	}
+
+	return owners, rows.Err()
+}
+
+// Transfer is the outcome of moving the subscriptions of one chat to another.
+// Subscriptions to feeds that the other chat already has, and those beyond
+// its limit, stay with the old chat.
+type Transfer struct {
+	Moved      int
+	Duplicates int
+	OverLimit  int
 }
 
-func (db *DB) Subs(ctx context.Context, feedID int64, latestUpdate *time.Time) (<-chan Sub, error) {
-	rows, err := db.q.QueryContext(ctx, "SELECT chatID, lastUpdate FROM updates WHERE feedID=? AND updates.lastUpdate < ?", feedID, latestUpdate.Unix())
+// TransferChat moves the subscriptions of chat from to chat to, together
+// with their settings, read positions and delivered items. The settings of
+// chat from are taken over unless chat to has its own.
+func (db *DB) TransferChat(ctx context.Context, from, to int64) (t Transfer, err error) {
+	tx, err := db.q.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return t, err
 	}
 
-	ch := make(chan Sub)
-	go func() {
-		defer close(ch)
+	db.checkMu.RLock()
+	check := db.checkChatConstraint
+	db.checkMu.RUnlock()
 
-		for rows.Next() {
-			var chatID, lastUpdate int64
-			if err := rows.Scan(&chatID, &lastUpdate); err != nil {
-				break
-			}
+	rows, err := tx.QueryContext(ctx, "SELECT nr, feedID FROM updates WHERE chatID=? ORDER BY nr", from)
+	if err != nil {
+		tx.Rollback()
+		return t, err
+	}
+
+	type subscription struct{ nr, feedID int64 }
+	var subs []subscription
+	for rows.Next() {
+		var s subscription
+		if err := rows.Scan(&s.nr, &s.feedID); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return t, err
+		}
+		subs = append(subs, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return t, err
+	}
+
+	for _, s := range subs {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM updates WHERE chatID=? AND feedID=?", to, s.feedID).Scan(&exists); err != nil {
+			tx.Rollback()
+			return t, err
+		}
+		if exists {
+			t.Duplicates++
+			continue
+		}
+
+		if err := check(ctx, tx, 0, to); err == ErrMaxFeedsInChat {
+			t.OverLimit++
+			continue
+		} else if err != nil {
+			tx.Rollback()
+			return t, err
+		}
 
-			select {
-			case ch <- Sub{
-				ChatID:     chatID,
-				LastUpdate: time.Unix(lastUpdate, 0),
-			}:
-				// data sent
-			case <-ctx.Done():
-				rows.Close()
-				return
+		// Counts left from an earlier subscription of the target chat
+		// would collide with the ones that move along.
+		if _, err := tx.ExecContext(ctx, "DELETE FROM deliveryCounts WHERE chatID=? AND feedID=(SELECT feedID FROM updates WHERE nr=?)", to, s.nr); err != nil {
+			tx.Rollback()
+			return t, err
+		}
+
+		// The subscription keeps its number, so its filters, mutes and
+		// digest move along. Its topic stays behind with the chat.
+		for _, query := range []string{
+			"UPDATE updates SET chatID=?, threadID=0 WHERE chatID=? AND nr=?",
+			"UPDATE deliveredItems SET chatID=? WHERE chatID=? AND feedID=(SELECT feedID FROM updates WHERE nr=?)",
+			"UPDATE deliveryCounts SET chatID=? WHERE chatID=? AND feedID=(SELECT feedID FROM updates WHERE nr=?)",
+		} {
+			if _, err := tx.ExecContext(ctx, query, to, from, s.nr); err != nil {
+				tx.Rollback()
+				return t, err
 			}
 		}
-	}()
+		t.Moved++
+	}
+
+	var hasSettings bool
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM chats WHERE chatID=?", to).Scan(&hasSettings); err != nil {
+		tx.Rollback()
+		return t, err
+	}
+	if !hasSettings {
+		_, err := tx.ExecContext(ctx, "INSERT INTO chats (chatID, dedupLinks, skipRepublished, updateInterval, digestDescriptionLength, timezone) "+
+			"SELECT ?, dedupLinks, skipRepublished, updateInterval, digestDescriptionLength, timezone FROM chats WHERE chatID=?", to, from)
+		if err != nil {
+			tx.Rollback()
+			return t, err
+		}
+	}
 
-	return ch, nil
+	return t, tx.Commit()
 }
 
-func (db *DB) UpdateSub(ctx context.Context, chatID, feedID int64, t time.Time) error {
-	_, err := db.q.ExecContext(ctx, "UPDATE updates SET lastUpdate=? WHERE chatID=? AND feedID=?", t.Unix(), chatID, feedID)
+// ChangeSubOwner makes userID the owner of the chat's subscription to a feed,
+// which then counts against userID's limits instead.
+func (db *DB) ChangeSubOwner(ctx context.Context, chatID, feedNum, userID int64) error {
+	feedID, err := db.feedIDByNum(ctx, chatID, feedNum)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.q.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	db.checkMu.RLock()
+	check := db.checkOwnerConstraint
+	db.checkMu.RUnlock()
+
+	if err := check(ctx, tx, userID, chatID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE updates SET userID=? WHERE chatID=? AND feedID=?", userID, chatID, feedID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) SetFormat(ctx context.Context, chatID, feedNum int64, format string) error {
+	feedID, err := db.feedIDByNum(ctx, chatID, feedNum)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.q.ExecContext(ctx, "UPDATE updates SET format=? WHERE chatID=? AND feedID=?", format, chatID, feedID)
 	return err
 }
 
-func (db *DB) AddFeedError(ctx context.Context, feedID int64) error {
-	_, err := db.q.ExecContext(ctx, "INSERT INTO feedErrors (feedID, timestamp) VALUES (?,?)", feedID, time.Now().Unix())
+// RenameSub sets the title under which the feed is shown in the chat. An
+// empty title shows the feed under its own title again.
+func (db *DB) RenameSub(ctx context.Context, chatID, feedNum int64, title string) error {
+	feedID, err := db.feedIDByNum(ctx, chatID, feedNum)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.q.ExecContext(ctx, "UPDATE updates SET displayTitle=? WHERE chatID=? AND feedID=?", title, chatID, feedID)
 	return err
 }
 
-func (db *DB) RecentFeedErrors(ctx context.Context, since time.Time, feedID int64) (n int, err error) {
-	err = db.q.QueryRowContext(ctx, "SELECT COUNT(*) FROM feedErrors WHERE feedID=? AND timestamp >= ?", feedID, since.Unix()).Scan(&n)
-	return
+func (db *DB) SetNote(ctx context.Context, chatID, feedNum int64, note string) error {
+	feedID, err := db.feedIDByNum(ctx, chatID, feedNum)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.q.ExecContext(ctx, "UPDATE updates SET note=? WHERE chatID=? AND feedID=?", note, chatID, feedID)
+	return err
 }
 
-func (db *DB) DropFeed(ctx context.Context, id int64) error {
-	_, err := db.q.ExecContext(ctx, "DELETE FROM feeds WHERE id=?", id)
+// AddFilter adds a keyword to the filters of the chat's subscription to a feed.
+func (db *DB) AddFilter(ctx context.Context, chatID, feedNum int64, keyword string) error {
+	return db.addKeyword(ctx, "filters", chatID, feedNum, keyword)
+}
+
+// ClearFilters removes all filters of the chat's subscription to a feed.
+func (db *DB) ClearFilters(ctx context.Context, chatID, feedNum int64) error {
+	feedID, err := db.feedIDByNum(ctx, chatID, feedNum)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.q.ExecContext(ctx, "DELETE FROM filters WHERE updateNr IN (SELECT nr FROM updates WHERE chatID=? AND feedID=?)", chatID, feedID)
 	return err
 }
 
-func (db *DB) LogRequest(ctx context.Context, name, text string, userID int64) error {
-	_, err := db.q.ExecContext(ctx, "INSERT INTO requests (userID, timestamp, name, text) VALUES (?,?,?,?)", userID, time.Now().Unix(), name, text)
+// Filters returns the filter keywords of the chat's subscription to a feed.
+func (db *DB) Filters(ctx context.Context, chatID, feedID int64) ([]string, error) {
+	return db.keywords(ctx, "filters", chatID, feedID)
+}
+
+// ChatFilters returns the filter keywords of all subscriptions of the chat by
+// the URL of the feed.
+func (db *DB) ChatFilters(ctx context.Context, chatID int64) (map[string][]string, error) {
+	return db.chatKeywords(ctx, "filters", chatID)
+}
+
+// AddMute adds a keyword to the muted keywords of the chat's subscription to a feed.
+func (db *DB) AddMute(ctx context.Context, chatID, feedNum int64, keyword string) error {
+	return db.addKeyword(ctx, "mutes", chatID, feedNum, keyword)
+}
+
+// RemoveMute removes a muted keyword of the chat's subscription to a feed and
+// returns whether it was muted.
+func (db *DB) RemoveMute(ctx context.Context, chatID, feedNum int64, keyword string) (bool, error) {
+	feedID, err := db.feedIDByNum(ctx, chatID, feedNum)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := db.q.ExecContext(ctx, "DELETE FROM mutes WHERE keyword=? AND updateNr IN (SELECT nr FROM updates WHERE chatID=? AND feedID=?)", keyword, chatID, feedID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Mutes returns the muted keywords of the chat's subscription to a feed.
+func (db *DB) Mutes(ctx context.Context, chatID, feedID int64) ([]string, error) {
+	return db.keywords(ctx, "mutes", chatID, feedID)
+}
+
+// ChatMutes returns the muted keywords of all subscriptions of the chat by the
+// URL of the feed.
+func (db *DB) ChatMutes(ctx context.Context, chatID int64) (map[string][]string, error) {
+	return db.chatKeywords(ctx, "mutes", chatID)
+}
+
+// addKeyword, keywords and chatKeywords work on the keyword tables (filters
+// and mutes), which are keyed by the subscription.
+func (db *DB) addKeyword(ctx context.Context, table string, chatID, feedNum int64, keyword string) error {
+	feedID, err := db.feedIDByNum(ctx, chatID, feedNum)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.q.ExecContext(ctx, "INSERT INTO "+table+" (updateNr, keyword) SELECT nr, ? FROM updates WHERE chatID=? AND feedID=?", keyword, chatID, feedID)
 	return err
 }
 
-func (db *DB) RecentRequests(ctx context.Context, since time.Time, userID int64) (n int, err error) {
-	err = db.q.QueryRowContext(ctx, "SELECT COUNT(*) FROM requests WHERE userID=? AND timestamp >= ?", userID, since.Unix()).Scan(&n)
-	return
+func (db *DB) keywords(ctx context.Context, table string, chatID, feedID int64) ([]string, error) {
+	rows, err := db.q.QueryContext(ctx, "SELECT k.keyword FROM "+table+" k JOIN updates ON k.updateNr = updates.nr WHERE updates.chatID=? AND updates.feedID=? ORDER BY k.nr", chatID, feedID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keywords []string
+	for rows.Next() {
+		var keyword string
+		if err := rows.Scan(&keyword); err != nil {
+			return nil, err
+		}
+
+		keywords = append(keywords, keyword)
+	}
+
+	return keywords, rows.Err()
+}
+
+func (db *DB) chatKeywords(ctx context.Context, table string, chatID int64) (map[string][]string, error) {
+	rows, err := db.q.QueryContext(ctx, "SELECT feeds.url, k.keyword FROM "+table+" k JOIN updates ON k.updateNr = updates.nr JOIN feeds ON updates.feedID = feeds.id WHERE updates.chatID=? ORDER BY k.nr", chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keywords := make(map[string][]string)
+	for rows.Next() {
+		var url, keyword string
+		if err := rows.Scan(&url, &keyword); err != nil {
+			return nil, err
+		}
+
+		keywords[url] = append(keywords[url], keyword)
+	}
+
+	return keywords, rows.Err()
+}
+
+func (db *DB) SetIgnoreTitleChanges(ctx context.Context, chatID, feedNum int64, ignore bool) error {
+	feedID, err := db.feedIDByNum(ctx, chatID, feedNum)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.q.ExecContext(ctx, "UPDATE updates SET ignoreTitleChanges=? WHERE chatID=? AND feedID=?", ignore, chatID, feedID)
+	return err
+}
+
+// SetSnooze keeps new items of the feed from being sent to the chat until
+// the given time. If queue is set, they are sent once the snooze ends,
+// otherwise they are skipped. A zero time ends the snooze.
+func (db *DB) SetSnooze(ctx context.Context, chatID, feedNum int64, until time.Time, queue bool) error {
+	feedID, err := db.feedIDByNum(ctx, chatID, feedNum)
+	if err != nil {
+		return err
+	}
+
+	var untilUnix int64
+	if !until.IsZero() {
+		untilUnix = until.Unix()
+	}
+
+	_, err = db.q.ExecContext(ctx, "UPDATE updates SET snoozeUntil=?, snoozeQueue=? WHERE chatID=? AND feedID=?", untilUnix, queue, chatID, feedID)
+	return err
+}
+
+// BackfillSub moves the read position of the chat's subscription to the feed
+// back to since and makes the feed due, so that the next update sends the
+// items published after it. The validators of the feed are dropped, as the
+// feed must be loaded even if it did not change.
+func (db *DB) BackfillSub(ctx context.Context, chatID, feedID int64, since time.Time) error {
+	tx, err := db.q.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE updates SET lastUpdate=? WHERE chatID=? AND feedID=?", since.Unix(), chatID, feedID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE feeds SET nextFetch=0, etag='', lastModified='' WHERE id=?", feedID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MarkSubRead moves the read position of the chat's subscription to the
+// feed with the given number to now, so that only items published later
+// are sent. A read position that is already later is kept.
+func (db *DB) MarkSubRead(ctx context.Context, chatID, feedNum int64, now time.Time) error {
+	feedID, err := db.feedIDByNum(ctx, chatID, feedNum)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.q.ExecContext(ctx, "UPDATE updates SET lastUpdate=? WHERE chatID=? AND feedID=? AND lastUpdate < ?", now.Unix(), chatID, feedID, now.Unix())
+	return err
+}
+
+// MarkChatRead is like MarkSubRead for all subscriptions of the chat. It
+// returns the number of subscriptions whose read position moved.
+func (db *DB) MarkChatRead(ctx context.Context, chatID int64, now time.Time) (int64, error) {
+	res, err := db.q.ExecContext(ctx, "UPDATE updates SET lastUpdate=? WHERE chatID=? AND lastUpdate < ?", now.Unix(), chatID, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// SetDigest puts the chat's subscription to a feed into digest mode, with
+// digests sent at the given time after midnight, or back into instant mode
+// if at is negative. Only items that arrive from now on are in the next digest.
+func (db *DB) SetDigest(ctx context.Context, chatID, feedNum int64, at time.Duration, now time.Time) error {
+	feedID, err := db.feedIDByNum(ctx, chatID, feedNum)
+	if err != nil {
+		return err
+	}
+
+	minutes := int64(-1)
+	if at >= 0 {
+		minutes = int64(at / time.Minute)
+	}
+
+	_, err = db.q.ExecContext(ctx, "UPDATE updates SET digestAt=?, digestSent=? WHERE chatID=? AND feedID=?", minutes, now.Unix(), chatID, feedID)
+	return err
+}
+
+func (db *DB) SetDedupLinks(ctx context.Context, chatID int64, dedup bool) error {
+	_, err := db.q.ExecContext(ctx, "INSERT INTO chats (chatID, dedupLinks) VALUES (?,?) "+db.onConflict("chatID")+" dedupLinks="+db.inserted("dedupLinks"), chatID, dedup)
+	return err
+}
+
+func (db *DB) SetSkipRepublished(ctx context.Context, chatID int64, skip bool) error {
+	_, err := db.q.ExecContext(ctx, "INSERT INTO chats (chatID, skipRepublished) VALUES (?,?) "+db.onConflict("chatID")+" skipRepublished="+db.inserted("skipRepublished"), chatID, skip)
+	return err
+}
+
+func (db *DB) SetChatInterval(ctx context.Context, chatID int64, interval time.Duration) error {
+	_, err := db.q.ExecContext(ctx, "INSERT INTO chats (chatID, updateInterval) VALUES (?,?) "+db.onConflict("chatID")+" updateInterval="+db.inserted("updateInterval"), chatID, int64(interval/time.Minute))
+	return err
+}
+
+func (db *DB) SetDigestDescriptionLength(ctx context.Context, chatID int64, length int) error {
+	_, err := db.q.ExecContext(ctx, "INSERT INTO chats (chatID, digestDescriptionLength) VALUES (?,?) "+db.onConflict("chatID")+" digestDescriptionLength="+db.inserted("digestDescriptionLength"), chatID, length)
+	return err
+}
+
+// SetChatTimezone stores the IANA name of the chat's time zone.
+func (db *DB) SetChatTimezone(ctx context.Context, chatID int64, timezone string) error {
+	_, err := db.q.ExecContext(ctx, "INSERT INTO chats (chatID, timezone) VALUES (?,?) "+db.onConflict("chatID")+" timezone="+db.inserted("timezone"), chatID, timezone)
+	return err
+}
+
+// ChatLocation returns the time zone of the chat, which is UTC unless the
+// chat chose another one.
+func (db *DB) ChatLocation(ctx context.Context, chatID int64) (*time.Location, error) {
+	var timezone string
+	err := db.q.QueryRowContext(ctx, "SELECT timezone FROM chats WHERE chatID=?", chatID).Scan(&timezone)
+	if err == sql.ErrNoRows {
+		return time.UTC, nil
+	}
+	if err != nil {
+		return time.UTC, err
+	}
+
+	return chatLocation(timezone), nil
+}
+
+func (db *DB) ChatInterval(ctx context.Context, chatID int64) (time.Duration, error) {
+	var minutes int64
+	err := db.q.QueryRowContext(ctx, "SELECT updateInterval FROM chats WHERE chatID=?", chatID).Scan(&minutes)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return time.Duration(minutes) * time.Minute, err
+}
+
+func (db *DB) SetRedirect(ctx context.Context, chatID int64, r Redirect) error {
+	_, err := db.q.ExecContext(ctx, "INSERT INTO chats (chatID, redirectChatID, redirectUntil, redirectOnly) VALUES (?,?,?,?) "+db.onConflict("chatID")+" redirectChatID="+db.inserted("redirectChatID")+", redirectUntil="+db.inserted("redirectUntil")+", redirectOnly="+db.inserted("redirectOnly"), chatID, r.ChatID, r.Until.Unix(), r.Only)
+	return err
+}
+
+type Feed struct {
+	ID    int64
+	Title string
+
+	// URL is stored without scheme, so that the same feed is found regardless
+	// of how it is fetched.
+	URL    string
+	Scheme string
+
+	// PublishInterval is the estimated time between new items of the feed.
+	PublishInterval time.Duration
+
+	// AdvertisedInterval is how often the feed says it changes, or 0 if it
+	// does not say; it is only set by ActiveFeeds.
+	AdvertisedInterval time.Duration
+
+	// UserID is the user who added the feed first, Shape is its last
+	// observed structure and Cache holds the validators of the last
+	// response; they are only set by ActiveFeeds.
+	UserID int64
+	Shape  FeedShape
+	Cache  HTTPCache
+
+	// Note is the note of the chat's subscription and FeedID is the ID of
+	// the feed in the database, as ID is its number in the chat; both are
+	// only set by chat specific queries.
+	Note   string
+	FeedID int64
+
+	// SnoozedUntil is when the snooze of the chat's subscription ends; it
+	// is only set by FeedsByChat.
+	SnoozedUntil time.Time
+
+	// ThreadID is the forum topic of the chat that AddFeedToChat sends the
+	// items of the feed to, zero for the general one.
+	ThreadID int
+
+	// BasicAuth holds the credentials of feeds that require HTTP Basic
+	// authentication, nil for all others. They are kept apart from URL,
+	// so that they are never shown.
+	BasicAuth *url.Userinfo
+}
+
+// FullURL returns the URL the feed is fetched from, without credentials.
+func (f *Feed) FullURL() string {
+	return f.Scheme + ":" + f.URL
+}
+
+// fetchURL returns FullURL with the credentials of the feed, if any.
+func (f *Feed) fetchURL() string {
+	if f.BasicAuth == nil {
+		return f.FullURL()
+	}
+
+	u, err := url.Parse(f.FullURL())
+	if err != nil {
+		return f.FullURL()
+	}
+
+	u.User = f.BasicAuth
+	return u.String()
+}
+
+// basicAuth returns the credentials stored in the authUser and authPassword
+// columns of a feed.
+func basicAuth(user, password string) *url.Userinfo {
+	if user == "" && password == "" {
+		return nil
+	}
+
+	return url.UserPassword(user, password)
+}
+
+// authColumns returns the values of the authUser and authPassword columns
+// for the given credentials.
+func authColumns(auth *url.Userinfo) (user, password string) {
+	if auth == nil {
+		return "", ""
+	}
+
+	password, _ = auth.Password()
+	return auth.Username(), password
+}
+
+// FeedOfChat returns the feed with the given number in the chat and the chat's subscription to it.
+func (db *DB) FeedOfChat(ctx context.Context, chatID, feedNum int64) (f Feed, sub Sub, err error) {
+	if feedNum < 1 {
+		err = sql.ErrNoRows
+		return
+	}
+
+	var authUser, authPassword string
+	row := db.q.QueryRowContext(ctx, fmt.Sprintf("SELECT "+subColumns+", "+chatFeedTitle+", feeds.url, feeds.scheme, updates.note, feeds.authUser, feeds.authPassword FROM "+subTables+" JOIN feeds on updates.feedID = feeds.id WHERE updates.chatID = ? ORDER BY nr LIMIT %d, 1", feedNum-1), chatID)
+	if sub, err = scanSub(row.Scan, &f.Title, &f.URL, &f.Scheme, &f.Note, &authUser, &authPassword); err != nil {
+		return
+	}
+
+	f.BasicAuth = basicAuth(authUser, authPassword)
+
+	f.ID = feedNum
+	f.FeedID = sub.FeedID
+	return
+}
+
+func (db *DB) FeedByURL(ctx context.Context, url string) (f Feed, err error) {
+	var authUser, authPassword string
+	f.URL = url
+	err = db.q.QueryRowContext(ctx, "SELECT id,title,scheme,authUser,authPassword FROM feeds WHERE url=?", url).Scan(&f.ID, &f.Title, &f.Scheme, &authUser, &authPassword)
+	f.BasicAuth = basicAuth(authUser, authPassword)
+	return
+}
+
+// FeedByID returns the feed with the given ID. It returns sql.ErrNoRows if
+// there is no such feed.
+func (db *DB) FeedByID(ctx context.Context, id int64) (f Feed, err error) {
+	var authUser, authPassword string
+	f.ID = id
+	err = db.q.QueryRowContext(ctx, "SELECT title,url,scheme,authUser,authPassword FROM feeds WHERE id=?", id).Scan(&f.Title, &f.URL, &f.Scheme, &authUser, &authPassword)
+	f.BasicAuth = basicAuth(authUser, authPassword)
+	return
+}
+
+// SetFeedCache stores the validators of the last response for a feed.
+func (db *DB) SetFeedCache(ctx context.Context, feedID int64, cache HTTPCache) error {
+	_, err := db.q.ExecContext(ctx, "UPDATE feeds SET etag=?, lastModified=? WHERE id=?", cache.ETag, cache.LastModified, feedID)
+	return err
+}
+
+// SetFeedSchedule stores the estimated publish interval of a feed, the
+// interval it advertises and when it should be fetched next.
+func (db *DB) SetFeedSchedule(ctx context.Context, feedID int64, publishInterval, advertised time.Duration, nextFetch time.Time) error {
+	next := int64(0)
+	if !nextFetch.IsZero() {
+		next = nextFetch.Unix()
+	}
+
+	_, err := db.q.ExecContext(ctx, "UPDATE feeds SET publishInterval=?, advertisedInterval=?, nextFetch=? WHERE id=?", int64(publishInterval/time.Second), int64(advertised/time.Second), next, feedID)
+	return err
+}
+
+func (db *DB) SetFeedShape(ctx context.Context, feedID int64, shape FeedShape) error {
+	_, err := db.q.ExecContext(ctx, "UPDATE feeds SET feedType=?, hasDescriptions=? WHERE id=?", shape.Type, shape.Descriptions, feedID)
+	return err
+}
+
+// ActiveFeeds returns the feeds that at least one chat subscribes to and
+// that are due to be fetched.
+func (db *DB) ActiveFeeds(ctx context.Context) ([]Feed, error) {
+	rows, err := db.q.QueryContext(ctx, "SELECT id,url,scheme,title,feeds.userID,publishInterval,advertisedInterval,feedType,hasDescriptions,etag,lastModified,authUser,authPassword FROM feeds "+
+		"JOIN (SELECT DISTINCT feedID FROM updates) subscribed ON subscribed.feedID = feeds.id WHERE nextFetch <= ?", time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var feeds []Feed
+	for rows.Next() {
+		var feed Feed
+		var publishInterval, advertised int64
+		var authUser, authPassword string
+		if err := rows.Scan(&feed.ID, &feed.URL, &feed.Scheme, &feed.Title, &feed.UserID, &publishInterval, &advertised, &feed.Shape.Type, &feed.Shape.Descriptions, &feed.Cache.ETag, &feed.Cache.LastModified, &authUser, &authPassword); err != nil {
+			return nil, err
+		}
+
+		feed.PublishInterval = time.Duration(publishInterval) * time.Second
+		feed.AdvertisedInterval = time.Duration(advertised) * time.Second
+		feed.BasicAuth = basicAuth(authUser, authPassword)
+		feeds = append(feeds, feed)
+	}
+
+	return feeds, rows.Err()
+}
+
+type Sub struct {
+	ChatID int64
+	FeedID int64
+
+	// UserID is the owner of the subscription.
+	UserID int64
+
+	LastUpdate time.Time
+
+	// LastSent is when items were last sent to the chat.
+	LastSent time.Time
+
+	IgnoreTitleChanges bool
+
+	// Format is the format in which items are sent, see itemFormats.
+	Format string
+
+	// DisplayTitle replaces the title of the feed in the chat if it is set.
+	DisplayTitle string
+
+	// In digest mode, new items are collected and sent once a day at
+	// DigestAt after midnight in the chat's time zone. DigestAt is
+	// negative otherwise.
+	// DigestSent is when the last digest was sent.
+	DigestAt   time.Duration
+	DigestSent time.Time
+
+	// No items are sent while the subscription is snoozed until
+	// SnoozedUntil. They are kept for later if SnoozeQueue is set and
+	// skipped otherwise.
+	SnoozedUntil time.Time
+	SnoozeQueue  bool
+
+	// ThreadID is the forum topic of the chat that items are sent to, zero
+	// for the general one. Redirected items go to the general topic of the
+	// other chat.
+	ThreadID int
+
+	// DedupLinks is a setting of the chat. If set, items whose link was
+	// already delivered to the chat by a feed listed before are skipped.
+	DedupLinks bool
+
+	// SkipRepublished is a setting of the chat. If set, items that the feed
+	// already delivered with the same content are skipped, even if they were
+	// published again with a newer date.
+	SkipRepublished bool
+
+	// Redirect is a setting of the chat.
+	Redirect Redirect
+
+	// Interval is a setting of the chat. Items are sent at most this often.
+	Interval time.Duration
+
+	// DigestDescriptionLength is a setting of the chat. Digests show at
+	// most this many characters of each description; zero means the default.
+	DigestDescriptionLength int
+
+	// Location is the time zone of the chat, see DB.ChatLocation.
+	Location *time.Location
+
+	// Filters are keywords of which items must contain at least one to be
+	// sent. Items containing one of the Mutes are never sent. Neither is
+	// loaded by Subs, see DB.Filters and DB.Mutes.
+	Filters []string
+	Mutes   []string
+}
+
+// Redirect sends the updates of a chat to another chat until it expires.
+type Redirect struct {
+	ChatID int64
+	Until  time.Time
+
+	// Only suppresses delivery to the original chat while the redirect is active.
+	Only bool
+}
+
+func (r Redirect) Active(now time.Time) bool {
+	return r.ChatID != 0 && now.Before(r.Until)
+}
+
+// Snoozed reports whether sub is snoozed at now.
+func (sub *Sub) Snoozed(now time.Time) bool {
+	return now.Before(sub.SnoozedUntil)
+}
+
+// IntervalPassed reports whether enough time has passed since items were
+// last sent for sub to receive new ones, allowing them to have been sent up
+// to slack later than planned.
+func (sub *Sub) IntervalPassed(now time.Time, slack time.Duration) bool {
+	return sub.Interval <= 0 || now.Sub(sub.LastSent) >= sub.Interval-slack
+}
+
+// Recipients returns the chats that should receive the updates for sub.
+func (sub *Sub) Recipients(now time.Time) []int64 {
+	if !sub.Redirect.Active(now) {
+		return []int64{sub.ChatID}
+	}
+
+	if sub.Redirect.Only {
+		return []int64{sub.Redirect.ChatID}
+	}
+
+	return []int64{sub.ChatID, sub.Redirect.ChatID}
+}
+
+// ThreadOf returns the forum topic that the updates for sub are sent to in
+// chatID, one of its recipients.
+func (sub *Sub) ThreadOf(chatID int64) int {
+	if chatID != sub.ChatID {
+		return 0
+	}
+
+	return sub.ThreadID
+}
+
+// chatFeedTitle selects the title under which a feed is shown in a chat from
+// updates joined with feeds.
+const chatFeedTitle = "COALESCE(NULLIF(updates.displayTitle, ''), feeds.title)"
+
+// subColumns are the columns that scanSub expects, selected from subTables.
+const subColumns = "updates.chatID, updates.feedID, updates.userID, updates.lastUpdate, updates.lastSent, updates.ignoreTitleChanges, updates.format, updates.displayTitle, updates.digestAt, updates.digestSent, updates.snoozeUntil, updates.snoozeQueue, updates.threadID, " +
+	"COALESCE(chats.dedupLinks, 0), COALESCE(chats.skipRepublished, 0), COALESCE(chats.redirectChatID, 0), COALESCE(chats.redirectUntil, 0), COALESCE(chats.redirectOnly, 0), COALESCE(chats.updateInterval, 0), COALESCE(chats.digestDescriptionLength, 0), COALESCE(chats.timezone, '')"
+const subTables = "updates LEFT JOIN chats ON chats.chatID = updates.chatID"
+
+// scanSub scans subColumns followed by the extra destinations.
+func scanSub(scan func(dest ...interface{}) error, extra ...interface{}) (sub Sub, err error) {
+	var lastUpdate, lastSent, digestAt, digestSent, snoozeUntil, redirectUntil, interval int64
+	var timezone string
+	dest := []interface{}{&sub.ChatID, &sub.FeedID, &sub.UserID, &lastUpdate, &lastSent, &sub.IgnoreTitleChanges, &sub.Format,
+		&sub.DisplayTitle, &digestAt, &digestSent, &snoozeUntil, &sub.SnoozeQueue, &sub.ThreadID, &sub.DedupLinks, &sub.SkipRepublished, &sub.Redirect.ChatID, &redirectUntil, &sub.Redirect.Only, &interval, &sub.DigestDescriptionLength, &timezone}
+
+	if err = scan(append(dest, extra...)...); err != nil {
+		return
+	}
+
+	sub.LastUpdate = time.Unix(lastUpdate, 0)
+	sub.LastSent = time.Unix(lastSent, 0)
+	sub.DigestAt = time.Duration(digestAt) * time.Minute
+	sub.DigestSent = time.Unix(digestSent, 0)
+	sub.SnoozedUntil = time.Unix(snoozeUntil, 0)
+	sub.Redirect.Until = time.Unix(redirectUntil, 0)
+	sub.Interval = time.Duration(interval) * time.Minute
+	sub.Location = chatLocation(timezone)
+	return
+}
+
+// Subs returns the subscriptions of the feed that did not get the items up
+// to latestUpdate yet.
+func (db *DB) Subs(ctx context.Context, feedID int64, latestUpdate *time.Time) ([]Sub, error) {
+	rows, err := db.q.QueryContext(ctx, "SELECT "+subColumns+" FROM "+subTables+" WHERE updates.feedID=? AND updates.lastUpdate < ?", feedID, latestUpdate.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var subs []Sub
+	for rows.Next() {
+		sub, err := scanSub(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+
+		subs = append(subs, sub)
+	}
+
+	return subs, rows.Err()
+}
+
+func (db *DB) SetLastSent(ctx context.Context, chatID, feedID int64, t time.Time) error {
+	_, err := db.q.ExecContext(ctx, "UPDATE updates SET lastSent=? WHERE chatID=? AND feedID=?", t.Unix(), chatID, feedID)
+	return err
+}
+
+// DigestItem is an item that waits to be sent with the next digest of a
+// subscription. Nr orders the items of a digest.
+type DigestItem struct {
+	Nr          int64
+	Title       string
+	Link        string
+	Description string
+	Published   time.Time
+}
+
+const insertDigestItem = "INSERT INTO digestItems (updateNr, title, link, description, published) SELECT nr, ?, ?, ?, ? FROM updates WHERE chatID=? AND feedID=?"
+
+// AddDigestItem keeps an item for the next digest of the chat's subscription to a feed.
+func (db *DB) AddDigestItem(ctx context.Context, chatID, feedID int64, item DigestItem) error {
+	_, err := db.q.ExecContext(ctx, insertDigestItem, item.Title, item.Link, item.Description, item.Published.Unix(), chatID, feedID)
+	return err
+}
+
+// PendingDigest is a subscription that has items for its next digest, with
+// the title of the feed in the chat.
+type PendingDigest struct {
+	Sub
+	Title string
+}
+
+// PendingDigests returns the subscriptions that have items for their next
+// digest, including those that left digest mode since the items were kept.
+func (db *DB) PendingDigests(ctx context.Context) ([]PendingDigest, error) {
+	rows, err := db.q.QueryContext(ctx, "SELECT "+subColumns+", "+chatFeedTitle+" FROM "+subTables+" JOIN feeds ON updates.feedID = feeds.id "+
+		"WHERE EXISTS (SELECT 1 FROM digestItems WHERE digestItems.updateNr = updates.nr) ORDER BY updates.nr")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var digests []PendingDigest
+	for rows.Next() {
+		var digest PendingDigest
+		if digest.Sub, err = scanSub(rows.Scan, &digest.Title); err != nil {
+			return nil, err
+		}
+
+		digests = append(digests, digest)
+	}
+
+	return digests, rows.Err()
+}
+
+// DigestItems returns the items for the next digest of the chat's
+// subscription to a feed in the order in which they were added.
+func (db *DB) DigestItems(ctx context.Context, chatID, feedID int64) ([]DigestItem, error) {
+	rows, err := db.q.QueryContext(ctx, "SELECT d.nr, d.title, d.link, d.description, d.published FROM digestItems d JOIN updates ON d.updateNr = updates.nr "+
+		"WHERE updates.chatID=? AND updates.feedID=? ORDER BY d.nr", chatID, feedID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []DigestItem
+	for rows.Next() {
+		var item DigestItem
+		var published int64
+		if err := rows.Scan(&item.Nr, &item.Title, &item.Link, &item.Description, &published); err != nil {
+			return nil, err
+		}
+
+		item.Published = time.Unix(published, 0)
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// ClearDigest removes the items up to lastNr from the digest of the chat's
+// subscription to a feed after they were sent at the given time.
+func (db *DB) ClearDigest(ctx context.Context, chatID, feedID, lastNr int64, sent time.Time) error {
+	_, err := db.q.ExecContext(ctx, "DELETE FROM digestItems WHERE nr <= ? AND updateNr IN (SELECT nr FROM updates WHERE chatID=? AND feedID=?)", lastNr, chatID, feedID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.q.ExecContext(ctx, "UPDATE updates SET digestSent=? WHERE chatID=? AND feedID=?", sent.Unix(), chatID, feedID)
+	return err
+}
+
+// Subscriber is a chat that is subscribed to a feed, with the title of the
+// feed in that chat.
+type Subscriber struct {
+	ChatID int64
+	Title  string
+}
+
+// SubscribedChats returns all chats that are subscribed to the feed.
+func (db *DB) SubscribedChats(ctx context.Context, feedID int64) ([]Subscriber, error) {
+	rows, err := db.q.QueryContext(ctx, "SELECT updates.chatID, "+chatFeedTitle+" FROM updates JOIN feeds ON updates.feedID = feeds.id WHERE updates.feedID=?", feedID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscribers []Subscriber
+	for rows.Next() {
+		var s Subscriber
+		if err := rows.Scan(&s.ChatID, &s.Title); err != nil {
+			return nil, err
+		}
+
+		subscribers = append(subscribers, s)
+	}
+
+	return subscribers, rows.Err()
+}
+
+// FeedSubscriber is a chat that is subscribed to a feed, as shown by
+// /admin feed.
+type FeedSubscriber struct {
+	ChatID     int64
+	LastUpdate time.Time
+}
+
+// SubscribersOfFeed returns the chats that are subscribed to the feed with
+// the time up to which they received its items, in the order they subscribed.
+func (db *DB) SubscribersOfFeed(ctx context.Context, feedID int64) ([]FeedSubscriber, error) {
+	rows, err := db.q.QueryContext(ctx, "SELECT chatID, lastUpdate FROM updates WHERE feedID=? ORDER BY nr", feedID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscribers []FeedSubscriber
+	for rows.Next() {
+		var s FeedSubscriber
+		var lastUpdate int64
+		if err := rows.Scan(&s.ChatID, &lastUpdate); err != nil {
+			return nil, err
+		}
+
+		s.LastUpdate = time.Unix(lastUpdate, 0)
+		subscribers = append(subscribers, s)
+	}
+
+	return subscribers, rows.Err()
+}
+
+func (db *DB) UpdateSub(ctx context.Context, chatID, feedID int64, t time.Time) error {
+	_, err := db.q.ExecContext(ctx, "UPDATE updates SET lastUpdate=? WHERE chatID=? AND feedID=?", t.Unix(), chatID, feedID)
+	return err
+}
+
+// DeliveredItemHash returns the hash stored when the item identified by key was
+// last delivered to the chat. It returns sql.ErrNoRows if it was never delivered.
+func (db *DB) DeliveredItemHash(ctx context.Context, chatID, feedID int64, key string) (hash string, err error) {
+	err = db.q.QueryRowContext(ctx, "SELECT hash FROM deliveredItems WHERE chatID=? AND feedID=? AND itemKey=? ORDER BY timestamp DESC LIMIT 1", chatID, feedID, key).Scan(&hash)
+	return
+}
+
+type DeliveredItem struct {
+	Key         string
+	Hash        string
+	ContentHash string
+	LinkHash    string
+	Published   time.Time
+}
+
+const insertDeliveredItem = "INSERT INTO deliveredItems (chatID, feedID, itemKey, hash, contentHash, linkHash, published, timestamp) VALUES (?,?,?,?,?,?,?,?)"
+
+func (db *DB) AddDeliveredItem(ctx context.Context, chatID, feedID int64, item DeliveredItem) error {
+	_, err := db.q.ExecContext(ctx, insertDeliveredItem, chatID, feedID, item.Key, item.Hash, item.ContentHash, item.LinkHash, item.Published.Unix(), time.Now().Unix())
+	return err
+}
+
+// SubProgress is what an update handled for a subscription: the items that
+// were delivered, the items that were kept for the next digest and the time
+// up to which the chat has received the feed.
+type SubProgress struct {
+	Until       time.Time
+	Delivered   []DeliveredItem
+	DigestItems []DigestItem
+}
+
+// AdvanceSub stores the progress of the chat's subscription to a feed in one
+// transaction, so that it is either stored completely or not at all.
+func (db *DB) AdvanceSub(ctx context.Context, chatID, feedID int64, p SubProgress) error {
+	tx, err := db.q.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range p.DigestItems {
+		if _, err := tx.ExecContext(ctx, insertDigestItem, item.Title, item.Link, item.Description, item.Published.Unix(), chatID, feedID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	now := time.Now().Unix()
+	for _, item := range p.Delivered {
+		if _, err := tx.ExecContext(ctx, insertDeliveredItem, chatID, feedID, item.Key, item.Hash, item.ContentHash, item.LinkHash, item.Published.Unix(), now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE updates SET lastUpdate=? WHERE chatID=? AND feedID=?", p.Until.Unix(), chatID, feedID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ContentDelivered reports whether an item with the given content hash was
+// delivered to the chat by the feed since the given time.
+func (db *DB) ContentDelivered(ctx context.Context, chatID, feedID int64, contentHash string, since time.Time) (delivered bool, err error) {
+	err = db.q.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM deliveredItems WHERE chatID=? AND feedID=? AND contentHash=? AND timestamp >= ?", chatID, feedID, contentHash, since.Unix()).Scan(&delivered)
+	return
+}
+
+// LinkDeliveredByEarlierFeed reports whether an item with the given link hash
+// was delivered to the chat since the given time by a feed that is listed
+// before feedID, i.e. one with a higher priority, or by a feed that the chat
+// no longer subscribes to, like one that moved to a new URL.
+func (db *DB) LinkDeliveredByEarlierFeed(ctx context.Context, chatID, feedID int64, linkHash string, since time.Time) (delivered bool, err error) {
+	err = db.q.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM deliveredItems LEFT JOIN updates ON updates.chatID = deliveredItems.chatID AND updates.feedID = deliveredItems.feedID "+
+		"WHERE deliveredItems.chatID=? AND deliveredItems.linkHash=? AND deliveredItems.timestamp >= ? AND deliveredItems.feedID <> ? "+
+		"AND (updates.nr IS NULL OR updates.nr < (SELECT nr FROM updates WHERE chatID=? AND feedID=?))", chatID, linkHash, since.Unix(), feedID, chatID, feedID).Scan(&delivered)
+	return
+}
+
+// DeliveryLatency returns the average time between publication and delivery of
+// the items of a feed that were delivered to the chat, and the number of items
+// the average is based on.
+func (db *DB) DeliveryLatency(ctx context.Context, chatID, feedNum int64) (avg time.Duration, n int, err error) {
+	feedID, err := db.feedIDByNum(ctx, chatID, feedNum)
+	if err != nil {
+		return
+	}
+
+	var seconds sql.NullFloat64
+	err = db.q.QueryRowContext(ctx, "SELECT COUNT(*), AVG(timestamp - published) FROM deliveredItems WHERE chatID=? AND feedID=?", chatID, feedID).Scan(&n, &seconds)
+	avg = time.Duration(seconds.Float64 * float64(time.Second))
+	return
+}
+
+func (db *DB) PruneDeliveredItems(ctx context.Context, before time.Time) error {
+	_, err := db.q.ExecContext(ctx, "DELETE FROM deliveredItems WHERE timestamp < ?", before.Unix())
+	return err
+}
+
+func (db *DB) AddFeedError(ctx context.Context, feedID int64) error {
+	_, err := db.q.ExecContext(ctx, "INSERT INTO feedErrors (feedID, timestamp) VALUES (?,?)", feedID, time.Now().Unix())
+	return err
+}
+
+func (db *DB) RecentFeedErrors(ctx context.Context, since time.Time, feedID int64) (n int, err error) {
+	err = db.q.QueryRowContext(ctx, "SELECT COUNT(*) FROM feedErrors WHERE feedID=? AND timestamp >= ?", feedID, since.Unix()).Scan(&n)
+	return
+}
+
+// FeedStatus is the state of a feed in a chat as shown by /status.
+type FeedStatus struct {
+	ID           int64
+	Title        string
+	LastUpdate   time.Time
+	RecentErrors int
+}
+
+// ChatFeedStatus returns the status of each feed in the chat, numbered like
+// in FeedsByChat. Only errors since the given time are counted.
+func (db *DB) ChatFeedStatus(ctx context.Context, chatID int64, since time.Time) ([]FeedStatus, error) {
+	rows, err := db.q.QueryContext(ctx, "SELECT ROW_NUMBER() OVER (ORDER BY updates.nr),"+chatFeedTitle+",updates.lastUpdate,COALESCE(recent.n,0) FROM updates JOIN feeds ON updates.feedID = feeds.id LEFT JOIN (SELECT feedID, COUNT(*) AS n FROM feedErrors WHERE timestamp >= ? GROUP BY feedID) recent ON recent.feedID = feeds.id WHERE updates.chatID = ? ORDER BY updates.nr", since.Unix(), chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []FeedStatus
+	for rows.Next() {
+		var status FeedStatus
+		var lastUpdate int64
+		if err := rows.Scan(&status.ID, &status.Title, &lastUpdate, &status.RecentErrors); err != nil {
+			return nil, err
+		}
+
+		status.LastUpdate = time.Unix(lastUpdate, 0)
+		list = append(list, status)
+	}
+
+	return list, rows.Err()
+}
+
+// FeedStats is the usage of a feed across all chats as shown by /admin feeds.
+type FeedStats struct {
+	Feed
+	Subscribers  int
+	RecentErrors int
+}
+
+// AllFeedStats returns every feed with the number of chats subscribed to it
+// and the number of errors since the given time, ordered by ID.
+func (db *DB) AllFeedStats(ctx context.Context, since time.Time) ([]FeedStats, error) {
+	rows, err := db.q.QueryContext(ctx, "SELECT feeds.id, feeds.title, feeds.url, feeds.scheme, COUNT(updates.nr), COALESCE(recent.n, 0) FROM feeds "+
+		"LEFT JOIN updates ON updates.feedID = feeds.id "+
+		"LEFT JOIN (SELECT feedID, COUNT(*) AS n FROM feedErrors WHERE timestamp >= ? GROUP BY feedID) recent ON recent.feedID = feeds.id "+
+		"GROUP BY feeds.id, feeds.title, feeds.url, feeds.scheme, recent.n ORDER BY feeds.id", since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []FeedStats
+	for rows.Next() {
+		var stats FeedStats
+		if err := rows.Scan(&stats.ID, &stats.Title, &stats.URL, &stats.Scheme, &stats.Subscribers, &stats.RecentErrors); err != nil {
+			return nil, err
+		}
+
+		list = append(list, stats)
+	}
+
+	return list, rows.Err()
+}
+
+func (db *DB) DropFeed(ctx context.Context, id int64) error {
+	_, err := db.q.ExecContext(ctx, "DELETE FROM feeds WHERE id=?", id)
+	return err
+}
+
+// orphanFeeds selects the feeds that no chat subscribes to and whose
+// delivered items are not kept for deduplication anymore.
+const orphanFeeds = "SELECT id FROM feeds WHERE NOT EXISTS (SELECT 1 FROM updates WHERE updates.feedID = feeds.id) " +
+	"AND NOT EXISTS (SELECT 1 FROM deliveredItems WHERE deliveredItems.feedID = feeds.id)"
+
+// PruneOrphanFeeds removes the feeds that the last chat unsubscribed from,
+// together with their errors, and returns how many were removed.
+func (db *DB) PruneOrphanFeeds(ctx context.Context) (int64, error) {
+	tx, err := db.q.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// MySQL cannot select from a table that it deletes from, unless the
+	// selection is materialized in a derived table.
+	orphans := "SELECT id FROM (" + orphanFeeds + ") orphans"
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM feedErrors WHERE feedID IN ("+orphans+")"); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM feeds WHERE id IN ("+orphans+")")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
+
+// userFeedLimit returns how many feeds the user may add in total: the quota
+// that an admin set for the user, or else def. Zero means no limit.
+func userFeedLimit(ctx context.Context, q queryRower, userID int64, def int) (limit int, err error) {
+	err = q.QueryRowContext(ctx, "SELECT maxTotalFeeds FROM userQuotas WHERE userID=?", userID).Scan(&limit)
+	if err == sql.ErrNoRows {
+		return def, nil
+	}
+
+	return
+}
+
+// SetUserQuota sets how many feeds the user may add in total, overriding
+// MaxTotalFeedsByUser. Zero means no limit.
+func (db *DB) SetUserQuota(ctx context.Context, userID int64, maxTotalFeeds int) error {
+	_, err := db.q.ExecContext(ctx, "INSERT INTO userQuotas (userID, maxTotalFeeds) VALUES (?,?) "+db.onConflict("userID")+" maxTotalFeeds="+db.inserted("maxTotalFeeds"), userID, maxTotalFeeds)
+	return err
+}
+
+// ResetUserQuota removes the quota of the user, so that MaxTotalFeedsByUser
+// applies again.
+func (db *DB) ResetUserQuota(ctx context.Context, userID int64) error {
+	_, err := db.q.ExecContext(ctx, "DELETE FROM userQuotas WHERE userID=?", userID)
+	return err
+}
+
+// DeliveryPaused reports whether an admin paused the delivery of items.
+func (db *DB) DeliveryPaused(ctx context.Context) (bool, error) {
+	var value string
+	err := db.q.QueryRowContext(ctx, "SELECT value FROM botState WHERE name='paused'").Scan(&value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return value == "1", err
+}
+
+// SetDeliveryPaused stores whether the delivery of items is paused, so that
+// a pause lasts across restarts.
+func (db *DB) SetDeliveryPaused(ctx context.Context, paused bool) error {
+	value := "0"
+	if paused {
+		value = "1"
+	}
+
+	_, err := db.q.ExecContext(ctx, "INSERT INTO botState (name, value) VALUES ('paused',?) "+db.onConflict("name")+" value="+db.inserted("value"), value)
+	return err
+}
+
+// requestBucket returns the start of the counting bucket that t falls into.
+func requestBucket(t time.Time) int64 {
+	return t.Unix() / requestBucketSeconds * requestBucketSeconds
+}
+
+// logRequest records a request of the user. If AggregateRequests is set, only
+// the per-user request counter is incremented and name and text are discarded.
+func (db *DB) logRequest(ctx context.Context, now time.Time, name, text string, userID int64) error {
+	if db.AggregateRequests {
+		_, err := db.q.ExecContext(ctx, "INSERT INTO requestCounts (userID, bucket, count) VALUES (?,?,1) "+db.onConflict("userID, bucket")+" count=count+1", userID, requestBucket(now))
+		return err
+	}
+
+	_, err := db.q.ExecContext(ctx, "INSERT INTO requests (userID, timestamp, name, text) VALUES (?,?,?,?)", userID, now.Unix(), name, text)
+	return err
+}
+
+// RecentRequests counts the requests of the user since the given time. With
+// AggregateRequests set, the requests in the bucket that since falls into are
+// assumed to be spread evenly, so only the share of them after since counts.
+func (db *DB) RecentRequests(ctx context.Context, since time.Time, userID int64) (n int, err error) {
+	if !db.AggregateRequests {
+		err = db.q.QueryRowContext(ctx, "SELECT COUNT(*) FROM requests WHERE userID=? AND timestamp >= ?", userID, since.Unix()).Scan(&n)
+		return
+	}
+
+	first := requestBucket(since)
+	rows, err := db.q.QueryContext(ctx, "SELECT bucket, count FROM requestCounts WHERE userID=? AND bucket >= ?", userID, first)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var total float64
+	for rows.Next() {
+		var bucket int64
+		var count int
+		if err = rows.Scan(&bucket, &count); err != nil {
+			return
+		}
+
+		if bucket == first {
+			total += float64(count) * float64(first+requestBucketSeconds-since.Unix()) / requestBucketSeconds
+		} else {
+			total += float64(count)
+		}
+	}
+
+	return int(math.Round(total)), rows.Err()
+}
+
+// deliveryBucket returns the start of the counting bucket that t falls into.
+func deliveryBucket(t time.Time) int64 {
+	return t.Unix() / deliveryBucketSeconds * deliveryBucketSeconds
+}
+
+// IncrementDeliveries adds n to the number of items that the feed delivered
+// to the chat in the current bucket.
+func (db *DB) IncrementDeliveries(ctx context.Context, chatID, feedID int64, n int) error {
+	_, err := db.q.ExecContext(ctx, "INSERT INTO deliveryCounts (chatID, feedID, bucket, count) VALUES (?,?,?,?) "+db.onConflict("chatID, feedID, bucket")+" count=count+"+db.inserted("count"), chatID, feedID, deliveryBucket(time.Now()), n)
+	return err
+}
+
+// FeedActivity is how many items a feed delivered to a chat as shown by
+// /mostactive.
+type FeedActivity struct {
+	ID         int64
+	Title      string
+	Deliveries int
+}
+
+// MostActiveFeeds returns up to limit feeds of the chat that delivered items
+// since the given time, numbered like in FeedsByChat and ordered by the
+// number of items, most first. Whole buckets are counted, so items of up to
+// an hour before since may count too.
+func (db *DB) MostActiveFeeds(ctx context.Context, chatID int64, since time.Time, limit int) ([]FeedActivity, error) {
+	rows, err := db.q.QueryContext(ctx, "SELECT ROW_NUMBER() OVER (ORDER BY updates.nr),"+chatFeedTitle+",COALESCE(recent.n,0) FROM updates JOIN feeds ON updates.feedID = feeds.id "+
+		"LEFT JOIN (SELECT feedID, SUM(count) AS n FROM deliveryCounts WHERE chatID=? AND bucket >= ? GROUP BY feedID) recent ON recent.feedID = feeds.id "+
+		"WHERE updates.chatID = ? ORDER BY updates.nr", chatID, deliveryBucket(since), chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []FeedActivity
+	for rows.Next() {
+		var a FeedActivity
+		if err := rows.Scan(&a.ID, &a.Title, &a.Deliveries); err != nil {
+			return nil, err
+		}
+
+		if a.Deliveries > 0 {
+			list = append(list, a)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Feeds with the same number keep their order in the chat.
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Deliveries > list[j].Deliveries })
+	if len(list) > limit {
+		list = list[:limit]
+	}
+
+	return list, nil
+}
+
+// PruneDeliveryCounts removes the delivery counters of buckets before the given time.
+func (db *DB) PruneDeliveryCounts(ctx context.Context, before time.Time) error {
+	_, err := db.q.ExecContext(ctx, "DELETE FROM deliveryCounts WHERE bucket < ?", deliveryBucket(before))
+	return err
+}
+
+// PruneRequestCounts removes the request counters of buckets before the given time.
+func (db *DB) PruneRequestCounts(ctx context.Context, before time.Time) error {
+	_, err := db.q.ExecContext(ctx, "DELETE FROM requestCounts WHERE bucket < ?", requestBucket(before))
+	return err
 }
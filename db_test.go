@@ -0,0 +1,737 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// openTestDB returns an empty, migrated SQLite database that is removed when
+// the test ends.
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+
+	db, err := OpenDB("sqlite3", filepath.Join(t.TempDir(), "bot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Prepare()
+	return db
+}
+
+func feedTitles(t *testing.T, db *DB, chatID int64) []string {
+	t.Helper()
+
+	feeds, err := db.FeedsByChat(context.Background(), chatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var titles []string
+	for _, f := range feeds {
+		titles = append(titles, f.Title)
+	}
+
+	return titles
+}
+
+func TestAddListRemoveFeeds(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	for _, title := range []string{"a", "b", "c"} {
+		feed := Feed{Title: title, URL: "//example.com/" + title, Scheme: "https"}
+		if err := db.AddFeedToChat(ctx, 1, 10, feed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := feedTitles(t, db, 10); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("feeds of chat = %v, want [a b c]", got)
+	}
+
+	if err := db.RemoveFeedFromChat(ctx, 10, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := feedTitles(t, db, 10); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Fatalf("feeds of chat after removing #2 = %v, want [a c]", got)
+	}
+
+	for _, num := range []int64{0, -3, 3} {
+		if err := db.RemoveFeedFromChat(ctx, 10, num); err != sql.ErrNoRows {
+			t.Errorf("removing feed #%d: err = %v, want sql.ErrNoRows", num, err)
+		}
+
+		if _, _, err := db.FeedOfChat(ctx, 10, num); err != sql.ErrNoRows {
+			t.Errorf("FeedOfChat #%d: err = %v, want sql.ErrNoRows", num, err)
+		}
+	}
+
+	if got := feedTitles(t, db, 10); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Fatalf("feeds of chat after invalid removals = %v, want [a c]", got)
+	}
+}
+
+func TestAddFeedToChatTwice(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	feed := Feed{Title: "a", URL: "//example.com/a", Scheme: "https"}
+	if err := db.AddFeedToChat(ctx, 1, 10, feed); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddFeedToChat(ctx, 2, 10, feed); err != ErrAlreadySubscribed {
+		t.Fatalf("adding the feed again: err = %v, want ErrAlreadySubscribed", err)
+	}
+
+	var n int
+	if err := db.q.QueryRow("SELECT COUNT(*) FROM updates WHERE chatID=10").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("chat has %d subscriptions, want 1", n)
+	}
+
+	// Other chats may still add it.
+	if err := db.AddFeedToChat(ctx, 2, 20, feed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubIntervalPassed(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		interval  time.Duration
+		sinceSent time.Duration
+		want      bool
+	}{
+		{0, 0, true},
+		{2 * time.Hour, 0, false},
+		{2 * time.Hour, time.Hour, false},
+		// The previous update may have reached the chat a bit later.
+		{2 * time.Hour, 2*time.Hour - time.Second, true},
+		{2 * time.Hour, 2 * time.Hour, true},
+		{24 * time.Hour, 23 * time.Hour, false},
+	}
+
+	for _, tt := range tests {
+		sub := Sub{Interval: tt.interval, LastSent: now.Add(-tt.sinceSent)}
+		if got := sub.IntervalPassed(now, defaultUpdateTimeout); got != tt.want {
+			t.Errorf("interval %s, sent %s ago: IntervalPassed = %v, want %v", tt.interval, tt.sinceSent, got, tt.want)
+		}
+	}
+}
+
+func TestChatInterval(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: "a", URL: "//example.com/a", Scheme: "https"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SetChatInterval(ctx, 10, 3*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := db.ChatInterval(ctx, 10); err != nil || got != 3*time.Hour {
+		t.Fatalf("ChatInterval = %s, %v, want 3h", got, err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	subs, err := db.Subs(ctx, 1, &later)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for _, sub := range subs {
+		n++
+		if sub.Interval != 3*time.Hour {
+			t.Errorf("interval of subscription = %s, want 3h", sub.Interval)
+		}
+	}
+	if n != 1 {
+		t.Fatalf("got %d subscriptions, want 1", n)
+	}
+}
+
+func TestRemoveAllFeedsFromChat(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	for _, chatID := range []int64{10, 20} {
+		for _, title := range []string{"a", "b", "c"} {
+			if err := db.AddFeedToChat(ctx, 1, chatID, Feed{Title: title, URL: "//example.com/" + title, Scheme: "https"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.SetChatInterval(ctx, 10, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := db.RemoveAllFeedsFromChat(ctx, 10)
+	if err != nil || n != 3 {
+		t.Fatalf("RemoveAllFeedsFromChat = %d, %v, want 3", n, err)
+	}
+
+	if got := feedTitles(t, db, 10); len(got) != 0 {
+		t.Errorf("feeds of chat after removal %v, want none", got)
+	}
+	if got := feedTitles(t, db, 20); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("feeds of other chat %v, want [a b c]", got)
+	}
+	if interval, err := db.ChatInterval(ctx, 10); err != nil || interval != time.Hour {
+		t.Errorf("interval of chat after removal = %s, %v, want 1h", interval, err)
+	}
+
+	if n, err := db.RemoveAllFeedsFromChat(ctx, 10); err != nil || n != 0 {
+		t.Errorf("RemoveAllFeedsFromChat again = %d, %v, want 0", n, err)
+	}
+}
+
+// TestListsReleaseConnections checks that nothing is left running when the
+// result of a query for feeds or subscriptions is not used at all.
+func TestListsReleaseConnections(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	db.q.SetMaxOpenConns(1)
+
+	for _, title := range []string{"a", "b", "c"} {
+		if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: title, URL: "//example.com/" + title, Scheme: "https"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	later := time.Now().Add(time.Minute)
+	queries := map[string]func() error{
+		"FeedsByChat": func() error { _, err := db.FeedsByChat(ctx, 10); return err },
+		"ActiveFeeds": func() error { _, err := db.ActiveFeeds(ctx); return err },
+		"Subs":        func() error { _, err := db.Subs(ctx, 1, &later); return err },
+	}
+
+	before := runtime.NumGoroutine()
+	for name, query := range queries {
+		for i := 0; i < 5; i++ {
+			if err := query(); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+
+		// With its only connection still in use, the pool could not
+		// answer another query.
+		timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		_, err := db.ChatInterval(timeoutCtx, 10)
+		cancel()
+		if err != nil {
+			t.Fatalf("query after %s: %v", name, err)
+		}
+	}
+
+	// Goroutines of the driver may take a moment to end.
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("%d goroutines before the queries, %d after", before, after)
+	}
+}
+
+// TestCommandsWithOneConnection checks that the commands that list the feeds
+// of a chat have the whole list before they query the database again, which
+// they could not do while the list still held the only connection.
+func TestCommandsWithOneConnection(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	db.q.SetMaxOpenConns(1)
+
+	for _, title := range []string{"news a", "news b", "sports"} {
+		if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: title, URL: "//example.com/" + title, Scheme: "https"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	listFeeds(timeoutCtx, db, 10)
+	exportFeeds(timeoutCtx, db, 10, time.Now())
+	removeMatch(timeoutCtx, db, 10, "news")
+
+	feeds, err := db.FeedsByChat(timeoutCtx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := matchFingerprint(matchFeeds(feeds, "news")) + ":news"
+	confirmRemoveMatch(timeoutCtx, db, 10, 1, data)
+
+	if timeoutCtx.Err() != nil {
+		t.Fatal("commands waited for a connection")
+	}
+	if got := feedTitles(t, db, 10); !reflect.DeepEqual(got, []string{"sports"}) {
+		t.Fatalf("feeds after /removematch = %q, want only sports", got)
+	}
+}
+
+func TestPruneOrphanFeeds(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	for _, title := range []string{"a", "b", "c"} {
+		feed := Feed{Title: title, URL: "//example.com/" + title, Scheme: "https"}
+		if err := db.AddFeedToChat(ctx, 1, 10, feed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddFeedError(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Feed c delivered an item, which is kept for deduplication.
+	now := time.Now()
+	if err := db.AddDeliveredItem(ctx, 10, 3, DeliveredItem{Key: "1", Published: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, num := range []int64{3, 1} {
+		if err := db.RemoveFeedFromChat(ctx, 10, num); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dueTitles := func() []string {
+		feeds, err := db.ActiveFeeds(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var titles []string
+		for _, f := range feeds {
+			titles = append(titles, f.Title)
+		}
+		return titles
+	}
+
+	if got := dueTitles(); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("due feeds = %v, want [b]", got)
+	}
+
+	if n, err := db.PruneOrphanFeeds(ctx); err != nil || n != 1 {
+		t.Fatalf("PruneOrphanFeeds = %d, %v, want 1", n, err)
+	}
+	if _, err := db.FeedByURL(ctx, "//example.com/a"); err != sql.ErrNoRows {
+		t.Fatalf("orphaned feed a: err = %v, want sql.ErrNoRows", err)
+	}
+
+	var left int
+	if err := db.q.QueryRow("SELECT COUNT(*) FROM feedErrors").Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Fatalf("%d errors of the orphaned feed are left", left)
+	}
+
+	// Feed c goes once its delivered items are pruned.
+	if err := db.PruneDeliveredItems(ctx, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.PruneOrphanFeeds(ctx); err != nil || n != 1 {
+		t.Fatalf("PruneOrphanFeeds after pruning delivered items = %d, %v, want 1", n, err)
+	}
+	if _, err := db.FeedByURL(ctx, "//example.com/b"); err != nil {
+		t.Fatalf("subscribed feed b: %v", err)
+	}
+}
+
+func TestChangeSubOwner(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	db.MaxActiveFeedsByUser = 1
+	db.Prepare()
+
+	// User 1 adds a feed to chat 10, user 2 one to chat 20.
+	if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: "a", URL: "//example.com/a", Scheme: "https"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddFeedToChat(ctx, 2, 20, Feed{Title: "b", URL: "//example.com/b", Scheme: "https"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// User 2 is at the limit and cannot take over the feed of chat 10.
+	if err := db.ChangeSubOwner(ctx, 10, 1, 2); err != ErrMaxActiveFeedsByUser {
+		t.Fatalf("giving the feed to a user at the limit: err = %v, want ErrMaxActiveFeedsByUser", err)
+	}
+
+	if err := db.ChangeSubOwner(ctx, 10, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	_, sub, err := db.FeedOfChat(ctx, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.UserID != 3 {
+		t.Fatalf("owner = %d, want 3", sub.UserID)
+	}
+
+	// The quota of user 1 is free again.
+	if err := db.AddFeedToChat(ctx, 1, 20, Feed{Title: "c", URL: "//example.com/c", Scheme: "https"}); err != nil {
+		t.Fatalf("adding a feed after giving one away: %v", err)
+	}
+}
+
+func TestUserQuota(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	db.MaxTotalFeedsByUser = 1
+	db.MaxActiveFeedsByUser = 10
+	db.Prepare()
+
+	n := 0
+	add := func(userID int64) error {
+		n++
+		return db.AddFeedToChat(ctx, userID, 10, Feed{Title: "feed", URL: fmt.Sprintf("//example.com/%d", n), Scheme: "https"})
+	}
+
+	// Without an override, the limit of the config applies.
+	for _, userID := range []int64{1, 2} {
+		if err := add(userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := add(1); err != ErrMaxTotalFeedsByUser {
+		t.Fatalf("adding a feed over the limit: err = %v, want ErrMaxTotalFeedsByUser", err)
+	}
+
+	if err := db.SetUserQuota(ctx, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := add(1); err != nil {
+		t.Fatalf("adding a feed within the quota: %v", err)
+	}
+	if err := add(1); err != ErrMaxTotalFeedsByUser {
+		t.Fatalf("adding a feed over the quota: err = %v, want ErrMaxTotalFeedsByUser", err)
+	}
+	if err := add(2); err != ErrMaxTotalFeedsByUser {
+		t.Fatalf("quota of another user applied: err = %v", err)
+	}
+
+	if err := db.SetUserQuota(ctx, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := add(1); err != nil {
+		t.Fatalf("adding a feed without limit: %v", err)
+	}
+
+	if err := db.ResetUserQuota(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := add(1); err != ErrMaxTotalFeedsByUser {
+		t.Fatalf("adding a feed after resetting the quota: err = %v, want ErrMaxTotalFeedsByUser", err)
+	}
+}
+
+func TestAggregatedRequestsMatchLoggedRequests(t *testing.T) {
+	ctx := context.Background()
+	logged := openTestDB(t)
+	aggregated := openTestDB(t)
+	aggregated.AggregateRequests = true
+
+	start := time.Unix(requestBucket(time.Now()), 0).Add(-time.Hour)
+	for _, offset := range []time.Duration{0, time.Minute, 4 * time.Minute, 5 * time.Minute, 7 * time.Minute, 12 * time.Minute, 14 * time.Minute} {
+		for _, db := range []*DB{logged, aggregated} {
+			if err := db.logRequest(ctx, start.Add(offset), "addfeed", "/addfeed https://example.com/", 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Another user's requests are not counted.
+	for _, db := range []*DB{logged, aggregated} {
+		if err := db.logRequest(ctx, start, "feeds", "/feeds", 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Windows that start at a bucket boundary count exactly the same.
+	for _, since := range []time.Duration{0, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute} {
+		want, err := logged.RecentRequests(ctx, start.Add(since), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := aggregated.RecentRequests(ctx, start.Add(since), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != want {
+			t.Errorf("requests since %s: aggregated %d, logged %d", since, got, want)
+		}
+	}
+
+	// Otherwise the share of the first bucket is estimated: two requests in
+	// [10m, 15m), of which the window covers three fifths.
+	if got, err := aggregated.RecentRequests(ctx, start.Add(12*time.Minute), 1); err != nil || got != 1 {
+		t.Errorf("requests since 12m: aggregated %d, %v, want 1", got, err)
+	}
+
+	if err := aggregated.PruneRequestCounts(ctx, start.Add(10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := aggregated.RecentRequests(ctx, start, 1); err != nil || got != 2 {
+		t.Errorf("requests after pruning: %d, %v, want 2", got, err)
+	}
+}
+
+func TestDeliveryLatency(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	for _, name := range []string{"a", "b"} {
+		if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: name, URL: "//example.com/" + name, Scheme: "https"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, n, err := db.DeliveryLatency(ctx, 10, 1); err != nil || n != 0 {
+		t.Fatalf("latency without deliveries: n = %d, err = %v", n, err)
+	}
+
+	now := time.Now()
+	for i, delay := range []time.Duration{time.Hour, 2 * time.Hour, 6 * time.Hour} {
+		item := DeliveredItem{Key: fmt.Sprint(i), Published: now.Add(-delay)}
+		if err := db.AddDeliveredItem(ctx, 10, 1, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Deliveries of other feeds and chats do not count.
+	for _, d := range []struct{ chatID, feedID int64 }{{10, 2}, {20, 1}} {
+		if err := db.AddDeliveredItem(ctx, d.chatID, d.feedID, DeliveredItem{Key: "x", Published: now.Add(-100 * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	avg, n, err := db.DeliveryLatency(ctx, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("latency is based on %d items, want 3", n)
+	}
+	if d := avg - 3*time.Hour; d < -time.Minute || d > time.Minute {
+		t.Fatalf("average latency %s, want 3h", avg)
+	}
+}
+
+func TestNotes(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	for _, name := range []string{"a", "b"} {
+		if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: name, URL: "//example.com/" + name, Scheme: "https"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	notes := func() []string {
+		feeds, err := db.FeedsByChat(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var notes []string
+		for _, f := range feeds {
+			notes = append(notes, f.Note)
+		}
+		return notes
+	}
+
+	if err := db.SetNote(ctx, 10, 2, "owned by @alice, remove after launch"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := notes(); !reflect.DeepEqual(got, []string{"", "owned by @alice, remove after launch"}) {
+		t.Fatalf("notes in listing = %q", got)
+	}
+
+	if f, _, err := db.FeedOfChat(ctx, 10, 2); err != nil || f.Note != "owned by @alice, remove after launch" {
+		t.Fatalf("note of feed = %q, %v", f.Note, err)
+	}
+
+	if err := db.SetNote(ctx, 10, 2, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := notes(); !reflect.DeepEqual(got, []string{"", ""}) {
+		t.Fatalf("notes after clearing = %q", got)
+	}
+}
+
+func TestFeedByURL(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	if _, err := db.FeedByURL(ctx, "//example.com/feed"); err != sql.ErrNoRows {
+		t.Fatalf("unknown feed: err = %v, want sql.ErrNoRows", err)
+	}
+
+	for _, name := range []string{"other", "feed"} {
+		if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: "Title of " + name, URL: "//example.com/" + name, Scheme: "http"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := db.FeedByURL(ctx, "//example.com/feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Feed{ID: 2, Title: "Title of feed", URL: "//example.com/feed", Scheme: "http"}
+	if f != want {
+		t.Fatalf("FeedByURL = %+v, want %+v", f, want)
+	}
+}
+
+func TestRenameSub(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	for _, chatID := range []int64{10, 20} {
+		if err := db.AddFeedToChat(ctx, 1, chatID, Feed{Title: "Home", URL: "//example.com/feed", Scheme: "https"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.RenameSub(ctx, 10, 2, "Other"); err != sql.ErrNoRows {
+		t.Fatalf("renaming unknown feed: err = %v, want sql.ErrNoRows", err)
+	}
+
+	if err := db.RenameSub(ctx, 10, 1, "Example blog"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := feedTitles(t, db, 10); !reflect.DeepEqual(got, []string{"Example blog"}) {
+		t.Fatalf("titles in renamed chat = %q", got)
+	}
+	// The title is only changed in the chat that renamed the feed.
+	if got := feedTitles(t, db, 20); !reflect.DeepEqual(got, []string{"Home"}) {
+		t.Fatalf("titles in other chat = %q", got)
+	}
+
+	f, sub, err := db.FeedOfChat(ctx, 10, 1)
+	if err != nil || f.Title != "Example blog" || sub.DisplayTitle != "Example blog" {
+		t.Fatalf("FeedOfChat = %q, %q, %v", f.Title, sub.DisplayTitle, err)
+	}
+
+	subscribers, err := db.SubscribedChats(ctx, f.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Subscriber{{10, "Example blog"}, {20, "Home"}}
+	if !reflect.DeepEqual(subscribers, want) {
+		t.Fatalf("subscribers = %+v, want %+v", subscribers, want)
+	}
+
+	if err := db.RenameSub(ctx, 10, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := feedTitles(t, db, 10); !reflect.DeepEqual(got, []string{"Home"}) {
+		t.Fatalf("titles after reset = %q", got)
+	}
+}
+
+func TestPrepareAppliesChangedLimits(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	db.MaxFeedsPerChat = 1
+	db.Prepare()
+
+	add := func(name string) error {
+		return db.AddFeedToChat(ctx, 1, 10, Feed{Title: name, URL: "//example.com/" + name, Scheme: "https"})
+	}
+
+	if err := add("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := add("b"); err != ErrMaxFeedsInChat {
+		t.Fatalf("adding a feed over the limit: err = %v, want ErrMaxFeedsInChat", err)
+	}
+
+	db.MaxFeedsPerChat = 2
+	db.Prepare()
+
+	if err := add("b"); err != nil {
+		t.Fatalf("adding a feed after raising the limit: %v", err)
+	}
+}
+
+func TestAdvanceSubIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: "a", URL: "//example.com/a", Scheme: "https"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateSub(ctx, 10, 1, firstSecond); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	progress := SubProgress{
+		Until:       now,
+		Delivered:   []DeliveredItem{{Key: "1", Published: now}},
+		DigestItems: []DigestItem{{Title: "1", Published: now}},
+	}
+
+	count := func(table string) (n int) {
+		if err := db.q.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// Storing the delivered items fails after the digest item was added.
+	if _, err := db.q.Exec("ALTER TABLE deliveredItems RENAME TO deliveredItemsAside"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AdvanceSub(ctx, 10, 1, progress); err == nil {
+		t.Fatal("AdvanceSub without deliveredItems table succeeded")
+	}
+	if _, err := db.q.Exec("ALTER TABLE deliveredItemsAside RENAME TO deliveredItems"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := count("digestItems"); n != 0 {
+		t.Fatalf("%d digest items were kept by the failed transaction", n)
+	}
+	if _, sub, err := db.FeedOfChat(ctx, 10, 1); err != nil || !sub.LastUpdate.Equal(firstSecond) {
+		t.Fatalf("last update after failure = %s, %v, want it unchanged", sub.LastUpdate, err)
+	}
+
+	if err := db.AdvanceSub(ctx, 10, 1, progress); err != nil {
+		t.Fatal(err)
+	}
+	if count("digestItems") != 1 || count("deliveredItems") != 1 {
+		t.Fatalf("stored %d digest items and %d delivered items, want 1 each", count("digestItems"), count("deliveredItems"))
+	}
+	if _, sub, err := db.FeedOfChat(ctx, 10, 1); err != nil || !sub.LastUpdate.Equal(now) {
+		t.Fatalf("last update = %s, %v, want %s", sub.LastUpdate, err, now)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// dbRetryDelays are the pauses between the attempts of a statement that
+// failed because the database was unavailable. They bridge a restart of the
+// database without holding up commands for long.
+var dbRetryDelays = []time.Duration{100 * time.Millisecond, 400 * time.Millisecond, time.Second, 2 * time.Second}
+
+// dbOpenDelays are the pauses between the attempts to reach the database
+// when the bot starts, which may be before the database is up.
+var dbOpenDelays = []time.Duration{time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 20 * time.Second}
+
+// isTransientDBError reports whether err means that the database could not
+// be reached or was too busy, so that the statement did not take effect and
+// can be tried again.
+func isTransientDBError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+
+	// Errors of a connection that broke while a statement was sent are
+	// not transient, as the statement may have taken effect.
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1040, // too many connections
+			1053, // server shutdown in progress
+			1205, // lock wait timeout exceeded
+			1213: // deadlock found
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryDB is a *sql.DB whose statements are tried again while the database
+// is unavailable for a moment. Statements within transactions are not, as
+// the whole transaction would have to start over; only BeginTx is.
+type retryDB struct {
+	*sql.DB
+}
+
+// retry calls f until it succeeds, fails for another reason than an
+// unavailable database, or dbRetryDelays are used up.
+func retry(ctx context.Context, f func() error) error {
+	err := f()
+	for _, delay := range dbRetryDelays {
+		if !isTransientDBError(err) {
+			return err
+		}
+
+		logrus.WithError(err).WithField("Retry after", delay).Warn("database unavailable, retrying")
+		if sleepContext(ctx, delay) != nil {
+			return err
+		}
+
+		err = f()
+	}
+
+	return err
+}
+
+func (db retryDB) ExecContext(ctx context.Context, query string, args ...interface{}) (res sql.Result, err error) {
+	err = retry(ctx, func() error {
+		res, err = db.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	return
+}
+
+func (db retryDB) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	err = retry(ctx, func() error {
+		rows, err = db.DB.QueryContext(ctx, query, args...)
+		return err
+	})
+	return
+}
+
+func (db retryDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) (row *sql.Row) {
+	retry(ctx, func() error {
+		row = db.DB.QueryRowContext(ctx, query, args...)
+		return row.Err()
+	})
+	return
+}
+
+func (db retryDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (tx *sql.Tx, err error) {
+	err = retry(ctx, func() error {
+		tx, err = db.DB.BeginTx(ctx, opts)
+		return err
+	})
+	return
+}
+
+// waitForDB pings the database until it answers, waiting dbOpenDelays in
+// between. It gives up early on errors that will not go away by waiting.
+func waitForDB(ctx context.Context, q *sql.DB) error {
+	err := q.PingContext(ctx)
+	for _, delay := range dbOpenDelays {
+		if !isTransientDBError(err) {
+			return err
+		}
+
+		logrus.WithError(err).WithField("Retry after", delay).Warn("cannot reach database yet")
+		if sleepContext(ctx, delay) != nil {
+			return err
+		}
+
+		err = q.PingContext(ctx)
+	}
+
+	return err
+}
+
+// backendError returns the reply to a command that failed with err. Users
+// are asked to try again if the database is just unavailable.
+func backendError(err error) string {
+	if isTransientDBError(err) {
+		return "The database is temporarily unavailable. Please try again in a minute."
+	}
+
+	return "Backend error"
+}
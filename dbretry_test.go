@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
+)
+
+// flakyConnector connects to a SQLite database, but the next failures
+// connections are refused as if the database was down.
+type flakyConnector struct {
+	name string
+
+	mu       sync.Mutex
+	failures int
+	attempts int
+}
+
+func (c *flakyConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	c.attempts++
+	fail := c.failures > 0
+	if fail {
+		c.failures--
+	}
+	c.mu.Unlock()
+
+	if fail {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+
+	return c.Driver().Open(c.name)
+}
+
+func (c *flakyConnector) Driver() driver.Driver {
+	return &sqlite3.SQLiteDriver{}
+}
+
+// fail makes the next n connections fail and resets the count of attempts.
+func (c *flakyConnector) fail(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failures, c.attempts = n, 0
+}
+
+func (c *flakyConnector) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.attempts
+}
+
+// openFlakyDB opens a database whose statements each need a new connection,
+// so that they fail while the connector refuses connections.
+func openFlakyDB(t *testing.T) (*sql.DB, *flakyConnector) {
+	t.Helper()
+
+	delays, openDelays := dbRetryDelays, dbOpenDelays
+	dbRetryDelays = []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}
+	dbOpenDelays = []time.Duration{time.Millisecond, time.Millisecond}
+	t.Cleanup(func() { dbRetryDelays, dbOpenDelays = delays, openDelays })
+
+	c := &flakyConnector{name: filepath.Join(t.TempDir(), "flaky.db")}
+	q := sql.OpenDB(c)
+	q.SetMaxIdleConns(0)
+	t.Cleanup(func() { q.Close() })
+
+	return q, c
+}
+
+func TestIsTransientDBError(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{driver.ErrBadConn, true},
+		{fmt.Errorf("query: %w", driver.ErrBadConn), true},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, false},
+		{&mysql.MySQLError{Number: 1040}, true},
+		{&mysql.MySQLError{Number: 1213}, true},
+		{&mysql.MySQLError{Number: 1062}, false},
+		{mysql.ErrInvalidConn, false},
+		{sql.ErrNoRows, false},
+		{errors.New("syntax error"), false},
+	} {
+		if got := isTransientDBError(tt.err); got != tt.want {
+			t.Errorf("isTransientDBError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDB(t *testing.T) {
+	ctx := context.Background()
+	q, c := openFlakyDB(t)
+	db := retryDB{q}
+
+	c.fail(2)
+	if _, err := db.ExecContext(ctx, "CREATE TABLE t (x INT)"); err != nil {
+		t.Fatalf("exec while the database comes back: %v", err)
+	}
+	if n := c.count(); n != 3 {
+		t.Errorf("exec took %d attempts, want 3", n)
+	}
+
+	c.fail(3)
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM t").Scan(&n); err != nil {
+		t.Fatalf("query row while the database comes back: %v", err)
+	}
+
+	c.fail(1)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("begin while the database comes back: %v", err)
+	}
+	tx.Rollback()
+
+	// An outage that lasts longer is reported as such.
+	c.fail(len(dbRetryDelays) + 1)
+	if _, err := db.QueryContext(ctx, "SELECT x FROM t"); !isTransientDBError(err) {
+		t.Fatalf("query during an outage: %v", err)
+	} else if got := backendError(err); got != "The database is temporarily unavailable. Please try again in a minute." {
+		t.Errorf("reply during an outage = %q", got)
+	}
+	if n := c.count(); n != len(dbRetryDelays)+1 {
+		t.Errorf("query took %d attempts, want %d", n, len(dbRetryDelays)+1)
+	}
+
+	// Other errors are not retried.
+	c.fail(0)
+	if _, err := db.ExecContext(ctx, "INSERT INTO nosuchtable VALUES (1)"); err == nil || isTransientDBError(err) {
+		t.Fatalf("insert into missing table: %v", err)
+	} else if got := backendError(err); got != "Backend error" {
+		t.Errorf("reply to another error = %q", got)
+	}
+	if n := c.count(); n != 1 {
+		t.Errorf("failing insert took %d attempts, want 1", n)
+	}
+
+	// Retries stop when the context is done.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	c.fail(len(dbRetryDelays) + 1)
+	if _, err := db.ExecContext(cancelled, "DELETE FROM t"); err == nil {
+		t.Fatal("exec with cancelled context succeeded")
+	}
+	if n := c.count(); n > 1 {
+		t.Errorf("exec with cancelled context took %d attempts", n)
+	}
+}
+
+func TestWaitForDB(t *testing.T) {
+	ctx := context.Background()
+	q, c := openFlakyDB(t)
+
+	c.fail(len(dbOpenDelays))
+	if err := waitForDB(ctx, q); err != nil {
+		t.Fatalf("database that comes up in time: %v", err)
+	}
+
+	c.fail(len(dbOpenDelays) + 1)
+	if err := waitForDB(ctx, q); !isTransientDBError(err) {
+		t.Fatalf("database that stays down: %v", err)
+	}
+	if n := c.count(); n != len(dbOpenDelays)+1 {
+		t.Errorf("waited for %d attempts, want %d", n, len(dbOpenDelays)+1)
+	}
+}
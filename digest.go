@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+	"github.com/mmcdole/gofeed"
+)
+
+// Due digests are looked for this often.
+const digestCheckInterval = time.Minute
+
+// Digests are read at a glance, so they show less of each description than
+// single items do, unless a chat chooses otherwise.
+const defaultDigestDescriptionLength = 120
+
+// Descriptions are cut to maxDigestDescriptionBytes when they are kept for a
+// digest, which is far more than a digest shows of them.
+const maxDigestDescriptionBytes = 16 << 10
+
+// DigestDue reports whether the items collected for sub's digest should be
+// sent at now. Items that are left over from digest mode are sent right away.
+func (sub *Sub) DigestDue(now time.Time) bool {
+	if sub.DigestAt < 0 {
+		return true
+	}
+
+	loc := sub.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	// The time of day is kept on days on which daylight saving time
+	// begins or ends.
+	now = now.In(loc)
+	scheduled := time.Date(now.Year(), now.Month(), now.Day(), int(sub.DigestAt/time.Hour), int(sub.DigestAt%time.Hour/time.Minute), 0, 0, loc)
+	if scheduled.After(now) {
+		scheduled = scheduled.AddDate(0, 0, -1)
+	}
+
+	return sub.DigestSent.Before(scheduled)
+}
+
+// parseDigestTime parses a time of day like 08:30 as the duration after midnight.
+func parseDigestTime(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// digestItemOf returns the parts of item that a digest shows.
+func digestItemOf(item *gofeed.Item) DigestItem {
+	desc := item.Description
+	if len(desc) > maxDigestDescriptionBytes {
+		desc = desc[:maxDigestDescriptionBytes]
+		for !utf8.ValidString(desc) {
+			desc = desc[:len(desc)-1]
+		}
+	}
+
+	return DigestItem{
+		Title:       item.Title,
+		Link:        item.Link,
+		Description: desc,
+		Published:   *item.PublishedParsed,
+	}
+}
+
+// digestDescriptionLength returns how much of each description the digests
+// of sub show.
+func digestDescriptionLength(sub *Sub) int {
+	if sub.DigestDescriptionLength > 0 {
+		return sub.DigestDescriptionLength
+	}
+
+	return defaultDigestDescriptionLength
+}
+
+// setDigestLength handles the /digestlength command.
+func setDigestLength(ctx context.Context, cfg *Config, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	length, err := strconv.Atoi(strings.TrimSpace(args))
+	if err != nil || length < 0 || length > cfg.Bot.MaxDescriptionLength {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("Please provide the number of characters, at most %d (0 for the default)", cfg.Bot.MaxDescriptionLength))
+	}
+
+	if err := db.SetDigestDescriptionLength(ctx, chatID, length); err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("set digest description length failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if length == 0 {
+		length = defaultDigestDescriptionLength
+	}
+
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("Digests in this chat show up to %d characters of each description.", length))
+}
+
+// setDigest handles the /digest command.
+func setDigest(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		return tgbotapi.NewMessage(chatID, "Usage: /digest <id> <HH:MM>|off")
+	}
+
+	num, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Please provide the ID of the feed")
+	}
+
+	at := time.Duration(-1)
+	if fields[1] != "off" {
+		if at, err = parseDigestTime(fields[1]); err != nil {
+			return tgbotapi.NewMessage(chatID, "Please provide the time of day like 08:30, or off")
+		}
+	}
+
+	if err := db.SetDigest(ctx, chatID, num, at, time.Now()); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("set digest failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if at < 0 {
+		return tgbotapi.NewMessage(chatID, "New items of this feed are sent as soon as possible again.")
+	}
+
+	loc, err := db.ChatLocation(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("get chat time zone failed")
+	}
+
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("New items of this feed are collected and sent daily at %s (%s).", fields[1], loc))
+}
+
+// flushDigests sends the digests that are due at now.
+func flushDigests(ctx context.Context, db *DB, send sendFunc, now time.Time) {
+	digests, err := db.PendingDigests(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("digest: PendingDigests")
+		return
+	}
+
+	for _, digest := range digests {
+		if !digest.DigestDue(now) {
+			continue
+		}
+
+		kept, err := db.DigestItems(ctx, digest.ChatID, digest.FeedID)
+		if err != nil {
+			logrus.WithError(err).WithField("Chat ID", digest.ChatID).Error("digest: DigestItems")
+			continue
+		}
+		if len(kept) == 0 {
+			continue
+		}
+
+		items := make([]*gofeed.Item, len(kept))
+		for i, item := range kept {
+			published := item.Published
+			items[i] = &gofeed.Item{
+				Title:           item.Title,
+				Link:            item.Link,
+				Description:     item.Description,
+				PublishedParsed: &published,
+			}
+		}
+
+		for _, chatID := range digest.Recipients(now) {
+			for _, msg := range digestMessages(chatID, digest.Title, items, digestDescriptionLength(&digest.Sub)) {
+				send.toThread(digest.ThreadOf(chatID))(msg)
+			}
+		}
+		itemsSent.Add(float64(len(items)))
+
+		if err := db.ClearDigest(ctx, digest.ChatID, digest.FeedID, kept[len(kept)-1].Nr, now); err != nil {
+			logrus.WithError(err).WithField("Chat ID", digest.ChatID).Error("digest: ClearDigest")
+		}
+
+		if err := db.SetLastSent(ctx, digest.ChatID, digest.FeedID, now); err != nil {
+			logrus.WithError(err).WithField("Chat ID", digest.ChatID).Error("digest: SetLastSent")
+		}
+	}
+}
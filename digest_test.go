@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+	"github.com/mmcdole/gofeed"
+)
+
+func TestDigestDue(t *testing.T) {
+	day := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	at := 8 * time.Hour
+
+	tests := []struct {
+		digestAt time.Duration
+		sent     time.Time
+		now      time.Time
+		due      bool
+	}{
+		{at, day.Add(-1 * time.Hour), day.Add(7 * time.Hour), false},
+		{at, day.Add(-1 * time.Hour), day.Add(8 * time.Hour), true},
+		{at, day.Add(8 * time.Hour), day.Add(9 * time.Hour), false},
+		{at, day.Add(-20 * time.Hour), day.Add(1 * time.Hour), true},
+		{at, day.Add(-16 * time.Hour), day.Add(1 * time.Hour), false},
+		{0, day.Add(-1 * time.Minute), day.Add(time.Minute), true},
+		{-time.Minute, day, day, true},
+	}
+
+	for _, tt := range tests {
+		sub := Sub{DigestAt: tt.digestAt, DigestSent: tt.sent}
+		if due := sub.DigestDue(tt.now); due != tt.due {
+			t.Errorf("digest at %s, sent %s: due at %s = %v, want %v", tt.digestAt, tt.sent, tt.now, due, tt.due)
+		}
+	}
+}
+
+func TestParseDigestTime(t *testing.T) {
+	if at, err := parseDigestTime("08:30"); err != nil || at != 8*time.Hour+30*time.Minute {
+		t.Errorf("parseDigestTime(08:30) = %s, %v", at, err)
+	}
+
+	for _, s := range []string{"8", "24:00", "08:60", "noon"} {
+		if _, err := parseDigestTime(s); err == nil {
+			t.Errorf("parseDigestTime(%q) succeeded", s)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{MaxDescriptionLength: defaultMaxDescriptionLength, FetchAttempts: 1}}
+
+	var requests int
+	srv := newTestFeedServer(t, &requests)
+	addTestFeed(t, db, 1, 10, srv.URL)
+
+	day := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	if err := db.SetDigest(ctx, 10, 1, 8*time.Hour, day.Add(7*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []tgbotapi.Chattable
+	send := func(msg tgbotapi.Chattable) { msgs = append(msgs, msg) }
+
+	var updates int64
+	updateFeed(ctx, cfg, db, srv.Client(), send, dueFeed(t, db), &updates)
+	if len(msgs) != 0 {
+		t.Fatalf("items of a digest were sent right away: %v", msgs)
+	}
+
+	flushDigests(ctx, db, send, day.Add(7*time.Hour+30*time.Minute))
+	if len(msgs) != 0 {
+		t.Fatalf("digest was sent before it was due: %v", msgs)
+	}
+
+	flushDigests(ctx, db, send, day.Add(8*time.Hour+time.Minute))
+	if len(msgs) != 1 {
+		t.Fatalf("got %d digest messages, want 1", len(msgs))
+	}
+	msg := msgs[0].(tgbotapi.MessageConfig)
+	if msg.ChatID != 10 || !strings.HasPrefix(msg.Text, "<i>Test</i>\n") || !strings.Contains(msg.Text, "First") {
+		t.Fatalf("unexpected digest %+v", msg)
+	}
+
+	flushDigests(ctx, db, send, day.Add(8*time.Hour+5*time.Minute))
+	if len(msgs) != 1 {
+		t.Fatalf("digest was sent twice")
+	}
+
+	if items, err := db.DigestItems(ctx, 10, dueFeed(t, db).ID); err != nil || len(items) != 0 {
+		t.Fatalf("%d items left after the digest was sent (err %v)", len(items), err)
+	}
+}
+
+func TestDigestOffSendsLeftoverItems(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	addTestFeed(t, db, 1, 10, "https://example.com/feed")
+	feedID := dueFeed(t, db).ID
+
+	now := time.Now()
+	if err := db.SetDigest(ctx, 10, 1, 8*time.Hour, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddDigestItem(ctx, 10, feedID, DigestItem{Title: "Kept", Link: "https://example.com/kept", Published: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := setDigest(ctx, db, 10, "1 off").(tgbotapi.MessageConfig).Text
+	if reply != "New items of this feed are sent as soon as possible again." {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+
+	var msgs []tgbotapi.Chattable
+	flushDigests(ctx, db, func(msg tgbotapi.Chattable) { msgs = append(msgs, msg) }, now)
+	if len(msgs) != 1 || !strings.Contains(msgs[0].(tgbotapi.MessageConfig).Text, "Kept") {
+		t.Fatalf("leftover items were not sent: %v", msgs)
+	}
+}
+
+func TestDigestDescriptionLength(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{MaxDescriptionLength: 1000}}
+
+	addTestFeed(t, db, 1, 10, "https://example.com/feed")
+	feedID := dueFeed(t, db).ID
+	description := strings.Repeat("x", 500)
+
+	digestText := func() string {
+		t.Helper()
+
+		if err := db.AddDigestItem(ctx, 10, feedID, DigestItem{Title: "Long", Description: description, Published: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+
+		var msgs []tgbotapi.Chattable
+		flushDigests(ctx, db, func(msg tgbotapi.Chattable) { msgs = append(msgs, msg) }, time.Now())
+		if len(msgs) != 1 {
+			t.Fatalf("got %d digest messages, want 1", len(msgs))
+		}
+
+		return msgs[0].(tgbotapi.MessageConfig).Text
+	}
+
+	if text := digestText(); !strings.Contains(text, strings.Repeat("x", defaultDigestDescriptionLength)+"…") || strings.Contains(text, strings.Repeat("x", defaultDigestDescriptionLength+1)) {
+		t.Errorf("digest does not show %d characters of the description:\n%s", defaultDigestDescriptionLength, text)
+	}
+
+	reply := setDigestLength(ctx, cfg, db, 10, "50").(tgbotapi.MessageConfig).Text
+	if reply != "Digests in this chat show up to 50 characters of each description." {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if text := digestText(); !strings.Contains(text, strings.Repeat("x", 50)+"…") || strings.Contains(text, strings.Repeat("x", 51)) {
+		t.Errorf("digest does not show 50 characters of the description:\n%s", text)
+	}
+
+	if reply := setDigestLength(ctx, cfg, db, 10, "1001").(tgbotapi.MessageConfig).Text; !strings.HasPrefix(reply, "Please provide") {
+		t.Errorf("too long digest description length was accepted: %q", reply)
+	}
+
+	// Single items are not affected by the length of digests.
+	published := time.Now()
+	item := &gofeed.Item{Title: "Long", Description: description, PublishedParsed: &published}
+	if text := itemMessage(10, formatFull, "", item, itemOptions{maxDescription: cfg.Bot.MaxDescriptionLength}).(tgbotapi.MessageConfig).Text; !strings.Contains(text, description) {
+		t.Errorf("single item does not show the whole description:\n%s", text)
+	}
+}
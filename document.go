@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+var errDocumentTooLarge = errors.New("file is too large")
+
+// documentOf returns the document attached to msg or, failing that, to the
+// message it replies to.
+func documentOf(msg *tgbotapi.Message) *tgbotapi.Document {
+	if msg.Document != nil {
+		return msg.Document
+	}
+
+	if msg.ReplyToMessage != nil {
+		return msg.ReplyToMessage.Document
+	}
+
+	return nil
+}
+
+// downloadDocument fetches a file that was sent to the bot. Files larger than
+// maxSize bytes are rejected.
+func downloadDocument(bot *tgbotapi.BotAPI, doc *tgbotapi.Document, maxSize int64) ([]byte, error) {
+	if int64(doc.FileSize) > maxSize {
+		return nil, errDocumentTooLarge
+	}
+
+	url, err := bot.GetFileDirectURL(doc.FileID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > maxSize {
+		return nil, errDocumentTooLarge
+	}
+
+	return data, nil
+}
+
+// captionCommand returns the command in the caption of a document, since
+// files can be sent with a command like /import as caption.
+func captionCommand(msg *tgbotapi.Message) (cmd, args string, ok bool) {
+	if msg.Document == nil || !strings.HasPrefix(msg.Caption, "/") {
+		return "", "", false
+	}
+
+	fields := strings.SplitN(msg.Caption[1:], " ", 2)
+	cmd = strings.SplitN(fields[0], "@", 2)[0]
+	if len(fields) == 2 {
+		args = strings.TrimSpace(fields[1])
+	}
+
+	return cmd, args, cmd != ""
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// feedCacheTTL is how long a parsed feed is kept after it was fetched last.
+const feedCacheTTL = time.Minute * 30
+
+// feedCacheSize is how many parsed feeds are kept at most. The feeds that
+// were used least recently are dropped first.
+const feedCacheSize = 200
+
+// feedCache keeps the feeds that were parsed recently, keyed by their URL as
+// stored in the database, so that they are not fetched again right away.
+type feedCache struct {
+	ttl  time.Duration
+	size int
+
+	mu    sync.Mutex
+	order *list.List // of *cachedFeed, most recently used first
+	feeds map[string]*list.Element
+}
+
+type cachedFeed struct {
+	url     string
+	feed    *gofeed.Feed
+	fetched time.Time
+
+	// updated is set once an update handled the items of feed, after which
+	// the update does not take it again.
+	updated bool
+}
+
+func newFeedCache(ttl time.Duration, size int) *feedCache {
+	return &feedCache{ttl: ttl, size: size, order: list.New(), feeds: make(map[string]*list.Element)}
+}
+
+// parsedFeeds is filled when feeds are added, updated or searched.
+var parsedFeeds = newFeedCache(feedCacheTTL, feedCacheSize)
+
+// Put stores the feed at url, which was fetched at now outside an update.
+// The next update of the feed may take it instead of fetching the feed. The
+// feed must not be modified afterwards.
+func (c *feedCache) Put(url string, feed *gofeed.Feed, now time.Time) {
+	c.put(&cachedFeed{url: url, feed: feed, fetched: now})
+}
+
+// PutUpdated stores the feed at url, which an update fetched at now and
+// handles the items of.
+func (c *feedCache) PutUpdated(url string, feed *gofeed.Feed, now time.Time) {
+	c.put(&cachedFeed{url: url, feed: feed, fetched: now, updated: true})
+}
+
+func (c *feedCache) put(cached *cachedFeed) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.feeds[cached.url]; ok {
+		c.order.Remove(e)
+	}
+	c.feeds[cached.url] = c.order.PushFront(cached)
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *feedCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.feeds, e.Value.(*cachedFeed).url)
+}
+
+// lookup returns the entry of url if it was fetched within the TTL and marks
+// it as used. Expired entries are dropped. c.mu must be held.
+func (c *feedCache) lookup(url string, now time.Time) *cachedFeed {
+	e, ok := c.feeds[url]
+	if !ok {
+		return nil
+	}
+
+	cached := e.Value.(*cachedFeed)
+	if now.Sub(cached.fetched) >= c.ttl {
+		c.remove(e)
+		return nil
+	}
+
+	c.order.MoveToFront(e)
+	return cached
+}
+
+// Touch marks the cached copy of the feed as current at now, for example
+// because the server said that it did not change.
+func (c *feedCache) Touch(url string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached := c.lookup(url, now); cached != nil {
+		cached.fetched = now
+	}
+}
+
+// Get returns the feed at url if it was fetched within the TTL.
+func (c *feedCache) Get(url string, now time.Time) (*gofeed.Feed, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached := c.lookup(url, now)
+	if cached == nil {
+		return nil, false
+	}
+
+	return cached.feed, true
+}
+
+// TakeForUpdate returns the feed at url if it was fetched within the TTL and
+// no update handled its items yet. The feed then counts as handled.
+func (c *feedCache) TakeForUpdate(url string, now time.Time) (*gofeed.Feed, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached := c.lookup(url, now)
+	if cached == nil || cached.updated {
+		return nil, false
+	}
+
+	cached.updated = true
+	return cached.feed, true
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+	"github.com/mmcdole/gofeed"
+)
+
+func TestFeedCache(t *testing.T) {
+	now := time.Now()
+	cache := newFeedCache(time.Hour, feedCacheSize)
+	feed := &gofeed.Feed{Title: "a"}
+
+	if _, ok := cache.Get("//a", now); ok {
+		t.Fatal("empty cache returned a feed")
+	}
+
+	cache.Put("//a", feed, now)
+	if got, ok := cache.Get("//a", now.Add(59*time.Minute)); !ok || got != feed {
+		t.Fatalf("Get within the TTL = %v, %v", got, ok)
+	}
+	if _, ok := cache.Get("//b", now); ok {
+		t.Fatal("Get of another URL returned the feed")
+	}
+	if _, ok := cache.Get("//a", now.Add(time.Hour)); ok {
+		t.Fatal("Get after the TTL returned the feed")
+	}
+	if n := len(cache.feeds); n != 0 {
+		t.Fatalf("cache holds %d feeds after expiry, want 0", n)
+	}
+
+	// A feed that did not change stays cached.
+	cache.Put("//a", feed, now)
+	cache.Touch("//a", now.Add(30*time.Minute))
+	if _, ok := cache.Get("//a", now.Add(80*time.Minute)); !ok {
+		t.Fatal("touched feed expired")
+	}
+
+	// Touching an expired feed does not bring it back.
+	cache.Touch("//a", now.Add(3*time.Hour))
+	if _, ok := cache.Get("//a", now.Add(3*time.Hour)); ok {
+		t.Fatal("expired feed was brought back")
+	}
+}
+
+func TestFeedCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	now := time.Now()
+	cache := newFeedCache(time.Hour, 2)
+
+	cache.Put("//a", &gofeed.Feed{}, now)
+	cache.Put("//b", &gofeed.Feed{}, now)
+	cache.Get("//a", now)
+	cache.Put("//c", &gofeed.Feed{}, now)
+
+	for url, want := range map[string]bool{"//a": true, "//b": false, "//c": true} {
+		if _, ok := cache.Get(url, now); ok != want {
+			t.Errorf("%s cached = %v, want %v", url, ok, want)
+		}
+	}
+}
+
+func TestFeedCacheTakeForUpdate(t *testing.T) {
+	now := time.Now()
+	cache := newFeedCache(time.Hour, feedCacheSize)
+	feed := &gofeed.Feed{}
+
+	cache.Put("//a", feed, now)
+	if _, ok := cache.TakeForUpdate("//a", now.Add(time.Hour)); ok {
+		t.Fatal("expired feed was taken")
+	}
+
+	cache.Put("//a", feed, now)
+	if got, ok := cache.TakeForUpdate("//a", now); !ok || got != feed {
+		t.Fatalf("TakeForUpdate = %v, %v", got, ok)
+	}
+	if _, ok := cache.TakeForUpdate("//a", now); ok {
+		t.Fatal("feed was taken twice")
+	}
+	if _, ok := cache.Get("//a", now); !ok {
+		t.Fatal("taken feed is not cached for others")
+	}
+
+	cache.PutUpdated("//b", feed, now)
+	if _, ok := cache.TakeForUpdate("//b", now); ok {
+		t.Fatal("feed stored by an update was taken")
+	}
+}
+
+func TestUpdateFeedTakesAddedFeedFromCache(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{MaxDescriptionLength: defaultMaxDescriptionLength}}
+
+	var requests int
+	srv := newTestFeedServer(t, &requests)
+	addTestFeed(t, db, 1, 10, srv.URL)
+
+	// The feed was fetched when it was added.
+	parsed, _, err := fetchFeed(ctx, srv.Client(), srv.URL, HTTPCache{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := dueFeed(t, db)
+	parsedFeeds.Put(info.URL, parsed, time.Now())
+	requests = 0
+
+	var sent []string
+	send := func(c tgbotapi.Chattable) {
+		sent = append(sent, c.(tgbotapi.MessageConfig).Text)
+	}
+
+	var count int64
+	if err := updateFeed(ctx, cfg, db, srv.Client(), send, info, &count); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 || len(sent) != 1 {
+		t.Fatalf("first update made %d requests and sent %q, want no request and the item", requests, sent)
+	}
+
+	// The update does not take its own parse again.
+	if err := updateFeed(ctx, cfg, db, srv.Client(), send, dueFeed(t, db), &count); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 || len(sent) != 1 {
+		t.Fatalf("second update made %d requests and sent %q, want one request and nothing new", requests, sent)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+const removeFeedCallbackPrefix = "removefeed:"
+const removeButtonsPerRow = 5
+
+// Listings of chats with more than feedsPerPage feeds are split into pages.
+const feedsPerPage = 10
+const feedsPageCallbackPrefix = "feeds:"
+
+// feedsListing returns the text of /feeds for the given page of the chat's
+// feeds and the keyboard to remove them and to turn pages. The page is
+// clamped to the existing ones. The keyboard is nil if there are no feeds.
+func feedsListing(ctx context.Context, db *DB, chatID int64, page int) (string, *tgbotapi.InlineKeyboardMarkup, error) {
+	feeds, err := db.FeedsByChat(ctx, chatID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	header := "Feeds in this chat:\n"
+	if interval, err := db.ChatInterval(ctx, chatID); err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("get chat interval")
+	} else if interval > 0 {
+		header = fmt.Sprintf("Feeds in this chat (updated every %s):\n", interval)
+	}
+
+	filters, err := db.ChatFilters(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("get chat filters")
+	}
+
+	mutes, err := db.ChatMutes(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("get chat mutes")
+	}
+
+	now := time.Now()
+
+	var entries []string
+	for _, feed := range feeds {
+		state := "active"
+		if isDormant(feed.PublishInterval) {
+			state = "dormant"
+		}
+
+		entry := fmt.Sprintf("[%d] %s (url %s, %s)\n", feed.ID, feed.Title, feed.FullURL(), state)
+		if feed.Note != "" {
+			entry += fmt.Sprintf("    Note: %s\n", feed.Note)
+		}
+		if keywords := filters[feed.URL]; len(keywords) > 0 {
+			entry += fmt.Sprintf("    Filter: %s\n", strings.Join(keywords, ", "))
+		}
+		if keywords := mutes[feed.URL]; len(keywords) > 0 {
+			entry += fmt.Sprintf("    Muted: %s\n", strings.Join(keywords, ", "))
+		}
+		if now.Before(feed.SnoozedUntil) {
+			entry += fmt.Sprintf("    Snoozed for another %s\n", snoozeLeft(feed.SnoozedUntil, now))
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(feeds) == 0 {
+		return "No feeds in this chat.", nil, nil
+	}
+
+	pages := (len(feeds) + feedsPerPage - 1) / feedsPerPage
+	if page >= pages {
+		page = pages - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+
+	first := page * feedsPerPage
+	last := first + feedsPerPage
+	if last > len(feeds) {
+		last = len(feeds)
+	}
+
+	text := header + strings.Join(entries[first:last], "")
+	if pages > 1 {
+		text += fmt.Sprintf("Page %d of %d\n", page+1, pages)
+	}
+
+	keyboard := feedsKeyboard(chatID, feeds[first:last], page, pages)
+	return text, &keyboard, nil
+}
+
+// feedsKeyboard has a button to remove each of the listed feeds and, if there
+// is more than one page, buttons to turn pages. The remove buttons refer to
+// the feeds by their ID in the database, which, unlike their number, does not
+// change when other feeds are removed.
+func feedsKeyboard(chatID int64, feeds []Feed, page, pages int) tgbotapi.InlineKeyboardMarkup {
+	suffix := ":" + strconv.Itoa(page)
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	var row []tgbotapi.InlineKeyboardButton
+	for _, feed := range feeds {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("Remove %d", feed.ID), removeFeedCallbackPrefix+strconv.FormatInt(feed.FeedID, 10)+suffix))
+		if len(row) == removeButtonsPerRow {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+
+	if pages > 1 {
+		prefix := feedsPageCallbackPrefix + strconv.FormatInt(chatID, 10) + ":"
+
+		var nav []tgbotapi.InlineKeyboardButton
+		if page > 0 {
+			nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("Prev", prefix+strconv.Itoa(page-1)))
+		}
+		if page < pages-1 {
+			nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("Next", prefix+strconv.Itoa(page+1)))
+		}
+		rows = append(rows, nav)
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// listFeeds handles the /feeds command.
+func listFeeds(ctx context.Context, db *DB, chatID int64) tgbotapi.Chattable {
+	text, keyboard, err := feedsListing(ctx, db, chatID, 0)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("enumerating feeds of chat")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	if keyboard != nil {
+		msg.ReplyMarkup = *keyboard
+	}
+
+	return msg
+}
+
+// editFeedsListing replaces the listing in the message with the given page.
+func editFeedsListing(ctx context.Context, db *DB, chatID int64, messageID int, page int) tgbotapi.Chattable {
+	text, keyboard, err := feedsListing(ctx, db, chatID, page)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("enumerating feeds of chat")
+		return tgbotapi.NewEditMessageText(chatID, messageID, backendError(err))
+	}
+
+	edit := tgbotapi.NewEditMessageText(chatID, messageID, text)
+	edit.ReplyMarkup = keyboard
+	return edit
+}
+
+// feedsPageCallback shows the page of the listing whose button was pressed.
+func feedsPageCallback(ctx context.Context, db *DB, chatID int64, messageID int, data string) tgbotapi.Chattable {
+	parts := strings.Split(strings.TrimPrefix(data, feedsPageCallbackPrefix), ":")
+	if len(parts) != 2 || parts[0] != strconv.FormatInt(chatID, 10) {
+		return nil
+	}
+
+	page, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil
+	}
+
+	return editFeedsListing(ctx, db, chatID, messageID, page)
+}
+
+// removeFeedCallback removes the feed whose remove button was pressed and
+// updates the listing to show the remaining feeds on the same page.
+func removeFeedCallback(ctx context.Context, db *DB, chatID int64, messageID int, data string) tgbotapi.Chattable {
+	parts := strings.Split(strings.TrimPrefix(data, removeFeedCallbackPrefix), ":")
+	if len(parts) != 2 {
+		return nil
+	}
+
+	feedID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	page, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil
+	}
+
+	if _, err := db.RemoveSub(ctx, chatID, feedID); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"Feed ID": feedID,
+		}).Error("remove feed from chat failed")
+
+		return tgbotapi.NewEditMessageText(chatID, messageID, backendError(err))
+	}
+
+	return editFeedsListing(ctx, db, chatID, messageID, page)
+}
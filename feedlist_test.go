@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+// buttonData returns the callback data of all buttons of keyboard.
+func buttonData(keyboard tgbotapi.InlineKeyboardMarkup) []string {
+	var data []string
+	for _, row := range keyboard.InlineKeyboard {
+		for _, button := range row {
+			data = append(data, *button.CallbackData)
+		}
+	}
+
+	return data
+}
+
+func TestRemoveFeedButtons(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: name, URL: "//example.com/" + name, Scheme: "https"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg := listFeeds(ctx, db, 10).(tgbotapi.MessageConfig)
+	buttons := buttonData(msg.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup))
+	if len(buttons) != 3 {
+		t.Fatalf("listing has %d buttons, want 3", len(buttons))
+	}
+
+	edit := removeFeedCallback(ctx, db, 10, 1, buttons[1]).(tgbotapi.EditMessageTextConfig)
+	if strings.Contains(edit.Text, "example.com/b") || !strings.Contains(edit.Text, "[2] c") {
+		t.Fatalf("listing after removing b:\n%s", edit.Text)
+	}
+	if got := buttonData(*edit.ReplyMarkup); len(got) != 2 || got[0] != buttons[0] || got[1] != buttons[2] {
+		t.Fatalf("buttons after removing b = %q", got)
+	}
+
+	// The buttons of the old listing still refer to the same feeds.
+	removeFeedCallback(ctx, db, 10, 1, buttons[1])
+	removeFeedCallback(ctx, db, 10, 1, buttons[2])
+	if got := feedTitles(t, db, 10); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("feeds after removing c with an old button = %q", got)
+	}
+
+	edit = removeFeedCallback(ctx, db, 10, 1, buttons[0]).(tgbotapi.EditMessageTextConfig)
+	if edit.Text != "No feeds in this chat." || edit.ReplyMarkup != nil {
+		t.Fatalf("listing after removing all feeds: %q, %v", edit.Text, edit.ReplyMarkup)
+	}
+
+	if res := removeFeedCallback(ctx, db, 10, 1, removeFeedCallbackPrefix+"x"); res != nil {
+		t.Fatalf("invalid callback data answered with %v", res)
+	}
+}
+
+func TestAllowRequest(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	user := &tgbotapi.User{ID: 1, FirstName: "Alice"}
+	other := &tgbotapi.User{ID: 2, FirstName: "Bob"}
+
+	// Requests are limited whether they are logged, and counted in the
+	// database, or not, and counted in memory.
+	for _, logRequests := range []bool{true, false} {
+		if _, err := db.q.ExecContext(ctx, "DELETE FROM requests"); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &Config{Bot: BotConfig{LogRequests: logRequests, MaxRequests: 5, RequestsWindow: duration{time.Minute}}}
+		limiter := newRateLimiter(cfg.Bot.MaxRequests, cfg.Bot.RequestsWindow.Duration)
+		allow := func(user *tgbotapi.User) bool {
+			return allowRequest(ctx, cfg, db, dbAuditSink{db}, limiter, user, 10, "feeds", "")
+		}
+
+		allowed := 0
+		for i := 0; i < 8; i++ {
+			if allow(user) {
+				allowed++
+			}
+		}
+		if allowed != 5 {
+			t.Errorf("log requests %v: %d requests were allowed, want 5", logRequests, allowed)
+		}
+		if !allow(other) {
+			t.Errorf("log requests %v: request of another user was limited", logRequests)
+		}
+
+		var stored int
+		if err := db.q.QueryRowContext(ctx, "SELECT COUNT(*) FROM requests").Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[bool]int{true: 6, false: 0}[logRequests]; stored != want {
+			t.Errorf("log requests %v: %d requests were stored, want %d", logRequests, stored, want)
+		}
+	}
+
+	// Requests stored before the bot started count, but the database is only
+	// asked once per user.
+	if _, err := db.q.ExecContext(ctx, "DELETE FROM requests"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.logRequest(ctx, time.Now(), "Alice", "/feeds", int64(user.ID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := &Config{Bot: BotConfig{LogRequests: true, MaxRequests: 5, RequestsWindow: duration{time.Minute}}}
+	limiter := newRateLimiter(stored.Bot.MaxRequests, stored.Bot.RequestsWindow.Duration)
+	if !allowRequest(ctx, stored, db, dbAuditSink{db}, limiter, user, 10, "feeds", "") {
+		t.Fatal("request within the limit was denied")
+	}
+	if _, err := db.q.ExecContext(ctx, "DELETE FROM requests"); err != nil {
+		t.Fatal(err)
+	}
+	allowed := 1
+	for i := 0; i < 5; i++ {
+		if allowRequest(ctx, stored, db, dbAuditSink{db}, limiter, user, 10, "feeds", "") {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("%d requests were allowed after 3 stored ones, want 2", allowed)
+	}
+
+	// The limit can be turned off.
+	cfg := &Config{Bot: BotConfig{MaxRequests: -1}}
+	limiter = newRateLimiter(cfg.Bot.MaxRequests, time.Minute)
+	for i := 0; i < 30; i++ {
+		if !allowRequest(ctx, cfg, db, dbAuditSink{db}, limiter, user, 10, "feeds", "") {
+			t.Fatal("request was limited although the limit is off")
+		}
+	}
+}
+
+func TestFeedsPages(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	addFeeds := func(from, to int) {
+		for i := from; i <= to; i++ {
+			if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: fmt.Sprint("feed ", i), URL: fmt.Sprint("//example.com/", i), Scheme: "https"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Small chats get no page buttons.
+	addFeeds(1, feedsPerPage)
+	msg := listFeeds(ctx, db, 10).(tgbotapi.MessageConfig)
+	if strings.Contains(msg.Text, "Page") {
+		t.Fatalf("listing of %d feeds has pages:\n%s", feedsPerPage, msg.Text)
+	}
+	if buttons := buttonData(msg.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup)); len(buttons) != feedsPerPage {
+		t.Fatalf("listing of %d feeds has %d buttons", feedsPerPage, len(buttons))
+	}
+
+	addFeeds(feedsPerPage+1, 2*feedsPerPage+3)
+	msg = listFeeds(ctx, db, 10).(tgbotapi.MessageConfig)
+	buttons := buttonData(msg.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup))
+	if !strings.Contains(msg.Text, "[10] feed 10") || strings.Contains(msg.Text, "[11]") || !strings.Contains(msg.Text, "Page 1 of 3") {
+		t.Fatalf("first page:\n%s", msg.Text)
+	}
+	if len(buttons) != feedsPerPage+1 || buttons[feedsPerPage] != "feeds:10:1" {
+		t.Fatalf("buttons of first page = %q", buttons)
+	}
+
+	if res := feedsPageCallback(ctx, db, 20, 1, "feeds:10:1"); res != nil {
+		t.Fatalf("page of another chat was shown: %v", res)
+	}
+
+	edit := feedsPageCallback(ctx, db, 10, 1, "feeds:10:2").(tgbotapi.EditMessageTextConfig)
+	buttons = buttonData(*edit.ReplyMarkup)
+	if !strings.Contains(edit.Text, "[23] feed 23") || strings.Contains(edit.Text, "[20]") || !strings.Contains(edit.Text, "Page 3 of 3") {
+		t.Fatalf("last page:\n%s", edit.Text)
+	}
+	if len(buttons) != 4 || buttons[3] != "feeds:10:1" {
+		t.Fatalf("buttons of last page = %q", buttons)
+	}
+
+	// Removing the feeds of the last page shows the page before it.
+	for _, data := range buttons[:3] {
+		edit = removeFeedCallback(ctx, db, 10, 1, data).(tgbotapi.EditMessageTextConfig)
+	}
+	if !strings.Contains(edit.Text, "[20] feed 20") || !strings.Contains(edit.Text, "Page 2 of 2") {
+		t.Fatalf("listing after emptying the last page:\n%s", edit.Text)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+var errNoHost = errors.New("URL has no host")
+
+// trackingParams are query parameters that only tell the publisher where a
+// link was found. They do not change the feed, so they are dropped.
+var trackingParams = map[string]bool{
+	"fbclid": true,
+	"gclid":  true,
+	"mc_cid": true,
+	"mc_eid": true,
+}
+
+func isTrackingParam(key string) bool {
+	key = strings.ToLower(key)
+	return strings.HasPrefix(key, "utm_") || trackingParams[key]
+}
+
+// withoutCredentials returns rawURL without the user name and password.
+func withoutCredentials(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+
+	u.User = nil
+	return u.String()
+}
+
+// canonicalizeURL brings a feed URL into a canonical form, so that URLs that
+// only differ in the case of the host, a default port, a fragment, tracking
+// parameters, the order of the query or a trailing slash refer to the same
+// feed. The scheme is kept as it is; a URL without one may omit the "//".
+func canonicalizeURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.HasPrefix(raw, "//") && !strings.Contains(raw, "://") {
+		raw = "//" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", errNoHost
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (port == "80" && u.Scheme != "https") || (port == "443" && u.Scheme != "http") {
+		u.Host = u.Hostname()
+		if strings.Contains(u.Host, ":") {
+			u.Host = "[" + u.Host + "]"
+		}
+	}
+
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	if u.RawQuery != "" {
+		if query, err := url.ParseQuery(u.RawQuery); err == nil {
+			for key := range query {
+				if isTrackingParam(key) {
+					delete(query, key)
+				}
+			}
+			u.RawQuery = query.Encode()
+		}
+	}
+	u.ForceQuery = false
+
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+	if u.Path == "" {
+		u.Path = "/"
+		u.RawPath = ""
+	}
+
+	return u.String(), nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestCanonicalizeURL(t *testing.T) {
+	classes := []struct {
+		want string
+		urls []string
+	}{
+		{"https://example.com/feed", []string{
+			"https://example.com/feed",
+			"https://example.com/feed/",
+			"https://EXAMPLE.com/feed",
+			"https://example.com:443/feed",
+			"https://example.com/feed#latest",
+			"https://example.com/feed?utm_source=x&utm_medium=y",
+			"https://example.com/feed?fbclid=abc",
+			" https://example.com/feed ",
+		}},
+		{"//example.com/feed", []string{
+			"example.com/feed",
+			"//example.com/feed/",
+			"example.com:80/feed",
+			"example.com:443/feed?",
+		}},
+		{"http://example.com:8080/", []string{
+			"http://example.com:8080",
+			"http://example.com:8080/",
+			"http://Example.COM:8080/#top",
+		}},
+		{"https://example.com:80/rss?a=1&b=2", []string{
+			"https://example.com:80/rss?b=2&a=1",
+			"https://example.com:80/rss/?a=1&utm_campaign=z&b=2",
+		}},
+	}
+
+	for _, class := range classes {
+		for _, raw := range class.urls {
+			got, err := canonicalizeURL(raw)
+			if err != nil {
+				t.Errorf("canonicalizeURL(%q): %v", raw, err)
+			} else if got != class.want {
+				t.Errorf("canonicalizeURL(%q) = %q, want %q", raw, got, class.want)
+			}
+		}
+	}
+
+	for _, raw := range []string{"", "https://", "https://exa mple.com/%zz"} {
+		if got, err := canonicalizeURL(raw); err == nil {
+			t.Errorf("canonicalizeURL(%q) = %q, want error", raw, got)
+		}
+	}
+}
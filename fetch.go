@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/rss"
+	"github.com/sirupsen/logrus"
+	htmlparse "golang.org/x/net/html"
+)
+
+const defaultFetchAttempts = 3
+
+// retryBaseDelay is the delay before the first retry of a failed fetch. It
+// doubles with each further retry.
+var retryBaseDelay = time.Second
+
+// userAgentTransport sets the User-Agent header of all requests.
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.next.RoundTrip(req)
+}
+
+// newFeedClient returns the client that all feeds are fetched with.
+func newFeedClient(cfg *Config) *http.Client {
+	return &http.Client{
+		Timeout: cfg.Bot.FeedFetchTimeout.Duration,
+		Transport: &userAgentTransport{
+			userAgent: cfg.Bot.UserAgent,
+			next:      http.DefaultTransport,
+		},
+	}
+}
+
+var errNotModified = errors.New("feed was not modified")
+
+// notAFeedError is returned for responses that are not feeds, like web pages.
+// Links are the feeds that the page refers to, if any.
+type notAFeedError struct {
+	Links []string
+}
+
+func (e *notAFeedError) Error() string {
+	return fmt.Sprintf("not a feed (%d feeds linked)", len(e.Links))
+}
+
+// feedLinkTypes are the types of the alternate links of a web page that
+// refer to feeds.
+var feedLinkTypes = map[string]bool{
+	"application/rss+xml":   true,
+	"application/atom+xml":  true,
+	"application/feed+json": true,
+}
+
+// discoverFeedLinks returns the URLs of the feeds that the HTML page at base
+// links to with <link rel="alternate">.
+func discoverFeedLinks(base *url.URL, r io.Reader) []string {
+	var links []string
+	seen := make(map[string]bool)
+
+	z := htmlparse.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case htmlparse.ErrorToken:
+			return links
+
+		case htmlparse.StartTagToken, htmlparse.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "link" || !hasAttr {
+				continue
+			}
+
+			var rel, typ, href string
+			for more := true; more; {
+				var key, val []byte
+				key, val, more = z.TagAttr()
+				switch string(key) {
+				case "rel":
+					rel = strings.ToLower(string(val))
+				case "type":
+					typ = strings.ToLower(strings.TrimSpace(string(val)))
+				case "href":
+					href = strings.TrimSpace(string(val))
+				}
+			}
+
+			if href == "" || !feedLinkTypes[typ] || !hasToken(rel, "alternate") {
+				continue
+			}
+
+			u, err := base.Parse(href)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				continue
+			}
+
+			if link := u.String(); !seen[link] {
+				seen[link] = true
+				links = append(links, link)
+			}
+		}
+	}
+}
+
+// hasToken reports whether the space separated list contains token.
+func hasToken(list, token string) bool {
+	for _, t := range strings.Fields(list) {
+		if t == token {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ttlKey is the key under which rssTranslator keeps the <ttl> of RSS feeds
+// in gofeed.Feed.Custom.
+const ttlKey = "ttl"
+
+// rssTranslator keeps the <ttl> of RSS feeds, which the generic feed drops.
+type rssTranslator struct {
+	gofeed.DefaultRSSTranslator
+}
+
+func (t *rssTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
+	f, err := t.DefaultRSSTranslator.Translate(feed)
+	if err != nil {
+		return nil, err
+	}
+
+	if r, ok := feed.(*rss.Feed); ok && r.TTL != "" {
+		if f.Custom == nil {
+			f.Custom = make(map[string]string)
+		}
+		f.Custom[ttlKey] = r.TTL
+	}
+
+	return f, nil
+}
+
+func newFeedParser() *gofeed.Parser {
+	parser := gofeed.NewParser()
+	parser.RSSTranslator = &rssTranslator{}
+	return parser
+}
+
+// HTTPCache holds the validators of the last response for a feed, which are
+// sent along with the next request so the server can tell us that nothing
+// changed.
+type HTTPCache struct {
+	ETag         string
+	LastModified string
+}
+
+// fetchFeed fetches and parses the feed at url. It returns errNotModified if
+// the server reports that the feed did not change since the response that
+// cache was taken from, and the validators of the new response otherwise.
+func fetchFeed(ctx context.Context, client *http.Client, url string, cache HTTPCache) (*gofeed.Feed, HTTPCache, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, cache, err
+	}
+
+	// Credentials in the URL are sent in the header instead, so that they
+	// do not show up in errors.
+	if user := req.URL.User; user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+		req.URL.User = nil
+	}
+
+	if cache.ETag != "" {
+		req.Header.Set("If-None-Match", cache.ETag)
+	}
+	if cache.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cache.LastModified)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, cache, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, cache, errNotModified
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, cache, gofeed.HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, cache, err
+	}
+
+	feed, err := newFeedParser().Parse(bytes.NewReader(body))
+	if err == gofeed.ErrFeedTypeNotDetected {
+		return nil, cache, &notAFeedError{Links: discoverFeedLinks(resp.Request.URL, bytes.NewReader(body))}
+	} else if err != nil {
+		return nil, cache, err
+	}
+
+	return feed, HTTPCache{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// isTransient reports whether fetching a feed failed in a way that may go
+// away by trying again, like a network error or an overloaded server.
+func isTransient(err error) bool {
+	var httpErr gofeed.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500 || httpErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// fetchFeedWithRetry is like fetchFeed, but makes up to attempts tries while
+// fetching fails for transient reasons. It gives up early if ctx would expire
+// before the next try.
+func fetchFeedWithRetry(ctx context.Context, client *http.Client, url string, cache HTTPCache, attempts int) (*gofeed.Feed, HTTPCache, error) {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		feed, newCache, err := fetchFeed(ctx, client, url, cache)
+		if err == nil || attempt >= attempts || !isTransient(err) || ctx.Err() != nil {
+			return feed, newCache, err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return feed, newCache, err
+		}
+
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Feed":    withoutCredentials(url),
+			"Attempt": attempt,
+			"Delay":   delay,
+		}).Debug("fetching feed failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			return feed, newCache, err
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+const testFeed = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Test</title>
+<item><title>First</title><link>https://example.com/1</link><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate></item>
+</channel></rss>`
+
+// newTestFeedServer serves testFeed with an ETag and answers requests that
+// send the ETag back with 304. It counts the requests in *requests.
+func newTestFeedServer(t *testing.T, requests *int) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, testFeed)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestFetchFeedNotModified(t *testing.T) {
+	var requests int
+	srv := newTestFeedServer(t, &requests)
+	ctx := context.Background()
+
+	feed, cache, err := fetchFeed(ctx, srv.Client(), srv.URL, HTTPCache{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Items) != 1 {
+		t.Fatalf("got %d items, want 1", len(feed.Items))
+	}
+	if cache.ETag != `"v1"` {
+		t.Fatalf("ETag = %q, want %q", cache.ETag, `"v1"`)
+	}
+
+	if _, _, err := fetchFeed(ctx, srv.Client(), srv.URL, cache); err != errNotModified {
+		t.Fatalf("fetch with validators: err = %v, want errNotModified", err)
+	}
+}
+
+// newFlakyFeedServer fails the first failures requests with status and
+// serves testFeed afterwards. It counts the requests in *requests.
+func newFlakyFeedServer(t *testing.T, failures, status int, requests *int) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+
+		if *requests <= failures {
+			w.WriteHeader(status)
+			return
+		}
+
+		fmt.Fprint(w, testFeed)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestFetchFeedWithRetry(t *testing.T) {
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	ctx := context.Background()
+
+	var requests int
+	srv := newFlakyFeedServer(t, 2, http.StatusServiceUnavailable, &requests)
+	if _, _, err := fetchFeedWithRetry(ctx, srv.Client(), srv.URL, HTTPCache{}, 3); err != nil {
+		t.Fatalf("third attempt failed: %v", err)
+	}
+	if requests != 3 {
+		t.Fatalf("made %d requests, want 3", requests)
+	}
+
+	requests = 0
+	srv = newFlakyFeedServer(t, 3, http.StatusServiceUnavailable, &requests)
+	if _, _, err := fetchFeedWithRetry(ctx, srv.Client(), srv.URL, HTTPCache{}, 3); err == nil {
+		t.Fatal("fetch succeeded after all attempts failed")
+	}
+	if requests != 3 {
+		t.Fatalf("made %d requests, want 3", requests)
+	}
+
+	// Errors that are not transient are not retried.
+	requests = 0
+	srv = newFlakyFeedServer(t, 1, http.StatusNotFound, &requests)
+	if _, _, err := fetchFeedWithRetry(ctx, srv.Client(), srv.URL, HTTPCache{}, 3); err == nil {
+		t.Fatal("fetch of missing feed succeeded")
+	}
+	if requests != 1 {
+		t.Fatalf("made %d requests for missing feed, want 1", requests)
+	}
+
+	// No retry is made if the context would expire while waiting for it.
+	retryBaseDelay = time.Hour
+	requests = 0
+	srv = newFlakyFeedServer(t, 2, http.StatusServiceUnavailable, &requests)
+	deadlineCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	if _, _, err := fetchFeedWithRetry(deadlineCtx, srv.Client(), srv.URL, HTTPCache{}, 3); err == nil {
+		t.Fatal("fetch succeeded without retry")
+	}
+	if requests != 1 {
+		t.Fatalf("made %d requests before deadline, want 1", requests)
+	}
+}
+
+func TestUpdateFeedRecordsErrorAfterRetries(t *testing.T) {
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{MaxDescriptionLength: defaultMaxDescriptionLength, FetchAttempts: 3}}
+	send := func(msg tgbotapi.Chattable) {}
+
+	for _, tt := range []struct {
+		failures   int
+		feedErrors int
+	}{{2, 0}, {3, 1}} {
+		var requests int
+		srv := newFlakyFeedServer(t, tt.failures, http.StatusBadGateway, &requests)
+		addTestFeed(t, db, 1, 10, srv.URL)
+
+		info, err := db.FeedByURL(ctx, withoutScheme(srv.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info.Scheme = "http"
+
+		var updates int64
+		updateFeed(ctx, cfg, db, srv.Client(), send, info, &updates)
+
+		if n, err := db.RecentFeedErrors(ctx, time.Now().Add(-time.Hour), info.ID); err != nil || n != tt.feedErrors {
+			t.Fatalf("%d failed fetches recorded %d feed errors (err %v), want %d", tt.failures, n, err, tt.feedErrors)
+		}
+	}
+}
+
+func TestDiscoverFeedLinks(t *testing.T) {
+	base, _ := url.Parse("https://example.com/blog/")
+	page := `<html><head>
+<link rel="stylesheet" type="text/css" href="/style.css">
+<link rel="alternate" type="application/rss+xml" href="feed.xml">
+<LINK REL="Alternate feed" TYPE="application/atom+xml" HREF="https://example.com/atom">
+<link rel="alternate" type="application/rss+xml" href="/blog/feed.xml">
+<link rel="alternate" type="application/rss+xml" href="ftp://example.com/feed">
+</head><body><a rel="alternate" type="application/rss+xml" href="/not-a-link-tag">x</a></body></html>`
+
+	links := discoverFeedLinks(base, strings.NewReader(page))
+	want := []string{"https://example.com/blog/feed.xml", "https://example.com/atom"}
+	if !reflect.DeepEqual(links, want) {
+		t.Fatalf("got %q, want %q", links, want)
+	}
+}
+
+func TestAddFeedDiscoversLinkedFeed(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{UserAgent: defaultUserAgent}}
+	user := tgbotapi.User{ID: 1, UserName: "alice"}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/blog":
+			fmt.Fprint(w, `<html><head><link rel="alternate" type="application/rss+xml" href="/feed"></head></html>`)
+		case "/broken":
+			fmt.Fprint(w, `<html><head><link rel="alternate" type="application/rss+xml" href="/missing"></head></html>`)
+		case "/feed":
+			fmt.Fprint(w, testFeed)
+		case "/plain":
+			fmt.Fprint(w, `<html><body>Hello</body></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	text := addFeed(ctx, cfg, db, user, 10, 0, srv.URL+"/blog").(tgbotapi.MessageConfig).Text
+	if text != `Feed "Test" was added to this chat.` {
+		t.Fatalf("unexpected reply %q", text)
+	}
+
+	feeds, err := db.FeedsByChat(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, feed := range feeds {
+		if feed.FullURL() != srv.URL+"/feed" {
+			t.Fatalf("subscribed to %s", feed.FullURL())
+		}
+	}
+
+	// Adding the feed again, directly or through the page, is refused.
+	for _, page := range []string{"/feed", "/blog"} {
+		text = addFeed(ctx, cfg, db, user, 10, 0, srv.URL+page).(tgbotapi.MessageConfig).Text
+		if text != "This feed is already in the chat." {
+			t.Fatalf("unexpected reply when adding %s again %q", page, text)
+		}
+	}
+	if titles := feedTitles(t, db, 10); len(titles) != 1 {
+		t.Fatalf("chat 10 has feeds %q", titles)
+	}
+
+	text = addFeed(ctx, cfg, db, user, 11, 0, srv.URL+"/broken").(tgbotapi.MessageConfig).Text
+	if !strings.Contains(text, "not a feed") || !strings.Contains(text, srv.URL+"/missing") {
+		t.Fatalf("unexpected reply for page with broken feed link %q", text)
+	}
+
+	text = addFeed(ctx, cfg, db, user, 11, 0, srv.URL+"/plain").(tgbotapi.MessageConfig).Text
+	if text != "This is a web page, not a feed. Please look for a link to its RSS or Atom feed." {
+		t.Fatalf("unexpected reply for plain page %q", text)
+	}
+
+	if titles := feedTitles(t, db, 11); len(titles) != 0 {
+		t.Fatalf("chat 11 has feeds %q", titles)
+	}
+}
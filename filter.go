@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+	"github.com/mmcdole/gofeed"
+)
+
+const maxFilterLength = 100
+const maxFiltersPerSub = 20
+
+// matchesKeyword reports whether the title or description of item contains
+// one of the keywords, ignoring case. Keywords that start with "#" match the
+// categories of item instead, compared as hashtags. Keywords are stored in
+// lower case.
+func matchesKeyword(item *gofeed.Item, keywords []string) bool {
+	text := strings.ToLower(item.Title + "\n" + stripTags(item.Description))
+
+	var tags map[string]bool
+	for _, keyword := range keywords {
+		if !strings.HasPrefix(keyword, "#") {
+			if strings.Contains(text, keyword) {
+				return true
+			}
+			continue
+		}
+
+		if tags == nil {
+			tags = make(map[string]bool)
+			for _, tag := range itemHashtags(item) {
+				tags[strings.ToLower(tag)] = true
+			}
+		}
+
+		if tag := hashtag(keyword); tag != "" && tags[tag] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filter handles the /filter command, which manages the keywords of which
+// items of a feed must contain at least one to be sent to the chat.
+func filter(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	num, keyword, err := parseKeywordArgs(args)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Usage: /filter <id> <keyword> or /filter <id> clear")
+	}
+
+	_, sub, err := db.FeedOfChat(ctx, chatID, num)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "There is no feed with this ID in this chat.")
+	}
+
+	filters, err := db.Filters(ctx, chatID, sub.FeedID)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("get filters failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	switch {
+	case keyword == "":
+		if len(filters) == 0 {
+			return tgbotapi.NewMessage(chatID, "All items of this feed are sent.")
+		}
+
+		return tgbotapi.NewMessage(chatID, "Only items containing one of these keywords are sent: "+strings.Join(filters, ", "))
+
+	case keyword == "clear":
+		if err := db.ClearFilters(ctx, chatID, num); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"Chat ID": chatID,
+				"#":       num,
+			}).Error("clear filters failed")
+
+			return tgbotapi.NewMessage(chatID, backendError(err))
+		}
+
+		return tgbotapi.NewMessage(chatID, "Filters were removed. All items of this feed are sent.")
+	}
+
+	if len(keyword) > maxFilterLength {
+		return tgbotapi.NewMessage(chatID, "This keyword is too long.")
+	}
+
+	for _, f := range filters {
+		if f == keyword {
+			return tgbotapi.NewMessage(chatID, "This keyword is already in the filters.")
+		}
+	}
+
+	if len(filters) >= maxFiltersPerSub {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("A feed can have at most %d filters.", maxFiltersPerSub))
+	}
+
+	if err := db.AddFilter(ctx, chatID, num, keyword); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("add filter failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	return tgbotapi.NewMessage(chatID, "Filter was saved. Only items containing one of these keywords are sent: "+strings.Join(append(filters, keyword), ", "))
+}
+
+// parseKeywordArgs parses the arguments "<id> <keyword>" of the keyword
+// commands. The keyword is returned in lower case and may be empty.
+func parseKeywordArgs(args string) (num int64, keyword string, err error) {
+	fields := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if num, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return
+	}
+
+	if len(fields) == 2 {
+		keyword = strings.ToLower(strings.TrimSpace(fields[1]))
+	}
+
+	return
+}
+
+// mute handles the /mute command. Items of the feed that contain a muted
+// keyword are not sent, regardless of the filters.
+func mute(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	num, keyword, err := parseKeywordArgs(args)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Usage: /mute <id> <keyword>")
+	}
+
+	_, sub, err := db.FeedOfChat(ctx, chatID, num)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "There is no feed with this ID in this chat.")
+	}
+
+	mutes, err := db.Mutes(ctx, chatID, sub.FeedID)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("get mutes failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if keyword == "" {
+		if len(mutes) == 0 {
+			return tgbotapi.NewMessage(chatID, "No keywords are muted for this feed.")
+		}
+
+		return tgbotapi.NewMessage(chatID, "Items containing one of these keywords are not sent: "+strings.Join(mutes, ", "))
+	}
+
+	if len(keyword) > maxFilterLength {
+		return tgbotapi.NewMessage(chatID, "This keyword is too long.")
+	}
+
+	for _, m := range mutes {
+		if m == keyword {
+			return tgbotapi.NewMessage(chatID, "This keyword is already muted.")
+		}
+	}
+
+	if len(mutes) >= maxFiltersPerSub {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("A feed can have at most %d muted keywords.", maxFiltersPerSub))
+	}
+
+	if err := db.AddMute(ctx, chatID, num, keyword); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("add mute failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	return tgbotapi.NewMessage(chatID, "Keyword was muted. Items containing one of these keywords are not sent: "+strings.Join(append(mutes, keyword), ", "))
+}
+
+// unmute handles the /unmute command.
+func unmute(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	num, keyword, err := parseKeywordArgs(args)
+	if err != nil || keyword == "" {
+		return tgbotapi.NewMessage(chatID, "Usage: /unmute <id> <keyword>")
+	}
+
+	removed, err := db.RemoveMute(ctx, chatID, num, keyword)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("remove mute failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if !removed {
+		return tgbotapi.NewMessage(chatID, "This keyword is not muted.")
+	}
+
+	return tgbotapi.NewMessage(chatID, "Keyword is no longer muted.")
+}
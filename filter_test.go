@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestMatchesKeyword(t *testing.T) {
+	item := &gofeed.Item{
+		Title:       "Go 1.22 is released",
+		Description: "<p>With <b>range over integers</b></p>",
+		Categories:  []string{"Golang", "Release Notes"},
+	}
+
+	tests := []struct {
+		keywords []string
+		want     bool
+	}{
+		{[]string{"released"}, true},
+		{[]string{"range over"}, true},
+		{[]string{"rust", "integers"}, true},
+		{[]string{"golang"}, false},
+		{[]string{"#golang"}, true},
+		{[]string{"#release_notes"}, true},
+		// Keywords are compared as hashtags, like the categories.
+		{[]string{"#release notes"}, true},
+		{[]string{"#release"}, false},
+		{[]string{"#go"}, false},
+		{[]string{"#"}, false},
+		{[]string{"#rust", "released"}, true},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := matchesKeyword(item, tt.keywords); got != tt.want {
+			t.Errorf("matchesKeyword(%q) = %v, want %v", tt.keywords, got, tt.want)
+		}
+	}
+
+	if matchesKeyword(&gofeed.Item{Title: "No categories"}, []string{"#golang"}) {
+		t.Error("item without categories matched a category")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+// lastSuccessfulUpdate is the time (in Unix nanoseconds) at which the last
+// periodic update finished without errors.
+var lastSuccessfulUpdate atomic.Int64
+
+// healthHandler answers liveness probes. It reports the bot as healthy if
+// it is still authorized at Telegram and the database can be reached.
+type healthHandler struct {
+	db       *DB
+	checkBot func() error
+}
+
+type healthStatus struct {
+	Status     string     `json:"status"`
+	Bot        string     `json:"bot"`
+	DB         string     `json:"db"`
+	LastUpdate *time.Time `json:"lastUpdate,omitempty"`
+
+	// Paused is set while an admin paused the delivery of items, which
+	// is why the last update may be old.
+	Paused bool `json:"paused,omitempty"`
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	status := healthStatus{Status: "ok", Bot: "ok", DB: "ok"}
+	code := http.StatusOK
+
+	if err := h.checkBot(); err != nil {
+		logrus.WithError(err).Warn("health check: bot is not authorized")
+		status.Status, status.Bot = "unavailable", err.Error()
+		code = http.StatusServiceUnavailable
+	}
+
+	if err := h.db.Ping(ctx); err != nil {
+		logrus.WithError(err).Warn("health check: cannot reach DB")
+		status.Status, status.DB = "unavailable", err.Error()
+		code = http.StatusServiceUnavailable
+	}
+
+	if n := lastSuccessfulUpdate.Load(); n != 0 {
+		t := time.Unix(0, n).UTC()
+		status.LastUpdate = &t
+	}
+
+	status.Paused = deliveryPaused.Load()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&status)
+}
+
+// serveHealth exposes the health check on addr under /healthz.
+func serveHealth(addr string, bot *tgbotapi.BotAPI, db *DB) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", &healthHandler{
+		db: db,
+		checkBot: func() error {
+			_, err := bot.GetMe()
+			return err
+		},
+	})
+
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		logrus.WithError(err).WithField("Address", addr).Fatalln("health server failed")
+	}()
+
+	logrus.WithField("Address", addr).Info("Serving health check")
+}
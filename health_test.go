@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+func checkHealth(t *testing.T, h *healthHandler) (int, healthStatus) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	var status healthStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+
+	return rec.Code, status
+}
+
+func TestHealthHandler(t *testing.T) {
+	db := openTestDB(t)
+	botErr := error(nil)
+	h := &healthHandler{db: db, checkBot: func() error { return botErr }}
+
+	lastSuccessfulUpdate.Store(0)
+	if code, status := checkHealth(t, h); code != http.StatusOK || status.LastUpdate != nil {
+		t.Fatalf("healthy bot before first update: %d %+v", code, status)
+	}
+
+	cfg := &Config{Bot: BotConfig{FetchConcurrency: 1, UpdateTimeout: duration{time.Minute}}}
+	before := time.Now()
+	if err := update(context.Background(), cfg, db, func(msg tgbotapi.Chattable) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	code, status := checkHealth(t, h)
+	if code != http.StatusOK || status.LastUpdate == nil || status.LastUpdate.Before(before.Truncate(time.Second)) {
+		t.Fatalf("healthy bot after update: %d %+v", code, status)
+	}
+
+	botErr = errors.New("Unauthorized")
+	if code, status := checkHealth(t, h); code != http.StatusServiceUnavailable || status.Bot != "Unauthorized" || status.DB != "ok" {
+		t.Fatalf("unauthorized bot: %d %+v", code, status)
+	}
+
+	botErr = nil
+	db.Close()
+	if code, status := checkHealth(t, h); code != http.StatusServiceUnavailable || status.Bot != "ok" || status.DB == "ok" {
+		t.Fatalf("closed DB: %d %+v", code, status)
+	}
+}
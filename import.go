@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+const maxOPMLSize = 1 << 20
+
+// The preview of an import has a button for each feed, which limits how many
+// feeds can be imported at once.
+const maxImportFeeds = 50
+const importButtonsPerRow = 5
+
+// Imports that were not confirmed within importExpiry are forgotten.
+const importExpiry = time.Hour
+
+const importCallbackPrefix = "import:"
+
+// pendingImport is an import that was previewed and waits for the user who
+// started it to confirm which of the feeds to subscribe to.
+type pendingImport struct {
+	userID   int64
+	urls     []string
+	selected []bool
+	created  time.Time
+}
+
+func (p *pendingImport) selectedURLs() []string {
+	var urls []string
+	for i, url := range p.urls {
+		if p.selected[i] {
+			urls = append(urls, url)
+		}
+	}
+
+	return urls
+}
+
+func (p *pendingImport) copy() pendingImport {
+	c := *p
+	c.selected = append([]bool(nil), p.selected...)
+	return c
+}
+
+// importSessions holds the imports that wait for confirmation.
+type importSessions struct {
+	mu      sync.Mutex
+	next    int64
+	pending map[int64]*pendingImport
+}
+
+func newImportSessions() *importSessions {
+	return &importSessions{
+		pending: make(map[int64]*pendingImport),
+	}
+}
+
+// add starts an import of urls with all feeds selected and returns its ID.
+func (s *importSessions) add(userID int64, urls []string) (int64, pendingImport) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, p := range s.pending {
+		if now.Sub(p.created) >= importExpiry {
+			delete(s.pending, id)
+		}
+	}
+
+	s.next++
+	p := &pendingImport{
+		userID:   userID,
+		urls:     urls,
+		selected: make([]bool, len(urls)),
+		created:  now,
+	}
+	for i := range p.selected {
+		p.selected[i] = true
+	}
+	s.pending[s.next] = p
+
+	return s.next, p.copy()
+}
+
+// toggle selects or deselects feed i of the import with the given ID if it
+// was started by userID.
+func (s *importSessions) toggle(id, userID int64, i int) (pendingImport, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pending[id]
+	if !ok || p.userID != userID || i < 0 || i >= len(p.urls) {
+		return pendingImport{}, false
+	}
+
+	p.selected[i] = !p.selected[i]
+	return p.copy(), true
+}
+
+// take ends the import with the given ID if it was started by userID.
+func (s *importSessions) take(id, userID int64) (pendingImport, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pending[id]
+	if !ok || p.userID != userID {
+		return pendingImport{}, false
+	}
+
+	delete(s.pending, id)
+	return p.copy(), true
+}
+
+// previewImport reads the OPML document attached to msg (or the message it
+// replies to) and asks the user which of the listed feeds to subscribe to.
+func previewImport(bot *tgbotapi.BotAPI, sessions *importSessions, msg *tgbotapi.Message) tgbotapi.Chattable {
+	chatID := msg.Chat.ID
+
+	doc := documentOf(msg)
+	if doc == nil {
+		return tgbotapi.NewMessage(chatID, "Send an OPML file with /import as caption or reply to one with /import.")
+	}
+
+	data, err := downloadDocument(bot, doc, maxOPMLSize)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Warn("cannot download OPML file")
+		return tgbotapi.NewMessage(chatID, "I cannot download this file.")
+	}
+
+	return importPreview(sessions, chatID, int64(msg.From.ID), data)
+}
+
+// importPreview parses the OPML document in data and starts an import of the
+// feeds listed in it.
+func importPreview(sessions *importSessions, chatID, userID int64, data []byte) tgbotapi.Chattable {
+	urls, err := readOPML(bytes.NewReader(data))
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "This does not look like an OPML file.")
+	}
+
+	if len(urls) == 0 {
+		return tgbotapi.NewMessage(chatID, "There are no feeds in this file.")
+	}
+
+	if len(urls) > maxImportFeeds {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("I can import at most %d feeds at once.", maxImportFeeds))
+	}
+
+	id, p := sessions.add(userID, urls)
+
+	text := "These feeds are in the file. Deselect the ones you do not want and confirm the import:\n"
+	for i, url := range urls {
+		text += fmt.Sprintf("[%d] %s\n", i+1, url)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = importKeyboard(id, &p)
+	return msg
+}
+
+// importKeyboard has a button to toggle each feed of an import, followed by
+// the buttons to confirm or cancel it.
+func importKeyboard(id int64, p *pendingImport) tgbotapi.InlineKeyboardMarkup {
+	prefix := importCallbackPrefix + strconv.FormatInt(id, 10) + ":"
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	var row []tgbotapi.InlineKeyboardButton
+	for i := range p.urls {
+		mark := "✗"
+		if p.selected[i] {
+			mark = "✓"
+		}
+
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s %d", mark, i+1), prefix+strconv.Itoa(i)))
+		if len(row) == importButtonsPerRow {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("Import %d feeds", len(p.selectedURLs())), prefix+"ok"),
+		tgbotapi.NewInlineKeyboardButtonData("Cancel", prefix+"cancel"),
+	))
+
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// importCallback handles a button of an import preview that was pressed by
+// userID. If the import was confirmed, it is returned and the caller has to
+// subscribe to its selected feeds.
+func importCallback(sessions *importSessions, chatID int64, messageID int, userID int64, data string) (tgbotapi.Chattable, *pendingImport) {
+	parts := strings.SplitN(strings.TrimPrefix(data, importCallbackPrefix), ":", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+
+	switch parts[1] {
+	case "ok":
+		p, ok := sessions.take(id, userID)
+		if !ok {
+			return nil, nil
+		}
+
+		if len(p.selectedURLs()) == 0 {
+			return tgbotapi.NewEditMessageText(chatID, messageID, "No feeds were selected, nothing was imported."), nil
+		}
+
+		return tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("Importing %d feeds...", len(p.selectedURLs()))), &p
+
+	case "cancel":
+		if _, ok := sessions.take(id, userID); !ok {
+			return nil, nil
+		}
+
+		return tgbotapi.NewEditMessageText(chatID, messageID, "Cancelled."), nil
+
+	default:
+		i, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, nil
+		}
+
+		p, ok := sessions.toggle(id, userID, i)
+		if !ok {
+			return nil, nil
+		}
+
+		return tgbotapi.NewEditMessageReplyMarkup(chatID, messageID, importKeyboard(id, &p)), nil
+	}
+}
+
+// importFeeds subscribes the chat to the given feeds on behalf of the user.
+// Feeds that cannot be added are skipped and counted.
+func importFeeds(ctx context.Context, cfg *Config, db *DB, userID, chatID int64, threadID int, urls []string) string {
+	feeds, err := db.FeedsByChat(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("enumerating feeds of chat")
+		return backendError(err)
+	}
+
+	known := make(map[string]bool)
+	for _, feed := range feeds {
+		known[feed.URL] = true
+	}
+
+	var added, duplicates, rejected int
+	for _, feedURL := range urls {
+		key := feedURL
+		if canonical, err := canonicalizeURL(feedURL); err == nil {
+			key = canonical
+		}
+		key = withoutScheme(key)
+		if known[key] {
+			duplicates++
+			continue
+		}
+		known[key] = true
+
+		_, err := subscribe(ctx, cfg, db, userID, chatID, threadID, feedURL)
+		switch {
+		case err == nil:
+			added++
+
+		case err == ErrAlreadySubscribed:
+			duplicates++
+
+		case err == errFishyURL, err == errFetchFeed, errors.As(err, new(*notAFeedError)),
+			err == ErrMaxFeedsInChat, err == ErrMaxActiveFeedsByUser, err == ErrMaxTotalFeedsByUser:
+			rejected++
+
+		default:
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"Chat ID":  chatID,
+				"Feed URL": stripCredentials(feedURL),
+			}).Error("import: unknown error in AddFeedToChat")
+			rejected++
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return fmt.Sprintf("Import finished: %d feeds added, %d skipped (already in this chat), %d rejected (limits reached or not fetchable).", added, duplicates, rejected)
+}
+
+// withoutScheme returns feedURL in the form in which feed URLs are stored.
+func withoutScheme(feedURL string) string {
+	u, err := url.Parse(feedURL)
+	if err != nil {
+		return feedURL
+	}
+
+	u.Scheme = ""
+	return u.String()
+}
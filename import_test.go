@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+const testOPML = `<?xml version="1.0"?>
+<opml version="2.0"><head><title>Feeds</title></head><body>
+<outline text="a" xmlUrl="https://example.com/a"/>
+<outline text="folder">
+	<outline text="b" xmlUrl="https://example.com/b"/>
+	<outline text="c" xmlUrl="https://example.com/c"/>
+</outline>
+</body></opml>`
+
+// pressButton returns the callback data of the button of markup whose text
+// starts with label.
+func pressButton(t *testing.T, markup tgbotapi.InlineKeyboardMarkup, label string) string {
+	t.Helper()
+
+	for _, row := range markup.InlineKeyboard {
+		for _, button := range row {
+			if strings.HasPrefix(button.Text, label) {
+				return *button.CallbackData
+			}
+		}
+	}
+
+	t.Fatalf("no button %q in %+v", label, markup)
+	return ""
+}
+
+func TestImportPreviewSelectConfirm(t *testing.T) {
+	sessions := newImportSessions()
+
+	preview, ok := importPreview(sessions, 10, 1, []byte(testOPML)).(tgbotapi.MessageConfig)
+	if !ok {
+		t.Fatalf("preview is %T, want a message", preview)
+	}
+	for _, url := range []string{"[1] https://example.com/a", "[2] https://example.com/b", "[3] https://example.com/c"} {
+		if !strings.Contains(preview.Text, url) {
+			t.Errorf("preview does not list %q:\n%s", url, preview.Text)
+		}
+	}
+
+	markup := preview.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup)
+
+	// Deselect the second feed.
+	res, confirmed := importCallback(sessions, 10, 5, 1, pressButton(t, markup, "✓ 2"))
+	if confirmed != nil {
+		t.Fatal("toggling a feed confirmed the import")
+	}
+	markup = *res.(tgbotapi.EditMessageReplyMarkupConfig).ReplyMarkup
+	pressButton(t, markup, "✗ 2")
+	pressButton(t, markup, "Import 2 feeds")
+
+	// Other users cannot change or confirm the import.
+	if res, confirmed := importCallback(sessions, 10, 5, 2, pressButton(t, markup, "Import")); res != nil || confirmed != nil {
+		t.Fatal("another user confirmed the import")
+	}
+
+	res, confirmed = importCallback(sessions, 10, 5, 1, pressButton(t, markup, "Import"))
+	if confirmed == nil {
+		t.Fatalf("import was not confirmed, reply %+v", res)
+	}
+	if got, want := confirmed.selectedURLs(), []string{"https://example.com/a", "https://example.com/c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("selected %v, want %v", got, want)
+	}
+
+	// The import is over, pressing the button again does nothing.
+	if res, confirmed := importCallback(sessions, 10, 5, 1, pressButton(t, markup, "Import")); res != nil || confirmed != nil {
+		t.Fatal("import was confirmed twice")
+	}
+}
+
+func TestImportPreviewCancel(t *testing.T) {
+	sessions := newImportSessions()
+
+	preview := importPreview(sessions, 10, 1, []byte(testOPML)).(tgbotapi.MessageConfig)
+	markup := preview.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup)
+
+	res, confirmed := importCallback(sessions, 10, 5, 1, pressButton(t, markup, "Cancel"))
+	if confirmed != nil || res.(tgbotapi.EditMessageTextConfig).Text != "Cancelled." {
+		t.Fatalf("cancel: reply %+v, confirmed %v", res, confirmed)
+	}
+
+	if len(sessions.pending) != 0 {
+		t.Fatalf("%d imports pending after cancel", len(sessions.pending))
+	}
+}
+
+func TestImportPreviewRejectsBadFiles(t *testing.T) {
+	sessions := newImportSessions()
+
+	tooMany := "<opml><body>" + strings.Repeat(`<outline xmlUrl="https://example.com/"/>`, maxImportFeeds+1) + "</body></opml>"
+
+	for _, data := range []string{"not xml", "<opml><body></body></opml>", tooMany} {
+		msg, ok := importPreview(sessions, 10, 1, []byte(data)).(tgbotapi.MessageConfig)
+		if !ok || msg.ReplyMarkup != nil {
+			t.Errorf("preview of %.30q offers an import", data)
+		}
+	}
+
+	if len(sessions.pending) != 0 {
+		t.Fatalf("%d imports pending after invalid files", len(sessions.pending))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+)
+
+const maxItemKeyLength = 191
+
+// itemKey identifies an item across fetches. The GUID is preferred because
+// some feeds change the link of an item when it is edited.
+func itemKey(item *gofeed.Item) string {
+	key := item.GUID
+	if key == "" {
+		key = item.Link
+	}
+
+	if len(key) > maxItemKeyLength {
+		return hashFields(key)
+	}
+
+	return key
+}
+
+func hashFields(fields ...string) string {
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// untitledContentHash hashes everything that is shown to the user except the
+// title, so items whose title was merely edited hash to the same value.
+func untitledContentHash(item *gofeed.Item) string {
+	return hashFields(item.Link, item.Description, item.Content)
+}
+
+// contentHash hashes everything that is shown to the user, so an item that
+// is published again with a newer date but unchanged hashes to the same value.
+func contentHash(item *gofeed.Item) string {
+	return hashFields(item.Title, item.Link, item.Description, item.Content)
+}
+
+// linkHash identifies the story that item refers to across feeds, by its link
+// in canonical form or by its GUID if that is a URI. It is empty if the item
+// has neither, as such items cannot be told apart.
+func linkHash(item *gofeed.Item) string {
+	if item.Link != "" {
+		link := item.Link
+		if canonical, err := canonicalizeURL(link); err == nil {
+			link = withoutScheme(canonical)
+		}
+
+		return hashFields(link)
+	}
+
+	// GUIDs like "42" are only unique within their feed.
+	if strings.Contains(item.GUID, ":") {
+		return hashFields("guid", item.GUID)
+	}
+
+	return ""
+}
+
+// deliveredItemOf returns the record of item that is stored when it is delivered.
+func deliveredItemOf(item *gofeed.Item) DeliveredItem {
+	return DeliveredItem{
+		Key:         itemKey(item),
+		Hash:        untitledContentHash(item),
+		ContentHash: contentHash(item),
+		LinkHash:    linkHash(item),
+		Published:   *item.PublishedParsed,
+	}
+}
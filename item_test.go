@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestUntitledContentHash(t *testing.T) {
+	item := &gofeed.Item{Title: "Titel", Link: "https://example.com/1", Description: "Text"}
+	retitled := &gofeed.Item{Title: "Title", Link: item.Link, Description: item.Description}
+	edited := &gofeed.Item{Title: item.Title, Link: item.Link, Description: "Other text"}
+
+	if untitledContentHash(item) != untitledContentHash(retitled) {
+		t.Error("hash depends on the title")
+	}
+	if untitledContentHash(item) == untitledContentHash(edited) {
+		t.Error("hash does not depend on the description")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	published, republished := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	item := &gofeed.Item{Title: "Title", Link: "https://example.com/1", Description: "Text", PublishedParsed: &published}
+	bumped := &gofeed.Item{Title: item.Title, Link: item.Link, Description: item.Description, PublishedParsed: &republished}
+	retitled := &gofeed.Item{Title: "Titel", Link: item.Link, Description: item.Description, PublishedParsed: &published}
+
+	if contentHash(item) != contentHash(bumped) {
+		t.Error("hash depends on the date")
+	}
+	if contentHash(item) == contentHash(retitled) {
+		t.Error("hash does not depend on the title")
+	}
+}
+
+func TestItemKey(t *testing.T) {
+	if key := itemKey(&gofeed.Item{GUID: "guid", Link: "https://example.com/"}); key != "guid" {
+		t.Errorf("key = %q, want the GUID", key)
+	}
+	if key := itemKey(&gofeed.Item{Link: "https://example.com/"}); key != "https://example.com/" {
+		t.Errorf("key = %q, want the link", key)
+	}
+
+	long := "https://example.com/" + strings.Repeat("x", maxItemKeyLength)
+	if key := itemKey(&gofeed.Item{Link: long}); len(key) > maxItemKeyLength {
+		t.Errorf("key of long link has length %d", len(key))
+	}
+}
@@ -1,16 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/sirupsen/logrus"
 
@@ -18,286 +27,1630 @@ import (
 	"github.com/mmcdole/gofeed"
 )
 
+// configfilePath is where the config file is read from unless -config is
+// given.
 const configfilePath = "/etc/telegram-rss-bot.toml"
-const waitBetweenUpdatesTime = time.Hour
-const updateTimeout = time.Minute * 20
+const deliveredItemsRetention = time.Hour * 24 * 30
+const requestCountsRetention = time.Hour
+const deliveryCountsRetention = mostActiveWindow
+const sendQueueSize = 100
+const shutdownTimeout = time.Second * 30
+const storeProgressTimeout = time.Second * 10
+const maxNoteLength = 255
+const maxDisplayTitleLength = 100
+const fetchRequestsWindow = time.Minute * 5
+
+// Feeds that fail to load maxFeedErrors times within feedErrorWindow are dropped.
+const feedErrorWindow = time.Hour * 12
+const maxFeedErrors = 9
+
+type sendFunc func(msg tgbotapi.Chattable)
 
-type sendFunc func(chatID int64, text string)
+var firstSecond = time.Unix(0, 0)
+
+// feedError records that feed could not be loaded and drops it if that
+// happened too often recently.
+func feedError(ctx context.Context, db *DB, feed *Feed, send sendFunc) {
+	if err := db.AddFeedError(ctx, feed.ID); err != nil {
+		logrus.WithError(err).WithField("Feed", feed.URL).Error("cannot record feed error")
+	}
+
+	if n, err := db.RecentFeedErrors(ctx, time.Now().Add(-feedErrorWindow), feed.ID); err != nil {
+		return
+	} else if n >= maxFeedErrors {
+		logrus.WithField("Feed", feed.URL).Error("too many errors, dropping feed")
+
+		subscribers, err := db.SubscribedChats(ctx, feed.ID)
+		if err != nil {
+			logrus.WithError(err).WithField("Feed", feed.URL).Error("failed to fetch subs for feed")
+		}
+
+		if err := db.DropFeed(ctx, feed.ID); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"Errors/12h": n,
+				"Feed":       feed.URL,
+			}).Error("cannot drop feed")
+			return
+		}
+
+		for _, s := range subscribers {
+			send(tgbotapi.NewMessage(s.ChatID, fmt.Sprintf("Your feed \"%s\" was removed because it could not be loaded multiple times.", s.Title)))
+		}
+	}
+}
+
+// newItemsForSub returns the items that were published after the last update
+// of sub, oldest first, limited to the configured backlog.
+func newItemsForSub(cfg *Config, items []*gofeed.Item, sub Sub) []*gofeed.Item {
+	newItems := []*gofeed.Item{}
+	for _, item := range items {
+		if item.PublishedParsed != nil && item.PublishedParsed.After(sub.LastUpdate) {
+			newItems = append(newItems, item)
+		}
+	}
+
+	sort.Slice(newItems, func(i, j int) bool {
+		return newItems[i].PublishedParsed.Before(*newItems[j].PublishedParsed)
+	})
+
+	if max := cfg.Bot.MaxBacklog; max > 0 && len(newItems) > max {
+		newItems = cfg.Bot.BacklogSelector()(newItems, max)
+	}
+
+	return newItems
+}
+
+// skipReason decides whether a new item must not be delivered to a chat
+// because of the chat's settings. It returns an empty string if the item
+// should be delivered.
+func skipReason(ctx context.Context, cfg *Config, db *DB, sub Sub, feedID int64, item *gofeed.Item, delivered DeliveredItem) string {
+	if matchesKeyword(item, sub.Mutes) {
+		return "contains a muted keyword"
+	}
+
+	if len(sub.Filters) > 0 && !matchesKeyword(item, sub.Filters) {
+		return "does not match the filters"
+	}
+
+	if sub.IgnoreTitleChanges {
+		if prev, err := db.DeliveredItemHash(ctx, sub.ChatID, feedID, delivered.Key); err == nil && prev == delivered.Hash {
+			return "only the title changed"
+		}
+	}
+
+	if sub.SkipRepublished {
+		dup, err := db.ContentDelivered(ctx, sub.ChatID, feedID, delivered.ContentHash, time.Now().Add(-cfg.Bot.DedupWindow.Duration))
+		if err != nil {
+			logrus.WithError(err).Error("update: ContentDelivered")
+		} else if dup {
+			return "same content was delivered recently"
+		}
+	}
+
+	// Items without a link or a unique GUID cannot be told apart.
+	if sub.DedupLinks && delivered.LinkHash != "" {
+		dup, err := db.LinkDeliveredByEarlierFeed(ctx, sub.ChatID, feedID, delivered.LinkHash, time.Now().Add(-cfg.Bot.DedupWindow.Duration))
+		if err != nil {
+			logrus.WithError(err).Error("update: LinkDeliveredByEarlierFeed")
+		} else if dup {
+			return "link was delivered by a feed listed earlier or removed"
+		}
+	}
+
+	return ""
+}
+
+// scheduleFeed stores the intervals of a feed that was just fetched and when
+// it is fetched next.
+func scheduleFeed(ctx context.Context, cfg *Config, db *DB, info *Feed, publishInterval, advertised time.Duration) {
+	next := nextFetch(time.Now(), info.ID, publishInterval, advertised, &cfg.Bot)
+	if err := db.SetFeedSchedule(ctx, info.ID, publishInterval, advertised, next); err != nil {
+		logrus.WithError(err).WithField("Feed", info.FullURL()).Error("update: SetFeedSchedule")
+	}
+}
+
+// storeFeedCache stores the validators of the last response for the feed if
+// they changed.
+func storeFeedCache(ctx context.Context, db *DB, info *Feed, cache HTTPCache) {
+	if cache == info.Cache {
+		return
+	}
+
+	if err := db.SetFeedCache(ctx, info.ID, cache); err != nil {
+		logrus.WithError(err).WithField("Feed", info.FullURL()).Error("update: SetFeedCache")
+	}
+}
+
+// updateFeed fetches a feed and sends its new items to the subscribed chats.
+// Feeds are updated concurrently, so updateCount is counted atomically.
+// Errors of the feed and of single subscriptions are logged and retried in
+// later updates; only the error of a cancelled update is returned.
+func updateFeed(ctx context.Context, cfg *Config, db *DB, client *http.Client, send sendFunc, info Feed, updateCount *int64) error {
+	url := info.FullURL()
+	logrus.WithField("Feed", url).Debug("update: load feed")
+
+	// A dry run fetches and schedules the feed as usual, but only logs the
+	// messages and keeps the read positions.
+	dryRun := cfg.Bot.DryRun
+	if dryRun {
+		send = logMessage
+	}
+
+	// A feed that takes too long to load counts as an error of the feed,
+	// unlike the cancellation of the whole update.
+	fetchCtx := ctx
+	if timeout := cfg.Bot.FeedFetchTimeout.Duration; timeout > 0 {
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// A feed that was just fetched elsewhere, for example when it was
+	// added, is not fetched again. Its validators stay as they are.
+	feed, fromCache := parsedFeeds.TakeForUpdate(info.URL, time.Now())
+	cache, err := info.Cache, error(nil)
+	if fromCache {
+		logrus.WithField("Feed", url).Debug("update: feed taken from cache")
+	} else {
+		fetchStart := time.Now()
+		feed, cache, err = fetchFeedWithRetry(fetchCtx, client, info.fetchURL(), info.Cache, cfg.Bot.FetchAttempts)
+		feedFetchDuration.Observe(time.Since(fetchStart).Seconds())
+		if err == nil || err == errNotModified {
+			feedsFetched.Inc()
+		} else {
+			feedFetchErrors.Inc()
+		}
+	}
+
+	// Validators are only stored while no subscription has items pending,
+	// so there is nothing to send if the feed was not modified.
+	if err == errNotModified {
+		logrus.WithField("Feed", url).Debug("update: feed not modified")
+		parsedFeeds.Touch(info.URL, time.Now())
+
+		scheduleFeed(ctx, cfg, db, &info, info.PublishInterval, info.AdvertisedInterval)
+
+		return nil
+	}
+
+	if err != nil {
+		logrus.WithError(err).WithField("Feed", url).Error("update: error with feed (parsing)")
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// A feed that fails is tried again in its next slot, not in the
+		// next update.
+		scheduleFeed(ctx, cfg, db, &info, info.PublishInterval, info.AdvertisedInterval)
+
+		if !dryRun {
+			feedError(ctx, db, &info, send)
+		}
+
+		return nil
+	}
+
+	if !fromCache {
+		parsedFeeds.PutUpdated(info.URL, feed, time.Now())
+	}
+
+	if shape := observeShape(info.Shape, feed); shape != info.Shape {
+		if changes := shapeChanges(info.Shape, shape); len(changes) != 0 {
+			logrus.WithFields(logrus.Fields{
+				"Feed":    url,
+				"Changes": changes,
+			}).Info("update: feed changed its shape")
+
+			send(tgbotapi.NewMessage(info.UserID, fmt.Sprintf("Your feed \"%s\" may have changed: %s. You might want to check whether it still works as expected.", info.Title, strings.Join(changes, " and "))))
+		}
+
+		if !dryRun {
+			if err := db.SetFeedShape(ctx, info.ID, shape); err != nil {
+				logrus.WithError(err).WithField("Feed", url).Error("update: SetFeedShape")
+			}
+		}
+	}
+
+	// A feed without items was fetched successfully, there is just nothing
+	// to send. Its publish interval cannot be estimated anew.
+	if len(feed.Items) == 0 {
+		logrus.WithField("Feed", url).Debug("update: feed has no items")
+
+		scheduleFeed(ctx, cfg, db, &info, info.PublishInterval, advertisedInterval(feed))
+		if !dryRun {
+			storeFeedCache(ctx, db, &info, cache)
+		}
+
+		return nil
+	}
+
+	scheduleFeed(ctx, cfg, db, &info, estimatePublishInterval(feed.Items), advertisedInterval(feed))
+
+	updated := feed.UpdatedParsed
+	if updated == nil {
+		updated = &firstSecond
+		for _, item := range feed.Items {
+			pub := item.PublishedParsed
+			if pub != nil && pub.After(*updated) {
+				updated = pub
+			}
+		}
+
+		if updated == &firstSecond {
+			logrus.WithField("Feed", url).Error("update: no timestamps")
+			if !dryRun {
+				feedError(ctx, db, &info, send)
+			}
+			return nil
+		}
+	}
+
+	subs, err := db.Subs(ctx, info.ID, updated)
+	if err != nil {
+		logrus.WithError(err).WithField("Feed", url).Error("update: getting chat IDs")
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"#Chats": len(subs),
+		"Feed":   info.URL,
+	}).Debug("update: chats that need update")
+
+	// The validators of the response are only kept once every subscription
+	// got its new items. Otherwise the server could answer the next request
+	// with 304 and the remaining items would not be sent until the feed
+	// changes again.
+	pending := false
+
+	for _, sub := range subs {
+		newItems := newItemsForSub(cfg, feed.Items, sub)
+		if len(newItems) == 0 {
+			continue
+		}
+
+		// The subscription advances once its items were handled, up to the
+		// newest one that was sent, skipped or kept for a digest. Items
+		// after it are tried again in the next update.
+		var progress SubProgress
+		handled := func(until time.Time, delivered ...DeliveredItem) {
+			progress.Until = until
+			progress.Delivered = append(progress.Delivered, delivered...)
+		}
+
+		storeProgress := func() {
+			if dryRun || progress.Until.IsZero() {
+				return
+			}
+
+			// The items were sent already, so the progress is stored even
+			// if the update was cancelled meanwhile.
+			storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), storeProgressTimeout)
+			defer cancel()
+
+			if err := db.AdvanceSub(storeCtx, sub.ChatID, info.ID, progress); err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"Chat ID": sub.ChatID,
+					"Feed":    info.URL,
+				}).Error("update: AdvanceSub")
+
+				pending = true
+				return
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"Chat ID": sub.ChatID,
+				"Feed":    info.URL,
+				"Until":   progress.Until,
+			}).Debug("update: advanced subscription")
+
+			// The counts are only used for /mostactive, so an error
+			// does not hold the subscription back.
+			if n := len(progress.Delivered); n > 0 {
+				if err := db.IncrementDeliveries(storeCtx, sub.ChatID, info.ID, n); err != nil {
+					logrus.WithError(err).WithField("Chat ID", sub.ChatID).Error("update: IncrementDeliveries")
+				}
+			}
+		}
+
+		// Snoozed subscriptions skip their new items, unless they are
+		// kept for when the snooze ends.
+		if sub.Snoozed(time.Now()) {
+			if sub.SnoozeQueue {
+				pending = true
+			} else {
+				handled(*newItems[len(newItems)-1].PublishedParsed)
+				storeProgress()
+			}
+			continue
+		}
+
+		// Items for digests are collected regardless of the interval.
+		// Updates may take up to the update timeout, by which the time
+		// between two deliveries to a chat varies.
+		digest := sub.DigestAt >= 0
+		if !digest && !sub.IntervalPassed(time.Now(), cfg.Bot.UpdateTimeout.Duration) {
+			pending = true
+			continue
+		}
+
+		if sub.Filters, err = db.Filters(ctx, sub.ChatID, info.ID); err != nil {
+			logrus.WithError(err).Error("update: Filters")
+			pending = true
+			continue
+		}
+
+		if sub.Mutes, err = db.Mutes(ctx, sub.ChatID, info.ID); err != nil {
+			logrus.WithError(err).Error("update: Mutes")
+			pending = true
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"Chat ID":      sub.ChatID,
+			"New Items":    len(newItems),
+			"Chat updated": sub.LastUpdate,
+			"Feed updated": updated,
+		}).Debug("update: new items for chat")
+
+		sent := false
+
+		opts := itemOptions{maxDescription: cfg.Bot.MaxDescriptionLength, images: cfg.Bot.SendImages, template: cfg.Bot.messageTemplate}
+		if cfg.Bot.ShowPublished {
+			opts.published = sub.Location
+		}
+		opts.categories = cfg.Bot.ShowCategories
+
+		// With batching, items are collected and sent together. The
+		// subscription only advances once the batch was sent.
+		batching := cfg.Bot.BatchItems && (sub.Format == formatFull || sub.Format == formatCompact)
+		var batch []*gofeed.Item
+		var batchDelivered []DeliveredItem
+		var batchUntil time.Time
+
+		flush := func() {
+			for _, chatID := range sub.Recipients(time.Now()) {
+				for _, msg := range batchMessages(chatID, sub.Format, sub.DisplayTitle, batch) {
+					send.toThread(sub.ThreadOf(chatID))(msg)
+				}
+			}
+			atomic.AddInt64(updateCount, int64(len(batch)))
+			itemsSent.Add(float64(len(batch)))
+			sent = true
+
+			handled(batchUntil, batchDelivered...)
+			batch, batchDelivered = nil, nil
+		}
+
+		for _, item := range newItems {
+			if ctx.Err() != nil {
+				break
+			}
+
+			delivered := deliveredItemOf(item)
+
+			if reason := skipReason(ctx, cfg, db, sub, info.ID, item, delivered); reason != "" {
+				logrus.WithFields(logrus.Fields{
+					"Chat ID": sub.ChatID,
+					"Feed":    info.URL,
+					"Item":    delivered.Key,
+					"Reason":  reason,
+				}).Debug("update: skipping item")
+
+				if len(batch) > 0 {
+					batchUntil = *item.PublishedParsed
+				} else {
+					handled(*item.PublishedParsed)
+				}
+				continue
+			}
+
+			if digest {
+				if dryRun {
+					logrus.WithFields(logrus.Fields{
+						"Chat ID": sub.ChatID,
+						"Item":    delivered.Key,
+					}).Info("dry run: would add item to digest")
+					continue
+				}
+
+				progress.DigestItems = append(progress.DigestItems, digestItemOf(item))
+				handled(*item.PublishedParsed, delivered)
+				continue
+			}
+
+			if batching {
+				batch = append(batch, item)
+				batchDelivered = append(batchDelivered, delivered)
+				batchUntil = *item.PublishedParsed
+				if len(batch) == cfg.Bot.BatchSize {
+					flush()
+				}
+				continue
+			}
+
+			for _, chatID := range sub.Recipients(time.Now()) {
+				send.toThread(sub.ThreadOf(chatID))(itemMessage(chatID, sub.Format, sub.DisplayTitle, item, opts))
+			}
+			atomic.AddInt64(updateCount, 1)
+			itemsSent.Inc()
+			sent = true
+
+			handled(*item.PublishedParsed, delivered)
+		}
+
+		// A batch that was not complete when the update was cancelled is
+		// sent in the next one.
+		if len(batch) > 0 && ctx.Err() == nil {
+			flush()
+		}
+
+		storeProgress()
+
+		if sent && !dryRun {
+			if err := db.SetLastSent(ctx, sub.ChatID, info.ID, time.Now()); err != nil {
+				logrus.WithError(err).Error("update: SetLastSent")
+			}
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if pending {
+		cache = HTTPCache{}
+	}
+
+	if !dryRun {
+		storeFeedCache(ctx, db, &info, cache)
+	}
+
+	return nil
+}
+
+func update(parentCtx context.Context, cfg *Config, db *DB, send sendFunc) (anyErr error) {
+	ctx, cancel := context.WithTimeout(parentCtx, cfg.Bot.UpdateTimeout.Duration)
+	defer cancel()
+
+	var updateCount int64
+	defer func() {
+		if n := atomic.LoadInt64(&updateCount); n > 0 {
+			logrus.Infof("update: Sent %d feed updates to chats.", n)
+		}
+	}()
+
+	// Nothing is fetched while the delivery is paused, so no feed is
+	// marked as updated and the items are sent after the pause.
+	if deliveryPaused.Load() {
+		logrus.Debug("update: delivery is paused")
+		return nil
+	}
+
+	feeds, err := db.ActiveFeeds(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("update: get feeds")
+		return err
+	}
+
+	client := newFeedClient(cfg)
+	jobs := make(chan Feed)
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	for i := 0; i < cfg.Bot.FetchConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for info := range jobs {
+				if err := updateFeed(ctx, cfg, db, client, send, info, &updateCount); err != nil {
+					errMu.Lock()
+					anyErr = err
+					errMu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, info := range feeds {
+		jobs <- info
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// The update went through all due feeds in time. Errors of single
+	// feeds do not count against the health of the update loop.
+	lastSuccessfulUpdate.Store(time.Now().UnixNano())
+
+	return
+}
+
+// prune removes the records that are no longer needed.
+func prune(ctx context.Context, db *DB) {
+	if err := db.PruneDeliveredItems(ctx, time.Now().Add(-deliveredItemsRetention)); err != nil {
+		logrus.WithError(err).Error("prune: PruneDeliveredItems")
+	}
+
+	if err := db.PruneRequestCounts(ctx, time.Now().Add(-requestCountsRetention)); err != nil {
+		logrus.WithError(err).Error("prune: PruneRequestCounts")
+	}
+
+	if err := db.PruneDeliveryCounts(ctx, time.Now().Add(-deliveryCountsRetention)); err != nil {
+		logrus.WithError(err).Error("prune: PruneDeliveryCounts")
+	}
+
+	if n, err := db.PruneOrphanFeeds(ctx); err != nil {
+		logrus.WithError(err).Error("prune: PruneOrphanFeeds")
+	} else if n > 0 {
+		logrus.WithField("Feeds", n).Info("prune: removed feeds without subscribers")
+	}
+}
+
+func periodicUpdate(ctx context.Context, config *sharedConfig, db *DB, send sendFunc) {
+	interval := config.Get().Bot.UpdateInterval.Duration
+
+	// Each feed is due at its own time within the update interval, so
+	// updates run more often and only fetch the feeds that are due.
+	tick := time.NewTicker(updateCheckInterval(interval))
+	defer tick.Stop()
+
+	pruneTick := time.NewTicker(interval)
+	defer pruneTick.Stop()
+
+	// Digests are sent between updates, which keeps them from missing the
+	// items that an update is collecting.
+	digestTick := time.NewTicker(digestCheckInterval)
+	defer digestTick.Stop()
+
+	for {
+		logrus.Debug("periodic update started")
+
+		err := update(ctx, config.Get(), db, send)
+		if err != nil && err == ctx.Err() {
+			logrus.WithContext(ctx).Error("update took too long.")
+		}
+
+		logrus.Debug("periodic update ended")
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-digestTick.C:
+				if !config.Get().Bot.DryRun && !deliveryPaused.Load() {
+					flushDigests(ctx, db, send, now)
+				}
+			case <-pruneTick.C:
+				prune(ctx, db)
+			case <-tick.C:
+				break wait
+			}
+		}
+	}
+}
+
+// reload reads the config file at path again and applies the settings that
+// can be changed while the bot runs.
+func reload(config *sharedConfig, db *DB, path string) {
+	loaded, err := loadConfigFile(path)
+	if err != nil {
+		logrus.WithError(err).WithField("path", path).Error("cannot reload config file")
+		return
+	}
+
+	if err := loaded.Validate(); err != nil {
+		logrus.WithError(err).WithField("path", path).Error("invalid config file, keeping the current one")
+		return
+	}
+
+	cfg := reloadedConfig(config.Get(), loaded)
+
+	db.MaxFeedsPerChat = cfg.Bot.MaxFeedsPerChat
+	db.MaxTotalFeedsByUser = cfg.Bot.MaxTotalFeedsByUser
+	db.MaxActiveFeedsByUser = cfg.Bot.MaxActiveFeedsByUser
+	db.Prepare()
+
+	config.Set(cfg)
+	logrus.Info("reloaded config file")
+}
+
+var errFishyURL = errors.New("cannot parse feed URL")
+var errFetchFeed = errors.New("cannot fetch feed")
+
+// subscribe adds the feed at feedURL to the chat on behalf of the user and
+// returns the feed with its title, URL and credentials. Feeds that are not
+// known yet are fetched first. If feedURL is a web page, the first feed it
+// links to that can be fetched is added instead. A *notAFeedError is
+// returned if there is none.
+func subscribe(ctx context.Context, cfg *Config, db *DB, userID, chatID int64, threadID int, feedURL string) (Feed, error) {
+	feed, err := subscribeURL(ctx, cfg, db, userID, chatID, threadID, feedURL)
+
+	var notFeed *notAFeedError
+	if !errors.As(err, &notFeed) {
+		return feed, err
+	}
+
+	for _, link := range notFeed.Links {
+		feed, err := subscribeURL(ctx, cfg, db, userID, chatID, threadID, link)
+		if err == errFetchFeed || errors.As(err, new(*notAFeedError)) {
+			continue
+		}
+
+		return feed, err
+	}
+
+	return Feed{}, notFeed
+}
+
+func subscribeURL(ctx context.Context, cfg *Config, db *DB, userID, chatID int64, threadID int, feedURL string) (Feed, error) {
+	client := newFeedClient(cfg)
+
+	canonical, err := canonicalizeURL(feedURL)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"Feed URL": stripCredentials(feedURL),
+		}).Warn("cannot parse URL")
+
+		return Feed{}, errFishyURL
+	}
+
+	u, err := url.Parse(canonical)
+	if err != nil {
+		return Feed{}, errFishyURL
+	}
+
+	// The credentials are stored apart from the URL, which must not reveal
+	// them. A feed that is known with credentials is only shared with those
+	// who know them.
+	auth := u.User
+	u.User = nil
+	u.Scheme = ""
+	url := u.String()
+
+	title := ""
+	scheme := "https"
+	info, err := db.FeedByURL(ctx, url)
+	if err == nil && info.BasicAuth != nil && !sameCredentials(info.BasicAuth, auth) {
+		return Feed{}, errFetchFeed
+	} else if err != nil {
+		u.User = auth
+
+		var feed *gofeed.Feed
+		if feed, scheme, err = fetchAnyScheme(ctx, client, *u); errors.As(err, new(*notAFeedError)) {
+			return Feed{}, err
+		} else if err != nil {
+			return Feed{}, errFetchFeed
+		}
 
-var firstSecond = time.Unix(0, 0)
+		// The first update, and a backfill, use this parse.
+		parsedFeeds.Put(url, feed, time.Now())
+		title = feed.Title
+	} else {
+		title = info.Title
+		scheme = info.Scheme
+	}
+
+	added := Feed{
+		Title:     title,
+		URL:       url,
+		Scheme:    scheme,
+		BasicAuth: auth,
+		ThreadID:  threadID,
+	}
+
+	return added, db.AddFeedToChat(ctx, userID, chatID, added)
+}
+
+// sameCredentials reports whether the given credentials are equal. It does
+// not leak their contents through its timing.
+func sameCredentials(a, b *url.Userinfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	aPassword, _ := a.Password()
+	bPassword, _ := b.Password()
+	return subtle.ConstantTimeCompare([]byte(a.Username()+"\x00"+aPassword), []byte(b.Username()+"\x00"+bPassword)) == 1
+}
+
+// fetchAnyScheme fetches the feed at u, which has no scheme, via HTTPS and
+// falls back to plain HTTP. It returns the scheme that worked. There is no
+// fallback if the server answered with something that is not a feed.
+func fetchAnyScheme(ctx context.Context, client *http.Client, u url.URL) (feed *gofeed.Feed, scheme string, err error) {
+	for _, scheme = range []string{"https", "http"} {
+		u.Scheme = scheme
+
+		feed, _, err = fetchFeed(ctx, client, u.String(), HTTPCache{})
+		if err == nil || errors.As(err, new(*notAFeedError)) {
+			return
+		}
+
+		logrus.WithError(err).WithField("Fetch URL", withoutCredentials(u.String())).Warn("cannot fetch feed")
+	}
+
+	return
+}
+
+// addFeed handles the /addfeed command. The URL may be followed by
+// "--backfill n" to also get the latest n items of the feed.
+func addFeed(ctx context.Context, cfg *Config, db *DB, user tgbotapi.User, chatID int64, threadID int, args string) tgbotapi.Chattable {
+	feedURL, backfill, ok := parseAddFeedArgs(args, cfg.Bot.BackfillItems)
+	if !ok {
+		return tgbotapi.NewMessage(chatID, "Usage: /addfeed <url> [--backfill <n>]")
+	}
+
+	if backfill > maxBackfillItems {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("At most %d items can be backfilled.", maxBackfillItems))
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"Username": user.UserName,
+		"Name":     user.FirstName + " " + user.LastName,
+		"User ID":  user.ID,
+		"Chat ID":  chatID,
+		"Feed URL": stripCredentials(feedURL),
+	}).Debug("/addfeed command")
+
+	feed, err := subscribe(ctx, cfg, db, int64(user.ID), chatID, threadID, feedURL)
+
+	msg := tgbotapi.NewMessage(chatID, "")
+	if notFeed := (*notAFeedError)(nil); errors.As(err, &notFeed) {
+		msg.Text = "This is a web page, not a feed."
+		if len(notFeed.Links) > 0 {
+			msg.Text += " It links to these feeds, but I cannot fetch them:\n" + strings.Join(notFeed.Links, "\n")
+		} else {
+			msg.Text += " Please look for a link to its RSS or Atom feed."
+		}
+
+		return msg
+	}
+
+	switch err {
+	case nil:
+		msg.Text = fmt.Sprintf("Feed \"%s\" was added to this chat.", feed.Title)
+
+		if backfill > 0 {
+			if n := backfillSub(ctx, cfg, db, chatID, feed, backfill); n > 0 {
+				msg.Text += fmt.Sprintf(" Its latest %d items will arrive shortly.", n)
+			}
+		}
+
+	case errFishyURL:
+		msg.Text = "Your feed is fishy."
+
+	case errFetchFeed:
+		msg.Text = "I cannot fetch your feed :("
+
+	case ErrAlreadySubscribed:
+		msg.Text = "This feed is already in the chat."
+
+	case ErrMaxFeedsInChat:
+		msg.Text = "You cannot add more feeds to this chat."
+
+		logrus.WithFields(logrus.Fields{
+			"Username": user.UserName,
+			"User ID":  user.ID,
+			"Chat ID":  chatID,
+		}).Error("maximum feeds in chat reached")
+
+	case ErrMaxActiveFeedsByUser, ErrMaxTotalFeedsByUser:
+		msg.Text = "I think you have added enough feeds for now."
+
+		logrus.WithFields(logrus.Fields{
+			"Username": user.UserName,
+			"User ID":  user.ID,
+		}).WithError(err).Error("maximum feeds by user reached")
+
+	default:
+		msg.Text = backendError(err)
+
+		logrus.WithFields(logrus.Fields{
+			"Username": user.UserName,
+			"User ID":  user.ID,
+		}).WithError(err).Error("unknown error in AddFeedToChat")
+	}
+
+	return msg
+}
+
+const removeMatchCallbackPrefix = "removematch:"
+const cancelCallback = "cancel"
+
+// matchFeeds returns the feeds whose title or URL contains pattern, ignoring case.
+func matchFeeds(feeds []Feed, pattern string) []Feed {
+	pattern = strings.ToLower(pattern)
+
+	var matched []Feed
+	for _, feed := range feeds {
+		if strings.Contains(strings.ToLower(feed.Title), pattern) || strings.Contains(strings.ToLower(feed.URL), pattern) {
+			matched = append(matched, feed)
+		}
+	}
+
+	return matched
+}
+
+// matchFingerprint identifies a set of matched feeds, so that a confirmation
+// only applies to the feeds that were shown.
+func matchFingerprint(feeds []Feed) string {
+	urls := make([]string, 0, len(feeds))
+	for _, feed := range feeds {
+		urls = append(urls, feed.URL)
+	}
+
+	return hashFields(urls...)[:16]
+}
+
+func removeMatch(ctx context.Context, db *DB, chatID int64, pattern string) tgbotapi.Chattable {
+	if pattern == "" {
+		return tgbotapi.NewMessage(chatID, "Please provide the text that the feeds to remove should contain")
+	}
+
+	if len(removeMatchCallbackPrefix+matchFingerprint(nil)+":"+pattern) > 64 {
+		return tgbotapi.NewMessage(chatID, "That text is too long.")
+	}
+
+	feeds, err := db.FeedsByChat(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("enumerating feeds of chat")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	matched := matchFeeds(feeds, pattern)
+	if len(matched) == 0 {
+		return tgbotapi.NewMessage(chatID, "No feeds in this chat match.")
+	}
+
+	text := "These feeds will be removed from this chat:\n"
+	for _, feed := range matched {
+		text += fmt.Sprintf("[%d] %s (url %s)\n", feed.ID, feed.Title, feed.FullURL())
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("Remove %d feeds", len(matched)), removeMatchCallbackPrefix+matchFingerprint(matched)+":"+pattern),
+		tgbotapi.NewInlineKeyboardButtonData("Cancel", cancelCallback),
+	))
+
+	return msg
+}
+
+// confirmRemoveMatch removes the feeds that removeMatch asked about. data is
+// the fingerprint of the shown feeds and the pattern, separated by a colon.
+// Nothing is removed if the feeds matching the pattern changed meanwhile.
+func confirmRemoveMatch(ctx context.Context, db *DB, chatID int64, messageID int, data string) tgbotapi.Chattable {
+	parts := strings.SplitN(data, ":", 2)
+	if len(parts) != 2 {
+		return tgbotapi.NewEditMessageText(chatID, messageID, "This confirmation is no longer valid.")
+	}
+	fingerprint, pattern := parts[0], parts[1]
+
+	feeds, err := db.FeedsByChat(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("enumerating feeds of chat")
+		return tgbotapi.NewEditMessageText(chatID, messageID, backendError(err))
+	}
+
+	matched := matchFeeds(feeds, pattern)
+	if matchFingerprint(matched) != fingerprint {
+		return tgbotapi.NewEditMessageText(chatID, messageID, "The matching feeds changed. Nothing was removed, please use /removematch again.")
+	}
+
+	var urls []string
+	for _, feed := range matched {
+		urls = append(urls, feed.URL)
+	}
+
+	n, err := db.RemoveFeedsFromChat(ctx, chatID, urls)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"Pattern": pattern,
+		}).Error("remove matching feeds from chat failed")
+
+		return tgbotapi.NewEditMessageText(chatID, messageID, backendError(err))
+	}
+
+	return tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("%d feeds were removed.", n))
+}
+
+const unsubscribeAllCallbackPrefix = "unsubscribeall:"
+
+// unsubscribeAll handles the /unsubscribeall command. It asks for
+// confirmation before anything is removed.
+func unsubscribeAll(ctx context.Context, db *DB, chatID int64) tgbotapi.Chattable {
+	feeds, err := db.FeedsByChat(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("enumerating feeds of chat")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if len(feeds) == 0 {
+		return tgbotapi.NewMessage(chatID, "No feeds in this chat.")
+	}
+
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Do you really want to remove all %d feeds from this chat?", len(feeds)))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("Remove %d feeds", len(feeds)), unsubscribeAllCallbackPrefix+matchFingerprint(feeds)),
+		tgbotapi.NewInlineKeyboardButtonData("Cancel", cancelCallback),
+	))
+
+	return msg
+}
+
+// confirmUnsubscribeAll removes the feeds of the chat once unsubscribeAll
+// was confirmed. Nothing is removed if the feeds changed meanwhile.
+func confirmUnsubscribeAll(ctx context.Context, db *DB, chatID int64, messageID int, fingerprint string) tgbotapi.Chattable {
+	feeds, err := db.FeedsByChat(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("enumerating feeds of chat")
+		return tgbotapi.NewEditMessageText(chatID, messageID, backendError(err))
+	}
+
+	if matchFingerprint(feeds) != fingerprint {
+		return tgbotapi.NewEditMessageText(chatID, messageID, "The feeds of this chat changed. Nothing was removed, please use /unsubscribeall again.")
+	}
+
+	n, err := db.RemoveAllFeedsFromChat(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("remove all feeds from chat failed")
+		return tgbotapi.NewEditMessageText(chatID, messageID, backendError(err))
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"Chat ID": chatID,
+		"Feeds":   n,
+	}).Info("removed all feeds from chat")
+
+	return tgbotapi.NewEditMessageText(chatID, messageID, fmt.Sprintf("%d feeds were removed.", n))
+}
+
+func redirect(ctx context.Context, db *DB, bot *tgbotapi.BotAPI, user tgbotapi.User, chatID int64, args string) tgbotapi.Chattable {
+	fields := strings.Fields(args)
+	if len(fields) == 1 && fields[0] == "off" {
+		if err := db.SetRedirect(ctx, chatID, Redirect{}); err != nil {
+			logrus.WithError(err).WithField("Chat ID", chatID).Error("clear redirect failed")
+			return tgbotapi.NewMessage(chatID, backendError(err))
+		}
+
+		return tgbotapi.NewMessage(chatID, "Updates are no longer redirected.")
+	}
+
+	if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "only") {
+		return tgbotapi.NewMessage(chatID, "Usage: /redirect <chat id> <duration> [only], e.g. /redirect -100123456 48h")
+	}
+
+	target, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || target == chatID {
+		return tgbotapi.NewMessage(chatID, "Please provide the ID of another chat")
+	}
+
+	d, err := time.ParseDuration(fields[1])
+	if err != nil || d <= 0 {
+		return tgbotapi.NewMessage(chatID, "Please provide a duration like 90m or 48h")
+	}
+
+	// do not let anybody direct updates into chats they are not part of
+	member, err := bot.GetChatMember(tgbotapi.ChatConfigWithUser{ChatID: target, UserID: user.ID})
+	if err != nil || member.HasLeft() || member.WasKicked() {
+		return tgbotapi.NewMessage(chatID, "You have to be a member of the target chat.")
+	}
+
+	r := Redirect{
+		ChatID: target,
+		Until:  time.Now().Add(d),
+		Only:   len(fields) == 3,
+	}
+
+	targetLoc, err := db.ChatLocation(ctx, target)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", target).Error("get chat time zone failed")
+	}
+
+	notice := fmt.Sprintf("Feed updates of chat %d are redirected to this chat until %s.", chatID, chatTime(r.Until, targetLoc))
+	if _, err := bot.Send(tgbotapi.NewMessage(target, notice)); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID":   chatID,
+			"Target ID": target,
+		}).Warn("cannot post to redirect target")
+
+		return tgbotapi.NewMessage(chatID, "I cannot post to that chat.")
+	}
+
+	if err := db.SetRedirect(ctx, chatID, r); err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("set redirect failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	loc, err := db.ChatLocation(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("get chat time zone failed")
+	}
+
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("Updates are redirected until %s.", chatTime(r.Until, loc)))
+}
+
+// feedStatus lists the feeds of the chat with the time of their last item
+// and the number of times they could not be loaded recently.
+func feedStatus(ctx context.Context, db *DB, chatID int64) tgbotapi.Chattable {
+	list, err := db.ChatFeedStatus(ctx, chatID, time.Now().Add(-feedErrorWindow))
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("get feed status failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if len(list) == 0 {
+		return tgbotapi.NewMessage(chatID, "No feeds in this chat.")
+	}
+
+	loc, err := db.ChatLocation(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("get chat time zone failed")
+	}
+
+	text := "Status of the feeds in this chat:\n"
+	for _, status := range list {
+		last := "never"
+		if status.LastUpdate.After(firstSecond) {
+			last = chatTime(status.LastUpdate, loc)
+		}
+
+		text += fmt.Sprintf("[%d] %s\n    Last item: %s\n", status.ID, status.Title, last)
+		if status.RecentErrors > 0 {
+			text += fmt.Sprintf("    Failed to load %d times in the last %d hours\n", status.RecentErrors, feedErrorWindow/time.Hour)
+		}
+	}
+
+	return tgbotapi.NewMessage(chatID, text)
+}
+
+// removeFeed handles the /removefeed command.
+func removeFeed(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	num, err := strconv.ParseInt(args, 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Please provide the ID of the feed to remove")
+	}
+
+	if err := db.RemoveFeedFromChat(ctx, chatID, num); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("remove feed from chat failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	return tgbotapi.NewMessage(chatID, "Feed was removed.")
+}
+
+// exportFeeds handles the /export command, which sends the feeds of the
+// chat as OPML file.
+func exportFeeds(ctx context.Context, db *DB, chatID int64, now time.Time) tgbotapi.Chattable {
+	list, err := db.FeedsByChat(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("enumerating feeds of chat")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if len(list) == 0 {
+		return tgbotapi.NewMessage(chatID, "No feeds in this chat.")
+	}
+
+	var buf bytes.Buffer
+	if err := writeOPML(&buf, "Feeds of Telegram chat "+strconv.FormatInt(chatID, 10), now, list); err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("writing OPML failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	return tgbotapi.NewDocumentUpload(chatID, tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("feeds-%d-%s.opml", chatID, now.UTC().Format("2006-01-02")),
+		Bytes: buf.Bytes(),
+	})
+}
+
+// renameFeed handles the /renamefeed command.
+func renameFeed(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	fields := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	num, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Please provide the ID of the feed")
+	}
+
+	title := ""
+	if len(fields) == 2 {
+		title = strings.TrimSpace(fields[1])
+	}
+
+	if utf8.RuneCountInString(title) > maxDisplayTitleLength {
+		return tgbotapi.NewMessage(chatID, "This title is too long.")
+	}
+
+	if err := db.RenameSub(ctx, chatID, num, title); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("rename feed failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if title == "" {
+		return tgbotapi.NewMessage(chatID, "The feed is shown under its own title again.")
+	}
+
+	return tgbotapi.NewMessage(chatID, "Feed was renamed.")
+}
+
+// setNote handles the /note command.
+func setNote(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	fields := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	num, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Please provide the ID of the feed")
+	}
+
+	note := ""
+	if len(fields) == 2 {
+		note = strings.TrimSpace(fields[1])
+	}
+
+	if len(note) > maxNoteLength {
+		return tgbotapi.NewMessage(chatID, "This note is too long.")
+	}
+
+	if err := db.SetNote(ctx, chatID, num, note); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("set note failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if note == "" {
+		return tgbotapi.NewMessage(chatID, "Note was removed.")
+	}
+
+	return tgbotapi.NewMessage(chatID, "Note was saved.")
+}
+
+// feedInfo handles the /feedinfo command.
+func feedInfo(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	num, err := strconv.ParseInt(strings.TrimSpace(args), 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Please provide the ID of the feed")
+	}
+
+	feed, sub, err := db.FeedOfChat(ctx, chatID, num)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("feed info failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	text := fmt.Sprintf("[%d] %s\nURL: %s\nLast item: %s\n", feed.ID, feed.Title, feed.FullURL(), chatTime(sub.LastUpdate, sub.Location))
+	if sub.IgnoreTitleChanges {
+		text += "Title-only changes are ignored.\n"
+	}
+	if feed.Note != "" {
+		text += fmt.Sprintf("Note: %s\n", feed.Note)
+	}
+
+	return tgbotapi.NewMessage(chatID, text)
+}
+
+// setDedup handles the /dedup command.
+func setDedup(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	args = strings.TrimSpace(args)
+	if args != "on" && args != "off" {
+		return tgbotapi.NewMessage(chatID, "Usage: /dedup on|off")
+	}
+
+	if err := db.SetDedupLinks(ctx, chatID, args == "on"); err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("set dedup links failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if args == "on" {
+		return tgbotapi.NewMessage(chatID, "Items whose link was already sent to this chat by a feed listed before will be skipped.")
+	}
+
+	return tgbotapi.NewMessage(chatID, "Items are sent regardless of other feeds.")
+}
+
+// setSkipRepublished handles the /skiprepublished command.
+func setSkipRepublished(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	args = strings.TrimSpace(args)
+	if args != "on" && args != "off" {
+		return tgbotapi.NewMessage(chatID, "Usage: /skiprepublished on|off")
+	}
+
+	if err := db.SetSkipRepublished(ctx, chatID, args == "on"); err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("set skip republished failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if args == "on" {
+		return tgbotapi.NewMessage(chatID, "Items that a feed publishes again without changes will be skipped.")
+	}
+
+	return tgbotapi.NewMessage(chatID, "Items that a feed publishes again are sent again.")
+}
 
-func feedError(ctx context.Context, db *DB, feed *Feed, send sendFunc) {
-	if n, err := db.RecentFeedErrors(ctx, time.Now().Add(-time.Hour*12), feed.ID); err != nil {
-		return
-	} else if n >= 9 {
-		logrus.WithField("Feed", feed.URL).Error("too many errors, dropping feed")
+// setInterval handles the /setinterval command.
+func setInterval(ctx context.Context, cfg *Config, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	minutes, err := strconv.ParseInt(strings.TrimSpace(args), 10, 64)
+	if err != nil || minutes < 0 {
+		return tgbotapi.NewMessage(chatID, "Please provide the interval in minutes")
+	}
 
-		var chatIDs []int64
-		subs, err := db.Subs(ctx, feed.ID, &firstSecond)
-		if err != nil {
-			logrus.WithError(err).WithField("Feed", feed.URL).Error("failed to fetch subs for feed")
-		} else {
-			for sub := range subs {
-				chatIDs = append(chatIDs, sub.ChatID)
-			}
-		}
+	interval := time.Duration(minutes) * time.Minute
+	// Shorter intervals could not be honoured, as updates only run this
+	// often.
+	if minInterval := cfg.Bot.UpdateInterval.Duration; interval != 0 && interval < minInterval {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("The interval must be at least %d minutes.", minInterval/time.Minute))
+	}
 
-		if err := db.DropFeed(ctx, feed.ID); err != nil {
-			logrus.WithError(err).WithFields(logrus.Fields{
-				"Errors/12h": n,
-				"Feed":       feed.URL,
-			}).Error("cannot drop feed")
-			return
-		}
+	if err := db.SetChatInterval(ctx, chatID, interval); err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("set chat interval failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
 
-		go func() {
-			for _, chatID := range chatIDs {
-				send(chatID, fmt.Sprintf("Your feed \"%s\" was removed because it could not be loaded multiple times.", feed.Title))
-			}
-		}()
+	if interval == 0 {
+		return tgbotapi.NewMessage(chatID, "New items are sent to this chat as soon as possible.")
 	}
+
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("New items are sent to this chat at most every %s.", interval))
 }
 
-func update(parentCtx context.Context, db *DB, send sendFunc) (anyErr error) {
-	ctx, cancel := context.WithTimeout(parentCtx, updateTimeout)
-	defer cancel()
+// setFormat handles the /format command.
+func setFormat(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	fields := strings.Fields(args)
+	if len(fields) != 2 || !isItemFormat(fields[1]) {
+		return tgbotapi.NewMessage(chatID, "Usage: /format <id> "+strings.Join(itemFormats, "|"))
+	}
 
-	fp := gofeed.NewParser()
+	num, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Please provide the ID of the feed")
+	}
 
-	updateCount := 0
-	defer logrus.Infof("update: Sent %d feed updates to chats.", updateCount)
+	if err := db.SetFormat(ctx, chatID, num, fields[1]); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("set format failed")
 
-	feeds, err := db.Feeds(ctx)
-	if err != nil {
-		logrus.WithError(err).Error("update: get feeds")
-		return err
+		return tgbotapi.NewMessage(chatID, backendError(err))
 	}
 
-	for info := range feeds {
-		url := "https:" + info.URL
-		logrus.WithField("Feed", url).Debug("update: load feed")
+	return tgbotapi.NewMessage(chatID, "Format was changed.")
+}
 
-		feed, err := fp.ParseURLWithContext(url, ctx)
-		if err != nil {
-			logrus.WithError(err).WithField("Feed", url).Error("update: error with feed (parsing)")
+// deliveryLatency handles the /latency command.
+func deliveryLatency(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	num, err := strconv.ParseInt(strings.TrimSpace(args), 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Please provide the ID of the feed")
+	}
 
-			if ctx.Err() != nil {
-				return ctx.Err()
-			}
+	avg, n, err := db.DeliveryLatency(ctx, chatID, num)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("delivery latency failed")
 
-			feedError(ctx, db, &info, send)
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
 
-			continue
-		}
+	if n == 0 {
+		return tgbotapi.NewMessage(chatID, "No items of this feed were delivered to this chat recently.")
+	}
 
-		updated := feed.UpdatedParsed
-		if updated == nil {
-			updated = &firstSecond
-			for _, item := range feed.Items {
-				pub := item.PublishedParsed
-				if pub != nil && pub.After(*updated) {
-					updated = pub
-				}
-			}
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("New items of this feed arrived %s after publication on average (based on %d items).", avg.Round(time.Minute), n))
+}
 
-			if updated == &firstSecond {
-				logrus.WithError(err).WithField("Feed", url).Error("update: no timestamps")
-				feedError(ctx, db, &info, send)
-				continue
-			}
-		}
+// ignoreTitles handles the /ignoretitles command.
+func ignoreTitles(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	fields := strings.Fields(args)
+	if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+		return tgbotapi.NewMessage(chatID, "Usage: /ignoretitles <id> on|off")
+	}
 
-		subs, err := db.Subs(ctx, info.ID, updated)
-		if err != nil {
-			logrus.WithError(err).WithField("Feed", url).Error("update: getting chat IDs")
+	num, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Please provide the ID of the feed")
+	}
 
-			if ctx.Err() != nil {
-				return ctx.Err()
-			}
+	ignore := fields[1] == "on"
+	if err := db.SetIgnoreTitleChanges(ctx, chatID, num, ignore); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("set ignore title changes failed")
 
-			continue
-		}
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
 
-		logrus.WithFields(logrus.Fields{
-			"#Chats": len(subs),
-			"Feed":   info.URL,
-		}).Debug("update: chats that need update")
-
-		for sub := range subs {
-			newItems := []*gofeed.Item{}
-			for _, item := range feed.Items {
-				if item.PublishedParsed != nil && item.PublishedParsed.After(sub.LastUpdate) {
-					newItems = append(newItems, item)
-				}
-			}
+	if ignore {
+		return tgbotapi.NewMessage(chatID, "Items of this feed are no longer resent when only their title changes.")
+	}
 
-			if len(newItems) == 0 {
-				continue
-			}
+	return tgbotapi.NewMessage(chatID, "Items of this feed are resent when their title changes.")
+}
 
-			logrus.WithFields(logrus.Fields{
-				"Chat ID":      sub.ChatID,
-				"New Items":    len(newItems),
-				"Chat updated": sub.LastUpdate,
-				"Feed updated": updated,
-			}).Debug("update: new items for chat")
+var urlRegexp = regexp.MustCompile(`(?i)\b[a-z][a-z0-9+.-]*://\S+|\bwww\.\S+`)
 
-			sort.Slice(newItems, func(i, j int) bool {
-				return newItems[i].PublishedParsed.Before(*newItems[j].PublishedParsed)
-			})
+// redact replaces the URLs in text, so that it can be logged without
+// revealing which feeds a user reads.
+func redact(text string) string {
+	return urlRegexp.ReplaceAllString(text, "[redacted]")
+}
 
-			for _, item := range newItems {
-				send(sub.ChatID, fmt.Sprintf("%s\n%s\n\nLink: %s", item.Title, item.Description, item.Link))
-				updateCount++
+var credentialsRegexp = regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.-]*://)[^/?#\s@]*@`)
 
-				anyErr = db.UpdateSub(ctx, sub.ChatID, info.ID, *item.PublishedParsed)
-				logrus.WithError(anyErr).Error("update: UpdateSub")
+// stripCredentials removes user names and passwords from the URLs in text.
+// Unlike the URLs themselves, they are never logged.
+func stripCredentials(text string) string {
+	return credentialsRegexp.ReplaceAllString(text, "$1")
+}
 
-				if ctx.Err() != nil {
-					return ctx.Err()
-				}
-			}
-		}
+// allowRequest reports whether the user did not send too many requests
+// recently, and records the request in the audit sink if requests are logged
+// or audited. Command is empty for the data of buttons, which is passed as
+// args.
+func allowRequest(ctx context.Context, cfg *Config, db *DB, sink AuditSink, limiter *rateLimiter, user *tgbotapi.User, chatID int64, command, args string) bool {
+	fullName := fmt.Sprint(user.FirstName, " ", user.LastName)
+	if !withinRequestLimit(ctx, cfg, db, limiter, int64(user.ID)) {
+		logrus.WithFields(logrus.Fields{
+			"User":     fullName,
+			"Username": user.UserName,
+		}).Error("many requests coming from user. ignoring.")
+		return false
 	}
 
-	return
-}
+	if !cfg.Bot.LogRequests && !cfg.Audit.Always {
+		return true
+	}
 
-func periodicUpdate(ctx context.Context, db *DB, send sendFunc) {
-	tick := time.NewTicker(waitBetweenUpdatesTime)
-	defer tick.Stop()
+	if cfg.Bot.RedactURLs() {
+		args = redact(args)
+	} else {
+		args = stripCredentials(args)
+	}
 
-	for {
-		logrus.Info("periodic update started")
+	e := AuditEvent{
+		Time:    time.Now(),
+		UserID:  int64(user.ID),
+		Name:    fullName,
+		ChatID:  chatID,
+		Command: command,
+		Args:    args,
+	}
+	if err := sink.Audit(ctx, e); err != nil {
+		logrus.WithError(err).Warn("cannot log request")
+	}
 
-		err := update(ctx, db, send)
-		if err != nil && err == ctx.Err() {
-			logrus.WithContext(ctx).Error("update took too long.")
-		}
+	return true
+}
 
-		logrus.Info("periodic update ended")
+// withinRequestLimit reports whether the user sent fewer requests than
+// allowed within the window. The requests are counted by limiter; if all of
+// them are stored in the requests table, those from before the bot started
+// are counted once when the user is first seen.
+func withinRequestLimit(ctx context.Context, cfg *Config, db *DB, limiter *rateLimiter, userID int64) bool {
+	if cfg.Bot.MaxRequests <= 0 {
+		return true
+	}
 
-		select {
-		case <-ctx.Done():
-			return
-		case <-tick.C:
+	if cfg.requestsStored() && !limiter.Known(userID) {
+		n, err := db.RecentRequests(ctx, time.Now().Add(-cfg.Bot.RequestsWindow.Duration), userID)
+		if err != nil {
+			logrus.WithError(err).Error("recent requests select error")
+		} else {
+			limiter.Seed(userID, n)
 		}
 	}
+
+	return limiter.Allow(userID)
 }
 
-const helptext = `This bot can serve you in the following ways:
+// mentionedUser returns the user that a command refers to. A user mentioned
+// in the command or given by ID in arg takes precedence over the author of
+// the message the command replies to.
+func mentionedUser(msg *tgbotapi.Message, arg string) (int64, bool) {
+	if msg.Entities != nil {
+		for _, entity := range *msg.Entities {
+			if entity.Type == "text_mention" && entity.User != nil {
+				return int64(entity.User.ID), true
+			}
+		}
+	}
 
-/addfeed <url>  ... Adds an RSS/Atom feed to this chat
-/feeds ... Lists the feeds that are assigned to this chat
-/removefeed <id> ... Remove a particular feed from this chat (use the number from feeds command)
-`
+	if id, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return id, true
+	}
 
-func addFeed(ctx context.Context, db *DB, user tgbotapi.User, chatID int64, feedURL string) tgbotapi.Chattable {
-	logrus.WithFields(logrus.Fields{
-		"Username": user.UserName,
-		"Name":     user.FirstName + " " + user.LastName,
-		"User ID":  user.ID,
-		"Chat ID":  chatID,
-		"Feed URL": feedURL,
-	}).Debug("/addfeed command")
+	if msg.ReplyToMessage != nil && msg.ReplyToMessage.From != nil && !msg.ReplyToMessage.From.IsBot {
+		return int64(msg.ReplyToMessage.From.ID), true
+	}
 
-	fp := gofeed.NewParser()
+	return 0, false
+}
 
-	u, err := url.Parse(feedURL)
+func isChatAdmin(bot *tgbotapi.BotAPI, chatID int64, userID int) bool {
+	member, err := bot.GetChatMember(tgbotapi.ChatConfigWithUser{ChatID: chatID, UserID: userID})
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"Feed URL": feedURL,
-		}).Warn("cannot parse URL")
-
-		return tgbotapi.NewMessage(chatID, "Your feed is fishy.")
+		return false
 	}
 
-	u.Scheme = ""
-	url := u.String()
+	return member.IsCreator() || member.IsAdministrator()
+}
 
-	title := ""
-	info, err := db.FeedByURL(ctx, url)
+func chown(ctx context.Context, db *DB, bot *tgbotapi.BotAPI, msg *tgbotapi.Message, args string) tgbotapi.Chattable {
+	chatID := msg.Chat.ID
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return tgbotapi.NewMessage(chatID, "Usage: /chown <id> <user>")
+	}
+
+	num, err := strconv.ParseInt(fields[0], 10, 64)
 	if err != nil {
-		// try to fetch the feed via HTTPS
-		u.Scheme = "https"
+		return tgbotapi.NewMessage(chatID, "Please provide the ID of the feed")
+	}
 
-		feed, err := fp.ParseURLWithContext(u.String(), ctx)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"Feed URL":  feedURL,
-				"HTTPS URL": u.String(),
-			}).Warn("cannot fetch feed")
+	target, ok := mentionedUser(msg, strings.Join(fields[1:], " "))
+	if !ok {
+		return tgbotapi.NewMessage(chatID, "I don't know who that is. Reply to a message of the new owner or give their user ID.")
+	}
 
-			return tgbotapi.NewMessage(chatID, "I cannot fetch your feed using HTTPS :(")
-		}
+	_, sub, err := db.FeedOfChat(ctx, chatID, num)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("feed info failed")
 
-		title = feed.Title
-	} else {
-		title = info.Title
+		return tgbotapi.NewMessage(chatID, backendError(err))
 	}
 
-	err = db.AddFeedToChat(ctx, int64(user.ID), chatID, Feed{
-		Title: title,
-		URL:   url,
-	})
+	if sub.UserID != int64(msg.From.ID) && !isChatAdmin(bot, chatID, msg.From.ID) {
+		return tgbotapi.NewMessage(chatID, "Only the owner of the feed or an administrator may do this.")
+	}
 
-	msg := tgbotapi.NewMessage(chatID, "")
-	switch err {
-	case nil:
-		msg.Text = fmt.Sprintf("Feed \"%s\" was added to this chat.", title)
+	if sub.UserID == target {
+		return tgbotapi.NewMessage(chatID, "This user already owns the feed.")
+	}
 
-	case ErrMaxFeedsInChat:
-		msg.Text = "You cannot add more feeds to this chat."
+	switch err := db.ChangeSubOwner(ctx, chatID, num, target); err {
+	case nil:
+		return tgbotapi.NewMessage(chatID, "The feed has a new owner.")
 
-		logrus.WithFields(logrus.Fields{
-			"Username": user.UserName,
-			"User ID":  user.ID,
-			"Chat ID":  chatID,
-		}).Error("maximum feeds in chat reached")
+	case ErrMaxActiveFeedsByUser:
+		return tgbotapi.NewMessage(chatID, "The new owner already has enough feeds.")
 
-	case ErrMaxActiveFeedsByUser, ErrMaxTotalFeedsByUser:
-		msg.Text = "I think you have added enough feeds for now."
+	default:
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+			"User ID": target,
+		}).Error("change sub owner failed")
 
-		logrus.WithFields(logrus.Fields{
-			"Username": user.UserName,
-			"User ID":  user.ID,
-		}).WithError(err).Error("maximum feeds by user reached")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+}
 
+// setupLogging applies the log configuration. Invalid settings are reported
+// and replaced by the defaults, which are info and text.
+func setupLogging(cfg *LogConfig) {
+	switch cfg.Format {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
 	default:
-		msg.Text = "Backend error"
-
-		logrus.WithFields(logrus.Fields{
-			"Username": user.UserName,
-			"User ID":  user.ID,
-		}).WithError(err).Error("unknown error in AddFeedToChat")
+		logrus.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp: true,
+		})
+		if cfg.Format != "" && cfg.Format != "text" {
+			logrus.WithField("Format", cfg.Format).Warn("unknown log format, using text")
+		}
 	}
 
-	return msg
+	level := logrus.InfoLevel
+	if cfg.Level != "" {
+		l, err := logrus.ParseLevel(cfg.Level)
+		if err != nil {
+			logrus.WithError(err).Warn("invalid log level, using info")
+		} else {
+			level = l
+		}
+	}
+	logrus.SetLevel(level)
 }
 
 func main() {
+	configPath := flag.String("config", configfilePath, "path of the config file")
+	dryRun := flag.Bool("dry-run", false, "only log the messages that updates would send")
+	checkConfig := flag.Bool("check-config", false, "only load and validate the config file")
+	printEffectiveConfig := flag.Bool("print-config", false, "only print the config with defaults applied and secrets redacted")
+	flag.Parse()
+
 	logrus.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
 	})
-	logrus.SetLevel(logrus.DebugLevel)
 
-	cfg, err := loadConfigFile(configfilePath)
+	cfg, err := loadConfigFile(*configPath)
 	if err != nil {
-		logrus.WithError(err).WithField("path", configfilePath).Fatalln("Cannot open config file")
+		logrus.WithError(err).WithField("path", *configPath).Fatalln("Cannot open config file")
+	}
+
+	if *printEffectiveConfig {
+		if err := printConfig(os.Stdout, cfg); err != nil {
+			logrus.WithError(err).Fatalln("cannot print config")
+		}
+		return
+	}
+
+	if err := cfg.Validate(); err != nil {
+		logrus.WithError(err).WithField("path", *configPath).Fatalln("Invalid config file")
+	}
+
+	if *checkConfig {
+		logrus.WithField("path", *configPath).Info("config file is valid")
+		return
+	}
+
+	if *dryRun {
+		cfg.Bot.DryRun = true
+	}
+	if cfg.Bot.DryRun {
+		logrus.Warn("dry run: updates only log the messages they would send")
+	}
+
+	setupLogging(&cfg.Log)
+
+	if _, ok := backlogSelectors[cfg.Bot.BacklogStrategy]; !ok && cfg.Bot.BacklogStrategy != "" {
+		logrus.WithField("Strategy", cfg.Bot.BacklogStrategy).Fatalln("unknown backlog strategy")
 	}
 
-	db, err := OpenDB(cfg.DB.Source)
+	db, err := OpenDB(cfg.DB.Driver, cfg.DB.Source)
 	if err != nil {
 		logrus.WithError(err).Fatalln("cannot open DB")
 	}
 
 	defer db.Close()
 
+	if err := db.Migrate(context.Background()); err != nil {
+		logrus.WithError(err).Fatalln("cannot migrate DB")
+	}
+
 	db.MaxFeedsPerChat = cfg.Bot.MaxFeedsPerChat
 	db.MaxTotalFeedsByUser = cfg.Bot.MaxTotalFeedsByUser
 	db.MaxActiveFeedsByUser = cfg.Bot.MaxActiveFeedsByUser
+	db.AggregateRequests = cfg.Bot.AggregateRequests
 	db.Prepare()
 
+	if err := loadDeliveryPaused(context.Background(), db); err != nil {
+		logrus.WithError(err).Fatalln("cannot load state of delivery")
+	}
+
 	bot, err := tgbotapi.NewBotAPI(cfg.Bot.APIKey)
 	if err != nil {
 		logrus.WithError(err).Fatalln("bot api error")
@@ -305,148 +1658,249 @@ func main() {
 
 	logrus.WithField("Bot User", bot.Self.UserName).Info("Authorized")
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	setupCommands(cfg, bot)
+
+	if cfg.Metrics.ListenAddr != "" {
+		serveMetrics(cfg.Metrics.ListenAddr)
+	}
 
-	updateCh, err := bot.GetUpdatesChan(u)
+	if cfg.Bot.HealthAddr != "" {
+		serveHealth(cfg.Bot.HealthAddr, bot, db)
+	}
 
-	sendCh := make(chan tgbotapi.Chattable)
-	send := func(chatID int64, text string) {
-		sendCh <- tgbotapi.NewMessage(chatID, text)
+	stopReceiving := make(chan struct{})
+	updateCh, err := updatesChannel(bot, &cfg.Webhook, stopReceiving)
+	if err != nil {
+		logrus.WithError(err).Fatalln("cannot receive updates")
 	}
 
+	// The configuration may be reloaded while the bot runs, see reload.
+	config := newSharedConfig(cfg)
+
 	osSignals := make(chan os.Signal, 1)
 
-	signal.Notify(osSignals, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(osSignals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
+	// Commands run with ctx, which is only cancelled once they had time to
+	// finish during shutdown. The periodic update is stopped first.
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updateCtx, stopUpdates := context.WithCancel(ctx)
 
-	go periodicUpdate(ctx, db, send)
+	// All messages that are not direct replies to commands go through the
+	// queue of the sender. Senders block while it is full instead of piling
+	// up goroutines.
+	sender := newSender(bot, db)
+	send := func(msg tgbotapi.Chattable) {
+		sender.Send(updateCtx, msg)
+	}
+
+	stopSending := make(chan struct{})
+	sendDone := make(chan struct{})
+	go func() {
+		defer close(sendDone)
+		sender.Run(ctx, stopSending)
+	}()
+
+	updateDone := make(chan struct{})
+	go func() {
+		defer close(updateDone)
+		periodicUpdate(updateCtx, config, db, send)
+	}()
+
+	// commands tracks the commands that run in the background.
+	var commands sync.WaitGroup
+	background := func(f func()) {
+		commands.Add(1)
+		go func() {
+			defer commands.Done()
+			f()
+		}()
+	}
 
-	if len(cfg.Bot.UserWhitelist) == 0 {
+	if !cfg.HasWhitelist() {
 		logrus.Info("No whitelist active")
 	} else {
-		logrus.Info("Whitelisting these users: ", cfg.Bot.UserWhitelist)
+		logrus.WithFields(logrus.Fields{
+			"Usernames": cfg.Bot.UserWhitelist,
+			"User IDs":  cfg.Bot.UserIDWhitelist,
+		}).Info("Whitelisting users")
+	}
+
+	audit, err := newAuditSink(&cfg.Audit, db)
+	if err != nil {
+		logrus.WithError(err).Fatalln("cannot open audit sink")
 	}
+	defer audit.Close()
+
+	fetchLimiter := newRateLimiter(cfg.Bot.MaxFetchRequests, fetchRequestsWindow)
+	requestLimiter := newRateLimiter(cfg.Bot.MaxRequests, cfg.Bot.RequestsWindow.Duration)
+	imports := newImportSessions()
 
 	logrus.Info("Ready")
+loop:
 	for {
 		select {
-		case <-ctx.Done():
-			logrus.Info("shutting down")
-			return
-
 		case sig := <-osSignals:
 			logrus.Infof("received signal %s", sig)
-			cancel()
-
-		case c := <-sendCh:
-			bot.Send(c)
-
-		case update := <-updateCh:
-			if update.Message == nil {
-				continue
-			}
-
-			if !update.Message.IsCommand() {
+			if sig == syscall.SIGHUP {
+				reload(config, db, *configPath)
 				continue
 			}
+			break loop
 
-			cmd := update.Message.Command()
-			args := update.Message.CommandArguments()
-			chatID := update.Message.Chat.ID
-			user := update.Message.From
-			fullName := fmt.Sprint(user.FirstName, " ", user.LastName)
+		case update := <-updateCh:
+			cfg := config.Get()
 
-			logrus.WithFields(logrus.Fields{
-				"User ID":  user.ID,
-				"Username": user.UserName,
-				"Cmd":      cmd,
-				"Args":     args,
-			}).Debug("received command")
+			if cb := update.CallbackQuery; cb != nil {
+				bot.AnswerCallbackQuery(tgbotapi.NewCallback(cb.ID, ""))
 
-			if cfg.Bot.LogRequests {
-				if n, err := db.RecentRequests(ctx, time.Now().Add(-time.Minute*5), int64(user.ID)); err != nil {
-					logrus.WithError(err).Error("recent requests select error")
-				} else if n > 25 {
-					logrus.WithFields(logrus.Fields{
-						"User":     fullName,
-						"Username": user.UserName,
-					}).Error("many requests coming from user. ignoring.")
+				if cb.Message == nil {
 					continue
 				}
 
-				err := db.LogRequest(ctx, fullName, update.Message.Text, int64(user.ID))
-				if err != nil {
-					logrus.WithError(err).Warn("cannot log request")
+				chatID := cb.Message.Chat.ID
+				messageID := cb.Message.MessageID
+				reply := func(c tgbotapi.Chattable) {
+					c = inThread(c, update.CallbackThread())
+					if err := sendMessage(bot, c); err != nil {
+						reportSendError(ctx, db, c, err, logrus.Fields{"Callback": cb.Data})
+					}
 				}
-			}
 
-			switch cmd {
-			case "help":
-				bot.Send(tgbotapi.NewMessage(chatID, helptext))
+				switch {
+				case cb.Data == cancelCallback:
+					reply(tgbotapi.NewEditMessageText(chatID, messageID, "Cancelled."))
 
-			case "addfeed":
-				if !cfg.IsWhitelisted(user.UserName) {
-					bot.Send(tgbotapi.NewMessage(chatID, "You may not do this."))
-					break
-				}
+				case strings.HasPrefix(cb.Data, removeMatchCallbackPrefix):
+					reply(confirmRemoveMatch(ctx, db, chatID, messageID, strings.TrimPrefix(cb.Data, removeMatchCallbackPrefix)))
 
-				args = strings.TrimSpace(args)
-				if args == "" {
-					bot.Send(tgbotapi.NewMessage(chatID, "copy the URL of the feed after the command"))
-					break
-				}
+				case strings.HasPrefix(cb.Data, unsubscribeAllCallbackPrefix):
+					reply(confirmUnsubscribeAll(ctx, db, chatID, messageID, strings.TrimPrefix(cb.Data, unsubscribeAllCallbackPrefix)))
 
-				go func() {
-					msg := addFeed(ctx, db, *user, chatID, args)
-					if msg != nil {
-						bot.Send(msg)
+				case strings.HasPrefix(cb.Data, removeFeedCallbackPrefix) && cb.From != nil:
+					if !cfg.IsWhitelisted(*cb.From) || !allowRequest(ctx, cfg, db, audit, requestLimiter, cb.From, chatID, "", cb.Data) {
+						break
 					}
-				}()
-
-			case "feeds":
-				feeds, err := db.FeedsByChat(ctx, chatID)
-				if err != nil {
-					logrus.WithError(err).WithField("Chat ID", chatID).Error("enumerating feeds of chat")
-					bot.Send(tgbotapi.NewMessage(chatID, "Backend error"))
-					break
-				}
 
-				text := "Feeds in this chat:\n"
-				anyFeeds := false
-				for feed := range feeds {
-					text += fmt.Sprintf("[%d] %s (url https:%s)\n", feed.ID, feed.Title, feed.URL)
-					anyFeeds = true
-				}
+					if res := removeFeedCallback(ctx, db, chatID, messageID, cb.Data); res != nil {
+						reply(res)
+					}
+
+				case strings.HasPrefix(cb.Data, feedsPageCallbackPrefix):
+					if res := feedsPageCallback(ctx, db, chatID, messageID, cb.Data); res != nil {
+						reply(res)
+					}
 
-				if !anyFeeds {
-					text = "No feeds in this chat."
+				case strings.HasPrefix(cb.Data, importCallbackPrefix) && cb.From != nil:
+					res, confirmed := importCallback(imports, chatID, messageID, int64(cb.From.ID), cb.Data)
+					if res != nil {
+						reply(res)
+					}
+
+					if confirmed != nil {
+						background(func() {
+							reply(tgbotapi.NewEditMessageText(chatID, messageID, importFeeds(ctx, cfg, db, confirmed.userID, chatID, update.CallbackThread(), confirmed.selectedURLs())))
+						})
+					}
 				}
 
-				bot.Send(tgbotapi.NewMessage(chatID, text))
+				continue
+			}
+
+			if update.Message == nil || migrateChat(ctx, db, update.Message) {
+				continue
+			}
 
-			case "removefeed":
-				num, err := strconv.ParseInt(args, 10, 64)
-				if err != nil {
-					bot.Send(tgbotapi.NewMessage(chatID, "Please provide the ID of the feed to remove"))
-					break
+			cmd, args, ok := captionCommand(update.Message)
+			if !ok {
+				if !update.Message.IsCommand() {
+					continue
 				}
 
-				if err := db.RemoveFeedFromChat(ctx, chatID, num); err != nil {
-					logrus.WithError(err).WithFields(logrus.Fields{
-						"Chat ID": chatID,
-						"#":       num,
-					}).Error("remove feed from chat failed")
+				cmd = update.Message.Command()
+				args = update.Message.CommandArguments()
+			}
 
-					bot.Send(tgbotapi.NewMessage(chatID, "Backend error"))
-					break
+			chatID := update.Message.Chat.ID
+			user := update.Message.From
+			threadID := update.MessageThread()
+			reply := func(c tgbotapi.Chattable) {
+				c = inThread(c, threadID)
+				if err := sendMessage(bot, c); err != nil {
+					reportSendError(ctx, db, c, err, logrus.Fields{"Cmd": cmd})
 				}
+			}
+
+			loggedArgs := stripCredentials(args)
+			if cfg.Bot.RedactURLs() {
+				loggedArgs = redact(args)
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"User ID":  user.ID,
+				"Username": user.UserName,
+				"Cmd":      cmd,
+				"Args":     loggedArgs,
+			}).Debug("received command")
+
+			if !isUngated(cmd) && !allowRequest(ctx, cfg, db, audit, requestLimiter, user, chatID, cmd, args) {
+				continue
+			}
 
-				bot.Send(tgbotapi.NewMessage(chatID, "Feed was removed."))
-			default:
-				bot.Send(tgbotapi.NewMessage(chatID, "I don't know that command"))
+			c := &commandContext{
+				ctx:      ctx,
+				cfg:      cfg,
+				db:       db,
+				bot:      bot,
+				msg:      update.Message,
+				chatID:   chatID,
+				threadID: threadID,
+				user:     *user,
+				args:     args,
+				imports:  imports,
 			}
+			runCommand(c, cmd, fetchLimiter, background, reply)
 		}
 	}
+
+	logrus.Info("shutting down")
+	close(stopReceiving)
+
+	stopUpdates()
+	if !waitFor(updateDone, shutdownTimeout) {
+		logrus.Warn("periodic update did not stop in time")
+	}
+
+	commandsDone := make(chan struct{})
+	go func() {
+		commands.Wait()
+		close(commandsDone)
+	}()
+	if !waitFor(commandsDone, shutdownTimeout) {
+		logrus.Warn("commands did not finish in time")
+	}
+
+	close(stopSending)
+	if !waitFor(sendDone, shutdownTimeout) {
+		logrus.Warn("sending did not stop in time")
+	}
+
+	drainCtx, cancelDrain := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancelDrain()
+	if dropped := sender.Drain(drainCtx); dropped > 0 {
+		logrus.WithField("Dropped", dropped).Warn("could not send all queued messages in time")
+	}
+}
+
+// waitFor waits until done is closed or the timeout expires and reports
+// whether done was closed.
+func waitFor(done <-chan struct{}, timeout time.Duration) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
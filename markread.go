@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+// markRead handles the /markread command, which skips the items of a feed,
+// or of all feeds with "all", that were published until now.
+func markRead(ctx context.Context, db *DB, chatID int64, args string, now time.Time) tgbotapi.Chattable {
+	args = strings.TrimSpace(args)
+	if args == "all" {
+		n, err := db.MarkChatRead(ctx, chatID, now)
+		if err != nil {
+			logrus.WithError(err).WithField("Chat ID", chatID).Error("mark chat read failed")
+			return tgbotapi.NewMessage(chatID, backendError(err))
+		}
+
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("%d feeds were marked as read. Only items published from now on will be sent.", n))
+	}
+
+	num, err := strconv.ParseInt(args, 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Usage: /markread <id>|all")
+	}
+
+	if err := db.MarkSubRead(ctx, chatID, num, now); err == sql.ErrNoRows {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("There is no feed with ID %d in this chat.", num))
+	} else if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("mark feed read failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	return tgbotapi.NewMessage(chatID, "Feed was marked as read. Only items published from now on will be sent.")
+}
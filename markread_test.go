@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+func TestMarkRead(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{MaxDescriptionLength: defaultMaxDescriptionLength}}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, simulateFeed)
+	}))
+	defer srv.Close()
+	addTestFeed(t, db, 1, 10, srv.URL)
+
+	text := func(c tgbotapi.Chattable) string {
+		return c.(tgbotapi.MessageConfig).Text
+	}
+
+	// Only the items of January 5 and 6 were published afterwards.
+	jan4 := time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)
+	if got := text(markRead(ctx, db, 10, "1", jan4)); got != "Feed was marked as read. Only items published from now on will be sent." {
+		t.Fatalf("mark feed read: %q", got)
+	}
+
+	var sent int
+	var count int64
+	if err := updateFeed(ctx, cfg, db, srv.Client(), func(tgbotapi.Chattable) { sent++ }, dueFeed(t, db), &count); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 {
+		t.Fatalf("sent %d items after marking the feed read, want 2", sent)
+	}
+
+	if got := text(markRead(ctx, db, 10, "9", jan4)); got != "There is no feed with ID 9 in this chat." {
+		t.Fatalf("mark unknown feed read: %q", got)
+	}
+	if got := text(markRead(ctx, db, 10, "some", jan4)); got != "Usage: /markread <id>|all" {
+		t.Fatalf("mark read without ID: %q", got)
+	}
+}
+
+func TestMarkReadAll(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	for _, chatID := range []int64{10, 20} {
+		for _, title := range []string{"a", "b"} {
+			if err := db.AddFeedToChat(ctx, 1, chatID, Feed{Title: title, URL: "//example.com/" + title, Scheme: "https"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// New subscriptions start at the time they were added.
+	now := time.Now().Add(time.Hour).Truncate(time.Second)
+	if got := markRead(ctx, db, 10, "all", now).(tgbotapi.MessageConfig).Text; got != "2 feeds were marked as read. Only items published from now on will be sent." {
+		t.Fatalf("mark all read: %q", got)
+	}
+
+	// Read positions are never moved back.
+	if n, err := db.MarkChatRead(ctx, 10, now.Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("MarkChatRead with earlier time = %d, %v, want 0", n, err)
+	}
+
+	for _, chatID := range []int64{10, 20} {
+		for num := int64(1); num <= 2; num++ {
+			_, sub, err := db.FeedOfChat(ctx, chatID, num)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if read := sub.LastUpdate.Equal(now); read != (chatID == 10) {
+				t.Errorf("chat %d, feed %d: read position %s", chatID, num, sub.LastUpdate)
+			}
+		}
+	}
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+	"github.com/mmcdole/gofeed"
+	htmlparse "golang.org/x/net/html"
+)
+
+// Formats in which items of a feed are delivered to a chat.
+const (
+	formatFull    = "full"
+	formatCompact = "compact"
+	formatPoll    = "poll"
+	formatQuiz    = "quiz"
+)
+
+var itemFormats = []string{formatFull, formatCompact, formatPoll, formatQuiz}
+
+func isItemFormat(format string) bool {
+	for _, f := range itemFormats {
+		if f == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Limits of the Telegram API for polls.
+const (
+	maxPollQuestionLength = 300
+	maxPollOptionLength   = 100
+	minPollOptions        = 2
+	maxPollOptions        = 10
+)
+
+// pollItem is an item that has the structure of a question: the title is the
+// question and the description contains the answers, separated by line breaks
+// or "|". For quizzes, the correct answer is marked with a leading "*".
+type pollItem struct {
+	Question string
+	Options  []string
+	Correct  int
+}
+
+// parsePollItem returns the poll that item describes. It returns false if item
+// does not have the structure of a poll.
+func parsePollItem(item *gofeed.Item, quiz bool) (poll pollItem, ok bool) {
+	poll.Question = strings.TrimSpace(item.Title)
+	if poll.Question == "" || len([]rune(poll.Question)) > maxPollQuestionLength {
+		return poll, false
+	}
+
+	// Descriptions are HTML, so answers are often list items or separated
+	// by <br>.
+	poll.Correct = -1
+	answers := strings.FieldsFunc(stripTags(item.Description), func(r rune) bool {
+		return r == '\n' || r == '|'
+	})
+
+	for _, answer := range answers {
+		answer = strings.TrimSpace(answer)
+		if answer == "" {
+			continue
+		}
+
+		if strings.HasPrefix(answer, "*") {
+			if poll.Correct != -1 {
+				return poll, false
+			}
+
+			poll.Correct = len(poll.Options)
+			answer = strings.TrimSpace(answer[1:])
+		}
+
+		if answer == "" || len([]rune(answer)) > maxPollOptionLength {
+			return poll, false
+		}
+
+		poll.Options = append(poll.Options, answer)
+	}
+
+	if len(poll.Options) < minPollOptions || len(poll.Options) > maxPollOptions {
+		return poll, false
+	}
+
+	if quiz && poll.Correct == -1 {
+		return poll, false
+	}
+
+	return poll, true
+}
+
+// formatItem renders item as Telegram HTML: the title in bold, linking to the
+// item, followed by at most maxDescription characters of the description.
+func formatItem(item *gofeed.Item, maxDescription int) string {
+	title := strings.TrimSpace(item.Title)
+	link := strings.TrimSpace(item.Link)
+	if title == "" {
+		title = link
+	}
+
+	var b strings.Builder
+	if title != "" {
+		b.WriteString("<b>")
+		if isWebLink(link) {
+			fmt.Fprintf(&b, `<a href="%s">%s</a>`, html.EscapeString(link), html.EscapeString(title))
+		} else {
+			b.WriteString(html.EscapeString(title))
+		}
+		b.WriteString("</b>")
+	}
+
+	if desc := sanitizeDescription(item.Description, maxDescription); desc != "" {
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(html.EscapeString(desc))
+	}
+
+	return b.String()
+}
+
+func isWebLink(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// sanitizeDescription turns the HTML description of an item into plain text
+// on a single line. Text longer than maxRunes characters is cut off and ends
+// with an ellipsis.
+func sanitizeDescription(s string, maxRunes int) string {
+	text := []rune(strings.Join(strings.Fields(stripTags(s)), " "))
+	if len(text) <= maxRunes {
+		return string(text)
+	}
+
+	return strings.TrimRightFunc(string(text[:maxRunes]), unicode.IsSpace) + "…"
+}
+
+// stripTags returns the text content of an HTML fragment. Entities are
+// decoded and line breaks are kept where the markup had them.
+func stripTags(s string) string {
+	var b strings.Builder
+	inScript := false
+
+	z := htmlparse.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		switch tt {
+		case htmlparse.ErrorToken:
+			return b.String()
+
+		case htmlparse.TextToken:
+			if !inScript {
+				b.Write(z.Text())
+			}
+
+		case htmlparse.StartTagToken, htmlparse.EndTagToken, htmlparse.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style":
+				inScript = tt == htmlparse.StartTagToken
+			case "br", "p", "div", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6":
+				b.WriteByte('\n')
+			}
+		}
+	}
+}
+
+// maxMessageLength is the maximum length of a message in Telegram.
+const maxMessageLength = 4096
+
+// Limits that keep a line of a batch well below maxMessageLength.
+const (
+	maxBatchTitleLength = 200
+	maxBatchLinkLength  = 2000
+)
+
+// formatItemLine renders item as a single line for a batch of items.
+func formatItemLine(item *gofeed.Item) string {
+	link := strings.TrimSpace(item.Link)
+	title := strings.TrimSpace(item.Title)
+	if title == "" {
+		title = link
+	}
+
+	if t := []rune(title); len(t) > maxBatchTitleLength {
+		title = string(t[:maxBatchTitleLength]) + "…"
+	}
+
+	href := html.EscapeString(link)
+	if !isWebLink(link) || len(href) > maxBatchLinkLength {
+		return "• " + html.EscapeString(title)
+	}
+
+	return fmt.Sprintf(`• <a href="%s">%s</a>`, href, html.EscapeString(title))
+}
+
+// formatCompactLine renders item as "Title — Link" on a single line. Either
+// part is left out if the item does not have it.
+func formatCompactLine(item *gofeed.Item) string {
+	link := strings.TrimSpace(item.Link)
+	title := strings.TrimSpace(item.Title)
+	if t := []rune(title); len(t) > maxBatchTitleLength {
+		title = string(t[:maxBatchTitleLength]) + "…"
+	}
+
+	if !isWebLink(link) || len(link) > maxBatchLinkLength {
+		link = ""
+	}
+
+	switch {
+	case title == "":
+		return html.EscapeString(link)
+	case link == "":
+		return html.EscapeString(title)
+	}
+
+	return html.EscapeString(title) + " — " + html.EscapeString(link)
+}
+
+// compactMessage sends item in the compact format, without a preview of the
+// link so that it stays a single line.
+func compactMessage(chatID int64, item *gofeed.Item) tgbotapi.MessageConfig {
+	msg := tgbotapi.NewMessage(chatID, formatCompactLine(item))
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.DisableWebPagePreview = true
+	return msg
+}
+
+// feedTitleLine renders the title of a feed above its items, or nothing if
+// feedTitle is empty.
+func feedTitleLine(feedTitle string) string {
+	if feedTitle == "" {
+		return ""
+	}
+
+	return "<i>" + html.EscapeString(feedTitle) + "</i>"
+}
+
+// batchMessages combines items into as few messages as the length limit
+// allows, one line per item in the compact format or as a bulleted link
+// otherwise. Each message starts with feedTitle if it is set.
+func batchMessages(chatID int64, format, feedTitle string, items []*gofeed.Item) []tgbotapi.Chattable {
+	lines := make([]string, len(items))
+	for i, item := range items {
+		if format == formatCompact {
+			lines[i] = formatCompactLine(item)
+		} else {
+			lines[i] = formatItemLine(item)
+		}
+	}
+
+	return packMessages(chatID, feedTitleLine(feedTitle), lines, "\n")
+}
+
+// digestMessages combines items into as few messages as the length limit
+// allows, each with at most maxDescription characters of its description.
+// Each message starts with feedTitle.
+func digestMessages(chatID int64, feedTitle string, items []*gofeed.Item, maxDescription int) []tgbotapi.Chattable {
+	parts := make([]string, len(items))
+	for i, item := range items {
+		parts[i] = formatItem(item, maxDescription)
+	}
+
+	return packMessages(chatID, feedTitleLine(feedTitle), parts, "\n\n")
+}
+
+// packMessages joins parts with sep into as few messages as the length limit
+// allows. Each message starts with header, which is separated by a line break.
+func packMessages(chatID int64, header string, parts []string, sep string) []tgbotapi.Chattable {
+	var msgs []tgbotapi.Chattable
+	add := func(text string) {
+		msg := tgbotapi.NewMessage(chatID, text)
+		msg.ParseMode = tgbotapi.ModeHTML
+		msg.DisableWebPagePreview = true
+		msgs = append(msgs, msg)
+	}
+
+	text := header
+	for _, part := range parts {
+		if text != header && messageLength(text)+len(sep)+messageLength(part) > maxMessageLength {
+			add(text)
+			text = header
+		}
+
+		switch {
+		case text == header && text != "":
+			text += "\n"
+		case text != "":
+			text += sep
+		}
+		text += part
+	}
+
+	if text != header {
+		add(text)
+	}
+
+	return msgs
+}
+
+// publishedTime renders when item was published in loc, or when it was
+// updated if the feed does not tell. It is empty if neither is known.
+func publishedTime(item *gofeed.Item, loc *time.Location) string {
+	t := item.PublishedParsed
+	if t == nil {
+		t = item.UpdatedParsed
+	}
+	if t == nil {
+		return ""
+	}
+
+	return t.In(loc).Format("2006-01-02 15:04")
+}
+
+// itemOptions control how items are rendered as text.
+type itemOptions struct {
+	// maxDescription is the number of characters of the description that
+	// are shown.
+	maxDescription int
+
+	// published is the time zone in which the publish time of the item is
+	// shown; it is omitted if published is nil.
+	published *time.Location
+
+	// images sends items that have an image as photo with the text as
+	// caption.
+	images bool
+
+	// categories shows the categories of the item as hashtags.
+	categories bool
+
+	// template renders the text of the item. It is defaultItemTemplate
+	// if nil.
+	template *template.Template
+}
+
+// itemTemplateData is what the template of an item message is executed with.
+// All fields are escaped for Telegram HTML and empty if the item does not
+// have them.
+type itemTemplateData struct {
+	// Title is the title of the item, or its link if it has none.
+	Title string
+
+	// Description is the description of the item as plain text, cut off
+	// after the configured number of characters.
+	Description string
+
+	// Link is the link of the item if it is a web link.
+	Link string
+
+	// Published is when the item was published in the time zone of the
+	// chat. It is only set if publish times are shown.
+	Published string
+
+	// FeedTitle is the title of the feed as shown in the chat.
+	FeedTitle string
+
+	// Tags are the categories of the item as hashtags separated by spaces,
+	// like "#go #release". They are only set if categories are shown.
+	Tags string
+}
+
+// defaultItemTemplate renders an item like formatItem, below the title of
+// the feed and above when it was published.
+const defaultItemTemplate = `{{if .FeedTitle}}<i>{{.FeedTitle}}</i>
+{{end}}{{if .Title}}<b>{{if .Link}}<a href="{{.Link}}">{{.Title}}</a>{{else}}{{.Title}}{{end}}</b>{{end}}
+{{- if and .Title .Description}}
+
+{{end}}{{.Description}}{{if .Published}}
+
+Published: {{.Published}}{{end}}{{if .Tags}}
+
+{{.Tags}}{{end}}`
+
+var itemTemplate = template.Must(parseItemTemplate(defaultItemTemplate))
+
+// parseItemTemplate parses text as template for item messages. It also
+// executes it for an empty and a complete item, which catches fields that
+// do not exist.
+func parseItemTemplate(text string) (*template.Template, error) {
+	t, err := template.New("message").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	sample := itemTemplateData{
+		Title:       "Title",
+		Description: "Description",
+		Link:        "https://example.com/",
+		Published:   "2006-01-02 15:04",
+		FeedTitle:   "Feed",
+		Tags:        "#tag",
+	}
+	for _, data := range []itemTemplateData{{}, sample} {
+		if err := t.Execute(io.Discard, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// itemTemplateDataOf returns the data with which the template of an item
+// message renders item.
+func itemTemplateDataOf(feedTitle string, item *gofeed.Item, opts itemOptions) itemTemplateData {
+	title := strings.TrimSpace(item.Title)
+	link := strings.TrimSpace(item.Link)
+	if title == "" {
+		title = link
+	}
+
+	data := itemTemplateData{
+		Title:       html.EscapeString(title),
+		Description: html.EscapeString(sanitizeDescription(item.Description, opts.maxDescription)),
+		FeedTitle:   html.EscapeString(feedTitle),
+	}
+
+	if isWebLink(link) {
+		data.Link = html.EscapeString(link)
+	}
+
+	if opts.published != nil {
+		data.Published = publishedTime(item, opts.published)
+	}
+
+	if opts.categories {
+		tags := itemHashtags(item)
+		if len(tags) > maxHashtags {
+			tags = tags[:maxHashtags]
+		}
+		for i := range tags {
+			tags[i] = "#" + tags[i]
+		}
+		data.Tags = html.EscapeString(strings.Join(tags, " "))
+	}
+
+	return data
+}
+
+// Limits of the hashtags shown for the categories of an item.
+const (
+	maxHashtagLength = 64
+	maxHashtags      = 10
+)
+
+// hashtag turns category into the text of a Telegram hashtag, without "#".
+// Hashtags consist of letters, digits and underscores only, so other
+// characters become underscores between words. It is empty if category
+// has no letters, as Telegram does not link hashtags of digits only.
+func hashtag(category string) string {
+	var tag []rune
+	gap := false
+	for _, r := range category {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			gap = true
+			continue
+		}
+
+		if gap && len(tag) > 0 {
+			tag = append(tag, '_')
+		}
+		gap = false
+		tag = append(tag, r)
+	}
+
+	if len(tag) > maxHashtagLength {
+		tag = tag[:maxHashtagLength]
+	}
+
+	for _, r := range tag {
+		if unicode.IsLetter(r) {
+			return string(tag)
+		}
+	}
+
+	return ""
+}
+
+// itemHashtags returns the categories of item as hashtags without "#", in
+// their order and without duplicates that differ only in case.
+func itemHashtags(item *gofeed.Item) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, category := range item.Categories {
+		tag := hashtag(category)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+
+		seen[strings.ToLower(tag)] = true
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+// itemText renders item with the template in opts, by default with
+// feedTitle above it if it is set.
+func itemText(feedTitle string, item *gofeed.Item, opts itemOptions) string {
+	t := opts.template
+	if t == nil {
+		t = itemTemplate
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, itemTemplateDataOf(feedTitle, item, opts)); err != nil {
+		logrus.WithError(err).WithField("Item", item.Link).Error("cannot execute message template")
+
+		b.Reset()
+		itemTemplate.Execute(&b, itemTemplateDataOf(feedTitle, item, opts))
+	}
+
+	return b.String()
+}
+
+func textMessage(chatID int64, feedTitle string, item *gofeed.Item, opts itemOptions) tgbotapi.MessageConfig {
+	msg := tgbotapi.NewMessage(chatID, itemText(feedTitle, item, opts))
+	msg.ParseMode = tgbotapi.ModeHTML
+	return msg
+}
+
+// maxCaptionLength is the maximum length of the caption of a photo in Telegram.
+const maxCaptionLength = 1024
+
+// photoMessage sends an item as photo. Fallback is sent instead if the photo
+// cannot be sent, for example because Telegram cannot load the image.
+type photoMessage struct {
+	tgbotapi.PhotoConfig
+	Fallback tgbotapi.MessageConfig
+}
+
+// pollMessage sends an item as poll or quiz. The library does not support
+// polls, so it is sent with a request of its own. The embedded message is the
+// item as text, which is sent instead if the poll cannot be sent.
+type pollMessage struct {
+	tgbotapi.MessageConfig
+	Question        string
+	Options         []string
+	Type            string
+	CorrectOptionID int
+}
+
+func (p pollMessage) request() (string, url.Values, error) {
+	v, err := baseChatValues(&p.BaseChat)
+	if err != nil {
+		return "", v, err
+	}
+
+	options, err := json.Marshal(p.Options)
+	if err != nil {
+		return "", v, err
+	}
+
+	v.Set("question", p.Question)
+	v.Set("options", string(options))
+	v.Set("type", p.Type)
+	if p.Type == "quiz" {
+		v.Set("correct_option_id", strconv.Itoa(p.CorrectOptionID))
+	}
+
+	return "sendPoll", v, nil
+}
+
+func (p pollMessage) sendWith(bot *tgbotapi.BotAPI) error {
+	method, v, err := p.request()
+	if err != nil {
+		return err
+	}
+
+	_, err = bot.MakeRequest(method, v)
+	return err
+}
+
+// itemImage returns the URL of the image of item, taken from its image or
+// else from its first image enclosure. It is empty if there is none.
+func itemImage(item *gofeed.Item) string {
+	if item.Image != nil && isWebLink(strings.TrimSpace(item.Image.URL)) {
+		return strings.TrimSpace(item.Image.URL)
+	}
+
+	for _, enclosure := range item.Enclosures {
+		if strings.HasPrefix(enclosure.Type, "image/") && isWebLink(strings.TrimSpace(enclosure.URL)) {
+			return strings.TrimSpace(enclosure.URL)
+		}
+	}
+
+	return ""
+}
+
+// photoCaption renders item like itemText, with as much of the description
+// as fits into a caption. It returns false if not even the rest fits.
+func photoCaption(feedTitle string, item *gofeed.Item, opts itemOptions) (string, bool) {
+	for {
+		caption := itemText(feedTitle, item, opts)
+		excess := messageLength(caption) - maxCaptionLength
+		if excess <= 0 {
+			return caption, true
+		}
+
+		if opts.maxDescription == 0 {
+			return "", false
+		}
+
+		opts.maxDescription -= excess
+		if opts.maxDescription < 0 {
+			opts.maxDescription = 0
+		}
+	}
+}
+
+// itemMessage builds the message that delivers item to a chat in the given
+// format. Items that cannot be shown in that format are sent as text, which
+// starts with feedTitle if it is set, or as photo if they have an image and
+// opts allow it.
+func itemMessage(chatID int64, format, feedTitle string, item *gofeed.Item, opts itemOptions) tgbotapi.Chattable {
+	if format == formatCompact {
+		return compactMessage(chatID, item)
+	}
+
+	if format != formatPoll && format != formatQuiz {
+		return textOrPhotoMessage(chatID, feedTitle, item, opts)
+	}
+
+	poll, ok := parsePollItem(item, format == formatQuiz)
+	if !ok {
+		return textOrPhotoMessage(chatID, feedTitle, item, opts)
+	}
+
+	msg := pollMessage{
+		MessageConfig: textMessage(chatID, feedTitle, item, opts),
+		Question:      poll.Question,
+		Options:       poll.Options,
+		Type:          "regular",
+	}
+	if format == formatQuiz {
+		msg.Type = "quiz"
+		msg.CorrectOptionID = poll.Correct
+	}
+
+	return msg
+}
+
+func textOrPhotoMessage(chatID int64, feedTitle string, item *gofeed.Item, opts itemOptions) tgbotapi.Chattable {
+	msg := textMessage(chatID, feedTitle, item, opts)
+	if !opts.images {
+		return msg
+	}
+
+	image := itemImage(item)
+	if image == "" {
+		return msg
+	}
+
+	caption, ok := photoCaption(feedTitle, item, opts)
+	if !ok {
+		return msg
+	}
+
+	photo := tgbotapi.NewPhotoShare(chatID, image)
+	photo.Caption = caption
+	photo.ParseMode = tgbotapi.ModeHTML
+	return photoMessage{PhotoConfig: photo, Fallback: msg}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+	"github.com/mmcdole/gofeed"
+)
+
+func TestParsePollItem(t *testing.T) {
+	tests := []struct {
+		name        string
+		title, desc string
+		quiz        bool
+		want        []string
+		correct     int
+		ok          bool
+	}{
+		{"lines", "Capital of France?", "Paris\nLyon\nNice", false, []string{"Paris", "Lyon", "Nice"}, -1, true},
+		{"pipes", "Capital of France?", "Paris | Lyon", false, []string{"Paris", "Lyon"}, -1, true},
+		{"list", "Capital of France?", "<ul><li>Paris</li><li>Lyon &amp; Co</li></ul>", false, []string{"Paris", "Lyon & Co"}, -1, true},
+		{"br", "Capital of France?", "<p>Paris<br>Lyon<br/>Nice</p>", false, []string{"Paris", "Lyon", "Nice"}, -1, true},
+		{"quiz", "Capital of France?", "Lyon\n*Paris\nNice", true, []string{"Lyon", "Paris", "Nice"}, 1, true},
+		{"quiz list", "Capital of France?", "<ol><li>Lyon</li><li>*Paris</li></ol>", true, []string{"Lyon", "Paris"}, 1, true},
+
+		{"no title", "", "Paris\nLyon", false, nil, 0, false},
+		{"one answer", "Capital of France?", "Paris", false, nil, 0, false},
+		{"no answers", "Capital of France?", "<p></p>", false, nil, 0, false},
+		{"too many answers", "Count", strings.Repeat("x|", maxPollOptions+1), false, nil, 0, false},
+		{"long answer", "Capital of France?", "Paris\n" + strings.Repeat("x", maxPollOptionLength+1), false, nil, 0, false},
+		{"two correct", "Capital of France?", "*Paris\n*Lyon", true, nil, 0, false},
+		{"quiz without correct", "Capital of France?", "Paris\nLyon", true, nil, 0, false},
+		{"prose", "A blog post", "<p>Some text about things.</p>", false, nil, 0, false},
+	}
+
+	for _, tt := range tests {
+		poll, ok := parsePollItem(&gofeed.Item{Title: tt.title, Description: tt.desc}, tt.quiz)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if !reflect.DeepEqual(poll.Options, tt.want) {
+			t.Errorf("%s: options = %q, want %q", tt.name, poll.Options, tt.want)
+		}
+		if poll.Correct != tt.correct {
+			t.Errorf("%s: correct = %d, want %d", tt.name, poll.Correct, tt.correct)
+		}
+	}
+}
+
+func TestItemMessagePoll(t *testing.T) {
+	question := &gofeed.Item{Title: "Capital of France?", Description: "<ul><li>Lyon</li><li>*Paris</li></ul>"}
+
+	poll, ok := itemMessage(10, formatQuiz, "", question, itemOptions{maxDescription: defaultMaxDescriptionLength}).(pollMessage)
+	if !ok {
+		t.Fatal("quiz item was not sent as poll")
+	}
+	if poll.ChatID != 10 || !strings.Contains(poll.Text, "Capital of France?") {
+		t.Fatalf("poll falls back to %+v", poll.MessageConfig)
+	}
+
+	method, params, err := poll.request()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := url.Values{
+		"chat_id":              {"10"},
+		"question":             {"Capital of France?"},
+		"options":              {`["Lyon","Paris"]`},
+		"type":                 {"quiz"},
+		"correct_option_id":    {"1"},
+		"disable_notification": {"false"},
+	}
+	if method != "sendPoll" || !reflect.DeepEqual(params, want) {
+		t.Fatalf("quiz is sent with %s %v, want sendPoll %v", method, params, want)
+	}
+
+	poll, ok = itemMessage(10, formatPoll, "", question, itemOptions{maxDescription: defaultMaxDescriptionLength}).(pollMessage)
+	if !ok {
+		t.Fatal("poll item was not sent as poll")
+	}
+	if _, params, err := poll.request(); err != nil || params.Get("type") != "regular" || params.Has("correct_option_id") {
+		t.Fatalf("poll is sent with %v, %v", params, err)
+	}
+
+	// Items that are no polls fall back to text, as do all items in the full format.
+	post := &gofeed.Item{Title: "A blog post", Description: "<p>Some text.</p>"}
+	for _, c := range []struct {
+		format string
+		item   *gofeed.Item
+	}{{formatPoll, post}, {formatQuiz, post}, {formatFull, question}} {
+		if _, ok := itemMessage(10, c.format, "", c.item, itemOptions{maxDescription: defaultMaxDescriptionLength}).(tgbotapi.MessageConfig); !ok {
+			t.Errorf("item %q in format %s was not sent as text", c.item.Title, c.format)
+		}
+	}
+}
+
+func TestItemMessageCompact(t *testing.T) {
+	item := &gofeed.Item{Title: "Q&A", Link: "https://example.com/a?b=1&c=2", Description: "<p>A long description</p>"}
+	opts := itemOptions{maxDescription: defaultMaxDescriptionLength}
+
+	compact, ok := itemMessage(10, formatCompact, "Blog", item, opts).(tgbotapi.MessageConfig)
+	if !ok {
+		t.Fatal("compact item was not sent as text")
+	}
+	if want := "Q&amp;A — https://example.com/a?b=1&amp;c=2"; compact.Text != want {
+		t.Errorf("compact text = %q, want %q", compact.Text, want)
+	}
+	if !compact.DisableWebPagePreview || compact.ParseMode != tgbotapi.ModeHTML {
+		t.Errorf("compact message has preview %v, parse mode %q", !compact.DisableWebPagePreview, compact.ParseMode)
+	}
+
+	full := itemMessage(10, formatFull, "Blog", item, opts).(tgbotapi.MessageConfig)
+	if !strings.Contains(full.Text, "<b>") || !strings.Contains(full.Text, "A long description") || !strings.Contains(full.Text, "Blog") {
+		t.Errorf("full text = %q, want the feed title, the title in bold and the description", full.Text)
+	}
+
+	for _, tt := range []struct {
+		item *gofeed.Item
+		want string
+	}{
+		{&gofeed.Item{Link: "https://example.com/"}, "https://example.com/"},
+		{&gofeed.Item{Title: "Note", Link: "not a link"}, "Note"},
+	} {
+		if got := formatCompactLine(tt.item); got != tt.want {
+			t.Errorf("compact line of %+v = %q, want %q", tt.item, got, tt.want)
+		}
+	}
+
+	batch := batchMessages(10, formatCompact, "", []*gofeed.Item{item, item})
+	if text := batch[0].(tgbotapi.MessageConfig).Text; text != compact.Text+"\n"+compact.Text {
+		t.Errorf("compact batch = %q", text)
+	}
+}
+
+func TestBatchMessages(t *testing.T) {
+	var items []*gofeed.Item
+	for i := 0; i < 200; i++ {
+		items = append(items, &gofeed.Item{Title: strings.Repeat("😀", 50), Link: "https://example.com/"})
+	}
+
+	msgs := batchMessages(10, formatFull, "", items)
+	if len(msgs) < 2 {
+		t.Fatalf("200 long items fit into %d messages", len(msgs))
+	}
+
+	lines := 0
+	for i, msg := range msgs {
+		text := msg.(tgbotapi.MessageConfig).Text
+		if n := messageLength(text); n > maxMessageLength {
+			t.Errorf("message %d has length %d", i, n)
+		}
+		lines += strings.Count(text, "\n") + 1
+	}
+
+	if lines != len(items) {
+		t.Fatalf("messages have %d lines, want %d", lines, len(items))
+	}
+}
+
+func TestFormatItem(t *testing.T) {
+	tests := []struct {
+		name string
+		item gofeed.Item
+		want string
+	}{
+		{
+			"escaping",
+			gofeed.Item{Title: "Tom & Jerry <3", Link: "https://example.com/?a=1&b=\"2\"", Description: "1 < 2 & 3 > 2"},
+			`<b><a href="https://example.com/?a=1&amp;b=&#34;2&#34;">Tom &amp; Jerry &lt;3</a></b>` + "\n\n" + "1 &lt; 2 &amp; 3 &gt; 2",
+		},
+		{
+			"tags",
+			gofeed.Item{Title: "Post", Link: "https://example.com/", Description: `<p>Hello <b>world</b>!</p><script>alert("x")</script><img src="x.png"><p>Bye &amp; thanks</p>`},
+			`<b><a href="https://example.com/">Post</a></b>` + "\n\nHello world! Bye &amp; thanks",
+		},
+		{
+			"no description",
+			gofeed.Item{Title: "Post", Link: "https://example.com/"},
+			`<b><a href="https://example.com/">Post</a></b>`,
+		},
+		{
+			"no link",
+			gofeed.Item{Title: "Post", Description: "Text"},
+			"<b>Post</b>\n\nText",
+		},
+		{
+			"no title",
+			gofeed.Item{Link: "https://example.com/"},
+			`<b><a href="https://example.com/">https://example.com/</a></b>`,
+		},
+		{
+			"unsafe link",
+			gofeed.Item{Title: "Post", Link: "javascript:alert(1)"},
+			"<b>Post</b>",
+		},
+		{
+			"description only",
+			gofeed.Item{Description: "Text"},
+			"Text",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := formatItem(&tt.item, defaultMaxDescriptionLength); got != tt.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeDescription(t *testing.T) {
+	if got := sanitizeDescription("<p>one\ntwo</p>  <p>three</p>", 100); got != "one two three" {
+		t.Errorf("whitespace was not collapsed: %q", got)
+	}
+
+	if got := sanitizeDescription("aaaa bbbb cccc", 10); got != "aaaa bbbb…" {
+		t.Errorf("cut description = %q", got)
+	}
+
+	if got := sanitizeDescription("äöü ß", 3); got != "äöü…" {
+		t.Errorf("description was not cut at characters: %q", got)
+	}
+}
+
+func TestFeedTitleInMessages(t *testing.T) {
+	item := &gofeed.Item{Title: "News", Link: "https://example.com/1"}
+
+	text := itemMessage(10, formatFull, "Tom & Jerry", item, itemOptions{maxDescription: defaultMaxDescriptionLength}).(tgbotapi.MessageConfig).Text
+	if want := "<i>Tom &amp; Jerry</i>\n" + formatItem(item, defaultMaxDescriptionLength); text != want {
+		t.Fatalf("item message = %q, want %q", text, want)
+	}
+
+	var items []*gofeed.Item
+	for i := 0; i < 200; i++ {
+		items = append(items, &gofeed.Item{Title: strings.Repeat("😀", 50), Link: "https://example.com/"})
+	}
+
+	msgs := batchMessages(10, formatFull, "Blog", items)
+	if len(msgs) < 2 {
+		t.Fatalf("200 long items fit into %d messages", len(msgs))
+	}
+
+	lines := 0
+	for i, msg := range msgs {
+		text := msg.(tgbotapi.MessageConfig).Text
+		if !strings.HasPrefix(text, "<i>Blog</i>\n• ") {
+			t.Errorf("message %d does not start with the feed title: %.40q", i, text)
+		}
+		if n := messageLength(text); n > maxMessageLength {
+			t.Errorf("message %d has length %d", i, n)
+		}
+		lines += strings.Count(text, "\n")
+	}
+
+	if lines != len(items) {
+		t.Fatalf("messages have %d item lines, want %d", lines, len(items))
+	}
+}
+
+func TestPublishedLine(t *testing.T) {
+	vienna, err := time.LoadLocation("Europe/Vienna")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	published := time.Date(2024, 1, 2, 14, 4, 0, 0, time.UTC)
+	updated := time.Date(2024, 1, 3, 9, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		item *gofeed.Item
+		loc  *time.Location
+		want string
+	}{
+		{&gofeed.Item{Title: "a", PublishedParsed: &published, UpdatedParsed: &updated}, time.UTC, "\n\nPublished: 2024-01-02 14:04"},
+		{&gofeed.Item{Title: "a", PublishedParsed: &published}, vienna, "\n\nPublished: 2024-01-02 15:04"},
+		{&gofeed.Item{Title: "a", UpdatedParsed: &updated}, time.UTC, "\n\nPublished: 2024-01-03 09:30"},
+		{&gofeed.Item{Title: "a"}, time.UTC, ""},
+		{&gofeed.Item{Title: "a", PublishedParsed: &published}, nil, ""},
+	}
+
+	for _, tt := range tests {
+		text := itemMessage(10, formatFull, "", tt.item, itemOptions{maxDescription: defaultMaxDescriptionLength, published: tt.loc}).(tgbotapi.MessageConfig).Text
+		if want := formatItem(tt.item, defaultMaxDescriptionLength) + tt.want; text != want {
+			t.Errorf("item message in %v = %q, want %q", tt.loc, text, want)
+		}
+	}
+}
+
+func TestMessageTemplate(t *testing.T) {
+	tmpl, err := parseItemTemplate(`{{.Title}} ({{.FeedTitle}}){{with .Link}} {{.}}{{end}}{{with .Published}} @ {{.}}{{end}}
+{{.Description}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := time.Date(2024, 1, 2, 14, 4, 0, 0, time.UTC)
+	opts := itemOptions{maxDescription: 10, published: time.UTC, template: tmpl}
+
+	tests := []struct {
+		item *gofeed.Item
+		want string
+	}{
+		{
+			&gofeed.Item{Title: "R&D", Link: "https://example.com/?a=1&b=2", Description: "<p>A long description</p>", PublishedParsed: &published},
+			"R&amp;D (Blog) https://example.com/?a=1&amp;b=2 @ 2024-01-02 14:04\nA long des…",
+		},
+		// Missing fields are left out.
+		{&gofeed.Item{Title: "Only a title"}, "Only a title (Blog)\n"},
+		{&gofeed.Item{Link: "https://example.com/1"}, "https://example.com/1 (Blog) https://example.com/1\n"},
+		{&gofeed.Item{Link: "ftp://example.com/1"}, "ftp://example.com/1 (Blog)\n"},
+		{&gofeed.Item{}, " (Blog)\n"},
+	}
+
+	for _, tt := range tests {
+		if got := itemText("Blog", tt.item, opts); got != tt.want {
+			t.Errorf("item %+v: text = %q, want %q", tt.item, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultMessageTemplate(t *testing.T) {
+	items := []*gofeed.Item{
+		{Title: "News", Link: "https://example.com/1", Description: "Some <b>text</b>"},
+		{Title: "No link", Description: "Some text"},
+		{Link: "https://example.com/2"},
+		{Description: "Only a description"},
+		{},
+	}
+
+	for _, item := range items {
+		if got, want := itemText("", item, itemOptions{maxDescription: defaultMaxDescriptionLength}), formatItem(item, defaultMaxDescriptionLength); got != want {
+			t.Errorf("item %+v: text = %q, want %q", item, got, want)
+		}
+	}
+}
+
+func TestHashtag(t *testing.T) {
+	tests := []struct {
+		category, want string
+	}{
+		{"Go", "Go"},
+		{"machine learning", "machine_learning"},
+		{" Go / Golang ", "Go_Golang"},
+		{"C++", "C"},
+		{"snake_case", "snake_case"},
+		{"Österreich", "Österreich"},
+		{"2024", ""},
+		{"Top 10", "Top_10"},
+		{"#already", "already"},
+		{"!!!", ""},
+		{strings.Repeat("x", maxHashtagLength+10), strings.Repeat("x", maxHashtagLength)},
+	}
+
+	for _, tt := range tests {
+		if got := hashtag(tt.category); got != tt.want {
+			t.Errorf("hashtag(%q) = %q, want %q", tt.category, got, tt.want)
+		}
+	}
+}
+
+func TestCategoriesInMessage(t *testing.T) {
+	item := &gofeed.Item{Title: "News", Link: "https://example.com/1", Categories: []string{"Go", "machine learning", "go", "2024"}}
+
+	opts := itemOptions{maxDescription: defaultMaxDescriptionLength}
+	if got, want := itemText("", item, opts), formatItem(item, defaultMaxDescriptionLength); got != want {
+		t.Errorf("text without categories = %q, want %q", got, want)
+	}
+
+	opts.categories = true
+	if got, want := itemText("", item, opts), formatItem(item, defaultMaxDescriptionLength)+"\n\n#Go #machine_learning"; got != want {
+		t.Errorf("text with categories = %q, want %q", got, want)
+	}
+
+	var many []string
+	for i := 0; i < maxHashtags+5; i++ {
+		many = append(many, fmt.Sprintf("tag%d", i))
+	}
+	text := itemText("", &gofeed.Item{Title: "Many", Categories: many}, opts)
+	if n := strings.Count(text, "#"); n != maxHashtags {
+		t.Errorf("text shows %d hashtags, want %d", n, maxHashtags)
+	}
+
+	// Items without categories have no hashtag line.
+	if got, want := itemText("", &gofeed.Item{Title: "Plain"}, opts), "<b>Plain</b>"; got != want {
+		t.Errorf("text of item without categories = %q, want %q", got, want)
+	}
+}
+
+func TestParseItemTemplateErrors(t *testing.T) {
+	for _, text := range []string{
+		"{{.Title",
+		"{{.Author}}",
+		"{{if .Title}}{{.Summary}}{{end}}",
+	} {
+		if _, err := parseItemTemplate(text); err == nil {
+			t.Errorf("%q: no error", text)
+		}
+	}
+}
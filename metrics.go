@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	feedsFetched = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rssbot_feeds_fetched_total",
+		Help: "Number of feeds that were fetched successfully, including unmodified ones.",
+	})
+
+	feedFetchErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rssbot_feed_fetch_errors_total",
+		Help: "Number of feeds that could not be fetched or parsed.",
+	})
+
+	itemsSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rssbot_items_sent_total",
+		Help: "Number of feed items that were sent to chats.",
+	})
+
+	messagesFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rssbot_messages_failed_total",
+		Help: "Number of messages that could not be sent.",
+	})
+
+	feedFetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "rssbot_feed_fetch_duration_seconds",
+		Help:    "Time it takes to fetch and parse a feed.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// serveMetrics exposes the metrics on addr under /metrics.
+func serveMetrics(addr string) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(feedsFetched, feedFetchErrors, itemsSent, messagesFailed, feedFetchDuration)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		logrus.WithError(err).WithField("Address", addr).Fatalln("metrics server failed")
+	}()
+
+	logrus.WithField("Address", addr).Info("Serving metrics")
+}
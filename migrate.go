@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed schema.mysql
+var mysqlSchema string
+
+//go:embed schema.sqlite
+var sqliteSchema string
+
+// migration holds the statements that upgrade the schema by one version, for
+// each of the supported drivers. Every migration must be safe to apply to a
+// database that already has its changes, since databases that were set up by
+// hand do not know their version. Adding a column that exists is tolerated.
+type migration struct {
+	mysql  []string
+	sqlite []string
+}
+
+// migrations are applied in order; migration i results in schema version i+1.
+// Never change a migration that was released, append a new one instead.
+var migrations = []migration{
+	{mysql: splitStatements(mysqlSchema), sqlite: splitStatements(sqliteSchema)},
+	{
+		mysql: append(addedColumns,
+			"CREATE TABLE IF NOT EXISTS `chats` ("+
+				"`chatID` BIGINT NOT NULL, "+
+				"`dedupLinks` BOOLEAN NOT NULL DEFAULT 0, "+
+				"`redirectChatID` BIGINT NOT NULL DEFAULT 0, "+
+				"`redirectUntil` BIGINT NOT NULL DEFAULT 0, "+
+				"`redirectOnly` BOOLEAN NOT NULL DEFAULT 0, "+
+				"`updateInterval` INT NOT NULL DEFAULT 0, "+
+				"PRIMARY KEY (`chatID`))",
+			"CREATE TABLE IF NOT EXISTS `deliveredItems` ("+
+				"`nr` BIGINT NOT NULL AUTO_INCREMENT, "+
+				"`chatID` BIGINT NOT NULL, "+
+				"`feedID` BIGINT NOT NULL, "+
+				"`itemKey` VARCHAR(191) NOT NULL, "+
+				"`hash` CHAR(64) NOT NULL, "+
+				"`linkHash` CHAR(64) NOT NULL, "+
+				"`published` BIGINT NOT NULL, "+
+				"`timestamp` BIGINT NOT NULL, "+
+				"PRIMARY KEY (`nr`), "+
+				"KEY `chatID_feedID_itemKey` (`chatID`,`feedID`,`itemKey`), "+
+				"KEY `chatID_linkHash` (`chatID`,`linkHash`), "+
+				"CONSTRAINT `fk_feedID_3` FOREIGN KEY (`feedID`) REFERENCES `feeds` (`id`) ON DELETE CASCADE)",
+			"CREATE TABLE IF NOT EXISTS `requestCounts` ("+
+				"`userID` BIGINT NOT NULL, "+
+				"`bucket` BIGINT NOT NULL, "+
+				"`count` INT NOT NULL, "+
+				"PRIMARY KEY (`userID`,`bucket`))",
+		),
+		sqlite: append(addedColumns,
+			"CREATE TABLE IF NOT EXISTS `chats` ("+
+				"`chatID` BIGINT NOT NULL PRIMARY KEY, "+
+				"`dedupLinks` BOOLEAN NOT NULL DEFAULT 0, "+
+				"`redirectChatID` BIGINT NOT NULL DEFAULT 0, "+
+				"`redirectUntil` BIGINT NOT NULL DEFAULT 0, "+
+				"`redirectOnly` BOOLEAN NOT NULL DEFAULT 0, "+
+				"`updateInterval` INT NOT NULL DEFAULT 0)",
+			"CREATE TABLE IF NOT EXISTS `deliveredItems` ("+
+				"`nr` INTEGER PRIMARY KEY AUTOINCREMENT, "+
+				"`chatID` BIGINT NOT NULL, "+
+				"`feedID` BIGINT NOT NULL REFERENCES `feeds` (`id`) ON DELETE CASCADE, "+
+				"`itemKey` VARCHAR(191) NOT NULL, "+
+				"`hash` CHAR(64) NOT NULL, "+
+				"`linkHash` CHAR(64) NOT NULL, "+
+				"`published` BIGINT NOT NULL, "+
+				"`timestamp` BIGINT NOT NULL)",
+			"CREATE INDEX IF NOT EXISTS `chatID_feedID_itemKey` ON `deliveredItems` (`chatID`,`feedID`,`itemKey`)",
+			"CREATE INDEX IF NOT EXISTS `chatID_linkHash` ON `deliveredItems` (`chatID`,`linkHash`)",
+			"CREATE TABLE IF NOT EXISTS `requestCounts` ("+
+				"`userID` BIGINT NOT NULL, "+
+				"`bucket` BIGINT NOT NULL, "+
+				"`count` INT NOT NULL, "+
+				"PRIMARY KEY (`userID`,`bucket`))",
+		),
+	},
+	{
+		mysql: []string{"CREATE TABLE IF NOT EXISTS `filters` (" +
+			"`nr` BIGINT NOT NULL AUTO_INCREMENT, " +
+			"`updateNr` BIGINT NOT NULL, " +
+			"`keyword` VARCHAR(100) NOT NULL, " +
+			"PRIMARY KEY (`nr`), " +
+			"UNIQUE KEY `updateNr_keyword_unique` (`updateNr`,`keyword`), " +
+			"CONSTRAINT `fk_updateNr` FOREIGN KEY (`updateNr`) REFERENCES `updates` (`nr`) ON DELETE CASCADE)"},
+		sqlite: []string{"CREATE TABLE IF NOT EXISTS `filters` (" +
+			"`nr` INTEGER PRIMARY KEY AUTOINCREMENT, " +
+			"`updateNr` BIGINT NOT NULL REFERENCES `updates` (`nr`) ON DELETE CASCADE, " +
+			"`keyword` VARCHAR(100) NOT NULL, " +
+			"UNIQUE (`updateNr`,`keyword`))"},
+	},
+	{
+		mysql: []string{"CREATE TABLE IF NOT EXISTS `mutes` (" +
+			"`nr` BIGINT NOT NULL AUTO_INCREMENT, " +
+			"`updateNr` BIGINT NOT NULL, " +
+			"`keyword` VARCHAR(100) NOT NULL, " +
+			"PRIMARY KEY (`nr`), " +
+			"UNIQUE KEY `updateNr_keyword_unique` (`updateNr`,`keyword`), " +
+			"CONSTRAINT `fk_updateNr_2` FOREIGN KEY (`updateNr`) REFERENCES `updates` (`nr`) ON DELETE CASCADE)"},
+		sqlite: []string{"CREATE TABLE IF NOT EXISTS `mutes` (" +
+			"`nr` INTEGER PRIMARY KEY AUTOINCREMENT, " +
+			"`updateNr` BIGINT NOT NULL REFERENCES `updates` (`nr`) ON DELETE CASCADE, " +
+			"`keyword` VARCHAR(100) NOT NULL, " +
+			"UNIQUE (`updateNr`,`keyword`))"},
+	},
+	{
+		mysql: []string{
+			"ALTER TABLE `feeds` ADD COLUMN `etag` VARCHAR(255) NOT NULL DEFAULT ''",
+			"ALTER TABLE `feeds` ADD COLUMN `lastModified` VARCHAR(64) NOT NULL DEFAULT ''",
+		},
+		sqlite: []string{
+			"ALTER TABLE `feeds` ADD COLUMN `etag` VARCHAR(255) NOT NULL DEFAULT ''",
+			"ALTER TABLE `feeds` ADD COLUMN `lastModified` VARCHAR(64) NOT NULL DEFAULT ''",
+		},
+	},
+	{
+		mysql:  []string{"ALTER TABLE `updates` ADD COLUMN `displayTitle` VARCHAR(100) NOT NULL DEFAULT ''"},
+		sqlite: []string{"ALTER TABLE `updates` ADD COLUMN `displayTitle` VARCHAR(100) NOT NULL DEFAULT ''"},
+	},
+	{
+		mysql: []string{
+			"ALTER TABLE `feeds` ADD COLUMN `authUser` VARCHAR(255) NOT NULL DEFAULT ''",
+			"ALTER TABLE `feeds` ADD COLUMN `authPassword` VARCHAR(255) NOT NULL DEFAULT ''",
+		},
+		sqlite: []string{
+			"ALTER TABLE `feeds` ADD COLUMN `authUser` VARCHAR(255) NOT NULL DEFAULT ''",
+			"ALTER TABLE `feeds` ADD COLUMN `authPassword` VARCHAR(255) NOT NULL DEFAULT ''",
+		},
+	},
+	{
+		mysql: []string{
+			"ALTER TABLE `updates` ADD COLUMN `digestAt` INT NOT NULL DEFAULT -1",
+			"ALTER TABLE `updates` ADD COLUMN `digestSent` BIGINT NOT NULL DEFAULT 0",
+			"CREATE TABLE IF NOT EXISTS `digestItems` (" +
+				"`nr` BIGINT NOT NULL AUTO_INCREMENT, " +
+				"`updateNr` BIGINT NOT NULL, " +
+				"`title` TEXT NOT NULL, " +
+				"`link` TEXT NOT NULL, " +
+				"`description` TEXT NOT NULL, " +
+				"`published` BIGINT NOT NULL, " +
+				"PRIMARY KEY (`nr`), " +
+				"CONSTRAINT `fk_updateNr_3` FOREIGN KEY (`updateNr`) REFERENCES `updates` (`nr`) ON DELETE CASCADE)",
+		},
+		sqlite: []string{
+			"ALTER TABLE `updates` ADD COLUMN `digestAt` INT NOT NULL DEFAULT -1",
+			"ALTER TABLE `updates` ADD COLUMN `digestSent` BIGINT NOT NULL DEFAULT 0",
+			"CREATE TABLE IF NOT EXISTS `digestItems` (" +
+				"`nr` INTEGER PRIMARY KEY AUTOINCREMENT, " +
+				"`updateNr` BIGINT NOT NULL REFERENCES `updates` (`nr`) ON DELETE CASCADE, " +
+				"`title` TEXT NOT NULL, " +
+				"`link` TEXT NOT NULL, " +
+				"`description` TEXT NOT NULL, " +
+				"`published` BIGINT NOT NULL)",
+		},
+	},
+	{
+		mysql:  []string{"ALTER TABLE `chats` ADD COLUMN `digestDescriptionLength` INT NOT NULL DEFAULT 0"},
+		sqlite: []string{"ALTER TABLE `chats` ADD COLUMN `digestDescriptionLength` INT NOT NULL DEFAULT 0"},
+	},
+	{
+		mysql:  []string{"ALTER TABLE `chats` ADD COLUMN `timezone` VARCHAR(64) NOT NULL DEFAULT ''"},
+		sqlite: []string{"ALTER TABLE `chats` ADD COLUMN `timezone` VARCHAR(64) NOT NULL DEFAULT ''"},
+	},
+	{
+		mysql:  []string{"ALTER TABLE `feeds` ADD COLUMN `advertisedInterval` BIGINT NOT NULL DEFAULT 0"},
+		sqlite: []string{"ALTER TABLE `feeds` ADD COLUMN `advertisedInterval` BIGINT NOT NULL DEFAULT 0"},
+	},
+	{
+		mysql: []string{
+			"ALTER TABLE `updates` ADD COLUMN `snoozeUntil` BIGINT NOT NULL DEFAULT 0",
+			"ALTER TABLE `updates` ADD COLUMN `snoozeQueue` BOOLEAN NOT NULL DEFAULT 0",
+		},
+		sqlite: []string{
+			"ALTER TABLE `updates` ADD COLUMN `snoozeUntil` BIGINT NOT NULL DEFAULT 0",
+			"ALTER TABLE `updates` ADD COLUMN `snoozeQueue` BOOLEAN NOT NULL DEFAULT 0",
+		},
+	},
+	{
+		mysql: []string{
+			"ALTER TABLE `deliveredItems` ADD COLUMN `contentHash` CHAR(64) NOT NULL DEFAULT ''",
+			"ALTER TABLE `chats` ADD COLUMN `skipRepublished` BOOLEAN NOT NULL DEFAULT 0",
+		},
+		sqlite: []string{
+			"ALTER TABLE `deliveredItems` ADD COLUMN `contentHash` CHAR(64) NOT NULL DEFAULT ''",
+			"ALTER TABLE `chats` ADD COLUMN `skipRepublished` BOOLEAN NOT NULL DEFAULT 0",
+		},
+	},
+	{
+		mysql: []string{"CREATE TABLE IF NOT EXISTS `deliveryCounts` (" +
+			"`chatID` BIGINT NOT NULL, " +
+			"`feedID` BIGINT NOT NULL, " +
+			"`bucket` BIGINT NOT NULL, " +
+			"`count` INT NOT NULL, " +
+			"PRIMARY KEY (`chatID`,`feedID`,`bucket`), " +
+			"CONSTRAINT `fk_feedID_4` FOREIGN KEY (`feedID`) REFERENCES `feeds` (`id`) ON DELETE CASCADE)"},
+		sqlite: []string{"CREATE TABLE IF NOT EXISTS `deliveryCounts` (" +
+			"`chatID` BIGINT NOT NULL, " +
+			"`feedID` BIGINT NOT NULL REFERENCES `feeds` (`id`) ON DELETE CASCADE, " +
+			"`bucket` BIGINT NOT NULL, " +
+			"`count` INT NOT NULL, " +
+			"PRIMARY KEY (`chatID`,`feedID`,`bucket`))"},
+	},
+	{
+		mysql: []string{"CREATE TABLE IF NOT EXISTS `userQuotas` (" +
+			"`userID` BIGINT NOT NULL, " +
+			"`maxTotalFeeds` INT NOT NULL, " +
+			"PRIMARY KEY (`userID`))"},
+		sqlite: []string{"CREATE TABLE IF NOT EXISTS `userQuotas` (" +
+			"`userID` BIGINT NOT NULL PRIMARY KEY, " +
+			"`maxTotalFeeds` INT NOT NULL)"},
+	},
+	{
+		mysql:  []string{"ALTER TABLE `updates` ADD COLUMN `threadID` INT NOT NULL DEFAULT 0"},
+		sqlite: []string{"ALTER TABLE `updates` ADD COLUMN `threadID` INT NOT NULL DEFAULT 0"},
+	},
+	{
+		mysql: []string{"CREATE TABLE IF NOT EXISTS `botState` (" +
+			"`name` VARCHAR(32) NOT NULL, " +
+			"`value` VARCHAR(255) NOT NULL, " +
+			"PRIMARY KEY (`name`))"},
+		sqlite: []string{"CREATE TABLE IF NOT EXISTS `botState` (" +
+			"`name` VARCHAR(32) NOT NULL PRIMARY KEY, " +
+			"`value` VARCHAR(255) NOT NULL)"},
+	},
+}
+
+// addedColumns brings the tables of the original schema up to date with the
+// columns that were added before the bot tracked its schema version. The
+// statements are the same for both drivers.
+var addedColumns = []string{
+	"ALTER TABLE `feeds` ADD COLUMN `scheme` VARCHAR(8) NOT NULL DEFAULT 'https'",
+	"ALTER TABLE `feeds` ADD COLUMN `publishInterval` BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE `feeds` ADD COLUMN `nextFetch` BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE `feeds` ADD COLUMN `feedType` VARCHAR(16) NOT NULL DEFAULT ''",
+	"ALTER TABLE `feeds` ADD COLUMN `hasDescriptions` BOOLEAN NOT NULL DEFAULT 0",
+	"ALTER TABLE `updates` ADD COLUMN `lastSent` BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE `updates` ADD COLUMN `ignoreTitleChanges` BOOLEAN NOT NULL DEFAULT 0",
+	"ALTER TABLE `updates` ADD COLUMN `note` VARCHAR(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE `updates` ADD COLUMN `format` VARCHAR(16) NOT NULL DEFAULT 'full'",
+}
+
+func splitStatements(script string) []string {
+	var stmts []string
+	for _, stmt := range strings.Split(script, ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+
+	return stmts
+}
+
+// isDuplicateColumn reports whether err is about adding a column that exists
+// already, which makes ADD COLUMN statements safe to apply twice.
+func isDuplicateColumn(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "duplicate column")
+}
+
+func (m *migration) statements(driver string) []string {
+	if driver == "sqlite3" {
+		return m.sqlite
+	}
+
+	return m.mysql
+}
+
+// Migrate creates missing tables and applies all migrations that the database
+// has not seen yet. The current version is kept in the schema_version table.
+func (db *DB) Migrate(ctx context.Context) error {
+	if _, err := db.q.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_version (version INT NOT NULL)"); err != nil {
+		return err
+	}
+
+	var from int
+	if err := db.q.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&from); err != nil {
+		return err
+	}
+
+	if from > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this bot (%d)", from, len(migrations))
+	}
+
+	for version := from + 1; version <= len(migrations); version++ {
+		if err := db.migrate(ctx, version); err != nil {
+			return fmt.Errorf("migration to version %d: %w", version, err)
+		}
+	}
+
+	if from != len(migrations) {
+		logrus.WithFields(logrus.Fields{
+			"From": from,
+			"To":   len(migrations),
+		}).Info("upgraded database schema")
+	}
+
+	return nil
+}
+
+// migrate applies the migration that results in the given version. Note that
+// MySQL commits schema changes implicitly, so there the transaction only
+// protects the version bump.
+func (db *DB) migrate(ctx context.Context, version int) error {
+	tx, err := db.q.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range migrations[version-1].statements(db.driver) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil && !isDuplicateColumn(err) {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM schema_version"); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_version (version) VALUES (?)", version); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := OpenDB("sqlite3", filepath.Join(t.TempDir(), "bot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A database set up by hand from the original schema, before the bot
+	// kept track of its version.
+	for _, stmt := range splitStatements(sqliteSchema) {
+		if _, err := db.q.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := db.q.Exec("INSERT INTO feeds (url,title,userID) VALUES ('example.com/feed','Example',1)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.q.Exec("INSERT INTO updates (chatID,feedID,lastUpdate,userID) VALUES (10,1,0,1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Running it again is a no-op.
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	feeds, err := db.ActiveFeeds(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	for _, f := range feeds {
+		n++
+		if f.Scheme != "https" {
+			t.Errorf("scheme of migrated feed = %q, want https", f.Scheme)
+		}
+	}
+	if n != 1 {
+		t.Fatalf("ActiveFeeds returned %d feeds, want 1", n)
+	}
+
+	byChat, err := db.FeedsByChat(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byChat) != 1 {
+		t.Fatalf("FeedsByChat returned %d feeds, want 1", len(byChat))
+	}
+
+	now := time.Now()
+	subs, err := db.Subs(ctx, 1, &now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n = 0
+	for _, sub := range subs {
+		n++
+		if sub.Format != "full" {
+			t.Errorf("format of migrated subscription = %q, want full", sub.Format)
+		}
+	}
+	if n != 1 {
+		t.Fatalf("Subs returned %d subscriptions, want 1", n)
+	}
+}
+
+func TestMigrateVersionedDatabase(t *testing.T) {
+	db := openTestDB(t)
+
+	var version int
+	if err := db.q.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Fatalf("schema version = %d, want %d", version, len(migrations))
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+// mostActiveWindow is how far back /mostactive counts the delivered items.
+const mostActiveWindow = time.Hour * 24 * 7
+
+// mostActiveLimit is how many feeds /mostactive lists at most.
+const mostActiveLimit = 10
+
+// mostActive handles the /mostactive command, which lists the feeds that
+// delivered the most items to the chat recently.
+func mostActive(ctx context.Context, db *DB, chatID int64, now time.Time) tgbotapi.Chattable {
+	list, err := db.MostActiveFeeds(ctx, chatID, now.Add(-mostActiveWindow), mostActiveLimit)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("get most active feeds failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	days := int(mostActiveWindow / (24 * time.Hour))
+	if len(list) == 0 {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("No items were sent to this chat in the last %d days.", days))
+	}
+
+	text := fmt.Sprintf("Items sent to this chat in the last %d days (approximately):\n", days)
+	for _, a := range list {
+		text += fmt.Sprintf("[%d] %s: %d\n", a.ID, a.Title, a.Deliveries)
+	}
+
+	return tgbotapi.NewMessage(chatID, text)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+func TestMostActive(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	now := time.Now()
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: name, URL: "//example.com/" + name, Scheme: "https"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	text := func() string {
+		return mostActive(ctx, db, 10, now).(tgbotapi.MessageConfig).Text
+	}
+
+	if got := text(); got != "No items were sent to this chat in the last 7 days." {
+		t.Fatalf("reply without deliveries = %q", got)
+	}
+
+	for _, d := range []struct {
+		chatID, feedID int64
+		n              int
+	}{{10, 1, 2}, {10, 3, 5}, {10, 1, 1}, {20, 2, 50}} {
+		if err := db.IncrementDeliveries(ctx, d.chatID, d.feedID, d.n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Deliveries before the window do not count.
+	if _, err := db.q.Exec("INSERT INTO deliveryCounts (chatID, feedID, bucket, count) VALUES (10, 2, ?, 100)", deliveryBucket(now.Add(-8*24*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Items sent to this chat in the last 7 days (approximately):\n[3] c: 5\n[1] a: 3\n"
+	if got := text(); got != want {
+		t.Fatalf("reply = %q, want %q", got, want)
+	}
+
+	list, err := db.MostActiveFeeds(ctx, 10, now.Add(-mostActiveWindow), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, []FeedActivity{{3, "c", 5}}) {
+		t.Fatalf("top feed = %+v, want c", list)
+	}
+
+	if err := db.PruneDeliveryCounts(ctx, now.Add(-deliveryCountsRetention)); err != nil {
+		t.Fatal(err)
+	}
+	var left int
+	if err := db.q.QueryRow("SELECT COUNT(*) FROM deliveryCounts WHERE feedID=2 AND chatID=10").Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Fatalf("%d counts before the window are left after pruning", left)
+	}
+
+	if err := db.RemoveChat(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.q.QueryRow("SELECT COUNT(*) FROM deliveryCounts WHERE chatID=10").Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Fatalf("%d counts of the removed chat are left", left)
+	}
+}
+
+func TestUpdateFeedCountsDeliveries(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{MaxDescriptionLength: defaultMaxDescriptionLength}}
+
+	var requests int
+	srv := newTestFeedServer(t, &requests)
+	addTestFeed(t, db, 1, 10, srv.URL)
+
+	var count int64
+	if err := updateFeed(ctx, cfg, db, srv.Client(), func(tgbotapi.Chattable) {}, dueFeed(t, db), &count); err != nil {
+		t.Fatal(err)
+	}
+
+	text := mostActive(ctx, db, 10, time.Now()).(tgbotapi.MessageConfig).Text
+	if !strings.HasSuffix(text, "[1] Test: 1\n") {
+		t.Fatalf("reply after delivering one item = %q", text)
+	}
+}
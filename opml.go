@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"time"
+)
+
+type opml struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    opmlHead `xml:"head"`
+	Body    opmlBody `xml:"body"`
+}
+
+type opmlHead struct {
+	Title       string `xml:"title"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+type opmlBody struct {
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	XMLURL   string        `xml:"xmlUrl,attr,omitempty"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+// writeOPML writes an OPML 2.0 document that lists the feeds.
+func writeOPML(w io.Writer, title string, created time.Time, feeds []Feed) error {
+	doc := opml{
+		Version: "2.0",
+		Head: opmlHead{
+			Title:       title,
+			DateCreated: created.UTC().Format(time.RFC1123Z),
+		},
+	}
+
+	for _, feed := range feeds {
+		doc.Body.Outlines = append(doc.Body.Outlines, opmlOutline{
+			Text:   feed.Title,
+			Title:  feed.Title,
+			Type:   "rss",
+			XMLURL: feed.FullURL(),
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// readOPML returns the feed URLs listed in an OPML document, including those
+// in nested outlines.
+func readOPML(r io.Reader) ([]string, error) {
+	var doc opml
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	var walk func(outlines []opmlOutline)
+	walk = func(outlines []opmlOutline) {
+		for _, o := range outlines {
+			if o.XMLURL != "" {
+				urls = append(urls, o.XMLURL)
+			}
+
+			walk(o.Outlines)
+		}
+	}
+	walk(doc.Body.Outlines)
+
+	return urls, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// deliveryPaused is set while an admin paused the delivery of items, e.g.
+// during maintenance of the database. Updates and digests are skipped then,
+// so the items are delivered once the delivery is resumed.
+var deliveryPaused atomic.Bool
+
+// loadDeliveryPaused restores a pause from before the bot was restarted.
+func loadDeliveryPaused(ctx context.Context, db *DB) error {
+	paused, err := db.DeliveryPaused(ctx)
+	if err != nil {
+		return err
+	}
+
+	deliveryPaused.Store(paused)
+	if paused {
+		logrus.Warn("delivery of items is paused, resume it with /admin resume")
+	}
+
+	return nil
+}
+
+// setDeliveryPaused pauses or resumes the delivery of items. The pause is
+// stored first, so that it is not lost if that fails.
+func setDeliveryPaused(ctx context.Context, db *DB, paused bool) error {
+	if err := db.SetDeliveryPaused(ctx, paused); err != nil {
+		return err
+	}
+
+	deliveryPaused.Store(paused)
+	return nil
+}
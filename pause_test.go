@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+func TestUpdatePaused(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{
+		Admins:               []int64{1},
+		FetchConcurrency:     1,
+		UpdateTimeout:        duration{time.Minute},
+		MaxDescriptionLength: defaultMaxDescriptionLength,
+	}}
+	t.Cleanup(func() { deliveryPaused.Store(false) })
+
+	var requests int
+	srv := newTestFeedServer(t, &requests)
+	addTestFeed(t, db, 1, 10, srv.URL)
+
+	command := func(args string) string {
+		msg := &tgbotapi.Message{From: &tgbotapi.User{ID: 1}, Chat: &tgbotapi.Chat{ID: 10}}
+		return admin(ctx, cfg, db, nil, msg, args).(tgbotapi.MessageConfig).Text
+	}
+
+	var sent []string
+	send := func(c tgbotapi.Chattable) {
+		sent = append(sent, c.(tgbotapi.MessageConfig).Text)
+	}
+
+	if text := command("pause"); text != "Delivery is paused. No feeds are fetched until /admin resume." {
+		t.Fatalf("reply to pause = %q", text)
+	}
+	if err := update(ctx, cfg, db, send); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 || len(sent) != 0 {
+		t.Fatalf("paused update made %d requests and sent %q", requests, sent)
+	}
+
+	// The pause outlasts a restart.
+	deliveryPaused.Store(false)
+	if err := loadDeliveryPaused(ctx, db); err != nil || !deliveryPaused.Load() {
+		t.Fatalf("pause after restart = %v, %v", deliveryPaused.Load(), err)
+	}
+
+	if text := command("resume"); text != "Delivery is resumed." {
+		t.Fatalf("reply to resume = %q", text)
+	}
+	if err := update(ctx, cfg, db, send); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 || len(sent) != 1 {
+		t.Fatalf("resumed update made %d requests and sent %q, want the item", requests, sent)
+	}
+	if paused, err := db.DeliveryPaused(ctx); err != nil || paused {
+		t.Fatalf("stored pause after resume = %v, %v", paused, err)
+	}
+}
+
+func TestHealthReportsPause(t *testing.T) {
+	db := openTestDB(t)
+	h := &healthHandler{db: db, checkBot: func() error { return nil }}
+	t.Cleanup(func() { deliveryPaused.Store(false) })
+
+	deliveryPaused.Store(true)
+	if code, status := checkHealth(t, h); code != http.StatusOK || status.Status != "ok" || !status.Paused {
+		t.Fatalf("paused bot: %d %+v", code, status)
+	}
+
+	deliveryPaused.Store(false)
+	if _, status := checkHealth(t, h); status.Paused {
+		t.Fatalf("resumed bot: %+v", status)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+	"github.com/mmcdole/gofeed"
+)
+
+const previewItems = 3
+
+// preview handles the /preview command. It fetches the feed at feedURL like
+// /addfeed does and shows its latest items without subscribing to it.
+func preview(ctx context.Context, cfg *Config, chatID int64, feedURL string) tgbotapi.Chattable {
+	u, err := url.Parse(feedURL)
+	if err != nil || u.Host == "" {
+		return tgbotapi.NewMessage(chatID, "This does not look like the URL of a feed.")
+	}
+
+	u.Scheme = ""
+	feed, _, err := fetchAnyScheme(ctx, newFeedClient(cfg), *u)
+	if err != nil {
+		logrus.WithError(err).WithField("Feed URL", withoutCredentials(u.String())).Debug("preview: cannot fetch feed")
+		return tgbotapi.NewMessage(chatID, "I cannot fetch this feed, or it is not a feed I understand.")
+	}
+
+	text := fmt.Sprintf("Feed \"%s\"", strings.TrimSpace(feed.Title))
+	items := latestItems(feed.Items, previewItems)
+	if len(items) == 0 {
+		text += " has no items yet."
+	} else {
+		text += fmt.Sprintf(", latest %d items:\n", len(items))
+		for _, item := range items {
+			text += fmt.Sprintf("• %s\n  %s\n", strings.TrimSpace(item.Title), strings.TrimSpace(item.Link))
+		}
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.DisableWebPagePreview = true
+	return msg
+}
+
+// latestItems returns the n most recently published items, newest first.
+// Items without a date keep their position relative to each other.
+func latestItems(items []*gofeed.Item, n int) []*gofeed.Item {
+	sorted := append([]*gofeed.Item(nil), items...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].PublishedParsed, sorted[j].PublishedParsed
+		return a != nil && (b == nil || a.After(*b))
+	})
+
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+
+	return sorted
+}
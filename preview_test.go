@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+const previewFeed = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Preview</title>
+<item><title>Second</title><link>https://example.com/2</link><pubDate>Tue, 02 Jan 2024 10:00:00 GMT</pubDate></item>
+<item><title>Fourth</title><link>https://example.com/4</link><pubDate>Thu, 04 Jan 2024 10:00:00 GMT</pubDate></item>
+<item><title>First</title><link>https://example.com/1</link><pubDate>Mon, 01 Jan 2024 10:00:00 GMT</pubDate></item>
+<item><title>Third</title><link>https://example.com/3</link><pubDate>Wed, 03 Jan 2024 10:00:00 GMT</pubDate></item>
+</channel></rss>`
+
+func TestPreview(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{UserAgent: defaultUserAgent}}
+
+	// The test server only speaks plain HTTP, so this also covers the
+	// fallback from HTTPS.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/feed" {
+			http.NotFound(w, r)
+			return
+		}
+
+		fmt.Fprint(w, previewFeed)
+	}))
+	defer srv.Close()
+
+	text := preview(ctx, cfg, 10, srv.URL+"/feed").(tgbotapi.MessageConfig).Text
+	want := "Feed \"Preview\", latest 3 items:\n" +
+		"• Fourth\n  https://example.com/4\n" +
+		"• Third\n  https://example.com/3\n" +
+		"• Second\n  https://example.com/2\n"
+	if text != want {
+		t.Fatalf("preview = %q, want %q", text, want)
+	}
+
+	// Nothing is stored.
+	if got := feedTitles(t, db, 10); len(got) != 0 {
+		t.Fatalf("preview subscribed the chat to %q", got)
+	}
+
+	for _, feedURL := range []string{srv.URL + "/missing", "no url", "%%"} {
+		text := preview(ctx, cfg, 10, feedURL).(tgbotapi.MessageConfig).Text
+		if !strings.HasPrefix(text, "I cannot fetch") && !strings.HasPrefix(text, "This does not look") {
+			t.Errorf("preview of %q = %q", feedURL, text)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter allows at most limit events per key within a sliding window.
+// A limit of 0 allows everything.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu     sync.Mutex
+	events map[int64][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		events: make(map[int64][]time.Time),
+	}
+}
+
+// Allow records an event for key and reports whether it is within the limit.
+// Events that are not allowed are not recorded.
+func (l *rateLimiter) Allow(key int64) bool {
+	if l.limit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := l.events[key]
+	for len(events) > 0 && now.Sub(events[0]) >= l.window {
+		events = events[1:]
+	}
+
+	if len(events) >= l.limit {
+		l.events[key] = events
+		return false
+	}
+
+	l.events[key] = append(events, now)
+	return true
+}
+
+// Known reports whether events of key were recorded since the limiter was
+// created.
+func (l *rateLimiter) Known(key int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.events[key]
+	return ok
+}
+
+// Seed records n earlier events of a key that is not known yet, as if they
+// just happened, so that they count for the whole window. Keys that are known
+// already are left alone.
+func (l *rateLimiter) Seed(key int64, n int) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.events[key]; ok {
+		return
+	}
+
+	events := make([]time.Time, 0, n)
+	for i := 0; i < n; i++ {
+		events = append(events, now)
+	}
+	l.events[key] = events
+}
+
+// tokenBucket allows events at rate per second on average and up to burst of
+// them at once.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// reserve takes a token and returns how long to wait until it is available.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Telegram allows about 30 messages per second in total and about one per
+// second in each chat.
+const maxSendsPerSecond = 30
+const maxChatSendsPerSecond = 1
+const chatSendBurst = 3
+
+// The buckets of idle chats are dropped once there are more than this.
+const maxChatBuckets = 1000
+
+// sendLimiter paces the messages that the bot sends.
+type sendLimiter struct {
+	mu     sync.Mutex
+	global *tokenBucket
+	chats  map[int64]*tokenBucket
+}
+
+func newSendLimiter() *sendLimiter {
+	return &sendLimiter{
+		global: newTokenBucket(maxSendsPerSecond, maxSendsPerSecond, time.Now()),
+		chats:  make(map[int64]*tokenBucket),
+	}
+}
+
+// Wait waits until a message may be sent to the chat, or ctx is done. A chat
+// ID of 0 only counts against the total.
+func (l *sendLimiter) Wait(ctx context.Context, chatID int64) error {
+	now := time.Now()
+
+	l.mu.Lock()
+	delay := l.global.reserve(now)
+	if chatID != 0 {
+		chat, ok := l.chats[chatID]
+		if !ok {
+			if len(l.chats) >= maxChatBuckets {
+				l.dropIdle(now)
+			}
+
+			chat = newTokenBucket(maxChatSendsPerSecond, chatSendBurst, now)
+			l.chats[chatID] = chat
+		}
+
+		if d := chat.reserve(now); d > delay {
+			delay = d
+		}
+	}
+	l.mu.Unlock()
+
+	return sleepContext(ctx, delay)
+}
+
+// dropIdle drops the buckets that are full, which are the same as new ones.
+func (l *sendLimiter) dropIdle(now time.Time) {
+	for chatID, b := range l.chats {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.chats, chatID)
+		}
+	}
+}
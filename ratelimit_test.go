@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, time.Hour)
+
+	if !l.Allow(1) || !l.Allow(1) {
+		t.Fatal("requests within the limit were denied")
+	}
+	if l.Allow(1) {
+		t.Fatal("third request within the window was allowed")
+	}
+
+	// Chats have their own budgets.
+	if !l.Allow(2) {
+		t.Fatal("request of another chat was denied")
+	}
+}
+
+func TestRateLimiterWindow(t *testing.T) {
+	l := newRateLimiter(1, 50*time.Millisecond)
+
+	if !l.Allow(1) || l.Allow(1) {
+		t.Fatal("limit of one request is not enforced")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !l.Allow(1) {
+		t.Fatal("request after the window was denied")
+	}
+}
+
+func TestRateLimitersAreIndependent(t *testing.T) {
+	// The fetch limiter is separate from the per-user request limit, so using
+	// up one budget does not affect the other.
+	fetch := newRateLimiter(1, time.Hour)
+	other := newRateLimiter(3, time.Hour)
+
+	if !fetch.Allow(1) || fetch.Allow(1) {
+		t.Fatal("fetch budget is not enforced")
+	}
+	for i := 0; i < 3; i++ {
+		if !other.Allow(1) {
+			t.Fatal("other budget was used up by fetch requests")
+		}
+	}
+	if fetch.Allow(1) {
+		t.Fatal("fetch budget was reset by other requests")
+	}
+
+	if unlimited := newRateLimiter(0, time.Hour); !unlimited.Allow(1) || !unlimited.Allow(1) {
+		t.Fatal("limiter without limit denied a request")
+	}
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	l := newRateLimiter(10, time.Hour)
+
+	// Many requests of a few users at once use up exactly their budgets.
+	var allowed [3]int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := i % len(allowed)
+			if l.Allow(int64(key)) {
+				atomic.AddInt64(&allowed[key], 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for key, n := range allowed {
+		if n != 10 {
+			t.Errorf("key %d: %d requests were allowed, want 10", key, n)
+		}
+	}
+}
+
+func TestRateLimiterSeed(t *testing.T) {
+	l := newRateLimiter(3, time.Hour)
+
+	if l.Known(1) {
+		t.Fatal("new key is known")
+	}
+	l.Seed(1, 2)
+	if !l.Known(1) {
+		t.Fatal("seeded key is not known")
+	}
+	if !l.Allow(1) || l.Allow(1) {
+		t.Fatal("seeded events do not count")
+	}
+
+	// Known keys are not seeded again.
+	l.Allow(2)
+	l.Seed(2, 3)
+	if !l.Allow(2) {
+		t.Fatal("known key was seeded")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// Feeds that publish less often than dormantPublishInterval are only fetched
+// every dormantFetchInterval.
+const dormantPublishInterval = time.Hour * 24 * 14
+const dormantFetchInterval = time.Hour * 24
+
+// estimatePublishInterval returns the median time between the publication of
+// consecutive items, or 0 if the feed has too few dated items to tell.
+func estimatePublishInterval(items []*gofeed.Item) time.Duration {
+	var times []time.Time
+	for _, item := range items {
+		if item.PublishedParsed != nil {
+			times = append(times, *item.PublishedParsed)
+		}
+	}
+
+	if len(times) < 2 {
+		return 0
+	}
+
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+
+	gaps := make([]time.Duration, 0, len(times)-1)
+	for i := 1; i < len(times); i++ {
+		gaps = append(gaps, times[i].Sub(times[i-1]))
+	}
+
+	sort.Slice(gaps, func(i, j int) bool {
+		return gaps[i] < gaps[j]
+	})
+
+	return gaps[len(gaps)/2]
+}
+
+func isDormant(publishInterval time.Duration) bool {
+	return publishInterval >= dormantPublishInterval
+}
+
+// Updates look for due feeds at most this often.
+const maxUpdateCheckInterval = time.Minute
+
+// updateCheckInterval returns how often updates look for due feeds.
+func updateCheckInterval(updateInterval time.Duration) time.Duration {
+	if updateInterval < maxUpdateCheckInterval {
+		return updateInterval
+	}
+
+	return maxUpdateCheckInterval
+}
+
+// fetchOffset returns the pseudo-random offset within the update interval at
+// which the feed with the given ID is fetched. It only depends on the ID, so a
+// feed keeps its slot from fetch to fetch and the fetches of all feeds are
+// spread evenly over the interval.
+func fetchOffset(feedID int64, updateInterval time.Duration) time.Duration {
+	return time.Duration(rand.New(rand.NewSource(feedID)).Int63n(int64(updateInterval)))
+}
+
+// syndicationPeriods are the values of sy:updatePeriod.
+var syndicationPeriods = map[string]time.Duration{
+	"hourly":  time.Hour,
+	"daily":   time.Hour * 24,
+	"weekly":  time.Hour * 24 * 7,
+	"monthly": time.Hour * 24 * 30,
+	"yearly":  time.Hour * 24 * 365,
+}
+
+// advertisedInterval returns how often the feed says it changes, from the
+// <ttl> of RSS feeds or the syndication module, or 0 if it does not say.
+func advertisedInterval(feed *gofeed.Feed) time.Duration {
+	if ttl, err := strconv.Atoi(strings.TrimSpace(feed.Custom[ttlKey])); err == nil && ttl > 0 {
+		return time.Duration(ttl) * time.Minute
+	}
+
+	var period, frequency string
+	for _, e := range feed.Extensions["sy"]["updatePeriod"] {
+		period = strings.ToLower(strings.TrimSpace(e.Value))
+	}
+	for _, e := range feed.Extensions["sy"]["updateFrequency"] {
+		frequency = strings.TrimSpace(e.Value)
+	}
+
+	if period == "" && frequency == "" {
+		return 0
+	}
+
+	// Both elements are optional; a feed is updated once a day by default.
+	interval := syndicationPeriods["daily"]
+	if period != "" {
+		var ok bool
+		if interval, ok = syndicationPeriods[period]; !ok {
+			return 0
+		}
+	}
+
+	if frequency != "" {
+		n, err := strconv.Atoi(frequency)
+		if err != nil || n <= 0 {
+			return 0
+		}
+		interval /= time.Duration(n)
+	}
+
+	return interval
+}
+
+// nextFetch returns when the feed with the given ID should be fetched next.
+// A feed that advertises how often it changes is fetched that often, within
+// the configured bounds; other feeds are fetched every update interval unless
+// they are dormant. A zero time means it is fetched with every update.
+func nextFetch(now time.Time, feedID int64, publishInterval, advertised time.Duration, bot *BotConfig) time.Time {
+	interval := bot.UpdateInterval.Duration
+	if advertised > 0 {
+		interval = advertised
+		if bot.MinFetchInterval.Duration > 0 && interval < bot.MinFetchInterval.Duration {
+			interval = bot.MinFetchInterval.Duration
+		}
+		if bot.MaxFetchInterval.Duration > 0 && interval > bot.MaxFetchInterval.Duration {
+			interval = bot.MaxFetchInterval.Duration
+		}
+	} else if isDormant(publishInterval) {
+		return now.Add(dormantFetchInterval)
+	}
+
+	if interval <= 0 {
+		return time.Time{}
+	}
+
+	next := now.Truncate(interval).Add(fetchOffset(feedID, interval))
+	if !next.After(now) {
+		next = next.Add(interval)
+	}
+
+	return next
+}
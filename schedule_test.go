@@ -0,0 +1,162 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func itemsAt(times ...time.Time) []*gofeed.Item {
+	items := make([]*gofeed.Item, len(times))
+	for i := range times {
+		items[i] = &gofeed.Item{PublishedParsed: &times[i]}
+	}
+
+	return items
+}
+
+func TestEstimatePublishInterval(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name  string
+		items []*gofeed.Item
+		want  time.Duration
+	}{
+		{"empty", nil, 0},
+		{"single item", itemsAt(start), 0},
+		{"daily", itemsAt(start, start.Add(day), start.Add(2*day), start.Add(3*day)), day},
+		{"unordered", itemsAt(start.Add(2*day), start, start.Add(day)), day},
+		// One long break does not change the median.
+		{"daily with break", itemsAt(start, start.Add(day), start.Add(2*day), start.Add(40*day)), day},
+		{"monthly", itemsAt(start, start.Add(30*day), start.Add(60*day)), 30 * day},
+		{"undated items", append(itemsAt(start, start.Add(time.Hour)), &gofeed.Item{}), time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := estimatePublishInterval(tt.items); got != tt.want {
+			t.Errorf("%s: interval %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNextFetch(t *testing.T) {
+	now := time.Now()
+	hourly := &BotConfig{UpdateInterval: duration{time.Hour}}
+
+	for _, interval := range []time.Duration{0, time.Hour, 24 * time.Hour, dormantPublishInterval - time.Second} {
+		if next := nextFetch(now, 1, interval, 0, &BotConfig{}); !next.IsZero() {
+			t.Errorf("feed publishing every %s is fetched at %s instead of with every update", interval, next)
+		}
+
+		next := nextFetch(now, 1, interval, 0, hourly)
+		if !next.After(now) || next.After(now.Add(time.Hour)) {
+			t.Errorf("feed publishing every %s is fetched at %s, not within the next hour", interval, next)
+		}
+
+		// The feed keeps its slot.
+		if again := nextFetch(next, 1, interval, 0, hourly); !again.Equal(next.Add(time.Hour)) {
+			t.Errorf("feed fetched at %s is fetched next at %s, want %s", next, again, next.Add(time.Hour))
+		}
+	}
+
+	for _, interval := range []time.Duration{dormantPublishInterval, 30 * 24 * time.Hour} {
+		if next := nextFetch(now, 1, interval, 0, hourly); !next.Equal(now.Add(dormantFetchInterval)) {
+			t.Errorf("dormant feed publishing every %s is fetched at %s", interval, next)
+		}
+	}
+}
+
+func TestNextFetchIsSpread(t *testing.T) {
+	const feeds = 600
+	const buckets = 6
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// All feeds are fetched at the same time, but their next fetches are
+	// spread over the following hour.
+	var counts [buckets]int
+	for id := int64(1); id <= feeds; id++ {
+		next := nextFetch(now, id, time.Hour, 0, &BotConfig{UpdateInterval: duration{time.Hour}})
+		if !next.After(now) || next.After(now.Add(time.Hour)) {
+			t.Fatalf("feed %d is fetched at %s, not within the next hour", id, next)
+		}
+
+		counts[next.Sub(now)*buckets/time.Hour]++
+	}
+
+	for i, n := range counts {
+		if n < feeds/buckets/2 || n > feeds/buckets*2 {
+			t.Errorf("%d of %d feeds are fetched in minutes %d to %d, want about %d: %v", n, feeds, i*60/buckets, (i+1)*60/buckets, feeds/buckets, counts)
+		}
+	}
+}
+
+func TestAdvertisedInterval(t *testing.T) {
+	const rssFeed = `<?xml version="1.0"?>
+<rss version="2.0" xmlns:sy="http://purl.org/rss/1.0/modules/syndication/">
+<channel><title>Test</title>%s<item><title>First</title></item></channel>
+</rss>`
+
+	tests := []struct {
+		name     string
+		elements string
+		want     time.Duration
+	}{
+		{"neither", "", 0},
+		{"ttl", "<ttl>90</ttl>", 90 * time.Minute},
+		{"invalid ttl", "<ttl>soon</ttl>", 0},
+		{"updatePeriod", "<sy:updatePeriod>weekly</sy:updatePeriod>", 7 * 24 * time.Hour},
+		{"updatePeriod and updateFrequency", "<sy:updatePeriod>hourly</sy:updatePeriod><sy:updateFrequency>4</sy:updateFrequency>", 15 * time.Minute},
+		{"updateFrequency only", "<sy:updateFrequency>2</sy:updateFrequency>", 12 * time.Hour},
+		{"unknown updatePeriod", "<sy:updatePeriod>sometimes</sy:updatePeriod>", 0},
+		{"ttl and updatePeriod", "<ttl>30</ttl><sy:updatePeriod>daily</sy:updatePeriod>", 30 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		feed, err := newFeedParser().ParseString(strings.Replace(rssFeed, "%s", tt.elements, 1))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if got := advertisedInterval(feed); got != tt.want {
+			t.Errorf("%s: interval %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNextFetchAdvertised(t *testing.T) {
+	now := time.Now()
+	bot := &BotConfig{
+		UpdateInterval:   duration{time.Hour},
+		MinFetchInterval: duration{15 * time.Minute},
+		MaxFetchInterval: duration{24 * time.Hour},
+	}
+
+	tests := []struct {
+		advertised time.Duration
+		interval   time.Duration
+	}{
+		{2 * time.Hour, 2 * time.Hour},
+		{10 * time.Minute, 15 * time.Minute},
+		{7 * 24 * time.Hour, 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		next := nextFetch(now, 1, 0, tt.advertised, bot)
+		if !next.After(now) || next.After(now.Add(tt.interval)) {
+			t.Errorf("feed advertising %s is fetched at %s, not within %s", tt.advertised, next, tt.interval)
+		}
+
+		if again := nextFetch(next, 1, 0, tt.advertised, bot); !again.Equal(next.Add(tt.interval)) {
+			t.Errorf("feed advertising %s is fetched every %s, want every %s", tt.advertised, again.Sub(next), tt.interval)
+		}
+	}
+
+	// The feed knows better than the estimate that it is dormant.
+	if next := nextFetch(now, 1, dormantPublishInterval, 2*time.Hour, bot); next.After(now.Add(2 * time.Hour)) {
+		t.Errorf("dormant feed advertising 2h is fetched at %s", next)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+	"github.com/mmcdole/gofeed"
+)
+
+const (
+	maxSearchQueryLength = 100
+	maxSearchResults     = 10
+
+	// maxSearchFetches is how many feeds a search fetches at most if they
+	// are not cached; the others are not searched.
+	maxSearchFetches = 10
+
+	// Longer titles are cut off and longer links left out, which keeps
+	// the results within maxMessageLength.
+	maxSearchTitleLength = 200
+	maxSearchLinkLength  = 150
+)
+
+// searchResult is an item that matched a search, with the number of its feed
+// in the chat.
+type searchResult struct {
+	feedNum int64
+	item    *gofeed.Item
+}
+
+// search handles the /search command. It looks for query in the items of all
+// feeds of the chat, like a keyword of /filter, and lists the newest matches.
+// Feeds are taken from cache if they were fetched recently.
+func search(ctx context.Context, cfg *Config, db *DB, cache *feedCache, chatID int64, query string, now time.Time) tgbotapi.Chattable {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if len(query) > maxSearchQueryLength {
+		return tgbotapi.NewMessage(chatID, "This search is too long.")
+	}
+
+	feeds, err := db.FeedsByChat(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("search: get feeds of chat failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if len(feeds) == 0 {
+		return tgbotapi.NewMessage(chatID, "No feeds in this chat.")
+	}
+
+	var results []searchResult
+	fetches, missed := 0, 0
+	client := newFeedClient(cfg)
+	for _, f := range feeds {
+		parsed, ok := cache.Get(f.URL, now)
+		if !ok {
+			if fetches == maxSearchFetches {
+				missed++
+				continue
+			}
+			fetches++
+
+			if parsed, err = fetchForSearch(ctx, client, db, f.FeedID); err != nil {
+				logrus.WithError(err).WithField("Feed", f.FullURL()).Debug("search: cannot fetch feed")
+				missed++
+				continue
+			}
+			cache.Put(f.URL, parsed, now)
+		}
+
+		for _, item := range parsed.Items {
+			if matchesKeyword(item, []string{query}) {
+				results = append(results, searchResult{feedNum: f.ID, item: item})
+			}
+		}
+	}
+
+	text := ""
+	if len(results) == 0 {
+		text = fmt.Sprintf("No recent items of the feeds in this chat match \"%s\".", query)
+	} else {
+		sort.SliceStable(results, func(i, j int) bool {
+			a, b := results[i].item.PublishedParsed, results[j].item.PublishedParsed
+			return a != nil && (b == nil || a.After(*b))
+		})
+
+		text = fmt.Sprintf("%d recent items match \"%s\"", len(results), query)
+		if len(results) > maxSearchResults {
+			text += fmt.Sprintf(", the newest %d are", maxSearchResults)
+			results = results[:maxSearchResults]
+		}
+		text += ":\n"
+
+		loc, err := db.ChatLocation(ctx, chatID)
+		if err != nil {
+			logrus.WithError(err).WithField("Chat ID", chatID).Error("get chat time zone failed")
+		}
+
+		for _, r := range results {
+			title := []rune(strings.TrimSpace(r.item.Title))
+			if len(title) > maxSearchTitleLength {
+				title = append(title[:maxSearchTitleLength], '…')
+			}
+
+			text += fmt.Sprintf("[%d] %s\n", r.feedNum, string(title))
+			if r.item.PublishedParsed != nil {
+				text += "  " + chatTime(*r.item.PublishedParsed, loc) + "\n"
+			}
+			if link := strings.TrimSpace(r.item.Link); link != "" && len(link) <= maxSearchLinkLength {
+				text += "  " + link + "\n"
+			}
+		}
+	}
+
+	if missed > 0 {
+		text += fmt.Sprintf("\n%d feeds could not be searched right now.", missed)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.DisableWebPagePreview = true
+	return msg
+}
+
+// fetchForSearch fetches the feed with the given ID, with its credentials.
+func fetchForSearch(ctx context.Context, client *http.Client, db *DB, feedID int64) (*gofeed.Feed, error) {
+	info, err := db.FeedByID(ctx, feedID)
+	if err != nil {
+		return nil, err
+	}
+
+	feed, _, err := fetchFeed(ctx, client, info.fetchURL(), HTTPCache{})
+	return feed, err
+}
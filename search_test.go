@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+	"github.com/mmcdole/gofeed"
+)
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{}
+
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Fetched</title>
+<item><title>Go generics explained</title><link>https://example.com/generics</link><pubDate>Wed, 03 Jan 2024 10:00:00 GMT</pubDate></item>
+<item><title>Rust news</title><link>https://example.com/rust</link><pubDate>Thu, 04 Jan 2024 10:00:00 GMT</pubDate></item>
+</channel></rss>`)
+	}))
+	t.Cleanup(srv.Close)
+
+	text := func(query string) string {
+		return search(ctx, cfg, db, newFeedCache(time.Hour, feedCacheSize), 10, query, time.Now()).(tgbotapi.MessageConfig).Text
+	}
+	if got := text("go"); got != "No feeds in this chat." {
+		t.Fatalf("search without feeds = %q", got)
+	}
+
+	addTestFeed(t, db, 1, 10, srv.URL+"/cached")
+	addTestFeed(t, db, 1, 10, srv.URL+"/fetched")
+
+	// The first feed was parsed by an update recently.
+	newer, older := time.Date(2024, 1, 5, 10, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	cache := newFeedCache(time.Hour, feedCacheSize)
+	cache.Put(strings.TrimPrefix(srv.URL, "http:")+"/cached", &gofeed.Feed{Items: []*gofeed.Item{
+		{Title: "Go 1.22 released", Link: "https://example.com/go122", PublishedParsed: &newer},
+		{Title: "Going further", Description: "Part two", PublishedParsed: &older},
+		{Title: "Cooking", PublishedParsed: &newer},
+	}}, time.Now())
+
+	got := search(ctx, cfg, db, cache, 10, " Go ", time.Now()).(tgbotapi.MessageConfig).Text
+	want := "3 recent items match \"go\":\n" +
+		"[1] Go 1.22 released\n  2024-01-05 10:00 UTC\n  https://example.com/go122\n" +
+		"[2] Go generics explained\n  2024-01-03 10:00 UTC\n  https://example.com/generics\n" +
+		"[1] Going further\n  2024-01-01 10:00 UTC\n"
+	if got != want {
+		t.Fatalf("search = %q, want %q", got, want)
+	}
+	if requests["/cached"] != 0 || requests["/fetched"] != 1 {
+		t.Fatalf("requests %v, want only the feed that was not cached", requests)
+	}
+
+	// The fetched feed is cached for the next search.
+	if got := search(ctx, cfg, db, cache, 10, "#nothing", time.Now()).(tgbotapi.MessageConfig).Text; got != "No recent items of the feeds in this chat match \"#nothing\"." {
+		t.Fatalf("search without matches = %q", got)
+	}
+	if requests["/fetched"] != 1 {
+		t.Fatalf("cached feed was fetched %d times", requests["/fetched"])
+	}
+
+	if got := text(strings.Repeat("x", maxSearchQueryLength+1)); got != "This search is too long." {
+		t.Fatalf("long search = %q", got)
+	}
+}
+
+func TestSearchReportsFeedsThatFail(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+	addTestFeed(t, db, 1, 10, srv.URL+"/gone")
+
+	got := search(ctx, &Config{}, db, newFeedCache(time.Hour, feedCacheSize), 10, "go", time.Now()).(tgbotapi.MessageConfig).Text
+	if want := "No recent items of the feeds in this chat match \"go\".\n1 feeds could not be searched right now."; got != want {
+		t.Fatalf("search = %q, want %q", got, want)
+	}
+}
+
+func TestUpdateFeedFillsFeedCache(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{MaxDescriptionLength: defaultMaxDescriptionLength}}
+
+	var requests int
+	srv := newTestFeedServer(t, &requests)
+	addTestFeed(t, db, 1, 10, srv.URL)
+
+	info := dueFeed(t, db)
+	var count int64
+	if err := updateFeed(ctx, cfg, db, srv.Client(), func(tgbotapi.Chattable) {}, info, &count); err != nil {
+		t.Fatal(err)
+	}
+
+	feed, ok := parsedFeeds.Get(info.URL, time.Now())
+	if !ok || len(feed.Items) != 1 || feed.Items[0].Title != "First" {
+		t.Fatalf("cached feed after update = %+v, %v", feed, ok)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+// messageLength returns the length of text as Telegram counts it, in UTF-16
+// code units.
+func messageLength(text string) int {
+	n := 0
+	for _, r := range text {
+		n += utf16Len(r)
+	}
+
+	return n
+}
+
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+
+	return 1
+}
+
+// prefixWithin returns the length in bytes of the longest prefix of text that
+// fits into a message.
+func prefixWithin(text string, limit int) int {
+	n := 0
+	for i, r := range text {
+		n += utf16Len(r)
+		if n > limit {
+			return i
+		}
+	}
+
+	return len(text)
+}
+
+// splitMessage splits text into chunks that fit into a message each. It cuts
+// at line breaks if possible, then at spaces, and never within an HTML entity.
+func splitMessage(text string) []string {
+	var chunks []string
+	for messageLength(text) > maxMessageLength {
+		cut := prefixWithin(text, maxMessageLength)
+		prefix := text[:cut]
+
+		if i := strings.LastIndexByte(prefix, '\n'); i > cut/2 {
+			cut = i
+		} else if i := strings.LastIndexByte(prefix, ' '); i > cut/2 {
+			cut = i
+		} else if i := strings.LastIndexByte(prefix, '&'); i > 0 && i > strings.LastIndexByte(prefix, ';') {
+			cut = i
+		}
+
+		chunks = append(chunks, text[:cut])
+		text = strings.TrimLeft(text[cut:], "\n ")
+	}
+
+	if text != "" || len(chunks) == 0 {
+		chunks = append(chunks, text)
+	}
+
+	return chunks
+}
+
+// requester is a message that the library cannot send, so it makes its
+// request itself.
+type requester interface {
+	sendWith(bot *tgbotapi.BotAPI) error
+}
+
+// baseChatValues returns the parameters of a request for chat, like the
+// library sets them.
+func baseChatValues(chat *tgbotapi.BaseChat) (url.Values, error) {
+	v := url.Values{}
+	if chat.ChannelUsername != "" {
+		v.Set("chat_id", chat.ChannelUsername)
+	} else {
+		v.Set("chat_id", strconv.FormatInt(chat.ChatID, 10))
+	}
+
+	if chat.ReplyToMessageID != 0 {
+		v.Set("reply_to_message_id", strconv.Itoa(chat.ReplyToMessageID))
+	}
+
+	if chat.ReplyMarkup != nil {
+		data, err := json.Marshal(chat.ReplyMarkup)
+		if err != nil {
+			return v, err
+		}
+
+		v.Set("reply_markup", string(data))
+	}
+
+	v.Set("disable_notification", strconv.FormatBool(chat.DisableNotification))
+	return v, nil
+}
+
+// sendRequest makes the request that sends c.
+func sendRequest(bot *tgbotapi.BotAPI, c tgbotapi.Chattable) error {
+	if r, ok := c.(requester); ok {
+		return r.sendWith(bot)
+	}
+
+	_, err := bot.Send(c)
+	return err
+}
+
+// sendMessage sends c. Text messages that are too long are sent in several
+// parts; the reply markup is attached to the last one. Photos and polls that
+// cannot be sent are replaced by their fallback.
+func sendMessage(bot *tgbotapi.BotAPI, c tgbotapi.Chattable) error {
+	return sendParts(func(part tgbotapi.Chattable) error {
+		return sendRequest(bot, part)
+	}, c)
+}
+
+// sendParts sends c like sendMessage, making each request with send.
+func sendParts(send func(tgbotapi.Chattable) error, c tgbotapi.Chattable) error {
+	if thread, ok := c.(threadMessage); ok {
+		return sendParts(func(part tgbotapi.Chattable) error {
+			return send(threadMessage{Chattable: part, ThreadID: thread.ThreadID})
+		}, thread.Chattable)
+	}
+
+	if photo, ok := c.(photoMessage); ok {
+		err := send(photo.PhotoConfig)
+		if err == nil || isChatGone(err) {
+			return err
+		}
+
+		logrus.WithError(err).WithField("Chat ID", photo.ChatID).Debug("cannot send photo, sending text instead")
+		c = photo.Fallback
+	}
+
+	if poll, ok := c.(pollMessage); ok {
+		err := send(poll)
+		if err == nil || isChatGone(err) {
+			return err
+		}
+
+		logrus.WithError(err).WithField("Chat ID", poll.ChatID).Debug("cannot send poll, sending text instead")
+		c = poll.MessageConfig
+	}
+
+	msg, ok := c.(tgbotapi.MessageConfig)
+	if !ok {
+		return send(c)
+	}
+
+	chunks := splitMessage(msg.Text)
+	for i, chunk := range chunks {
+		part := msg
+		part.Text = chunk
+		if i != len(chunks)-1 {
+			part.ReplyMarkup = nil
+		}
+
+		if err := send(part); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// chatOf returns the chat that c is sent to, or 0 if it is not known.
+func chatOf(c tgbotapi.Chattable) int64 {
+	switch msg := c.(type) {
+	case threadMessage:
+		return chatOf(msg.Chattable)
+	case tgbotapi.MessageConfig:
+		return msg.ChatID
+	case photoMessage:
+		return msg.ChatID
+	case tgbotapi.PhotoConfig:
+		return msg.ChatID
+	case tgbotapi.DocumentConfig:
+		return msg.ChatID
+	case pollMessage:
+		return msg.ChatID
+	case tgbotapi.EditMessageTextConfig:
+		return msg.ChatID
+	}
+
+	return 0
+}
+
+// threadMessage sends a message to a forum topic of its chat. The library
+// does not know about topics, so the request is made with the parameters
+// that the library would set and the topic.
+type threadMessage struct {
+	tgbotapi.Chattable
+	ThreadID int
+}
+
+func (m threadMessage) sendWith(bot *tgbotapi.BotAPI) error {
+	switch msg := m.Chattable.(type) {
+	case tgbotapi.MessageConfig:
+		v, err := messageValues(msg)
+		if err != nil {
+			return err
+		}
+
+		v.Set("message_thread_id", strconv.Itoa(m.ThreadID))
+		_, err = bot.MakeRequest("sendMessage", v)
+		return err
+
+	case pollMessage:
+		method, v, err := msg.request()
+		if err != nil {
+			return err
+		}
+
+		v.Set("message_thread_id", strconv.Itoa(m.ThreadID))
+		_, err = bot.MakeRequest(method, v)
+		return err
+
+	case tgbotapi.PhotoConfig:
+		return sendFile(bot, "sendPhoto", "photo", msg.BaseFile, msg.Caption, msg.ParseMode, m.ThreadID)
+
+	case tgbotapi.DocumentConfig:
+		return sendFile(bot, "sendDocument", "document", msg.BaseFile, msg.Caption, msg.ParseMode, m.ThreadID)
+	}
+
+	return sendRequest(bot, m.Chattable)
+}
+
+// messageValues returns the parameters of a request for msg, like the
+// library sets them.
+func messageValues(msg tgbotapi.MessageConfig) (url.Values, error) {
+	v, err := baseChatValues(&msg.BaseChat)
+	if err != nil {
+		return v, err
+	}
+
+	v.Set("text", msg.Text)
+	v.Set("disable_web_page_preview", strconv.FormatBool(msg.DisableWebPagePreview))
+	if msg.ParseMode != "" {
+		v.Set("parse_mode", msg.ParseMode)
+	}
+
+	return v, nil
+}
+
+// sendFile sends the photo or document f to a forum topic, uploading it
+// unless it is on Telegram already or given by URL.
+func sendFile(bot *tgbotapi.BotAPI, method, field string, f tgbotapi.BaseFile, caption, parseMode string, threadID int) error {
+	v, err := baseChatValues(&f.BaseChat)
+	if err != nil {
+		return err
+	}
+
+	v.Set("message_thread_id", strconv.Itoa(threadID))
+	if caption != "" {
+		v.Set("caption", caption)
+		if parseMode != "" {
+			v.Set("parse_mode", parseMode)
+		}
+	}
+
+	if f.UseExisting {
+		v.Set(field, f.FileID)
+		_, err = bot.MakeRequest(method, v)
+		return err
+	}
+
+	if f.MimeType != "" {
+		v.Set("mime_type", f.MimeType)
+	}
+
+	params := make(map[string]string)
+	for name := range v {
+		params[name] = v.Get(name)
+	}
+
+	_, err = bot.UploadFile(method, params, field, f.File)
+	return err
+}
+
+// inThread returns c sent to the given forum topic of its chat. Zero stands
+// for the general topic, and messages that are not sent to a topic, such as
+// edits, are returned unchanged.
+func inThread(c tgbotapi.Chattable, threadID int) tgbotapi.Chattable {
+	if threadID == 0 {
+		return c
+	}
+
+	switch c.(type) {
+	case tgbotapi.MessageConfig, photoMessage, pollMessage, tgbotapi.PhotoConfig, tgbotapi.DocumentConfig:
+		return threadMessage{Chattable: c, ThreadID: threadID}
+	}
+
+	return c
+}
+
+// toThread returns a sendFunc that sends to the given forum topic, see
+// inThread.
+func (send sendFunc) toThread(threadID int) sendFunc {
+	if threadID == 0 {
+		return send
+	}
+
+	return func(c tgbotapi.Chattable) {
+		send(inThread(c, threadID))
+	}
+}
+
+// logMessage logs what would be sent with c. It is used instead of sending in
+// dry runs.
+func logMessage(c tgbotapi.Chattable) {
+	entry := logrus.WithField("Chat ID", chatOf(c))
+	if thread, ok := c.(threadMessage); ok {
+		entry = entry.WithField("Topic ID", thread.ThreadID)
+		c = thread.Chattable
+	}
+
+	if photo, ok := c.(photoMessage); ok {
+		entry = entry.WithField("Photo", photo.FileID)
+		c = photo.Fallback
+	}
+
+	if poll, ok := c.(pollMessage); ok {
+		entry = entry.WithField("Poll", poll.Question)
+		c = poll.MessageConfig
+	}
+
+	if msg, ok := c.(tgbotapi.MessageConfig); ok {
+		entry = entry.WithField("Text", msg.Text)
+	}
+
+	entry.Info("dry run: would send message")
+}
+
+// isChatGone reports whether err means that the bot cannot send messages to
+// the chat anymore, because it was blocked, removed or the chat was deleted.
+func isChatGone(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "Forbidden:") || strings.Contains(msg, "chat not found")
+}
+
+// reportSendError logs err, which occurred sending c, and removes all
+// subscriptions of the chat if the bot cannot reach it anymore.
+func reportSendError(ctx context.Context, db *DB, c tgbotapi.Chattable, err error, fields logrus.Fields) {
+	messagesFailed.Inc()
+
+	chatID := chatOf(c)
+	log := logrus.WithError(err).WithFields(fields).WithField("Chat ID", chatID)
+
+	if chatID == 0 || !isChatGone(err) {
+		log.Error("sending failed")
+		return
+	}
+
+	log.Warn("chat is gone, removing its subscriptions")
+	if err := db.RemoveChat(ctx, chatID); err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("remove chat failed")
+	}
+}
+
+// A request that Telegram rejects because of too many requests is tried again
+// at most maxSendRetries times.
+const maxSendRetries = 3
+
+// sender sends the messages that are not direct replies to commands. It
+// paces them to stay within the limits of Telegram and tries them again when
+// Telegram asks to wait.
+type sender struct {
+	bot     *tgbotapi.BotAPI
+	db      *DB
+	limiter *sendLimiter
+	queue   chan tgbotapi.Chattable
+}
+
+func newSender(bot *tgbotapi.BotAPI, db *DB) *sender {
+	return &sender{
+		bot:     bot,
+		db:      db,
+		limiter: newSendLimiter(),
+		queue:   make(chan tgbotapi.Chattable, sendQueueSize),
+	}
+}
+
+// Send queues c. It blocks while the queue is full, unless ctx is done.
+func (s *sender) Send(ctx context.Context, c tgbotapi.Chattable) {
+	select {
+	case s.queue <- c:
+	case <-ctx.Done():
+	}
+}
+
+// Run sends the queued messages with ctx until stop is closed.
+func (s *sender) Run(ctx context.Context, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case c := <-s.queue:
+			s.deliver(ctx, c)
+		}
+	}
+}
+
+// Drain sends the messages that are left in the queue until ctx is done, and
+// returns how many were dropped.
+func (s *sender) Drain(ctx context.Context) int {
+	for len(s.queue) > 0 {
+		if ctx.Err() != nil {
+			return len(s.queue)
+		}
+
+		s.deliver(ctx, <-s.queue)
+	}
+
+	return 0
+}
+
+func (s *sender) deliver(ctx context.Context, c tgbotapi.Chattable) {
+	send := func(part tgbotapi.Chattable) error {
+		return s.request(ctx, part)
+	}
+
+	if err := sendParts(send, c); err != nil {
+		reportSendError(ctx, s.db, c, err, logrus.Fields{"Source": "update"})
+	}
+}
+
+// request makes a single request to send c once the limiter allows it. If
+// Telegram answers that there were too many requests, it waits as long as
+// Telegram asks and tries again.
+func (s *sender) request(ctx context.Context, c tgbotapi.Chattable) error {
+	chatID := chatOf(c)
+
+	for attempt := 0; ; attempt++ {
+		if err := s.limiter.Wait(ctx, chatID); err != nil {
+			return err
+		}
+
+		err := sendRequest(s.bot, c)
+
+		var tgErr tgbotapi.Error
+		if !errors.As(err, &tgErr) || tgErr.RetryAfter <= 0 || attempt == maxSendRetries {
+			return err
+		}
+
+		delay := time.Duration(tgErr.RetryAfter) * time.Second
+		logrus.WithFields(logrus.Fields{
+			"Chat ID":     chatID,
+			"Retry after": delay,
+		}).Warn("too many requests, waiting")
+
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
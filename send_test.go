@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+	"github.com/mmcdole/gofeed"
+)
+
+func checkChunks(t *testing.T, name string, chunks []string) {
+	t.Helper()
+
+	for i, chunk := range chunks {
+		if n := messageLength(chunk); n > maxMessageLength {
+			t.Errorf("%s: chunk %d has length %d", name, i, n)
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	exact := strings.Repeat("a", maxMessageLength)
+	if chunks := splitMessage(exact); len(chunks) != 1 || chunks[0] != exact {
+		t.Errorf("message of exactly %d characters was split into %d chunks", maxMessageLength, len(chunks))
+	}
+
+	over := exact + "b"
+	chunks := splitMessage(over)
+	checkChunks(t, "just over", chunks)
+	if len(chunks) != 2 || strings.Join(chunks, "") != over {
+		t.Errorf("message of %d characters was split into %d chunks", len(over), len(chunks))
+	}
+
+	// Characters outside the BMP count twice.
+	emoji := strings.Repeat("😀", maxMessageLength/2+1)
+	chunks = splitMessage(emoji)
+	checkChunks(t, "emoji", chunks)
+	if len(chunks) != 2 || strings.Join(chunks, "") != emoji {
+		t.Errorf("message of %d emoji was split into %d chunks", maxMessageLength/2+1, len(chunks))
+	}
+
+	// Multi-line text is cut between lines.
+	line := strings.Repeat("x", 99)
+	lines := strings.TrimSuffix(strings.Repeat(line+"\n", 100), "\n")
+	chunks = splitMessage(lines)
+	checkChunks(t, "lines", chunks)
+	if len(chunks) != 3 {
+		t.Fatalf("100 lines were split into %d chunks, want 3", len(chunks))
+	}
+	for i, chunk := range chunks {
+		for _, l := range strings.Split(chunk, "\n") {
+			if l != line {
+				t.Fatalf("chunk %d has a cut line %q", i, l)
+			}
+		}
+	}
+
+	// Entities are not cut.
+	entities := strings.Repeat("&amp;", maxMessageLength/5+1)
+	chunks = splitMessage(entities)
+	checkChunks(t, "entities", chunks)
+	for i, chunk := range chunks {
+		if strings.Count(chunk, "&") != strings.Count(chunk, "&amp;") {
+			t.Fatalf("chunk %d cuts an entity", i)
+		}
+	}
+}
+
+func TestIsChatGone(t *testing.T) {
+	tests := map[string]bool{
+		"Forbidden: bot was blocked by the user":   true,
+		"Forbidden: bot was kicked from the group": true,
+		"Bad Request: chat not found":              true,
+		"Too Many Requests: retry after 5":         false,
+		"Bad Request: message is too long":         false,
+	}
+
+	for msg, want := range tests {
+		if got := isChatGone(errors.New(msg)); got != want {
+			t.Errorf("isChatGone(%q) = %v, want %v", msg, got, want)
+		}
+	}
+}
+
+func TestSendErrorRemovesGoneChats(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	for _, chatID := range []int64{10, 20, 30} {
+		if err := db.AddFeedToChat(ctx, 1, chatID, Feed{Title: "a", URL: "//example.com/a", Scheme: "https"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetRedirect(ctx, 30, Redirect{ChatID: 10, Until: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chat 10 blocked the bot, chat 20 is only sent too much.
+	bot := newTestBot(t, func(method string, params url.Values) (interface{}, string) {
+		switch params.Get("chat_id") {
+		case "10":
+			return nil, "Forbidden: bot was blocked by the user"
+		case "20":
+			return nil, "Too Many Requests: retry after 5"
+		}
+		return tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: 30}}, ""
+	})
+
+	for _, chatID := range []int64{10, 20, 30} {
+		c := tgbotapi.NewMessage(chatID, "news")
+		if err := sendMessage(bot, c); err != nil {
+			reportSendError(ctx, db, c, err, nil)
+		}
+	}
+
+	for chatID, want := range map[int64]int{10: 0, 20: 1, 30: 1} {
+		if got := len(feedTitles(t, db, chatID)); got != want {
+			t.Errorf("chat %d has %d feeds, want %d", chatID, got, want)
+		}
+	}
+
+	// Updates are no longer redirected to the chat that is gone.
+	_, sub, err := db.FeedOfChat(ctx, 30, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Redirect.Active(time.Now()) {
+		t.Fatalf("chat 30 is still redirected to %d", sub.Redirect.ChatID)
+	}
+}
+
+func TestSendPhotoFallsBackToText(t *testing.T) {
+	item := &gofeed.Item{
+		Title:       "Cat",
+		Link:        "https://example.com/cat",
+		Description: strings.Repeat("meow ", 400),
+		Enclosures:  []*gofeed.Enclosure{{URL: "https://example.com/cat.mp3", Type: "audio/mpeg"}, {URL: "https://example.com/cat.jpg", Type: "image/jpeg"}},
+	}
+	opts := itemOptions{maxDescription: 2000, images: true}
+
+	photo, ok := itemMessage(10, formatFull, "Pets", item, opts).(photoMessage)
+	if !ok {
+		t.Fatal("item with an image enclosure was not sent as photo")
+	}
+	if photo.FileID != "https://example.com/cat.jpg" {
+		t.Errorf("photo of %q was sent", photo.FileID)
+	}
+	if n := messageLength(photo.Caption); n > maxCaptionLength || !strings.HasPrefix(photo.Caption, "<i>Pets</i>\n<b>") || !strings.HasSuffix(photo.Caption, "…") {
+		t.Errorf("caption of length %d is not shortened: %q", n, photo.Caption)
+	}
+	if !strings.Contains(photo.Fallback.Text, strings.TrimSpace(strings.Repeat("meow ", 400))) {
+		t.Errorf("fallback does not have the whole description")
+	}
+
+	if _, ok := itemMessage(10, formatFull, "Pets", item, itemOptions{maxDescription: 2000}).(tgbotapi.MessageConfig); !ok {
+		t.Error("item was sent as photo although images are disabled")
+	}
+	noImage := &gofeed.Item{Title: "Dog", Link: "https://example.com/dog"}
+	if _, ok := itemMessage(10, formatFull, "Pets", noImage, opts).(tgbotapi.MessageConfig); !ok {
+		t.Error("item without image was not sent as text")
+	}
+
+	var methods []string
+	failPhoto := true
+	bot := newTestBot(t, func(method string, params url.Values) (interface{}, string) {
+		methods = append(methods, method)
+		if method == "sendPhoto" && failPhoto {
+			return nil, "Bad Request: wrong file identifier/HTTP URL specified"
+		}
+		return tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: 10}}, ""
+	})
+
+	if err := sendMessage(bot, photo); err != nil || strings.Join(methods, ",") != "sendPhoto,sendMessage" {
+		t.Errorf("failed photo: methods %v, err %v", methods, err)
+	}
+
+	methods, failPhoto = nil, false
+	if err := sendMessage(bot, photo); err != nil || strings.Join(methods, ",") != "sendPhoto" {
+		t.Errorf("photo: methods %v, err %v", methods, err)
+	}
+}
+
+func TestSendPollFallsBackToText(t *testing.T) {
+	item := &gofeed.Item{Title: "Best pet?", Description: "Cat\nDog"}
+	poll := itemMessage(10, formatPoll, "Pets", item, itemOptions{maxDescription: 2000})
+
+	var requests []string
+	failPoll := true
+	bot := newTestBot(t, func(method string, params url.Values) (interface{}, string) {
+		requests = append(requests, method+":"+params.Get("question")+params.Get("options"))
+		if method == "sendPoll" && failPoll {
+			return nil, "Bad Request: polls can't be sent to this chat"
+		}
+		return tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: 10}}, ""
+	})
+
+	if err := sendMessage(bot, poll); err != nil || strings.Join(requests, ",") != `sendPoll:Best pet?["Cat","Dog"],sendMessage:` {
+		t.Errorf("failed poll: requests %v, err %v", requests, err)
+	}
+
+	requests, failPoll = nil, false
+	if err := sendMessage(bot, poll); err != nil || strings.Join(requests, ",") != `sendPoll:Best pet?["Cat","Dog"]` {
+		t.Errorf("poll: requests %v, err %v", requests, err)
+	}
+}
+
+func TestSenderRetriesAfterTooManyRequests(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	var mu sync.Mutex
+	var attempts []time.Time
+	bot := newTestBot(t, func(method string, params url.Values) (interface{}, string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts = append(attempts, time.Now())
+		if len(attempts) == 1 {
+			return nil, "Too Many Requests: retry after 1"
+		}
+		return tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: 10}}, ""
+	})
+
+	s := newSender(bot, db)
+	s.Send(ctx, tgbotapi.NewMessage(10, "news"))
+	if dropped := s.Drain(ctx); dropped != 0 {
+		t.Fatalf("%d messages were dropped", dropped)
+	}
+
+	if len(attempts) != 2 {
+		t.Fatalf("message was sent %d times, want 2", len(attempts))
+	}
+	if wait := attempts[1].Sub(attempts[0]); wait < time.Second {
+		t.Fatalf("message was sent again after %s, want at least 1s", wait)
+	}
+}
+
+func TestSendLimiterPacesChats(t *testing.T) {
+	ctx := context.Background()
+	l := newSendLimiter()
+
+	// A chat may get a few messages at once, then one per second.
+	start := time.Now()
+	for i := 0; i < chatSendBurst; i++ {
+		if err := l.Wait(ctx, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("burst took %s", elapsed)
+	}
+
+	// Other chats do not wait for it.
+	if err := l.Wait(ctx, 20); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("message to another chat waited %s", elapsed)
+	}
+
+	cancelled, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(cancelled, 10); err == nil {
+		t.Fatal("message after the burst was not delayed")
+	}
+}
+
+func TestSendToThread(t *testing.T) {
+	if _, ok := inThread(tgbotapi.NewMessage(10, "a"), 0).(tgbotapi.MessageConfig); !ok {
+		t.Error("message was sent to a topic without one")
+	}
+	if c := inThread(tgbotapi.NewEditMessageText(10, 1, "a"), 7); c != tgbotapi.Chattable(tgbotapi.NewEditMessageText(10, 1, "a")) {
+		t.Errorf("edit was changed: %+v", c)
+	}
+
+	var threads []string
+	bot := newTestBot(t, func(method string, params url.Values) (interface{}, string) {
+		threads = append(threads, method+":"+params.Get("message_thread_id"))
+		if method == "sendPhoto" {
+			return nil, "Bad Request: wrong file identifier/HTTP URL specified"
+		}
+		return tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: 10}}, ""
+	})
+
+	photo := photoMessage{PhotoConfig: tgbotapi.NewPhotoShare(10, "https://example.com/cat.jpg"), Fallback: tgbotapi.NewMessage(10, "Cat")}
+	send := sendFunc(func(c tgbotapi.Chattable) {
+		if err := sendMessage(bot, c); err != nil {
+			t.Error(err)
+		}
+	})
+	send.toThread(7)(photo)
+	send.toThread(0)(tgbotapi.NewMessage(10, "Dog"))
+
+	if got := strings.Join(threads, ","); got != "sendPhoto:7,sendMessage:7,sendMessage:" {
+		t.Errorf("requests %s, want the photo and its fallback in topic 7 and then a message without topic", got)
+	}
+
+	// Long texts, polls and uploads go to the topic, too.
+	threads = nil
+	send.toThread(7)(tgbotapi.NewMessage(10, strings.Repeat("meow ", 1000)))
+	send.toThread(7)(itemMessage(10, formatPoll, "", &gofeed.Item{Title: "Best pet?", Description: "Cat\nDog"}, itemOptions{}))
+	send.toThread(7)(tgbotapi.NewDocumentUpload(10, tgbotapi.FileBytes{Name: "feeds.opml", Bytes: []byte("<opml/>")}))
+
+	if got := strings.Join(threads, ","); got != "sendMessage:7,sendMessage:7,sendPoll:7,sendDocument:7" {
+		t.Errorf("requests %s, want all of them in topic 7", got)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// FeedShape describes the structure of a feed as it was last observed.
+// Significant changes often mean that the site behind the feed was redesigned.
+type FeedShape struct {
+	// Type is the format of the feed ("rss", "atom" or "json"), or empty if
+	// the feed was never observed.
+	Type string
+
+	Descriptions bool
+}
+
+// observeShape returns the shape of feed. If the feed has no items, it is
+// unknown whether they have descriptions and the previous value is kept.
+func observeShape(prev FeedShape, feed *gofeed.Feed) FeedShape {
+	shape := FeedShape{
+		Type:         feed.FeedType,
+		Descriptions: prev.Descriptions,
+	}
+
+	if len(feed.Items) != 0 {
+		shape.Descriptions = false
+		for _, item := range feed.Items {
+			if item.Description != "" || item.Content != "" {
+				shape.Descriptions = true
+				break
+			}
+		}
+	}
+
+	return shape
+}
+
+// shapeChanges lists the significant changes between two shapes of a feed.
+func shapeChanges(prev, cur FeedShape) []string {
+	if prev.Type == "" {
+		return nil
+	}
+
+	var changes []string
+	if prev.Type != cur.Type {
+		changes = append(changes, fmt.Sprintf("its format changed from %s to %s", prev.Type, cur.Type))
+	}
+
+	if prev.Descriptions && !cur.Descriptions {
+		changes = append(changes, "its items no longer have descriptions")
+	}
+
+	return changes
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestObserveShape(t *testing.T) {
+	withDescriptions := &gofeed.Feed{FeedType: "rss", Items: []*gofeed.Item{{Title: "a"}, {Title: "b", Description: "text"}}}
+	if shape := observeShape(FeedShape{}, withDescriptions); shape != (FeedShape{Type: "rss", Descriptions: true}) {
+		t.Errorf("shape %+v", shape)
+	}
+
+	withoutDescriptions := &gofeed.Feed{FeedType: "json", Items: []*gofeed.Item{{Title: "a"}}}
+	if shape := observeShape(FeedShape{Type: "rss", Descriptions: true}, withoutDescriptions); shape != (FeedShape{Type: "json"}) {
+		t.Errorf("shape %+v", shape)
+	}
+
+	// Without items, nothing is known about descriptions.
+	empty := &gofeed.Feed{FeedType: "rss"}
+	if shape := observeShape(FeedShape{Type: "rss", Descriptions: true}, empty); !shape.Descriptions {
+		t.Error("descriptions vanished from an empty feed")
+	}
+}
+
+func TestShapeChanges(t *testing.T) {
+	rss := FeedShape{Type: "rss", Descriptions: true}
+
+	tests := []struct {
+		name      string
+		prev, cur FeedShape
+		want      []string
+	}{
+		{"first observation", FeedShape{}, rss, nil},
+		{"unchanged", rss, rss, nil},
+		{"format", rss, FeedShape{Type: "json", Descriptions: true}, []string{"its format changed from rss to json"}},
+		{"descriptions vanished", rss, FeedShape{Type: "rss"}, []string{"its items no longer have descriptions"}},
+		{"descriptions appeared", FeedShape{Type: "rss"}, rss, nil},
+		{"both", rss, FeedShape{Type: "atom"}, []string{"its format changed from rss to atom", "its items no longer have descriptions"}},
+	}
+
+	for _, tt := range tests {
+		if got := shapeChanges(tt.prev, tt.cur); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: changes %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
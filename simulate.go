@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+const maxSimulatedItems = 20
+
+// parseSince parses a point in time given either as a duration before now
+// (like 48h) or as a date with optional time in UTC.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("cannot parse %q as duration or date", s)
+}
+
+// simulate reports which items of a feed would be delivered to the chat if its
+// last update was at the given time. Nothing is sent or stored.
+func simulate(ctx context.Context, cfg *Config, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	fields := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if len(fields) != 2 {
+		return tgbotapi.NewMessage(chatID, "Usage: /simulate <id> <since>, e.g. /simulate 1 48h or /simulate 1 2024-01-31")
+	}
+
+	num, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Please provide the ID of the feed")
+	}
+
+	since, err := parseSince(strings.TrimSpace(fields[1]), time.Now())
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Please provide a duration like 48h or a date like 2024-01-31")
+	}
+
+	info, sub, err := db.FeedOfChat(ctx, chatID, num)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("feed info failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	feed, _, err := fetchFeed(ctx, newFeedClient(cfg), info.fetchURL(), HTTPCache{})
+	if err != nil {
+		logrus.WithError(err).WithField("Feed", info.URL).Warn("simulate: cannot fetch feed")
+		return tgbotapi.NewMessage(chatID, "I cannot fetch this feed right now.")
+	}
+
+	if sub.Filters, err = db.Filters(ctx, chatID, sub.FeedID); err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("simulate: get filters")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if sub.Mutes, err = db.Mutes(ctx, chatID, sub.FeedID); err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("simulate: get mutes")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	sub.LastUpdate = since
+	items := newItemsForSub(cfg, feed.Items, sub)
+	if len(items) == 0 {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("No items of \"%s\" would be delivered.", info.Title))
+	}
+
+	lines := ""
+	delivered := 0
+	for i, item := range items {
+		reason := skipReason(ctx, cfg, db, sub, sub.FeedID, item, deliveredItemOf(item))
+		if reason == "" {
+			delivered++
+		}
+
+		if i >= maxSimulatedItems {
+			continue
+		}
+
+		lines += fmt.Sprintf("%s %s", item.PublishedParsed.In(sub.Location).Format("2006-01-02 15:04"), item.Title)
+		if reason != "" {
+			lines += fmt.Sprintf(" (skipped: %s)", reason)
+		}
+		lines += "\n"
+	}
+
+	if len(items) > maxSimulatedItems {
+		lines += fmt.Sprintf("... and %d more\n", len(items)-maxSimulatedItems)
+	}
+
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("%d items of \"%s\" would be delivered:\n%s", delivered, info.Title, lines))
+}
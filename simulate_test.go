@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+const simulateFeed = `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>News</title>
+<item><title>Old news</title><link>https://example.com/1</link><pubDate>Mon, 01 Jan 2024 10:00:00 GMT</pubDate></item>
+<item><title>Go news</title><link>https://example.com/2</link><pubDate>Wed, 03 Jan 2024 10:00:00 GMT</pubDate></item>
+<item><title>Other news</title><link>https://example.com/3</link><pubDate>Fri, 05 Jan 2024 10:00:00 GMT</pubDate></item>
+<item><title>More Go</title><link>https://example.com/4</link><pubDate>Sat, 06 Jan 2024 10:00:00 GMT</pubDate></item>
+</channel></rss>`
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]time.Time{
+		"48h":                  now.Add(-48 * time.Hour),
+		"2024-01-31":           time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC),
+		"2024-01-31 08:30":     time.Date(2024, 1, 31, 8, 30, 0, 0, time.UTC),
+		"2024-01-31T08:30:00Z": time.Date(2024, 1, 31, 8, 30, 0, 0, time.UTC),
+	}
+
+	for s, want := range tests {
+		if got, err := parseSince(s, now); err != nil || !got.Equal(want) {
+			t.Errorf("parseSince(%q) = %s, %v, want %s", s, got, err, want)
+		}
+	}
+
+	if _, err := parseSince("yesterday", now); err == nil {
+		t.Error("parseSince accepted \"yesterday\"")
+	}
+}
+
+func TestSimulateMatchesDelivery(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{Bot: BotConfig{MaxDescriptionLength: defaultMaxDescriptionLength, UserAgent: defaultUserAgent}}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, simulateFeed)
+	}))
+	defer srv.Close()
+
+	addTestFeed(t, db, 1, 10, srv.URL)
+	if err := db.AddFilter(ctx, 10, 1, "go"); err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	res := simulate(ctx, cfg, db, 10, "1 2024-01-02").(tgbotapi.MessageConfig)
+
+	var simulated []string
+	for _, line := range strings.Split(res.Text, "\n")[1:] {
+		if line != "" && !strings.Contains(line, "(skipped") {
+			simulated = append(simulated, line[len("2006-01-02 15:04 "):])
+		}
+	}
+
+	// Simulating does not change the subscription.
+	if _, sub, err := db.FeedOfChat(ctx, 10, 1); err != nil || !sub.LastUpdate.Equal(firstSecond) {
+		t.Fatalf("last update after simulating = %s, %v", sub.LastUpdate, err)
+	}
+
+	if err := db.UpdateSub(ctx, 10, 1, since); err != nil {
+		t.Fatal(err)
+	}
+
+	var delivered []string
+	send := func(msg tgbotapi.Chattable) {
+		text := msg.(tgbotapi.MessageConfig).Text
+		delivered = append(delivered, text[strings.Index(text, `">`)+2:strings.Index(text, "</a>")])
+	}
+
+	var count int64
+	if err := updateFeed(ctx, cfg, db, srv.Client(), send, dueFeed(t, db), &count); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(simulated)
+	sort.Strings(delivered)
+	if want := []string{"Go news", "More Go"}; !reflect.DeepEqual(delivered, want) {
+		t.Fatalf("delivered %q, want %q", delivered, want)
+	}
+	if !reflect.DeepEqual(simulated, delivered) {
+		t.Fatalf("simulated %q, delivered %q", simulated, delivered)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+// snooze handles the /snooze command, which silences a feed of the chat for
+// a while. Its new items are skipped, or sent after the snooze with "queue".
+func snooze(ctx context.Context, db *DB, chatID int64, args string, now time.Time) tgbotapi.Chattable {
+	fields := strings.Fields(args)
+	if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "queue") {
+		return tgbotapi.NewMessage(chatID, "Usage: /snooze <id> <duration>|off [queue], e.g. /snooze 2 3h")
+	}
+
+	num, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Please provide the ID of the feed")
+	}
+
+	var until time.Time
+	if fields[1] != "off" {
+		d, err := time.ParseDuration(fields[1])
+		if err != nil || d <= 0 {
+			return tgbotapi.NewMessage(chatID, "Please provide a duration like 90m or 48h, or off")
+		}
+		until = now.Add(d)
+	}
+
+	queue := len(fields) == 3
+	if err := db.SetSnooze(ctx, chatID, num, until, queue); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"Chat ID": chatID,
+			"#":       num,
+		}).Error("set snooze failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if until.IsZero() {
+		return tgbotapi.NewMessage(chatID, "New items of this feed are sent again.")
+	}
+
+	loc, err := db.ChatLocation(ctx, chatID)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("get chat time zone failed")
+	}
+
+	if queue {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("New items of this feed are held back until %s and sent then.", chatTime(until, loc)))
+	}
+
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("New items of this feed are skipped until %s.", chatTime(until, loc)))
+}
+
+// snoozeLeft renders how long a snooze that ends at until lasts from now on,
+// rounded up to minutes.
+func snoozeLeft(until, now time.Time) string {
+	left := until.Sub(now)
+	if rounded := left.Truncate(time.Minute); rounded < left {
+		left = rounded + time.Minute
+	}
+
+	return strings.TrimSuffix(left.String(), "0s")
+}
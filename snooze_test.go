@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+func TestUpdateFeedSnoozed(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{Bot: BotConfig{MaxDescriptionLength: defaultMaxDescriptionLength}}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, simulateFeed)
+	}))
+	defer srv.Close()
+
+	newest := time.Date(2024, 1, 6, 10, 0, 0, 0, time.UTC)
+
+	for _, queue := range []bool{false, true} {
+		db := openTestDB(t)
+		addTestFeed(t, db, 1, 10, srv.URL)
+
+		var sent []tgbotapi.Chattable
+		send := func(msg tgbotapi.Chattable) { sent = append(sent, msg) }
+
+		if err := db.SetSnooze(ctx, 10, 1, time.Now().Add(time.Hour), queue); err != nil {
+			t.Fatal(err)
+		}
+
+		var count int64
+		if err := updateFeed(ctx, cfg, db, srv.Client(), send, dueFeed(t, db), &count); err != nil {
+			t.Fatal(err)
+		}
+		if len(sent) != 0 {
+			t.Fatalf("queue %v: sent %d messages while snoozed", queue, len(sent))
+		}
+
+		_, sub, err := db.FeedOfChat(ctx, 10, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Skipped items advance the subscription, queued ones do not.
+		wantUpdate := newest
+		if queue {
+			wantUpdate = firstSecond
+		}
+		if !sub.LastUpdate.Equal(wantUpdate) {
+			t.Fatalf("queue %v: last update = %s, want %s", queue, sub.LastUpdate, wantUpdate)
+		}
+
+		// Once the snooze ended, only queued items are sent.
+		if err := db.SetSnooze(ctx, 10, 1, time.Time{}, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := updateFeed(ctx, cfg, db, srv.Client(), send, dueFeed(t, db), &count); err != nil {
+			t.Fatal(err)
+		}
+
+		want := 0
+		if queue {
+			want = 4
+		}
+		if len(sent) != want {
+			t.Fatalf("queue %v: sent %d messages after the snooze, want %d", queue, len(sent), want)
+		}
+	}
+}
+
+func TestSnoozeCommand(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	now := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: "a", URL: "//example.com/a", Scheme: "https"}); err != nil {
+		t.Fatal(err)
+	}
+
+	text := func(args string) string {
+		return snooze(ctx, db, 10, args, now).(tgbotapi.MessageConfig).Text
+	}
+
+	for _, args := range []string{"", "1", "1 soon", "1 -3h", "1 3h later", "x 3h"} {
+		if got := text(args); !strings.HasPrefix(got, "Usage") && !strings.HasPrefix(got, "Please") {
+			t.Errorf("/snooze %s: %q", args, got)
+		}
+	}
+
+	if got := text("1 3h queue"); got != "New items of this feed are held back until 2024-01-02 13:00 UTC and sent then." {
+		t.Fatalf("/snooze 1 3h queue: %q", got)
+	}
+
+	_, sub, err := db.FeedOfChat(ctx, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sub.SnoozedUntil.Equal(now.Add(3*time.Hour)) || !sub.SnoozeQueue {
+		t.Fatalf("snoozed until %s, queue %v", sub.SnoozedUntil, sub.SnoozeQueue)
+	}
+
+	if got := text("1 off"); got != "New items of this feed are sent again." {
+		t.Fatalf("/snooze 1 off: %q", got)
+	}
+	if _, sub, err := db.FeedOfChat(ctx, 10, 1); err != nil || sub.Snoozed(now) {
+		t.Fatalf("feed is still snoozed after /snooze off: %v", err)
+	}
+}
+
+func TestFeedsListingShowsSnooze(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	if err := db.AddFeedToChat(ctx, 1, 10, Feed{Title: "a", URL: "//example.com/a", Scheme: "https"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetSnooze(ctx, 10, 1, time.Now().Add(90*time.Minute), false); err != nil {
+		t.Fatal(err)
+	}
+
+	text, _, err := feedsListing(ctx, db, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "Snoozed for another 1h30m\n") {
+		t.Fatalf("listing does not show the snooze:\n%s", text)
+	}
+}
+
+func TestSnoozeLeft(t *testing.T) {
+	now := time.Now()
+
+	tests := map[time.Duration]string{
+		90 * time.Minute:                "1h30m",
+		3 * time.Hour:                   "3h0m",
+		time.Minute + time.Second:       "2m",
+		20 * time.Second:                "1m",
+		26*time.Hour + 59*time.Minute/2: "26h30m",
+	}
+
+	for left, want := range tests {
+		if got := snoozeLeft(now.Add(left), now); got != want {
+			t.Errorf("snoozeLeft(%s) = %q, want %q", left, got, want)
+		}
+	}
+}
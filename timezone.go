@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+const chatTimeLayout = "2006-01-02 15:04 MST"
+
+// chatLocation returns the time zone with the given IANA name. Chats that did
+// not choose a time zone, or whose zone is no longer known, use UTC.
+func chatLocation(timezone string) *time.Location {
+	if timezone == "" {
+		return time.UTC
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		logrus.WithError(err).WithField("Timezone", timezone).Warn("unknown time zone of chat")
+		return time.UTC
+	}
+
+	return loc
+}
+
+// chatTime renders t in the time zone of a chat.
+func chatTime(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format(chatTimeLayout)
+}
+
+// setTimezone handles the /timezone command. Without a name, it shows the
+// time zone of the chat.
+func setTimezone(ctx context.Context, db *DB, chatID int64, args string) tgbotapi.Chattable {
+	name := strings.TrimSpace(args)
+	if name == "" {
+		loc, err := db.ChatLocation(ctx, chatID)
+		if err != nil {
+			logrus.WithError(err).WithField("Chat ID", chatID).Error("get chat time zone failed")
+			return tgbotapi.NewMessage(chatID, backendError(err))
+		}
+
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("Times in this chat are shown in %s. Use /timezone <name> with a name like Europe/Vienna to change it.", loc))
+	}
+
+	// Local is the zone of the server, which is not what anybody means.
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		return tgbotapi.NewMessage(chatID, "I do not know this time zone. Please use a name like Europe/Vienna or America/New_York.")
+	}
+
+	if err := db.SetChatTimezone(ctx, chatID, loc.String()); err != nil {
+		logrus.WithError(err).WithField("Chat ID", chatID).Error("set chat time zone failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	return tgbotapi.NewMessage(chatID, fmt.Sprintf("Times in this chat are shown in %s now, where it is %s.", loc, chatTime(time.Now(), loc)))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+func TestSetTimezone(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	if loc, err := db.ChatLocation(ctx, 10); err != nil || loc != time.UTC {
+		t.Fatalf("chat without time zone uses %v (err %v), want UTC", loc, err)
+	}
+
+	for _, name := range []string{"Mars/Olympus_Mons", "Local", "../etc/passwd"} {
+		text := setTimezone(ctx, db, 10, name).(tgbotapi.MessageConfig).Text
+		if !strings.HasPrefix(text, "I do not know this time zone.") {
+			t.Errorf("time zone %q was accepted: %q", name, text)
+		}
+	}
+
+	text := setTimezone(ctx, db, 10, " Europe/Vienna ").(tgbotapi.MessageConfig).Text
+	if !strings.HasPrefix(text, "Times in this chat are shown in Europe/Vienna now") {
+		t.Fatalf("unexpected reply %q", text)
+	}
+
+	loc, err := db.ChatLocation(ctx, 10)
+	if err != nil || loc.String() != "Europe/Vienna" {
+		t.Fatalf("chat uses time zone %v (err %v), want Europe/Vienna", loc, err)
+	}
+
+	if text := setTimezone(ctx, db, 10, "").(tgbotapi.MessageConfig).Text; !strings.HasPrefix(text, "Times in this chat are shown in Europe/Vienna.") {
+		t.Errorf("unexpected reply %q", text)
+	}
+
+	// The time zone of the chat is used in its subscriptions.
+	addTestFeed(t, db, 1, 10, "https://example.com/feed")
+	if _, sub, err := db.FeedOfChat(ctx, 10, 1); err != nil || sub.Location.String() != "Europe/Vienna" {
+		t.Fatalf("subscription uses time zone %v (err %v)", sub.Location, err)
+	}
+
+	if _, err := db.q.ExecContext(ctx, "UPDATE updates SET lastUpdate=?", time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if text := feedStatus(ctx, db, 10).(tgbotapi.MessageConfig).Text; !strings.Contains(text, "Last item: 2024-01-10 13:00 CET") {
+		t.Errorf("status is not shown in the chat's time zone:\n%s", text)
+	}
+}
+
+func TestDigestDueInChatTimezone(t *testing.T) {
+	vienna, err := time.LoadLocation("Europe/Vienna")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	sub := Sub{DigestAt: 8 * time.Hour, Location: vienna}
+
+	// 08:00 in Vienna is 07:00 UTC in winter and 06:00 UTC in summer.
+	for _, day := range []time.Time{
+		time.Date(2024, 1, 10, 7, 0, 0, 0, time.UTC),
+		time.Date(2024, 7, 10, 6, 0, 0, 0, time.UTC),
+	} {
+		sub.DigestSent = day.Add(-12 * time.Hour)
+		if sub.DigestDue(day.Add(-time.Minute)) {
+			t.Errorf("digest is due a minute before %s", day)
+		}
+		if !sub.DigestDue(day) {
+			t.Errorf("digest is not due at %s", day)
+		}
+	}
+
+	// Daylight saving time begins on 2024-03-31 at 02:00, the digest is
+	// still sent at 08:00.
+	sub.DigestSent = time.Date(2024, 3, 30, 7, 0, 0, 0, time.UTC)
+	if sub.DigestDue(time.Date(2024, 3, 31, 5, 59, 0, 0, time.UTC)) || !sub.DigestDue(time.Date(2024, 3, 31, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("digest is not due at 08:00 on the day daylight saving time begins")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+// transferChat handles the /transfer command, which moves the feeds of
+// another chat to this one, for example after a group became a supergroup
+// and got a new chat ID. Only bot admins and the user who owns all feeds of
+// the old chat may do this.
+func transferChat(ctx context.Context, cfg *Config, db *DB, user tgbotapi.User, chatID int64, args string) tgbotapi.Chattable {
+	from, err := strconv.ParseInt(strings.TrimSpace(args), 10, 64)
+	if err != nil {
+		return tgbotapi.NewMessage(chatID, "Usage: /transfer <old chat ID>")
+	}
+
+	if from == chatID {
+		return tgbotapi.NewMessage(chatID, "The feeds are already in this chat.")
+	}
+
+	owners, err := db.SubOwners(ctx, from)
+	if err != nil {
+		logrus.WithError(err).WithField("Chat ID", from).Error("get owners of chat failed")
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	if len(owners) == 0 {
+		return tgbotapi.NewMessage(chatID, fmt.Sprintf("There are no feeds in chat %d.", from))
+	}
+
+	if !cfg.IsAdmin(int64(user.ID)) && (len(owners) != 1 || owners[0] != int64(user.ID)) {
+		return tgbotapi.NewMessage(chatID, "Only the owner of all feeds of that chat or a bot admin may do this.")
+	}
+
+	t, err := db.TransferChat(ctx, from, chatID)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"From": from,
+			"To":   chatID,
+		}).Error("transfer chat failed")
+
+		return tgbotapi.NewMessage(chatID, backendError(err))
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"From":     from,
+		"To":       chatID,
+		"User ID":  user.ID,
+		"Transfer": t,
+	}).Info("transferred feeds between chats")
+
+	text := fmt.Sprintf("%d feeds were moved to this chat.", t.Moved)
+	if t.Duplicates > 0 {
+		text += fmt.Sprintf(" %d feeds were already here.", t.Duplicates)
+	}
+	if t.OverLimit > 0 {
+		text += fmt.Sprintf(" %d feeds stay in the old chat, as this chat cannot have more feeds.", t.OverLimit)
+	}
+
+	return tgbotapi.NewMessage(chatID, text)
+}
+
+// migrateChat moves the feeds of a group that was upgraded to a supergroup.
+// Telegram announces this with a message in the old chat that carries the ID
+// of the new one, after which the old chat no longer receives messages. It
+// reports whether msg was such an announcement.
+func migrateChat(ctx context.Context, db *DB, msg *tgbotapi.Message) bool {
+	if msg.MigrateToChatID == 0 {
+		return false
+	}
+
+	from, to := msg.Chat.ID, msg.MigrateToChatID
+	t, err := db.TransferChat(ctx, from, to)
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"From": from,
+			"To":   to,
+		}).Error("migrate chat failed")
+
+		return true
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"From":     from,
+		"To":       to,
+		"Transfer": t,
+	}).Info("moved feeds of a group that became a supergroup")
+
+	return true
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+func TestTransferChat(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	for _, title := range []string{"a", "b", "c"} {
+		feed := Feed{Title: title, URL: "//example.com/" + title, Scheme: "https"}
+		if err := db.AddFeedToChat(ctx, 1, 10, feed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddFilter(ctx, 10, 1, "go"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetChatTimezone(ctx, 10, "Europe/Vienna"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chat 20 already has feed b, and may only have one more feed.
+	if err := db.AddFeedToChat(ctx, 1, 20, Feed{Title: "b", URL: "//example.com/b", Scheme: "https"}); err != nil {
+		t.Fatal(err)
+	}
+	db.MaxFeedsPerChat = 2
+	db.Prepare()
+
+	tr, err := db.TransferChat(ctx, 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Transfer{Moved: 1, Duplicates: 1, OverLimit: 1}); tr != want {
+		t.Fatalf("TransferChat = %+v, want %+v", tr, want)
+	}
+
+	if got := feedTitles(t, db, 20); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("feeds of new chat = %v, want [a b]", got)
+	}
+	if got := feedTitles(t, db, 10); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Fatalf("feeds of old chat = %v, want [b c]", got)
+	}
+
+	feed, err := db.FeedByURL(ctx, "//example.com/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters, err := db.Filters(ctx, 20, feed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(filters, []string{"go"}) {
+		t.Errorf("filters after transfer = %v, want [go]", filters)
+	}
+
+	loc, err := db.ChatLocation(ctx, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.String() != "Europe/Vienna" {
+		t.Errorf("time zone after transfer = %v, want Europe/Vienna", loc)
+	}
+}
+
+func TestTransferChatCommand(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	cfg := &Config{}
+	cfg.Bot.Admins = []int64{3}
+
+	for _, title := range []string{"a", "b"} {
+		feed := Feed{Title: title, URL: "//example.com/" + title, Scheme: "https"}
+		if err := db.AddFeedToChat(ctx, 1, 10, feed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	text := func(c tgbotapi.Chattable) string {
+		return c.(tgbotapi.MessageConfig).Text
+	}
+
+	if got := text(transferChat(ctx, cfg, db, tgbotapi.User{ID: 2}, 20, "10")); !strings.HasPrefix(got, "Only the owner") {
+		t.Fatalf("transfer by another user: %q", got)
+	}
+	if got := text(transferChat(ctx, cfg, db, tgbotapi.User{ID: 1}, 20, "30")); got != "There are no feeds in chat 30." {
+		t.Fatalf("transfer of empty chat: %q", got)
+	}
+	if got := text(transferChat(ctx, cfg, db, tgbotapi.User{ID: 1}, 20, "10")); got != "2 feeds were moved to this chat." {
+		t.Fatalf("transfer by owner: %q", got)
+	}
+
+	if err := db.AddFeedToChat(ctx, 2, 30, Feed{Title: "c", URL: "//example.com/c", Scheme: "https"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := text(transferChat(ctx, cfg, db, tgbotapi.User{ID: 3}, 20, "30")); got != "1 feeds were moved to this chat." {
+		t.Fatalf("transfer by admin: %q", got)
+	}
+
+	if got := feedTitles(t, db, 20); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("feeds after transfers = %v, want [a b c]", got)
+	}
+}
+
+func TestMigrateChat(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	for _, title := range []string{"a", "b"} {
+		if err := db.AddFeedToChat(ctx, 1, -10, Feed{Title: title, URL: "//example.com/" + title, Scheme: "https"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks)) })
+
+	message := func(data string) *tgbotapi.Message {
+		var update tgbotapi.Update
+		if err := json.Unmarshal([]byte(data), &update); err != nil {
+			t.Fatal(err)
+		}
+		return update.Message
+	}
+
+	// Ordinary messages are left to the commands.
+	if migrateChat(ctx, db, message(`{"update_id":1,"message":{"message_id":1,"chat":{"id":-10,"type":"group"},"text":"/feeds"}}`)) {
+		t.Fatal("command was handled as migration")
+	}
+
+	if !migrateChat(ctx, db, message(`{"update_id":2,"message":{"message_id":2,"chat":{"id":-10,"type":"group"},"migrate_to_chat_id":-1000000000010}}`)) {
+		t.Fatal("migration was not handled")
+	}
+
+	if got := feedTitles(t, db, -1000000000010); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("feeds of supergroup = %v, want [a b]", got)
+	}
+	if got := feedTitles(t, db, -10); len(got) != 0 {
+		t.Fatalf("feeds left in old group: %v", got)
+	}
+
+	entry := hook.LastEntry()
+	if entry == nil || entry.Level != logrus.InfoLevel || entry.Data["From"] != int64(-10) || entry.Data["To"] != int64(-1000000000010) {
+		t.Fatalf("migration was logged as %+v", entry)
+	}
+}
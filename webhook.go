@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+const defaultWebhookListenAddr = ":8443"
+
+// Long-polling requests for updates are answered after this many seconds if
+// there are none.
+const updatesTimeout = 60
+
+// botUpdate is an update from Telegram with the forum topics of its
+// messages, which the library does not decode.
+type botUpdate struct {
+	tgbotapi.Update
+
+	topics struct {
+		Message       *topicMessage `json:"message"`
+		CallbackQuery *struct {
+			Message *topicMessage `json:"message"`
+		} `json:"callback_query"`
+	}
+}
+
+// topicMessage holds the fields of a message that tell its forum topic.
+type topicMessage struct {
+	MessageThreadID int  `json:"message_thread_id"`
+	IsTopicMessage  bool `json:"is_topic_message"`
+}
+
+// thread returns the forum topic of m, or zero if it was not sent in a
+// topic. Replies in groups without topics have a thread, too.
+func (m *topicMessage) thread() int {
+	if m == nil || !m.IsTopicMessage {
+		return 0
+	}
+
+	return m.MessageThreadID
+}
+
+func (u *botUpdate) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &u.Update); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &u.topics)
+}
+
+// MessageThread returns the forum topic of the message of u.
+func (u *botUpdate) MessageThread() int {
+	return u.topics.Message.thread()
+}
+
+// CallbackThread returns the forum topic of the message whose button was
+// pressed.
+func (u *botUpdate) CallbackThread() int {
+	if u.topics.CallbackQuery == nil {
+		return 0
+	}
+
+	return u.topics.CallbackQuery.Message.thread()
+}
+
+// updatesChannel returns the channel on which updates from Telegram arrive.
+// Updates are received via webhook if it is configured and by long-polling
+// otherwise, until stop is closed.
+func updatesChannel(bot *tgbotapi.BotAPI, cfg *WebhookConfig, stop <-chan struct{}) (<-chan botUpdate, error) {
+	if !cfg.Enabled() {
+		// a webhook that is still registered would make polling fail
+		if _, err := bot.RemoveWebhook(); err != nil {
+			return nil, err
+		}
+
+		return pollUpdates(bot, stop), nil
+	}
+
+	return listenForWebhook(bot, cfg)
+}
+
+// pollUpdates long-polls Telegram for updates like GetUpdatesChan of the
+// library does.
+func pollUpdates(bot *tgbotapi.BotAPI, stop <-chan struct{}) <-chan botUpdate {
+	ch := make(chan botUpdate, bot.Buffer)
+
+	go func() {
+		offset := 0
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			v := url.Values{}
+			v.Set("offset", strconv.Itoa(offset))
+			v.Set("timeout", strconv.Itoa(updatesTimeout))
+
+			var updates []botUpdate
+			resp, err := bot.MakeRequest("getUpdates", v)
+			if err == nil {
+				err = json.Unmarshal(resp.Result, &updates)
+			}
+			if err != nil {
+				logrus.WithError(err).Warn("failed to get updates, retrying in 3 seconds")
+				select {
+				case <-stop:
+					return
+				case <-time.After(3 * time.Second):
+				}
+
+				continue
+			}
+
+			for _, update := range updates {
+				if update.UpdateID >= offset {
+					offset = update.UpdateID + 1
+					ch <- update
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+func listenForWebhook(bot *tgbotapi.BotAPI, cfg *WebhookConfig) (<-chan botUpdate, error) {
+	if (cfg.Cert == "") != (cfg.Key == "") {
+		return nil, errors.New("webhook needs both cert and key or neither")
+	}
+
+	u, err := url.Parse(cfg.PublicURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := bot.SetWebhook(tgbotapi.NewWebhook(u.String())); err != nil {
+		return nil, err
+	}
+
+	pattern := u.Path
+	if pattern == "" {
+		pattern = "/"
+	}
+
+	updateCh := make(chan botUpdate, bot.Buffer)
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		var update botUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		updateCh <- update
+	})
+
+	addr := cfg.ListenAddr
+	if addr == "" {
+		addr = defaultWebhookListenAddr
+	}
+
+	go func() {
+		var err error
+		if cfg.Cert != "" {
+			err = http.ListenAndServeTLS(addr, cfg.Cert, cfg.Key, nil)
+		} else {
+			err = http.ListenAndServe(addr, nil)
+		}
+
+		logrus.WithError(err).WithField("Address", addr).Fatalln("webhook server failed")
+	}()
+
+	logrus.WithFields(logrus.Fields{
+		"Address": addr,
+		"Path":    pattern,
+	}).Info("Listening for webhook")
+
+	return updateCh, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBotUpdateTopics(t *testing.T) {
+	for _, tt := range []struct {
+		raw                    string
+		message, callback      int
+		wantMessage, wantQuery bool
+	}{
+		{raw: `{"update_id":1,"message":{"message_id":5,"text":"/feeds","chat":{"id":10}}}`, wantMessage: true},
+		{raw: `{"update_id":1,"message":{"message_id":5,"message_thread_id":7,"is_topic_message":true,"chat":{"id":10}}}`, message: 7, wantMessage: true},
+		// Replies in groups without topics have a thread, too.
+		{raw: `{"update_id":1,"message":{"message_id":5,"message_thread_id":3,"chat":{"id":10}}}`, wantMessage: true},
+		{raw: `{"update_id":1,"callback_query":{"id":"a","data":"x","message":{"message_id":5,"message_thread_id":7,"is_topic_message":true,"chat":{"id":10}}}}`, callback: 7, wantQuery: true},
+		{raw: `{"update_id":1,"callback_query":{"id":"a","data":"x"}}`, wantQuery: true},
+	} {
+		var u botUpdate
+		if err := json.Unmarshal([]byte(tt.raw), &u); err != nil {
+			t.Fatalf("%s: %v", tt.raw, err)
+		}
+
+		if u.UpdateID != 1 || (u.Message != nil) != tt.wantMessage || (u.CallbackQuery != nil) != tt.wantQuery {
+			t.Errorf("%s: decoded as %+v", tt.raw, u.Update)
+		}
+		if got := u.MessageThread(); got != tt.message {
+			t.Errorf("%s: message topic = %d, want %d", tt.raw, got, tt.message)
+		}
+		if got := u.CallbackThread(); got != tt.callback {
+			t.Errorf("%s: callback topic = %d, want %d", tt.raw, got, tt.callback)
+		}
+	}
+}
+
+func TestPollUpdates(t *testing.T) {
+	var mu sync.Mutex
+	var offsets []string
+	bot := newTestBot(t, func(method string, params url.Values) (interface{}, string) {
+		if method != "getUpdates" {
+			return nil, "unexpected method " + method
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		offsets = append(offsets, params.Get("offset"))
+		if len(offsets) > 1 {
+			return []interface{}{}, ""
+		}
+
+		return []interface{}{json.RawMessage(`{"update_id":41,"message":{"message_id":5,"message_thread_id":7,"is_topic_message":true,"chat":{"id":10}}}`)}, ""
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	update := <-pollUpdates(bot, stop)
+	if update.UpdateID != 41 || update.Message == nil || update.MessageThread() != 7 {
+		t.Fatalf("received %+v in topic %d", update.Update, update.MessageThread())
+	}
+
+	// The next request confirms the update.
+	for {
+		mu.Lock()
+		n := len(offsets)
+		mu.Unlock()
+		if n > 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if offsets[0] != "0" || offsets[1] != "42" {
+		t.Fatalf("requested updates from offsets %v, want 0 and 42", offsets)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+// whoami handles the /whoami command, which tells users their ID. It is
+// what the whitelist and the admin list of the config file hold.
+func whoami(chatID int64, user tgbotapi.User) tgbotapi.Chattable {
+	text := fmt.Sprintf("User ID: %d", user.ID)
+	if user.UserName != "" {
+		text += "\nUsername: @" + user.UserName
+	}
+
+	return tgbotapi.NewMessage(chatID, text)
+}
+
+// chatInfo handles the /chatinfo command, which tells the ID and type of
+// the chat that msg was sent in, and its forum topic if any.
+func chatInfo(msg *tgbotapi.Message, threadID int) tgbotapi.Chattable {
+	text := fmt.Sprintf("Chat ID: %d\nType: %s", msg.Chat.ID, msg.Chat.Type)
+	if threadID != 0 {
+		text += fmt.Sprintf("\nTopic ID: %d", threadID)
+	}
+
+	return tgbotapi.NewMessage(msg.Chat.ID, text)
+}
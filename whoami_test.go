@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	tgbotapi "github.com/chtisgit/telegram-bot-api"
+)
+
+func TestWhoami(t *testing.T) {
+	if got := whoami(10, tgbotapi.User{ID: 42, UserName: "alice"}).(tgbotapi.MessageConfig).Text; got != "User ID: 42\nUsername: @alice" {
+		t.Errorf("whoami = %q", got)
+	}
+	if got := whoami(10, tgbotapi.User{ID: 42}).(tgbotapi.MessageConfig).Text; got != "User ID: 42" {
+		t.Errorf("whoami without username = %q", got)
+	}
+}
+
+func TestChatInfo(t *testing.T) {
+	msg := &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: -1001234, Type: "supergroup"}}
+	if got := chatInfo(msg, 0).(tgbotapi.MessageConfig).Text; got != "Chat ID: -1001234\nType: supergroup" {
+		t.Errorf("chatInfo = %q", got)
+	}
+
+	if got := chatInfo(msg, 7).(tgbotapi.MessageConfig).Text; got != "Chat ID: -1001234\nType: supergroup\nTopic ID: 7" {
+		t.Errorf("chatInfo in a topic = %q", got)
+	}
+}
+
+func TestDiagnosticCommandsAreUngated(t *testing.T) {
+	for _, name := range []string{"whoami", "chatinfo"} {
+		if !isUngated(name) {
+			t.Errorf("/%s is gated", name)
+		}
+	}
+	for _, name := range []string{"addfeed", "help", "nosuchcommand"} {
+		if isUngated(name) {
+			t.Errorf("/%s is ungated", name)
+		}
+	}
+}